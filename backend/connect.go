@@ -0,0 +1,185 @@
+// backend/connect.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultFrontendURL はオンボーディング後に戻るフロントエンドのURLの既定値です
+// 環境変数 FRONTEND_URL で変更できます
+const defaultFrontendURL = "http://localhost:5173"
+
+// frontendURL はフロントエンドのURLを返します
+func frontendURL() string {
+	if v := os.Getenv("FRONTEND_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return defaultFrontendURL
+}
+
+// connectAccountStatus は出品者の入金先のアカウントの状態を、profiles.stripe_account_statusの値に変換します
+func connectAccountStatus(chargesEnabled bool, payoutsEnabled bool, detailsSubmitted bool) string {
+	switch {
+	case chargesEnabled && payoutsEnabled:
+		return StripeAccountStatusEnabled
+	case detailsSubmitted:
+		return StripeAccountStatusPending
+	default:
+		return StripeAccountStatusRestricted
+	}
+}
+
+// sellerStripeAccountHandler は "/api/seller/stripe-account" へのリクエストをHTTPメソッドによって振り分ける
+func (a *Api) sellerStripeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.getSellerStripeAccountHandler(w, r)
+	case http.MethodPost:
+		a.createSellerStripeAccountHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getSellerStripeAccountHandler は認証されているユーザーのStripe Connectアカウントの登録状況を返します
+// 登録が完了していない場合は、Webhookの取りこぼしに備えてStripeから最新の状態を取得し直します
+func (a *Api) getSellerStripeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	sellerAccount, err := a.store.GetSellerStripeAccount(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get stripe account from DB: %v", err)
+		http.Error(w, "Failed to get stripe account", http.StatusInternalServerError)
+		return
+	}
+
+	if sellerAccount.StripeAccountID != "" && !sellerAccount.PayoutsEnabled() {
+		acct, err := a.paymentProvider().GetConnectAccount(r.Context(), sellerAccount.StripeAccountID)
+		if err != nil {
+			// Stripeに問い合わせできなくても、DBに記録されている状態を返す
+			log.Printf("WARN: Failed to refresh stripe account %s: %v", sellerAccount.StripeAccountID, err)
+		} else if status := acct.Status; status != sellerAccount.Status {
+			if _, err := a.store.UpdateStripeAccountStatus(r.Context(), acct.ID, status); err != nil {
+				log.Printf("ERROR: Failed to update stripe account status in DB: %v", err)
+				http.Error(w, "Failed to get stripe account", http.StatusInternalServerError)
+				return
+			}
+			sellerAccount.Status = status
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sellerAccount); err != nil {
+		log.Printf("ERROR: Failed to encode stripe account to JSON: %v", err)
+	}
+}
+
+// createSellerStripeAccountHandler は認証されているユーザーのStripe Connect（Express）アカウントを作成し、プロフィールに紐づけます
+// 既に作成済みの場合は、新たに作成せずに既存のアカウントを返します
+func (a *Api) createSellerStripeAccountHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	sellerAccount, err := a.store.GetSellerStripeAccount(r.Context(), userID)
+	if err != nil {
+		// アカウントの紐づけ先となるプロフィールが先に必要
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Profile not found. Please create a profile first", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get stripe account from DB: %v", err)
+		http.Error(w, "Failed to create stripe account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if sellerAccount.StripeAccountID != "" {
+		if err := json.NewEncoder(w).Encode(sellerAccount); err != nil {
+			log.Printf("ERROR: Failed to encode stripe account to JSON: %v", err)
+		}
+		return
+	}
+
+	// 同時にリクエストされても、アカウントは二重に作成されない
+	acct, err := a.paymentProvider().CreateConnectAccount(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to create stripe account for user %s: %v", shortID(userID), err)
+		http.Error(w, "Failed to create stripe account", http.StatusInternalServerError)
+		return
+	}
+
+	sellerAccount, err = a.store.SetSellerStripeAccount(r.Context(), userID, acct.ID, acct.Status)
+	if err != nil {
+		log.Printf("ERROR: Failed to save stripe account %s for user %s: %v", acct.ID, shortID(userID), err)
+		http.Error(w, "Failed to create stripe account", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(sellerAccount); err != nil {
+		log.Printf("ERROR: Failed to encode stripe account to JSON: %v", err)
+	}
+}
+
+// createOnboardingLinkHandler は認証されているユーザーのStripe Connectアカウントの登録ページのURLを返します
+// URLは短時間で失効するため、登録ページを開く直前に呼び出します
+func (a *Api) createOnboardingLinkHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sellerAccount, err := a.store.GetSellerStripeAccount(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get stripe account from DB: %v", err)
+		http.Error(w, "Failed to create onboarding link", http.StatusInternalServerError)
+		return
+	}
+	if sellerAccount.StripeAccountID == "" {
+		http.Error(w, "Stripe account has not been created yet", http.StatusConflict)
+		return
+	}
+
+	link, err := a.paymentProvider().CreateAccountLink(r.Context(), sellerAccount.StripeAccountID, frontendURL()+"/seller/onboarding/refresh", frontendURL()+"/seller/onboarding/complete")
+	if err != nil {
+		log.Printf("ERROR: Failed to create onboarding link for account %s: %v", sellerAccount.StripeAccountID, err)
+		http.Error(w, "Failed to create onboarding link", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(link); err != nil {
+		log.Printf("ERROR: Failed to encode onboarding link to JSON: %v", err)
+	}
+}
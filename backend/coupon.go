@@ -0,0 +1,533 @@
+// backend/coupon.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// クーポンの値引きの種類（coupons.discount_type）
+const (
+	// CouponDiscountTypePercentage は対象商品の小計に対する定率（%）の値引きです
+	CouponDiscountTypePercentage = "percentage"
+	// CouponDiscountTypeFixed は定額（円）の値引きです
+	CouponDiscountTypeFixed = "fixed"
+)
+
+// クーポンの値引きの負担者（coupons.funded_by）
+const (
+	// CouponFundedByPlatform はプラットフォームが負担する値引きです。出品者への入金額は値引き前と変わりません
+	CouponFundedByPlatform = "platform"
+	// CouponFundedBySeller は出品者が負担する値引きです。出品者の売上から差し引きます
+	CouponFundedBySeller = "seller"
+)
+
+// validCouponDiscountTypes はcoupon_discount_type型で定義されている値引きの種類です
+var validCouponDiscountTypes = map[string]bool{
+	CouponDiscountTypePercentage: true,
+	CouponDiscountTypeFixed:      true,
+}
+
+// couponCodePattern はクーポンコードの形式です（大文字の英数字・ハイフン・アンダースコアの3〜32文字）
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// normalizeCouponCode はクーポンコードの前後の空白を取り除き、大文字にします
+func normalizeCouponCode(v string) string {
+	return strings.ToUpper(strings.TrimSpace(v))
+}
+
+// ErrCouponNotFound は存在しないクーポンコードが指定された場合に返されます
+var ErrCouponNotFound = errors.New("coupon not found")
+
+// ErrCouponNotAvailable は停止中・利用開始前・期限切れのクーポンが指定された場合に返されます
+var ErrCouponNotAvailable = errors.New("coupon is not available")
+
+// ErrCouponNotApplicable はカートにクーポンの対象商品が無い場合に返されます
+var ErrCouponNotApplicable = errors.New("coupon does not apply to any items in the cart")
+
+// ErrCouponMinSpend は対象商品の小計がクーポンの最低利用金額に満たない場合に返されます
+var ErrCouponMinSpend = errors.New("cart does not meet the coupon's minimum spend")
+
+// ErrCouponUsageLimit はクーポンの利用回数が上限に達している場合に返されます
+var ErrCouponUsageLimit = errors.New("coupon usage limit reached")
+
+// ErrCouponCodeTaken は既に使われているクーポンコードで作成しようとした場合に返されます
+var ErrCouponCodeTaken = errors.New("coupon code is already taken")
+
+// ErrCouponTargetNotFound は存在しない出品者・商品を対象にクーポンを作成しようとした場合に返されます
+var ErrCouponTargetNotFound = errors.New("coupon target not found")
+
+// Coupon 構造体は、クーポンの内容を保持します
+type Coupon struct {
+	ID           int    `json:"id"`
+	Code         string `json:"code"`
+	DiscountType string `json:"discount_type"`
+	// DiscountValue は定率の場合は値引き率（%）、定額の場合は値引き額（円）です
+	DiscountValue int    `json:"discount_value"`
+	FundedBy      string `json:"funded_by"`
+	// SellerID は出品者負担のクーポンを発行した出品者です（プラットフォーム負担の場合は空）
+	SellerID string `json:"seller_id"`
+	// MinSpend は対象商品の小計がこの金額以上の場合に利用できる、最低利用金額です
+	MinSpend int `json:"min_spend"`
+	// MaxUses・MaxUsesPerUser は全体・購入者ごとの利用回数の上限です（nilの場合は無制限）
+	MaxUses        *int       `json:"max_uses"`
+	MaxUsesPerUser *int       `json:"max_uses_per_user"`
+	StartsAt       *time.Time `json:"starts_at"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	// EligibleSellerIDs・EligibleBeanIDs は対象の出品者・商品です（空の場合は絞り込まない）
+	EligibleSellerIDs []string `json:"eligible_seller_ids"`
+	EligibleBeanIDs   []int    `json:"eligible_bean_ids"`
+	Active            bool     `json:"active"`
+	// UsedCount は利用回数に数えている注文の件数です
+	UsedCount int       `json:"used_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate はクーポンの内容が正しいかを検証します
+func (c *Coupon) Validate() error {
+	if !couponCodePattern.MatchString(c.Code) {
+		return errors.New("code must be 3 to 32 characters of A-Z, 0-9, '-' or '_'")
+	}
+	if !validCouponDiscountTypes[c.DiscountType] {
+		return fmt.Errorf("invalid discount_type: %s", c.DiscountType)
+	}
+	if c.DiscountValue <= 0 {
+		return errors.New("discount_value must be positive")
+	}
+	if c.DiscountType == CouponDiscountTypePercentage && c.DiscountValue > 100 {
+		return errors.New("percentage discount_value must not exceed 100")
+	}
+	switch c.FundedBy {
+	case CouponFundedByPlatform:
+		if c.SellerID != "" {
+			return errors.New("platform-funded coupons must not have a seller_id")
+		}
+	case CouponFundedBySeller:
+		if c.SellerID == "" {
+			return errors.New("seller-funded coupons require a seller_id")
+		}
+	default:
+		return fmt.Errorf("invalid funded_by: %s", c.FundedBy)
+	}
+	if c.MinSpend < 0 {
+		return errors.New("min_spend must not be negative")
+	}
+	if (c.MaxUses != nil && *c.MaxUses <= 0) || (c.MaxUsesPerUser != nil && *c.MaxUsesPerUser <= 0) {
+		return errors.New("max_uses and max_uses_per_user must be positive")
+	}
+	if c.StartsAt != nil && c.ExpiresAt != nil && !c.StartsAt.Before(*c.ExpiresAt) {
+		return errors.New("starts_at must be before expires_at")
+	}
+
+	seenSellers := map[string]bool{}
+	for _, sellerID := range c.EligibleSellerIDs {
+		if !uuidPattern.MatchString(sellerID) {
+			return fmt.Errorf("invalid seller id in eligible_seller_ids: %s", sellerID)
+		}
+		if seenSellers[sellerID] {
+			return fmt.Errorf("duplicate seller id in eligible_seller_ids: %s", sellerID)
+		}
+		seenSellers[sellerID] = true
+	}
+	seenBeans := map[int]bool{}
+	for _, beanID := range c.EligibleBeanIDs {
+		if beanID <= 0 {
+			return fmt.Errorf("invalid bean id in eligible_bean_ids: %d", beanID)
+		}
+		if seenBeans[beanID] {
+			return fmt.Errorf("duplicate bean id in eligible_bean_ids: %d", beanID)
+		}
+		seenBeans[beanID] = true
+	}
+	return nil
+}
+
+// IsAvailableAt はクーポンが指定の時刻に利用できる（有効で、利用期間内である）かを返します
+func (c *Coupon) IsAvailableAt(now time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	if c.StartsAt != nil && now.Before(*c.StartsAt) {
+		return false
+	}
+	return c.ExpiresAt == nil || now.Before(*c.ExpiresAt)
+}
+
+// appliesTo は出品者の商品がクーポンの対象かを返します
+// 出品者負担のクーポンは、発行した出品者の商品だけが対象です
+func (c *Coupon) appliesTo(sellerID string, beanID int) bool {
+	if c.FundedBy == CouponFundedBySeller && sellerID != c.SellerID {
+		return false
+	}
+	if len(c.EligibleSellerIDs) > 0 && !containsString(c.EligibleSellerIDs, sellerID) {
+		return false
+	}
+	if len(c.EligibleBeanIDs) > 0 && !containsInt(c.EligibleBeanIDs, beanID) {
+		return false
+	}
+	return true
+}
+
+// DiscountFor は対象商品の小計に対する値引き額を返します
+// 定率の値引きは1円未満を切り捨て、値引き額は小計を超えません
+func (c *Coupon) DiscountFor(amount int) int {
+	discount := c.DiscountValue
+	if c.DiscountType == CouponDiscountTypePercentage {
+		discount = amount * c.DiscountValue / 100
+	}
+	if discount > amount {
+		return amount
+	}
+	return discount
+}
+
+// applyCoupon はクーポンの値引きを、出品者ごとの商品のgroupsに割り当て、値引き額の合計を返します
+// 値引きは対象商品の明細の金額に比例して割り当てるため、消費税額も値引き後の金額で計算され、明細ごとの返金額にも反映できます
+// 利用期間や利用回数の確認は行わないので、呼び出し側で確認してください
+func applyCoupon(coupon *Coupon, groups []SellerCartItems) (int, error) {
+	// すべての明細の対象となる金額を、出品者・明細の順に並べる
+	amounts := []int{}
+	eligibleSubtotal := 0
+	for i := range groups {
+		for _, item := range groups[i].Items {
+			amount := 0
+			if coupon.appliesTo(groups[i].SellerID, item.BeanID) {
+				amount = item.Price * item.Quantity
+			}
+			amounts = append(amounts, amount)
+			eligibleSubtotal += amount
+		}
+	}
+	if eligibleSubtotal == 0 {
+		return 0, ErrCouponNotApplicable
+	}
+	if eligibleSubtotal < coupon.MinSpend {
+		return 0, fmt.Errorf("%w: %d < %d", ErrCouponMinSpend, eligibleSubtotal, coupon.MinSpend)
+	}
+
+	discount := coupon.DiscountFor(eligibleSubtotal)
+	shares := allocateProportionally(discount, amounts)
+	for i := range groups {
+		groups[i].ItemDiscounts = shares[:len(groups[i].Items)]
+		shares = shares[len(groups[i].Items):]
+		groups[i].DiscountByTaxCategory = map[string]int{}
+		for j, item := range groups[i].Items {
+			category := TaxCategoryReduced
+			if item.TaxCategory == TaxCategoryStandard {
+				category = TaxCategoryStandard
+			}
+			groups[i].DiscountByTaxCategory[category] += groups[i].ItemDiscounts[j]
+		}
+		groups[i].DiscountFundedBy = ""
+		if groups[i].Discount() > 0 {
+			groups[i].DiscountFundedBy = coupon.FundedBy
+		}
+	}
+	return discount, nil
+}
+
+// redeemCoupon はクーポンコードのクーポンを確認し、値引きをgroupsに割り当てます
+// クーポンの行をロックしてから利用回数を数えるため、storeはトランザクションに紐づいている必要があります
+// 決済をやり直す場合は、先にユーザーの古い在庫確保を解放しておくと、古い保留中の注文を利用回数に数えません
+func redeemCoupon(ctx context.Context, store *Store, userID string, code string, groups []SellerCartItems, now time.Time) (*Coupon, error) {
+	coupon, err := store.GetCouponByCodeForUpdate(ctx, code)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrCouponNotFound
+		}
+		return nil, err
+	}
+	if !coupon.IsAvailableAt(now) {
+		return nil, ErrCouponNotAvailable
+	}
+
+	total, byUser, err := store.CountCouponUses(ctx, coupon.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if coupon.MaxUses != nil && total >= *coupon.MaxUses {
+		return nil, fmt.Errorf("%w: %d of %d uses", ErrCouponUsageLimit, total, *coupon.MaxUses)
+	}
+	if coupon.MaxUsesPerUser != nil && byUser >= *coupon.MaxUsesPerUser {
+		return nil, fmt.Errorf("%w: %d of %d uses by user", ErrCouponUsageLimit, byUser, *coupon.MaxUsesPerUser)
+	}
+
+	if _, err := applyCoupon(coupon, groups); err != nil {
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// allocateProportionally はtotalをweightsの比で按分します
+// 1円未満を切り捨てた残りは、先頭から1円ずつ割り当てるため、合計は必ずtotalと一致します
+// totalがweightsの合計以下であれば、割り当てがweightsを超えることはありません
+func allocateProportionally(total int, weights []int) []int {
+	shares := make([]int, len(weights))
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+	if sum == 0 {
+		return shares
+	}
+	allocated := 0
+	for i, w := range weights {
+		shares[i] = int(int64(total) * int64(w) / int64(sum))
+		allocated += shares[i]
+	}
+	for i := 0; allocated < total; i = (i + 1) % len(weights) {
+		if weights[i] > shares[i] {
+			shares[i]++
+			allocated++
+		}
+	}
+	return shares
+}
+
+// containsString はvaluesにvが含まれるかを返します
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt はvaluesにvが含まれるかを返します
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// createAdminCouponHandler はプラットフォームが負担するクーポンを発行し、監査ログに記録します
+// 対象の出品者・商品を指定しない場合は、すべての商品が対象になります
+func (a *Api) createAdminCouponHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := a.requirePermission(w, r, PermissionManageCoupons)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var coupon Coupon
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// 管理者が発行するクーポンはプラットフォームが負担する
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	coupon.FundedBy = CouponFundedByPlatform
+	coupon.SellerID = ""
+	coupon.Active = true
+	if err := coupon.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// クーポンと監査ログを1つのトランザクションで作成する
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context()) // エラー発生時にロールバック
+	store := NewStore(tx)
+
+	created, err := store.CreateCoupon(r.Context(), &coupon)
+	if err != nil {
+		if errors.Is(err, ErrCouponCodeTaken) {
+			http.Error(w, "Coupon code is already taken", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrCouponTargetNotFound) {
+			http.Error(w, "eligible_seller_ids and eligible_bean_ids must exist", http.StatusBadRequest)
+			return
+		}
+		log.Printf("ERROR: Failed to create platform coupon: %v", err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	audit := newAuditLog(actor, AuditActionCouponCreate, "coupon", strconv.Itoa(created.ID), "")
+	audit.Details["code"] = created.Code
+	audit.Details["discount_type"] = created.DiscountType
+	audit.Details["discount_value"] = created.DiscountValue
+	if err := store.RecordAuditLog(r.Context(), audit); err != nil {
+		log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit platform coupon: %v", err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Printf("ERROR: Failed to encode coupon to JSON: %v", err)
+	}
+}
+
+// sellerCouponsHandler は "/api/seller/coupons" へのリクエストをHTTPメソッドによって振り分ける
+func (a *Api) sellerCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.getSellerCouponsHandler(w, r)
+	case http.MethodPost:
+		a.createSellerCouponHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getSellerCouponsHandler は認証されているユーザーが発行したクーポンを、新しい順に返します
+func (a *Api) getSellerCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	coupons, err := a.store.GetCouponsBySellerID(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get coupons from DB: %v", err)
+		http.Error(w, "Failed to get coupons", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(coupons); err != nil {
+		log.Printf("ERROR: Failed to encode coupons to JSON: %v", err)
+	}
+}
+
+// createSellerCouponHandler は認証されているユーザーが負担するクーポンを発行します
+// 対象の商品を指定する場合は、ユーザー自身が出品している商品である必要があります
+func (a *Api) createSellerCouponHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	var coupon Coupon
+	if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// 出品者が発行できるのは自身が負担し、自身の商品だけを対象とするクーポンに限る
+	coupon.Code = normalizeCouponCode(coupon.Code)
+	coupon.FundedBy = CouponFundedBySeller
+	coupon.SellerID = userID
+	coupon.EligibleSellerIDs = nil
+	coupon.Active = true
+	if err := coupon.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(coupon.EligibleBeanIDs) > 0 {
+		owned, err := a.store.CountBeansOwnedBy(r.Context(), userID, coupon.EligibleBeanIDs)
+		if err != nil {
+			log.Printf("ERROR: Failed to check bean owners: %v", err)
+			http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+			return
+		}
+		if owned != len(coupon.EligibleBeanIDs) {
+			http.Error(w, "eligible_bean_ids must be beans you sell", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// クーポンと対象の商品を1つのトランザクションで作成する
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context()) // エラー発生時にロールバック
+
+	created, err := NewStore(tx).CreateCoupon(r.Context(), &coupon)
+	if err != nil {
+		if errors.Is(err, ErrCouponCodeTaken) {
+			http.Error(w, "Coupon code is already taken", http.StatusConflict)
+			return
+		}
+		log.Printf("ERROR: Failed to create coupon for user %s: %v", shortID(userID), err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit coupon for user %s: %v", shortID(userID), err)
+		http.Error(w, "Failed to create coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Printf("ERROR: Failed to encode coupon to JSON: %v", err)
+	}
+}
+
+// deactivateSellerCouponHandler は認証されているユーザーが発行したクーポンの利用を停止します
+// 既にクーポンを利用した注文には影響しません
+func (a *Api) deactivateSellerCouponHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーでなければエラー
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	// DELETEメソッドでなければエラー
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// URLからIDを取得
+	couponID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid coupon ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.store.DeactivateCoupon(r.Context(), couponID, userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Coupon not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to deactivate coupon %d: %v", couponID, err)
+		http.Error(w, "Failed to deactivate coupon", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// fakePaymentProvider はネットワークに接続しない、テスト用のPaymentProviderです
+// 作成した支払い・返金・入金をメモリに記録し、Stripeと同じ形式で署名したWebhookのイベントを発行します
+type fakePaymentProvider struct {
+	mu            sync.Mutex
+	webhookSecret string
+	seq           int
+
+	customers      map[string]string
+	paymentIntents map[string]*PaymentIntentParams
+	// paymentIntentStatuses は支払いの現在の状態です（succeedPaymentIntentでsucceededになる）
+	paymentIntentStatuses map[string]string
+	// charges は支払いが完了した支払いごとのChargeのIDです
+	charges   map[string]string
+	refunds   []RefundParams
+	transfers []TransferParams
+	reversals []TransferReversalParams
+
+	// accounts は出品者の入金先のアカウント（IDごと）、accountIDs はユーザーごとのアカウントのIDです
+	accounts   map[string]*ConnectAccount
+	accountIDs map[string]string
+	// paymentMethods は登録済みの支払い方法です（addCardで登録する）
+	paymentMethods map[string]*PaymentMethod
+	// setupIntents はカードの登録の手続きです（confirmSetupIntentで完了する）
+	setupIntents map[string]*SetupIntent
+
+	// declineOffSession がtrueの場合、保存済みのカードでの支払いをカードエラーで失敗させる
+	declineOffSession bool
+}
+
+// newFakePaymentProvider はWebhookの署名シークレットにtestWebhookSecretを使う、fakePaymentProviderを作成します
+func newFakePaymentProvider() *fakePaymentProvider {
+	return &fakePaymentProvider{
+		webhookSecret:         testWebhookSecret,
+		customers:             map[string]string{},
+		paymentIntents:        map[string]*PaymentIntentParams{},
+		paymentIntentStatuses: map[string]string{},
+		charges:               map[string]string{},
+		accounts:              map[string]*ConnectAccount{},
+		accountIDs:            map[string]string{},
+		paymentMethods:        map[string]*PaymentMethod{},
+		setupIntents:          map[string]*SetupIntent{},
+	}
+}
+
+// nextID はprefixで始まる、テスト内で一意なIDを返します（呼び出し側でロックしてください）
+func (f *fakePaymentProvider) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%d_%d", prefix, time.Now().UnixNano(), f.seq)
+}
+
+func (f *fakePaymentProvider) CreateCustomer(ctx context.Context, userID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.customers[userID]; ok {
+		return id, nil
+	}
+	id := f.nextID("cus")
+	f.customers[userID] = id
+	return id, nil
+}
+
+func (f *fakePaymentProvider) CreatePaymentIntent(ctx context.Context, params *PaymentIntentParams) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if params.PaymentMethodID != "" && f.declineOffSession {
+		return nil, &CardError{Code: "card_declined", Message: "Your card was declined."}
+	}
+	id := f.nextID("pi")
+	recorded := *params
+	f.paymentIntents[id] = &recorded
+
+	status := "requires_payment_method"
+	if params.PaymentMethodID != "" {
+		status = "succeeded"
+	}
+	f.paymentIntentStatuses[id] = status
+	return f.paymentIntentLocked(id), nil
+}
+
+func (f *fakePaymentProvider) GetPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.paymentIntents[paymentIntentID]; !ok {
+		return nil, fmt.Errorf("no such payment intent: %s", paymentIntentID)
+	}
+	return f.paymentIntentLocked(paymentIntentID), nil
+}
+
+func (f *fakePaymentProvider) CancelPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.paymentIntents[paymentIntentID]; !ok {
+		return nil, fmt.Errorf("no such payment intent: %s", paymentIntentID)
+	}
+	// 支払い済みの支払いは取り消せない
+	if f.paymentIntentStatuses[paymentIntentID] != "succeeded" {
+		f.paymentIntentStatuses[paymentIntentID] = "canceled"
+	}
+	return f.paymentIntentLocked(paymentIntentID), nil
+}
+
+// paymentIntentLocked は作成済みの支払いの現在の状態を返します（呼び出し側でロックしてください）
+func (f *fakePaymentProvider) paymentIntentLocked(id string) *PaymentIntent {
+	params := f.paymentIntents[id]
+	pi := &PaymentIntent{ID: id, ClientSecret: id + "_secret", Status: f.paymentIntentStatuses[id], Amount: params.Amount, Currency: params.Currency}
+	if pi.Status == "succeeded" {
+		pi.AmountReceived = params.Amount
+	}
+	return pi
+}
+
+func (f *fakePaymentProvider) CreateRefund(ctx context.Context, params *RefundParams) (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.paymentIntents[params.PaymentIntentID]; !ok {
+		return "", "", fmt.Errorf("no such payment intent: %s", params.PaymentIntentID)
+	}
+	f.refunds = append(f.refunds, *params)
+	return f.nextID("re"), RefundStatusSucceeded, nil
+}
+
+func (f *fakePaymentProvider) CreateTransfer(ctx context.Context, params *TransferParams) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transfers = append(f.transfers, *params)
+	return f.nextID("tr"), nil
+}
+
+func (f *fakePaymentProvider) ReverseTransfer(ctx context.Context, params *TransferReversalParams) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reversals = append(f.reversals, *params)
+	return f.nextID("trr"), nil
+}
+
+func (f *fakePaymentProvider) CreateConnectAccount(ctx context.Context, userID string) (*ConnectAccount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.accountIDs[userID]; ok {
+		acct := *f.accounts[id]
+		return &acct, nil
+	}
+	acct := &ConnectAccount{ID: f.nextID("acct"), Status: StripeAccountStatusRestricted}
+	f.accounts[acct.ID] = acct
+	f.accountIDs[userID] = acct.ID
+	created := *acct
+	return &created, nil
+}
+
+func (f *fakePaymentProvider) GetConnectAccount(ctx context.Context, accountID string) (*ConnectAccount, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acct, ok := f.accounts[accountID]
+	if !ok {
+		return nil, fmt.Errorf("no such account: %s", accountID)
+	}
+	found := *acct
+	return &found, nil
+}
+
+func (f *fakePaymentProvider) CreateAccountLink(ctx context.Context, accountID string, refreshURL string, returnURL string) (*AccountLink, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("no such account: %s", accountID)
+	}
+	return &AccountLink{URL: "https://connect.example.test/setup/" + accountID, ExpiresAt: time.Now().Add(5 * time.Minute).Unix()}, nil
+}
+
+// addCard は顧客に紐づいていないカードを登録し、そのIDを返します（フロントエンドでカードを登録した状態）
+func (f *fakePaymentProvider) addCard(last4 string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID("pm")
+	f.paymentMethods[id] = &PaymentMethod{ID: id, Card: &SavedCard{ID: id, Brand: "visa", Last4: last4, ExpMonth: 12, ExpYear: 2030}}
+	return id
+}
+
+func (f *fakePaymentProvider) ListCards(ctx context.Context, customerID string) ([]SavedCard, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cards := []SavedCard{}
+	for _, pm := range f.paymentMethods {
+		if pm.CustomerID == customerID && pm.Card != nil {
+			cards = append(cards, *pm.Card)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool { return cards[i].ID < cards[j].ID })
+	return cards, nil
+}
+
+func (f *fakePaymentProvider) GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pm, ok := f.paymentMethods[paymentMethodID]
+	if !ok {
+		return nil, ErrPaymentMethodNotFound
+	}
+	found := *pm
+	return &found, nil
+}
+
+func (f *fakePaymentProvider) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pm, ok := f.paymentMethods[paymentMethodID]
+	if !ok {
+		return ErrPaymentMethodNotFound
+	}
+	pm.CustomerID = ""
+	return nil
+}
+
+func (f *fakePaymentProvider) CreateSetupIntent(ctx context.Context, customerID string) (*SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID("seti")
+	si := &SetupIntent{ID: id, ClientSecret: id + "_secret", Status: "requires_payment_method", Usage: "off_session", CustomerID: customerID}
+	f.setupIntents[id] = si
+	created := *si
+	return &created, nil
+}
+
+func (f *fakePaymentProvider) GetSetupIntent(ctx context.Context, setupIntentID string) (*SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	si, ok := f.setupIntents[setupIntentID]
+	if !ok {
+		return nil, ErrSetupIntentNotFound
+	}
+	found := *si
+	return &found, nil
+}
+
+// confirmSetupIntent はフロントエンドでカードの登録を完了した状態にします（Stripeと同じく、カードを手続きの顧客に紐づけます）
+func (f *fakePaymentProvider) confirmSetupIntent(t *testing.T, setupIntentID string, paymentMethodID string) {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	si, ok := f.setupIntents[setupIntentID]
+	pm, found := f.paymentMethods[paymentMethodID]
+	if !ok || !found {
+		t.Fatalf("setup intent %s or payment method %s was not created", setupIntentID, paymentMethodID)
+	}
+	si.Status = "succeeded"
+	si.PaymentMethodID = paymentMethodID
+	pm.CustomerID = si.CustomerID
+}
+
+func (f *fakePaymentProvider) ConstructWebhookEvent(payload []byte, header http.Header) (*WebhookEvent, error) {
+	event, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), f.webhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	return webhookEventOf(&event), nil
+}
+
+// webhookRequest はobjectをデータに持つイベントを、Stripeと同じ形式で署名したWebhookのリクエストとして作成します
+func (f *fakePaymentProvider) webhookRequest(t *testing.T, eventType string, object interface{}) *http.Request {
+	t.Helper()
+
+	f.mu.Lock()
+	eventID := f.nextID("evt")
+	f.mu.Unlock()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":     eventID,
+		"object": "event",
+		"type":   eventType,
+		"data":   map[string]interface{}{"object": object},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	req := httptest.NewRequest("POST", "/api/webhooks/stripe", strings.NewReader(string(payload)))
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, f.webhookSecret))
+	req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	return req
+}
+
+// succeedPaymentIntent は作成済みの支払いが完了したイベント（payment_intent.succeeded）のWebhookのリクエストを作成します
+// 支払いに対応するChargeは、Stripeの新しいAPIバージョンと同じくlatest_chargeにIDで含めます
+func (f *fakePaymentProvider) succeedPaymentIntent(t *testing.T, paymentIntentID string) *http.Request {
+	t.Helper()
+
+	f.mu.Lock()
+	params, ok := f.paymentIntents[paymentIntentID]
+	if !ok {
+		f.mu.Unlock()
+		t.Fatalf("payment intent %s was not created", paymentIntentID)
+	}
+	chargeID, ok := f.charges[paymentIntentID]
+	if !ok {
+		chargeID = f.nextID("ch")
+		f.charges[paymentIntentID] = chargeID
+	}
+	f.paymentIntentStatuses[paymentIntentID] = "succeeded"
+	f.mu.Unlock()
+
+	return f.webhookRequest(t, "payment_intent.succeeded", map[string]interface{}{
+		"id":                   paymentIntentID,
+		"object":               "payment_intent",
+		"amount":               params.Amount,
+		"amount_received":      params.Amount,
+		"currency":             params.Currency,
+		"status":               "succeeded",
+		"metadata":             params.Metadata,
+		"payment_method_types": []string{"card"},
+		"transfer_group":       params.TransferGroup,
+		"latest_charge":        chargeID,
+	})
+}
+
+// succeedCharge は支払いが完了した支払いのChargeのイベント（charge.succeeded）のWebhookのリクエストを作成します
+// Destination Chargeの支払いであれば、Stripeと同じく出品者への入金（Transfer）をChargeに含め、そのIDも返します
+func (f *fakePaymentProvider) succeedCharge(t *testing.T, paymentIntentID string) (*http.Request, string) {
+	t.Helper()
+
+	f.mu.Lock()
+	params, ok := f.paymentIntents[paymentIntentID]
+	chargeID, charged := f.charges[paymentIntentID]
+	if !ok || !charged {
+		f.mu.Unlock()
+		t.Fatalf("payment intent %s has not succeeded", paymentIntentID)
+	}
+	charge := map[string]interface{}{
+		"id":             chargeID,
+		"object":         "charge",
+		"amount":         params.Amount,
+		"currency":       params.Currency,
+		"paid":           true,
+		"payment_intent": paymentIntentID,
+		"metadata":       params.Metadata,
+	}
+	transferID := ""
+	if params.TransferDestination != "" {
+		transferID = f.nextID("tr")
+		charge["transfer"] = transferID
+	}
+	f.mu.Unlock()
+
+	return f.webhookRequest(t, "charge.succeeded", charge), transferID
+}
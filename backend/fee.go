@@ -0,0 +1,34 @@
+// backend/fee.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// 手数料率はベーシスポイント（1 = 0.01%）の整数で扱い、浮動小数点による誤差を避けます
+const (
+	// defaultPlatformFeeBasisPoints はプラットフォーム手数料率の既定値（5%）です
+	// 環境変数 PLATFORM_FEE_BASIS_POINTS で変更でき、出品者ごとにprofilesで上書きできます
+	defaultPlatformFeeBasisPoints = 500
+	// maxFeeBasisPoints は手数料率の上限（100%）です
+	maxFeeBasisPoints = 10000
+)
+
+// platformFee は金額に手数料率を掛けたプラットフォーム手数料を、1円未満を切り捨てて返します
+// 切り捨てにより、手数料が出品者の不利に丸められることはありません
+func platformFee(amount int, basisPoints int) int {
+	return int(int64(amount) * int64(basisPoints) / maxFeeBasisPoints)
+}
+
+// parseFeeBasisPoints は手数料率の文字列を解釈します（0〜10000）
+func parseFeeBasisPoints(v string) (int, error) {
+	bp, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if bp < 0 || bp > maxFeeBasisPoints {
+		return 0, fmt.Errorf("fee basis points must be between 0 and %d: %d", maxFeeBasisPoints, bp)
+	}
+	return bp, nil
+}
@@ -2,23 +2,111 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/webhook"
 )
 
-// getBeansHandler はStoreを使ってDBから全件取得する
+// uuidPattern はUUID形式（ハイフン区切り）の文字列にマッチします
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// parseBeanFilter はクエリパラメータから豆の検索条件を組み立てます
+// 不正な値が含まれている場合は、クライアントに返すエラーメッセージを返します
+func parseBeanFilter(r *http.Request) (BeanFilter, error) {
+	q := r.URL.Query()
+	filter := BeanFilter{
+		Origin:       strings.TrimSpace(q.Get("origin")),
+		Process:      strings.ToLower(strings.TrimSpace(q.Get("process"))),
+		RoastProfile: strings.ToLower(strings.TrimSpace(q.Get("roast_profile"))),
+		SellerID:     strings.TrimSpace(q.Get("seller_id")),
+		Keyword:      strings.TrimSpace(q.Get("q")),
+		Sort:         strings.TrimSpace(q.Get("sort")),
+	}
+
+	if filter.Process != "" && !validProcesses[filter.Process] {
+		return filter, fmt.Errorf("Invalid process: %s", filter.Process)
+	}
+	if filter.RoastProfile != "" && !validRoastProfiles[filter.RoastProfile] {
+		return filter, fmt.Errorf("Invalid roast_profile: %s", filter.RoastProfile)
+	}
+	if filter.SellerID != "" && !uuidPattern.MatchString(filter.SellerID) {
+		return filter, fmt.Errorf("Invalid seller_id: %s", filter.SellerID)
+	}
+	if filter.Sort == "" {
+		filter.Sort = BeanSortNewest
+	}
+	if _, ok := beanSortOrders[filter.Sort]; !ok {
+		return filter, fmt.Errorf("Invalid sort: %s", filter.Sort)
+	}
+
+	for _, p := range []struct {
+		name string
+		dest **int
+	}{
+		{"min_price", &filter.MinPrice},
+		{"max_price", &filter.MaxPrice},
+	} {
+		v := strings.TrimSpace(q.Get(p.name))
+		if v == "" {
+			continue
+		}
+		price, err := strconv.Atoi(v)
+		if err != nil || price < 0 {
+			return filter, fmt.Errorf("Invalid %s: %s", p.name, v)
+		}
+		*p.dest = &price
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return filter, fmt.Errorf("min_price must not be greater than max_price")
+	}
+
+	return filter, nil
+}
+
+// parsePageParams はクエリパラメータ "limit" と "cursor" からページングの指定を組み立てます
+func parsePageParams(r *http.Request) (PageParams, error) {
+	q := r.URL.Query()
+	page := PageParams{Limit: DefaultPageLimit, Cursor: strings.TrimSpace(q.Get("cursor"))}
+
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > MaxPageLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", MaxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	return page, nil
+}
+
+// getBeansHandler はクエリパラメータの検索条件・並び順でDBから豆を1ページ分取得する
 func (a *Api) getBeansHandler(w http.ResponseWriter, r *http.Request) {
-	beans, err := a.store.GetAllBeans(r.Context())
+	filter, err := parseBeanFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	beans, err := a.store.SearchBeans(r.Context(), filter, page)
 	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		log.Printf("ERROR: Failed to get beans from DB: %v", err)
 		http.Error(w, "Failed to get beans from DB", http.StatusInternalServerError)
 		return
@@ -41,6 +129,10 @@ func (a *Api) getBeanHandler(w http.ResponseWriter, r *http.Request) {
 
 	bean, err := a.store.GetBeanByID(r.Context(), id)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
 		http.Error(w, "Failed to get bean from DB", http.StatusInternalServerError)
 		return
 	}
@@ -48,6 +140,21 @@ func (a *Api) getBeanHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	// 非公開の豆や停止中の出品者の豆は、出品者本人と管理者・モデレーター以外には存在しないものとして扱う
+	if !bean.Listed() {
+		principal, _ := principalFromContext(r.Context())
+		if principal != nil && principal.UserID != bean.UserID {
+			if err := a.loadRoles(r.Context(), principal); err != nil {
+				log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+				http.Error(w, "Failed to get user roles", http.StatusInternalServerError)
+				return
+			}
+		}
+		if principal == nil || (principal.UserID != bean.UserID && !principal.Can(PermissionModerateBeans)) {
+			http.NotFound(w, r)
+			return
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(bean); err != nil {
@@ -63,7 +170,11 @@ func (a *Api) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 // createBeanHandler は新しいコーヒー豆のデータを登録します
 func (a *Api) createBeanHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID := r.Context().Value(userIDKey).(string)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
 	var bean Bean
 	if err := json.NewDecoder(r.Body).Decode(&bean); err != nil {
@@ -76,6 +187,43 @@ func (a *Api) createBeanHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name and origin are required", http.StatusBadRequest)
 		return
 	}
+	if bean.Stock < 0 {
+		http.Error(w, "Stock must not be negative", http.StatusBadRequest)
+		return
+	}
+	if bean.WeightGrams < 0 {
+		http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+		return
+	}
+	bean.TaxCategory = strings.ToLower(strings.TrimSpace(bean.TaxCategory))
+	if bean.TaxCategory != "" && taxRates[bean.TaxCategory] == 0 {
+		http.Error(w, fmt.Sprintf("Invalid tax_category: %s", bean.TaxCategory), http.StatusBadRequest)
+		return
+	}
+
+	// 停止中の出品者は新しく出品できない
+	suspended, err := a.store.IsSellerSuspended(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get seller suspension from DB: %v", err)
+		http.Error(w, "Failed to create bean", http.StatusInternalServerError)
+		return
+	}
+	if suspended {
+		http.Error(w, "Your seller account is suspended", http.StatusForbidden)
+		return
+	}
+
+	// 売上を受け取れない出品者の豆は購入できないため、Stripe Connectの登録が完了していなければ出品させない
+	sellerAccount, err := a.store.GetSellerStripeAccount(r.Context(), userID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("ERROR: Failed to get stripe account from DB: %v", err)
+		http.Error(w, "Failed to create bean", http.StatusInternalServerError)
+		return
+	}
+	if sellerAccount == nil || !sellerAccount.PayoutsEnabled() {
+		http.Error(w, "Seller account must be enabled to list beans", http.StatusForbidden)
+		return
+	}
 
 	bean.UserID = userID
 
@@ -96,12 +244,21 @@ func (a *Api) createBeanHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// UpdateBeanRequest は豆の更新のリクエストボディです
+type UpdateBeanRequest struct {
+	Bean
+	// Stock は新しい在庫数です（省略した場合は現在の在庫数を維持します）
+	Stock *int `json:"stock"`
+	// WeightGrams は新しい1袋あたりの重量です（省略した場合は現在の重量を維持します）
+	WeightGrams *int `json:"weight_grams"`
+}
+
 // updateBeanHandler は既存のコーヒー豆のデータを更新します
+// モデレーター・管理者は他のユーザーの豆も更新でき、クエリパラメータ "reason" の理由とともに監査ログに記録されます
 func (a *Api) updateBeanHandler(w http.ResponseWriter, r *http.Request) {
-	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	// contextから、認証ミドルウェアが設定した利用者を取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
 
@@ -113,14 +270,35 @@ func (a *Api) updateBeanHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var bean Bean
-	if err := json.NewDecoder(r.Body).Decode(&bean); err != nil {
+	var req UpdateBeanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	bean := req.Bean
+	if req.Stock != nil && *req.Stock < 0 {
+		http.Error(w, "Stock must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.WeightGrams != nil && *req.WeightGrams < 0 {
+		http.Error(w, "Weight must not be negative", http.StatusBadRequest)
+		return
+	}
+	bean.TaxCategory = strings.ToLower(strings.TrimSpace(bean.TaxCategory))
+	if bean.TaxCategory != "" && taxRates[bean.TaxCategory] == 0 {
+		http.Error(w, fmt.Sprintf("Invalid tax_category: %s", bean.TaxCategory), http.StatusBadRequest)
+		return
+	}
+
+	// 他のユーザーの豆を更新できるかは利用者のロールで決まるので、ロールを取得しておく
+	if err := a.loadRoles(r.Context(), principal); err != nil {
+		log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+		http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+		return
+	}
 
 	// Store（DB）のBeanを更新する
-	updatedBean, err := a.store.UpdateBean(r.Context(), id, userID, &bean)
+	updatedBean, err := a.store.UpdateBean(r.Context(), id, principal, &bean, req.Stock, req.WeightGrams, strings.TrimSpace(r.URL.Query().Get("reason")))
 	if err != nil {
 		// pgx.ErrNoRowsは、更新対象が見つからなかった（IDが違うか、所有者でない）場合に返される
 		if err.Error() == "no rows in result set" {
@@ -141,11 +319,11 @@ func (a *Api) updateBeanHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // deleteBeanHandler は既存のコーヒー豆のデータを削除します
+// モデレーター・管理者は他のユーザーの豆（不正な出品など）も削除でき、クエリパラメータ "reason" の理由とともに監査ログに記録されます
 func (a *Api) deleteBeanHandler(w http.ResponseWriter, r *http.Request) {
-	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	// contextから、認証ミドルウェアが設定した利用者を取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
 
@@ -157,8 +335,15 @@ func (a *Api) deleteBeanHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 他のユーザーの豆を削除できるかは利用者のロールで決まるので、ロールを取得しておく
+	if err := a.loadRoles(r.Context(), principal); err != nil {
+		log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+		http.Error(w, "Failed to delete bean", http.StatusInternalServerError)
+		return
+	}
+
 	// Store（DB）のBeanを削除する
-	err = a.store.DeleteBean(r.Context(), id, userID)
+	err = a.store.DeleteBean(r.Context(), id, principal, strings.TrimSpace(r.URL.Query().Get("reason")))
 	if err != nil {
 		// pgx.ErrNoRowsは、削除対象が見つからなかった（IDが違うか、所有者でない）場合に返される
 		if err.Error() == "no rows in result set" {
@@ -175,17 +360,27 @@ func (a *Api) deleteBeanHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// getMyBeansHandler は認証されているユーザー自身の豆リストを取得します
+// getMyBeansHandler は認証されているユーザー自身の豆リストを1ページ分取得します
 func (a *Api) getMyBeansHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
+	userID := principal.UserID
 
-	beans, err := a.store.GetBeansByUserID(r.Context(), userID)
+	page, err := parsePageParams(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	beans, err := a.store.GetBeansByUserID(r.Context(), userID, page)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		log.Printf("ERROR: Failed to get beans from DB: %v", err)
 		http.Error(w, "Failed to get beans from DB", http.StatusInternalServerError)
 		return
@@ -205,12 +400,6 @@ func (a *Api) beansHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		a.getBeansHandler(w, r)
 	case http.MethodPost:
-		// POSTの場合は、contextにミドルウェアで認証済みのuserIDが入っているかチェック
-		userID, ok := r.Context().Value(userIDKey).(string)
-		if !ok || strings.TrimSpace(userID) == "" {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
-			return
-		}
 		a.createBeanHandler(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -226,21 +415,9 @@ func (a *Api) beanDetailHandler(w http.ResponseWriter, r *http.Request) {
 		a.getBeanHandler(w, r)
 
 	case http.MethodPut:
-		// PUT（更新）の場合は、認証済みユーザーである必要があるので、ここでチェック
-		userID, ok := r.Context().Value(userIDKey).(string)
-		if !ok || strings.TrimSpace(userID) == "" {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
-			return
-		}
 		a.updateBeanHandler(w, r)
 
 	case http.MethodDelete:
-		// DELETE（削除）の場合も、認証済みユーザーである必要があるので、ここでチェック
-		userID, ok := r.Context().Value(userIDKey).(string)
-		if !ok || strings.TrimSpace(userID) == "" {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
-			return
-		}
 		a.deleteBeanHandler(w, r)
 
 	default:
@@ -251,11 +428,11 @@ func (a *Api) beanDetailHandler(w http.ResponseWriter, r *http.Request) {
 // addCartItemHandler はカートに商品を追加します
 func (a *Api) addCartItemHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
+	userID := principal.UserID
 
 	var req AddCartItemRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -272,9 +449,15 @@ func (a *Api) addCartItemHandler(w http.ResponseWriter, r *http.Request) {
 	// Store（DB）にカートアイテムを追加/更新
 	cartItem, err := a.store.AddOrUpdateCartItem(r.Context(), userID, req)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Bean not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrInsufficientStock) {
+			http.Error(w, "Requested quantity exceeds available stock", http.StatusConflict)
+			return
+		}
 		log.Printf("ERROR: Failed to add or update cart item: %v", err)
-		// ここで、例えば "foreign key constraint" のような具体的なDBエラーをチェックして、
-		// 存在しないbean_idが指定された場合に404 Not Foundを返すことも可能
 		http.Error(w, "Failed to process cart operation", http.StatusInternalServerError)
 		return
 	}
@@ -290,11 +473,11 @@ func (a *Api) addCartItemHandler(w http.ResponseWriter, r *http.Request) {
 // getCartHandler は認証されているユーザーのカートの中身を取得します
 func (a *Api) getCartHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
+	userID := principal.UserID
 
 	// Storeからカートの中身を取得
 	cartItems, err := a.store.GetCartItemsByUserID(r.Context(), userID)
@@ -319,13 +502,6 @@ func (a *Api) getCartHandler(w http.ResponseWriter, r *http.Request) {
 
 // cartItemDetailHandlerは /api/cart/items/{id} へのリクエストをHTTPメソッドによって振り分ける
 func (a *Api) cartItemDetailHandler(w http.ResponseWriter, r *http.Request) {
-	// 認証済みユーザーである必要があるので、ここでチェック
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
-		return
-	}
-
 	switch r.Method {
 	case http.MethodPut:
 		a.updateCartItemHandler(w, r)
@@ -339,7 +515,11 @@ func (a *Api) cartItemDetailHandler(w http.ResponseWriter, r *http.Request) {
 // updateCartItemHandler はカート内の商品の数量を更新します
 func (a *Api) updateCartItemHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID := r.Context().Value(userIDKey).(string)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
 	// URLからIDを取得
 	idStr := r.PathValue("id")
@@ -368,6 +548,10 @@ func (a *Api) updateCartItemHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Cart item not found or you don't have permission to update it", http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, ErrInsufficientStock) {
+			http.Error(w, "Requested quantity exceeds available stock", http.StatusConflict)
+			return
+		}
 		log.Printf("ERROR: Failed to update cart item in DB: %v", err)
 		http.Error(w, "Failed to update cart item", http.StatusInternalServerError)
 		return
@@ -383,7 +567,11 @@ func (a *Api) updateCartItemHandler(w http.ResponseWriter, r *http.Request) {
 // deleteCartItemHandler はカートから商品を削除します
 func (a *Api) deleteCartItemHandler(w http.ResponseWriter, r *http.Request) {
 	// contextから、認証ミドルウェアが設定したユーザーIDを取得
-	userID := r.Context().Value(userIDKey).(string)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
 	// URLからIDを取得
 	idStr := r.PathValue("id")
@@ -423,7 +611,11 @@ func (a *Api) profileHandler(w http.ResponseWriter, r *http.Request) {
 
 // createProfileHandler は新しいプロフィールを登録します
 func (a *Api) createProfileHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDKey).(string)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
 	var profile Profile
 	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
@@ -432,9 +624,18 @@ func (a *Api) createProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	profile.UserID = userID
+	profile.InvoiceRegistrationNumber = normalizeInvoiceRegistrationNumber(profile.InvoiceRegistrationNumber)
+	if profile.InvoiceRegistrationNumber != "" && !isValidInvoiceRegistrationNumber(profile.InvoiceRegistrationNumber) {
+		http.Error(w, "Invoice registration number must be T followed by 13 digits", http.StatusBadRequest)
+		return
+	}
 
 	newProfile, err := a.store.CreateProfile(r.Context(), &profile)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Profile already exists", http.StatusConflict)
+			return
+		}
 		log.Printf("ERROR: Failed to create profile in DB: %v", err)
 		http.Error(w, "Failed to create profile", http.StatusInternalServerError)
 		return
@@ -447,19 +648,39 @@ func (a *Api) createProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// UpdateProfileRequest はプロフィールの更新のリクエストボディです
+type UpdateProfileRequest struct {
+	Profile
+	// InvoiceRegistrationNumber は新しい登録番号です（省略した場合は現在の登録番号を維持し、空文字列の場合は削除します）
+	InvoiceRegistrationNumber *string `json:"invoice_registration_number"`
+}
+
 // updateProfileHandler は既存のプロフィールを更新します
 func (a *Api) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(userIDKey).(string)
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
-	var profile Profile
-	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	profile := req.Profile
 	profile.UserID = userID
+	if req.InvoiceRegistrationNumber != nil {
+		number := normalizeInvoiceRegistrationNumber(*req.InvoiceRegistrationNumber)
+		if number != "" && !isValidInvoiceRegistrationNumber(number) {
+			http.Error(w, "Invoice registration number must be T followed by 13 digits", http.StatusBadRequest)
+			return
+		}
+		req.InvoiceRegistrationNumber = &number
+	}
 
-	updatedProfile, err := a.store.UpdateProfile(r.Context(), &profile)
+	updatedProfile, err := a.store.UpdateProfile(r.Context(), &profile, req.InvoiceRegistrationNumber)
 	if err != nil {
 		log.Printf("ERROR: Failed to update profile in DB: %v", err)
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
@@ -472,213 +693,456 @@ func (a *Api) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// createPaymentIntentHandler はStripeのPaymentIntentを作成し、client_secretを返します
-func (a *Api) createPaymentIntentHandler(w http.ResponseWriter, r *http.Request) {
-	// 認証済みユーザーでなければエラー
-	userID, ok := r.Context().Value(userIDKey).(string)
-	if !ok || strings.TrimSpace(userID) == "" {
-		http.Error(w, "Authentication required", http.StatusUnauthorized)
+// getOrdersHandler は認証されているユーザー自身の注文履歴を新しい順に1ページ分取得します
+// クエリパラメータ "status" で注文の状態を絞り込めます
+func (a *Api) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
+	userID := principal.UserID
 
-	// POSTメソッドでなければエラー
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// ユーザーのカート情報をDBから取得
-	cartItems, err := a.store.GetCartItemsByUserID(r.Context(), userID)
+	status := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("status")))
+	if status != "" && !validOrderStatuses[status] {
+		http.Error(w, fmt.Sprintf("Invalid status: %s", status), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePageParams(r)
 	if err != nil {
-		log.Printf("ERROR: Failed to get cart items from DB: %v", err)
-		http.Error(w, "Failed to get cart items", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// カートが空の場合はエラー
-	if len(cartItems) == 0 {
-		http.Error(w, "Cart is empty", http.StatusBadRequest)
+	orders, err := a.store.GetOrdersByUserID(r.Context(), userID, status, page)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		log.Printf("ERROR: Failed to get orders from DB: %v", err)
+		http.Error(w, "Failed to get orders", http.StatusInternalServerError)
 		return
 	}
 
-	// 合計金額を計算
-	var totalAmount int64
-	for _, item := range cartItems {
-		totalAmount += int64(item.Price) * int64(item.Quantity)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(orders); err != nil {
+		log.Printf("ERROR: Failed to encode orders to JSON: %v", err)
 	}
+}
 
-	// StripeのAPIキーを設定
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+// getOrderHandler は認証されているユーザー自身の注文を、明細とともに1件取得します
+func (a *Api) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
 
-	// PaymentIntentを作成
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(totalAmount),
-		Currency: stripe.String(string(stripe.CurrencyJPY)), // 通貨をJPYに設定
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled: stripe.Bool(true),
-		},
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	params.AddMetadata("user_id", userID)
 
-	pi, err := paymentintent.New(params)
+	// URLからIDを取得
+	id, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		log.Printf("ERROR: Failed to create PaymentIntent: %v", err)
-		http.Error(w, "Failed to create PaymentIntent", http.StatusInternalServerError)
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := a.store.GetOrderDetail(r.Context(), id, userID)
+	if err != nil {
+		// 他のユーザーの注文である可能性を示唆しないよう、一般的なNot Foundを返す
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get order from DB: %v", err)
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
 		return
 	}
 
-	// レスポンスを作成
-	response := map[string]string{"client_secret": pi.ClientSecret}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("ERROR: Failed to encode response to JSON: %v", err)
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		log.Printf("ERROR: Failed to encode order to JSON: %v", err)
 	}
 }
 
-// handleStripeWebhook はStripeからのWebhookを受け取り処理します
-func (a *Api) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
-	const MaxBodyBytes = int64(65536)
-	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
-	payload, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("ERROR: Failed to read webhook body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusServiceUnavailable)
+// getSellerOrdersHandler は認証されているユーザーへの受注（子注文）を、明細とともに新しい順に1ページ分取得します
+// クエリパラメータ "fulfillment_status" で発送の進捗を絞り込めます
+func (a *Api) getSellerOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
 		return
 	}
+	userID := principal.UserID
 
-	signatureHeader := r.Header.Get("Stripe-Signature")
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	event, err := webhook.ConstructEvent(payload, signatureHeader, webhookSecret)
+	status := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("fulfillment_status")))
+	if status != "" && !validFulfillmentStatuses[status] {
+		http.Error(w, fmt.Sprintf("Invalid fulfillment_status: %s", status), http.StatusBadRequest)
+		return
+	}
+	page, err := parsePageParams(r)
 	if err != nil {
-		log.Printf("ERROR: Webhook signature verification failed: %v", err)
-		http.Error(w, "Webhook signature verification failed", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	switch event.Type {
-	case "payment_intent.succeeded":
-		var paymentIntent stripe.PaymentIntent
-		if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
-			log.Printf("ERROR: Failed to unmarshal payment_intent.succeeded: %v", err)
-			http.Error(w, "Failed to parse webhook data", http.StatusBadRequest)
+	orders, err := a.store.GetSellerOrders(r.Context(), userID, status, page)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
 			return
 		}
-		log.Printf("✅ PaymentIntent succeeded: %s", paymentIntent.ID)
+		log.Printf("ERROR: Failed to get seller orders from DB: %v", err)
+		http.Error(w, "Failed to get seller orders", http.StatusInternalServerError)
+		return
+	}
 
-		userID, ok := paymentIntent.Metadata["user_id"]
-		shortUserID := userID
-		if len(userID) > 8 {
-			shortUserID = userID[:8]
-		}
-		if !ok || userID == "" {
-			log.Printf("ERROR: user_id not found in payment intent metadata for pi_id: %s", paymentIntent.ID)
-			http.Error(w, "User ID not found in metadata", http.StatusBadRequest)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(orders); err != nil {
+		log.Printf("ERROR: Failed to encode seller orders to JSON: %v", err)
+	}
+}
 
-		cartItems, err := a.store.GetCartItemsByUserID(r.Context(), userID)
-		if err != nil {
-			log.Printf("ERROR: Failed to get cart items for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to get cart items", http.StatusInternalServerError)
-			return
-		}
-		if len(cartItems) == 0 {
-			log.Printf("INFO: Cart is empty for user %s on payment success, possibly already processed.", shortUserID)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// UpdateFulfillmentRequest は発送の進捗を更新するリクエストのボディです
+type UpdateFulfillmentRequest struct {
+	Status         string `json:"status"`
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+}
 
-		// トランザクションを開始
-		tx, err := a.dbpool.Begin(r.Context())
-		if err != nil {
-			log.Printf("ERROR: Failed to begin transaction: %v", err)
-			http.Error(w, "Failed to process order", http.StatusInternalServerError)
-			return
-		}
-		defer tx.Rollback(r.Context()) // エラー発生時にロールバック
-
-		storeWithTx := NewStore(tx)
-		order := &Order{
-			UserID:                userID,
-			Status:                "succeeded",
-			TotalAmount:           int(paymentIntent.Amount),
-			Currency:              string(paymentIntent.Currency),
-			PaymentMethodType:     paymentIntent.PaymentMethodTypes[0],
-			StripePaymentIntentID: paymentIntent.ID,
+// updateFulfillmentHandler は出品者自身の子注文について、発送の進捗を次の段階に進めます
+// 発送済み（shipped）にする場合は、配送業者と追跡番号が必須です
+func (a *Api) updateFulfillmentHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// URLからIDを取得
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid sub-order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateFulfillmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Status = strings.ToLower(strings.TrimSpace(req.Status))
+	req.Carrier = strings.TrimSpace(req.Carrier)
+	req.TrackingNumber = strings.TrimSpace(req.TrackingNumber)
+
+	if !validFulfillmentStatuses[req.Status] {
+		http.Error(w, fmt.Sprintf("Invalid status: %s", req.Status), http.StatusBadRequest)
+		return
+	}
+	if req.Status == FulfillmentStatusShipped && (req.Carrier == "" || req.TrackingNumber == "") {
+		http.Error(w, "Carrier and tracking_number are required to mark a sub-order as shipped", http.StatusBadRequest)
+		return
+	}
+
+	// 状態の判定と更新を同じトランザクションで行う
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update fulfillment status", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	subOrder, err := NewStore(tx).UpdateFulfillmentStatus(r.Context(), id, userID, req.Status, req.Carrier, req.TrackingNumber)
+	if err != nil {
+		switch {
+		// 他の出品者の子注文である可能性を示唆しないよう、一般的なNot Foundを返す
+		case errors.Is(err, pgx.ErrNoRows):
+			http.Error(w, "Sub-order not found", http.StatusNotFound)
+		case errors.Is(err, ErrOrderNotFulfillable):
+			http.Error(w, "Order is not in a fulfillable state", http.StatusConflict)
+		case errors.Is(err, ErrInvalidFulfillmentTransition):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("ERROR: Failed to update fulfillment status in DB: %v", err)
+			http.Error(w, "Failed to update fulfillment status", http.StatusInternalServerError)
 		}
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to update fulfillment status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(subOrder); err != nil {
+		log.Printf("ERROR: Failed to encode sub-order to JSON: %v", err)
+	}
+}
+
+// CreatePaymentIntentRequest はPaymentIntentの作成時に受け取るリクエストボディです
+type CreatePaymentIntentRequest struct {
+	// CouponCode は利用するクーポンのコードです（利用しない場合は空）
+	CouponCode string `json:"coupon_code"`
+	// SavePaymentMethod は支払いに使うカードを次回以降のために保存するかです（購入者が選んだ場合のみ保存します）
+	SavePaymentMethod bool `json:"save_payment_method"`
+}
+
+// minimumChargeAmountJPY はStripeで日本円の支払いを受け付けられる最低金額です
+const minimumChargeAmountJPY = 50
+
+// createPaymentIntentHandler はStripeのPaymentIntentを作成し、client_secretを返します
+// クーポンコードが指定された場合は、サーバー側で内容を確認して値引きを請求額に反映します
+func (a *Api) createPaymentIntentHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーでなければエラー
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	// POSTメソッドでなければエラー
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// リクエストボディは省略できる
+	var req CreatePaymentIntentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	couponCode := normalizeCouponCode(req.CouponCode)
+
+	// ユーザーのカート情報をDBから取得
+	cartItems, err := a.store.GetCartItemsByUserID(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get cart items from DB: %v", err)
+		http.Error(w, "Failed to get cart items", http.StatusInternalServerError)
+		return
+	}
 
-		// 注文を作成
-		if _, err := storeWithTx.CreateOrder(r.Context(), order, cartItems); err != nil {
-			log.Printf("ERROR: Failed to create order for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to create order", http.StatusInternalServerError)
+	// カートが空の場合はエラー
+	if len(cartItems) == 0 {
+		http.Error(w, "Cart is empty", http.StatusBadRequest)
+		return
+	}
+	// カートに入れた後に非公開にされた豆や、停止された出品者の豆は購入できない
+	for _, item := range cartItems {
+		if !item.Available {
+			http.Error(w, "Some beans in your cart are no longer available", http.StatusConflict)
 			return
 		}
+	}
 
-		// カートを空にする
-		if err := storeWithTx.ClearCart(r.Context(), userID); err != nil {
-			log.Printf("ERROR: Failed to clear cart for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to clear cart", http.StatusInternalServerError)
+	// カートの商品を出品者ごとにまとめ、全員が売上を受け取れる状態か確認する
+	sellers, err := a.store.GroupCartItemsBySeller(r.Context(), cartItems)
+	if err != nil {
+		log.Printf("ERROR: Failed to get sellers of cart items: %v", err)
+		http.Error(w, "Failed to get cart items", http.StatusInternalServerError)
+		return
+	}
+	for _, seller := range sellers {
+		if !seller.PayoutsEnabled() {
+			http.Error(w, "Some beans in your cart are sold by a seller who cannot receive payments yet", http.StatusConflict)
 			return
 		}
+	}
 
-		// トランザクションをコミット
-		if err := tx.Commit(r.Context()); err != nil {
-			log.Printf("ERROR: Failed to commit transaction for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to finalize order", http.StatusInternalServerError)
-			return
+	// 出品者ごとの送料を、購入者のプロフィールの郵便番号を配送先として計算する
+	if err := a.store.QuoteShipping(r.Context(), userID, sellers); err != nil {
+		switch {
+		case errors.Is(err, ErrShippingAddressRequired):
+			http.Error(w, "A valid post code is required in your profile to calculate shipping", http.StatusBadRequest)
+		case errors.Is(err, ErrShippingUnavailable):
+			http.Error(w, "Some beans in your cart cannot be shipped to your address", http.StatusConflict)
+		default:
+			log.Printf("ERROR: Failed to calculate shipping fee: %v", err)
+			http.Error(w, "Failed to calculate shipping fee", http.StatusInternalServerError)
 		}
+		return
+	}
 
-		log.Printf("🎉 Order created successfully for user %s", shortUserID)
+	// カートの内容を、購入時点の価格を持つ注文明細として確定する
+	orderItems := orderItemsFromCart(cartItems)
 
-	case "payment_intent.payment_failed":
-		var paymentIntent stripe.PaymentIntent
-		if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
-			log.Printf("ERROR: Failed to unmarshal payment_intent.payment_failed: %v", err)
-			http.Error(w, "Failed to parse webhook data", http.StatusBadRequest)
-			return
-		}
-		log.Printf("❌ PaymentIntent failed: %s, Reason: %s", paymentIntent.ID, paymentIntent.LastPaymentError.Msg)
+	// 決済をやり直す場合に備えて、このユーザーの以前の決済を取り消し、取り消せた分の在庫を解放する
+	// 古い保留中の注文はクーポンの利用回数に数えなくなるので、やり直しでも同じクーポンを使える
+	if err := a.cancelReservedCheckouts(r.Context(), userID); err != nil {
+		log.Printf("ERROR: Failed to cancel previous checkouts: %v", err)
+		http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		return
+	}
 
-		userID, ok := paymentIntent.Metadata["user_id"]
-		shortUserID := userID
-		if len(userID) > 8 {
-			shortUserID = userID[:8]
-		}
-		if !ok || userID == "" {
-			log.Printf("ERROR: user_id not found in payment intent metadata for pi_id: %s", paymentIntent.ID)
-			http.Error(w, "User ID not found in metadata", http.StatusBadRequest)
-			return
-		}
+	// 保存済みのカードで支払えるよう、購入者のStripe Customerを用意する
+	payments := a.paymentProvider()
+	customerID, err := ensureStripeCustomer(r.Context(), a.store, payments, userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to prepare stripe customer: %v", err)
+		http.Error(w, "Failed to create PaymentIntent", http.StatusInternalServerError)
+		return
+	}
+
+	// クーポンの確認・在庫確保・保留中の注文の作成を1つのトランザクションで行い、
+	// 豆やクーポンの行をロックしたままStripeを呼び出さないよう、PaymentIntentはコミット後に作成する
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context()) // エラー発生時にロールバック
+
+	storeWithTx := NewStore(tx)
 
-		cartItems, err := a.store.GetCartItemsByUserID(r.Context(), userID)
+	// クーポンを確認し、値引きを出品者ごとの商品に割り当てる
+	var coupon *Coupon
+	if couponCode != "" {
+		coupon, err = redeemCoupon(r.Context(), storeWithTx, userID, couponCode, sellers, time.Now())
 		if err != nil {
-			log.Printf("ERROR: Failed to get cart items for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to get cart items", http.StatusInternalServerError)
+			switch {
+			case errors.Is(err, ErrCouponNotFound), errors.Is(err, ErrCouponNotAvailable):
+				http.Error(w, "Invalid or expired coupon code", http.StatusBadRequest)
+			case errors.Is(err, ErrCouponNotApplicable):
+				http.Error(w, "The coupon does not apply to any beans in your cart", http.StatusBadRequest)
+			case errors.Is(err, ErrCouponMinSpend):
+				http.Error(w, "Your cart does not meet the minimum spend for this coupon", http.StatusBadRequest)
+			case errors.Is(err, ErrCouponUsageLimit):
+				http.Error(w, "The coupon has reached its usage limit", http.StatusConflict)
+			default:
+				log.Printf("ERROR: Failed to apply coupon %s: %v", couponCode, err)
+				http.Error(w, "Failed to apply coupon", http.StatusInternalServerError)
+			}
 			return
 		}
+	}
 
-		order := &Order{
-			UserID:                userID,
-			Status:                "failed",
-			TotalAmount:           int(paymentIntent.Amount),
-			Currency:              string(paymentIntent.Currency),
-			PaymentMethodType:     paymentIntent.PaymentMethodTypes[0],
-			StripePaymentIntentID: paymentIntent.ID,
-		}
+	// 合計金額（商品の小計と送料から値引きを差し引いた額）を計算
+	var totalAmount, discountAmount int64
+	for _, seller := range sellers {
+		totalAmount += int64(seller.Total())
+		discountAmount += int64(seller.Discount())
+	}
+	if totalAmount < minimumChargeAmountJPY {
+		http.Error(w, fmt.Sprintf("The order total must be at least %d yen", minimumChargeAmountJPY), http.StatusBadRequest)
+		return
+	}
+
+	// PaymentIntentのパラメータを作成
+	params := &PaymentIntentParams{
+		Amount:     totalAmount,
+		Currency:   string(stripe.CurrencyJPY), // 通貨をJPYに設定
+		CustomerID: customerID,
+		// 購入者が選んだ場合は、支払いが完了したカードをCustomerに保存し、次回の購入で選べるようにする
+		SavePaymentMethod: req.SavePaymentMethod,
+		Metadata:          map[string]string{"user_id": userID},
+	}
 
-		// 失敗した注文も記録する
-		if _, err := a.store.CreateOrder(r.Context(), order, cartItems); err != nil {
-			log.Printf("ERROR: Failed to create failed order record for user %s: %v", shortUserID, err)
-			http.Error(w, "Failed to create order record", http.StatusInternalServerError)
+	// 出品者への入金方法を設定する
+	transferGroup := routePayouts(params, sellers, a.platformFeeBasisPoints, fmt.Sprintf("checkout_%s_%d", shortID(userID), time.Now().UnixNano()))
+	if coupon != nil {
+		params.Metadata["coupon_code"] = coupon.Code
+	}
+
+	// カートの数量分の在庫を確保する（在庫不足の場合は409を返す）
+	if err := storeWithTx.DecrementBeanStock(r.Context(), orderItems); err != nil {
+		if errors.Is(err, ErrInsufficientStock) {
+			http.Error(w, "Requested quantity exceeds available stock", http.StatusConflict)
 			return
 		}
-		log.Printf("📝 Failed order recorded for user %s", shortUserID)
+		log.Printf("ERROR: Failed to reserve stock: %v", err)
+		http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		return
+	}
 
-	default:
-		log.Printf("🤷‍♀️ Unhandled event type: %s", event.Type)
+	// 請求額と一致するカートのスナップショットを、保留中の注文として記録する
+	// Webhookではこの注文の状態だけを更新するので、支払い後にカートが変更されても注文内容は変わらない
+	order := &Order{
+		UserID:              userID,
+		Status:              OrderStatusPending,
+		TotalAmount:         int(totalAmount),
+		Currency:            string(stripe.CurrencyJPY),
+		StripeTransferGroup: transferGroup,
+		// 子注文ごとの手数料はこの手数料率と出品者ごとの上書きから、PaymentIntentと同じ計算で求める
+		PlatformFeeBasisPoints: a.platformFeeBasisPoints,
+	}
+	if coupon != nil {
+		order.CouponID = coupon.ID
+		order.CouponCode = coupon.Code
+	}
+	if _, err := storeWithTx.CreateOrderForSellers(r.Context(), order, sellers); err != nil {
+		log.Printf("ERROR: Failed to create pending order for user %s: %v", shortID(userID), err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// 注文をキーに在庫確保を記録し、有効期限を設定する
+	expiresAt := time.Now().Add(a.stockReservationTTL())
+	if err := storeWithTx.CreateStockReservations(r.Context(), userID, order.ID, orderItems, expiresAt); err != nil {
+		log.Printf("ERROR: Failed to create stock reservations for order %d: %v", order.ID, err)
+		http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit pending order %d: %v", order.ID, err)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	// 在庫を確保した注文に対してPaymentIntentを作成する
+	// 注文IDをメタデータに含め、同じ注文に対して二重に作成しないよう注文IDを冪等キーにする
+	params.Metadata["order_id"] = strconv.Itoa(order.ID)
+	params.IdempotencyKey = fmt.Sprintf("checkout_order_%d", order.ID)
+	pi, err := payments.CreatePaymentIntent(r.Context(), params)
+	if err != nil {
+		log.Printf("ERROR: Failed to create PaymentIntent for order %d: %v", order.ID, err)
+		a.abandonCheckout(r.Context(), order.ID, "")
+		http.Error(w, "Failed to create PaymentIntent", http.StatusInternalServerError)
+		return
+	}
+
+	// Webhookで注文を特定できるよう、PaymentIntentを注文に紐づける
+	if err := a.store.AttachPaymentIntent(r.Context(), order.ID, pi.ID); err != nil {
+		log.Printf("ERROR: Failed to attach pi_id %s to order %d: %v", pi.ID, order.ID, err)
+		a.abandonCheckout(r.Context(), order.ID, pi.ID)
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+
+	// レスポンスを作成（請求額と値引き額は確認画面の表示に使う）
+	response := map[string]interface{}{
+		"client_secret":   pi.ClientSecret,
+		"amount":          totalAmount,
+		"discount_amount": discountAmount,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("ERROR: Failed to encode response to JSON: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
 }
@@ -2,19 +2,31 @@ package main
 
 import (
 		"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go/v72"
 )
 
 // TestGetBeansHandlerは、DBから豆リストを取得するAPIの統合テストです
@@ -38,12 +50,140 @@ func TestGetBeansHandler(t *testing.T) {
 		t.Errorf("期待と異なるステータスコードです: got %v want %v", status, http.StatusOK)
 	}
 
-	var beans []Bean
-	if err := json.NewDecoder(rr.Body).Decode(&beans); err != nil {
+	var page BeanPage
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
 		t.Fatalf("レスポンスボディのJSONデコードに失敗しました: %v", err)
 	}
 }
 
+// TestGetBeansHandler_Filterは、豆リストの検索・絞り込み・並び替えの統合テストです
+func TestGetBeansHandler_Filter(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+	handler := http.HandlerFunc(api.getBeansHandler)
+
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	cheap, err := store.CreateBean(ctx, &Bean{Name: "Filter Test Yirgacheffe", Origin: "FilterTestland", Price: 800, Process: "washed", RoastProfile: "light", UserID: sellerID})
+	assert.NoError(t, err)
+	expensive, err := store.CreateBean(ctx, &Bean{Name: "Filter Test Geisha", Origin: "FilterTestland", Price: 3000, Process: "natural", RoastProfile: "light", UserID: sellerID})
+	assert.NoError(t, err)
+
+	getBeans := func(t *testing.T, query string) []Bean {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/beans?"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var page BeanPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatalf("レスポンスボディのJSONデコードに失敗しました: %v", err)
+		}
+		return page.Items
+	}
+
+	t.Run("正常系: 産地と精製方法で絞り込み", func(t *testing.T) {
+		beans := getBeans(t, "origin=filtertestland&process=natural")
+		if assert.Len(t, beans, 1) {
+			assert.Equal(t, expensive.ID, beans[0].ID)
+		}
+	})
+
+	t.Run("正常系: 価格帯で絞り込み", func(t *testing.T) {
+		beans := getBeans(t, "origin=FilterTestland&max_price=1000")
+		if assert.Len(t, beans, 1) {
+			assert.Equal(t, cheap.ID, beans[0].ID)
+		}
+	})
+
+	t.Run("正常系: キーワード検索と価格の昇順", func(t *testing.T) {
+		beans := getBeans(t, "q=filter+test&seller_id="+sellerID+"&sort=price_asc")
+		if assert.Len(t, beans, 2) {
+			assert.Equal(t, cheap.ID, beans[0].ID)
+			assert.Equal(t, expensive.ID, beans[1].ID)
+		}
+	})
+
+	t.Run("異常系: 不正なパラメータ", func(t *testing.T) {
+		for _, query := range []string{"process=dry", "roast_profile=burnt", "sort=random", "min_price=abc", "min_price=2000&max_price=1000", "seller_id=abc"} {
+			req := httptest.NewRequest("GET", "/api/beans?"+query, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		}
+	})
+}
+
+// TestGetBeansHandler_Paginationは、豆リストのカーソルページングの統合テストです
+func TestGetBeansHandler_Pagination(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+	handler := http.HandlerFunc(api.getBeansHandler)
+
+	// 同じ価格の豆を含めて、並び替えキーが重複しても取りこぼさないことを確認する
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	created := map[int]bool{}
+	for _, price := range []int{1000, 1000, 1500, 2000, 2000} {
+		bean, err := store.CreateBean(ctx, &Bean{Name: "Pagination Test Bean", Origin: "PaginationTestland", Price: price, Process: "washed", RoastProfile: "medium", UserID: sellerID})
+		assert.NoError(t, err)
+		created[bean.ID] = true
+	}
+
+	for _, sort := range []string{BeanSortNewest, BeanSortUpdated, BeanSortPriceAsc, BeanSortPriceDesc} {
+		t.Run("正常系: 全ページを辿る sort="+sort, func(t *testing.T) {
+			seen := map[int]bool{}
+			cursor := ""
+			for pages := 0; pages < 10; pages++ {
+				url := "/api/beans?origin=PaginationTestland&limit=2&sort=" + sort
+				if cursor != "" {
+					url += "&cursor=" + cursor
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+				assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+				var page BeanPage
+				if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+					t.Fatalf("レスポンスボディのJSONデコードに失敗しました: %v", err)
+				}
+				assert.Equal(t, len(created), page.TotalCount)
+				assert.LessOrEqual(t, len(page.Items), 2)
+				for _, b := range page.Items {
+					assert.False(t, seen[b.ID], "同じ豆が複数のページに含まれています: %d", b.ID)
+					seen[b.ID] = true
+				}
+				if page.NextCursor == nil {
+					break
+				}
+				cursor = *page.NextCursor
+			}
+			assert.Equal(t, created, seen)
+		})
+	}
+
+	t.Run("異常系: 不正なカーソルとlimit", func(t *testing.T) {
+		for _, query := range []string{"cursor=not-a-cursor", "limit=0", "limit=1000"} {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/beans?"+query, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		}
+	})
+}
+
 // TestGetBeanHandlerは、DBから特定の豆を取得するAPIの統合テストです
 func TestGetBeanHandler(t *testing.T) {
 	ctx := context.Background()
@@ -100,12 +240,43 @@ func TestCreateBeanHandler(t *testing.T) {
 	api := &Api{store: store}
 	handler := http.HandlerFunc(api.beansHandler)
 
+	// enableSeller は出品者のStripe Connectアカウントの状態を設定します
+	enableSeller := func(t *testing.T, userID string, status string) {
+		t.Helper()
+		_, err := tx.Exec(ctx, `
+			INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, stripe_account_id, stripe_account_status)
+			VALUES ($1, 'Seller', '', '', '', '', 'acct_test_' || replace($1::text, '-', ''), $2)
+			ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = EXCLUDED.stripe_account_id, stripe_account_status = EXCLUDED.stripe_account_status
+		`, userID, status)
+		if err != nil {
+			t.Fatalf("テストデータ（出品者のプロフィール）の作成に失敗しました: %v", err)
+		}
+	}
+
+	t.Run("異常系: Stripe Connectの登録が完了していない", func(t *testing.T) {
+		enableSeller(t, "00000000-0000-0000-0000-000000000000", StripeAccountStatusPending)
+
+		body := `{"name": "Test Bean", "origin": "Test Origin", "price": 1000, "process": "Washed", "roast_profile": "Medium"}`
+		req, _ := http.NewRequest("POST", "/api/beans", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: "00000000-0000-0000-0000-000000000000"}))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("期待と異なるステータスコードです: got %v want %v", status, http.StatusForbidden)
+		}
+	})
+
 	t.Run("正常系: 新しい豆を作成", func(t *testing.T) {
+		enableSeller(t, "00000000-0000-0000-0000-000000000000", StripeAccountStatusEnabled)
+
 		body := `{"name": "Test Bean", "origin": "Test Origin", "price": 1000, "process": "Washed", "roast_profile": "Medium"}`
 		req, _ := http.NewRequest("POST", "/api/beans", strings.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
 
-		ctxWithUser := context.WithValue(req.Context(), userIDKey, "00000000-0000-0000-0000-000000000000")
+		ctxWithUser := contextWithPrincipal(req.Context(), &Principal{UserID: "00000000-0000-0000-0000-000000000000"})
 		req = req.WithContext(ctxWithUser)
 
 		rr := httptest.NewRecorder()
@@ -154,7 +325,7 @@ func TestUpdateBeanHandler(t *testing.T) {
 	ownerUserID := "00000000-0000-0000-0000-000000000000"
 	otherUserID := "11111111-1111-1111-1111-111111111111"
 
-	myBean := &Bean{Name: "My Bean", Origin: "My Origin", Process: "washed", RoastProfile: "medium", UserID: ownerUserID}
+	myBean := &Bean{Name: "My Bean", Origin: "My Origin", Process: "washed", RoastProfile: "medium", UserID: ownerUserID, Stock: 7, WeightGrams: 250}
 	createdMyBean, err := store.CreateBean(ctx, myBean)
 	if err != nil {
 		t.Fatalf("テストデータ（自分の豆）の作成に失敗しました: %v", err)
@@ -173,7 +344,7 @@ func TestUpdateBeanHandler(t *testing.T) {
 		req.Header.Set("Content-Type", "application/json")
 		req.SetPathValue("id", strconv.Itoa(createdMyBean.ID))
 
-		ctxWithOwner := context.WithValue(req.Context(), userIDKey, ownerUserID)
+		ctxWithOwner := contextWithPrincipal(req.Context(), &Principal{UserID: ownerUserID})
 		req = req.WithContext(ctxWithOwner)
 
 		rr := httptest.NewRecorder()
@@ -190,6 +361,202 @@ func TestUpdateBeanHandler(t *testing.T) {
 		if updatedBean.Name != "Updated Name" {
 			t.Errorf("期待と異なる豆の名前です: got %v want %v", updatedBean.Name, "Updated Name")
 		}
+		// 在庫数を省略した場合は現在の在庫数が維持される
+		if updatedBean.Stock != 7 {
+			t.Errorf("期待と異なる在庫数です: got %v want %v", updatedBean.Stock, 7)
+		}
+		// 重量を省略した場合は現在の重量が維持される
+		if updatedBean.WeightGrams != 250 {
+			t.Errorf("期待と異なる重量です: got %v want %v", updatedBean.WeightGrams, 250)
+		}
+	})
+
+	t.Run("正常系: 重量だけを指定して更新", func(t *testing.T) {
+		updateBody := `{"name": "Updated Name", "origin": "Updated Origin", "process": "honey", "roast_profile": "medium", "weight_grams": 200}`
+		url := "/api/beans/" + strconv.Itoa(createdMyBean.ID)
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(updateBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetPathValue("id", strconv.Itoa(createdMyBean.ID))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: ownerUserID}))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var updatedBean Bean
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&updatedBean))
+		assert.Equal(t, 200, updatedBean.WeightGrams)
+		assert.Equal(t, 7, updatedBean.Stock)
+	})
+}
+
+// TestAddCartItemHandler_Stock は、在庫数を超えるカート追加が拒否されることを確認する統合テストです
+func TestAddCartItemHandler_Stock(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+	handler := http.HandlerFunc(api.addCartItemHandler)
+
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Limited Bean", Origin: "Test", Price: 2000, Process: "washed", RoastProfile: "medium", UserID: "11111111-1111-1111-1111-111111111111", Stock: 2})
+	assert.NoError(t, err)
+
+	addToCart := func(beanID, quantity int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"bean_id": %d, "quantity": %d}`, beanID, quantity)
+		req := httptest.NewRequest("POST", "/api/cart/items", strings.NewReader(body))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: buyerID}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("正常系: 在庫数以内の追加", func(t *testing.T) {
+		rr := addToCart(bean.ID, 2)
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	})
+
+	t.Run("異常系: カート内の数量と合わせて在庫数を超える", func(t *testing.T) {
+		rr := addToCart(bean.ID, 1)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("異常系: 存在しない豆", func(t *testing.T) {
+		rr := addToCart(999999999, 1)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+// TestStockReservations は、在庫確保の解放・期限切れ・注文済みへの変換を確認する統合テストです
+func TestStockReservations(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Reserved Bean", Origin: "Test", Price: 1800, Process: "honey", RoastProfile: "city", UserID: "11111111-1111-1111-1111-111111111111", Stock: 5})
+	assert.NoError(t, err)
+	items := []OrderItem{{BeanID: bean.ID, PriceAtPurchase: bean.Price, Quantity: 2}}
+
+	// reserve はチェックアウトと同じ手順で保留中の注文を作成して在庫を確保し、その注文を返します
+	reserve := func(t *testing.T, paymentIntentID string, expiresAt time.Time) *Order {
+		t.Helper()
+		assert.NoError(t, store.DecrementBeanStock(ctx, items))
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 3600, Currency: "jpy", StripePaymentIntentID: paymentIntentID},
+			[]CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, store.CreateStockReservations(ctx, buyerID, order.ID, items, expiresAt))
+		return order
+	}
+	stockOf := func(t *testing.T) int {
+		t.Helper()
+		b, err := store.GetBeanByID(ctx, bean.ID)
+		assert.NoError(t, err)
+		return b.Stock
+	}
+
+	t.Run("決済失敗時に解放される", func(t *testing.T) {
+		order := reserve(t, "pi_test_reservation_release", time.Now().Add(time.Hour))
+		assert.Equal(t, 3, stockOf(t))
+
+		_, err := store.ReleaseStockReservations(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, stockOf(t))
+
+		// 二重に解放しても在庫数は増えない
+		released, err := store.ReleaseStockReservations(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), released)
+		assert.Equal(t, 5, stockOf(t))
+	})
+
+	t.Run("有効期限切れで解放される", func(t *testing.T) {
+		reserve(t, "pi_test_reservation_expire", time.Now().Add(-time.Minute))
+		assert.Equal(t, 3, stockOf(t))
+
+		_, err := store.ExpireStockReservations(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, 5, stockOf(t))
+	})
+
+	t.Run("確保が期限切れになった保留中の注文は放置された注文として取得する", func(t *testing.T) {
+		order := reserve(t, "pi_test_reservation_abandoned", time.Now().Add(-time.Minute))
+		// 確保が有効な間は対象にしない
+		abandoned, err := store.GetAbandonedOrders(ctx, time.Now().Add(time.Minute), 1000)
+		assert.NoError(t, err)
+		for _, o := range abandoned {
+			assert.NotEqual(t, order.ID, o.ID)
+		}
+
+		_, err = store.ExpireStockReservations(ctx, time.Now())
+		assert.NoError(t, err)
+		abandoned, err = store.GetAbandonedOrders(ctx, time.Now().Add(time.Minute), 1000)
+		assert.NoError(t, err)
+		ids := []int{}
+		for _, o := range abandoned {
+			ids = append(ids, o.ID)
+		}
+		assert.Contains(t, ids, order.ID)
+		assert.Equal(t, 5, stockOf(t))
+	})
+
+	t.Run("支払いを待っている注文だけを決済のやり直しで取り消す対象にする", func(t *testing.T) {
+		order := reserve(t, "pi_test_reservation_retry", time.Now().Add(time.Hour))
+
+		orders, err := store.GetReservedCheckoutOrders(ctx, buyerID)
+		assert.NoError(t, err)
+		ids := []int{}
+		for _, o := range orders {
+			ids = append(ids, o.ID)
+		}
+		assert.Contains(t, ids, order.ID)
+
+		// 支払い中の注文は、購入者がまだ支払えるので対象にしない
+		_, err = store.TransitionOrderStatus(ctx, order.ID, OrderStatusProcessing, "konbini", "", "")
+		assert.NoError(t, err)
+		orders, err = store.GetReservedCheckoutOrders(ctx, buyerID)
+		assert.NoError(t, err)
+		for _, o := range orders {
+			assert.NotEqual(t, order.ID, o.ID)
+		}
+
+		_, err = store.ReleaseStockReservations(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, stockOf(t))
+	})
+
+	t.Run("決済成功時は在庫数を戻さずに注文済みにする", func(t *testing.T) {
+		order := reserve(t, "pi_test_reservation_convert", time.Now().Add(time.Hour))
+
+		converted, err := store.ConvertStockReservations(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), converted)
+
+		_, err = store.ExpireStockReservations(ctx, time.Now().Add(2*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, stockOf(t))
+	})
+
+	t.Run("確保が無いまま支払われた注文は在庫数を0まで減らして不足分を記録する", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 9000, Currency: "jpy", StripePaymentIntentID: "pi_test_reservation_shortfall"},
+			[]CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 5}})
+		assert.NoError(t, err)
+
+		shortfalls, err := store.DecrementBeanStockForPaidOrder(ctx, order.ID, []OrderItem{{BeanID: bean.ID, Quantity: 5}})
+		assert.NoError(t, err)
+		assert.Equal(t, []StockShortfall{{OrderID: order.ID, BeanID: bean.ID, Quantity: 2}}, shortfalls)
+		assert.Equal(t, 0, stockOf(t))
 	})
 }
 
@@ -255,7 +622,7 @@ func TestHandleStripeWebhook(t *testing.T) {
 	})
 }
 
-func TestHandleStripeWebhook_CreateOrder(t *testing.T) {
+func TestHandleStripeWebhook_CompleteOrder(t *testing.T) {
 	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
 
 	ctx := context.Background()
@@ -268,44 +635,2816 @@ func TestHandleStripeWebhook_CreateOrder(t *testing.T) {
 	// --- Arrange ---
 	// 1. テスト用のユーザーと豆を作成
 	testUserID := "00000000-0000-0000-0000-000000000000"
-	bean, err := store.CreateBean(ctx, &Bean{Name: "Test Bean for Order", Origin: "Test", Price: 1500, Process: "washed", RoastProfile: "medium", UserID: testUserID})
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Test Bean for Order", Origin: "Test", Price: 1500, Process: "washed", RoastProfile: "medium", UserID: testUserID, Stock: 5})
 	assert.NoError(t, err)
 	// テスト終了時に作成したデータを削除
-	defer store.DeleteBean(ctx, bean.ID, testUserID)
+	defer store.DeleteBean(ctx, bean.ID, &Principal{UserID: testUserID}, "")
 
 	// 2. カートに商品を追加
 	_, err = store.AddOrUpdateCartItem(ctx, testUserID, AddCartItemRequest{BeanID: bean.ID, Quantity: 2})
 	assert.NoError(t, err)
 	// このカートアイテムはWebhook内でClearCartされるので、個別の削除は不要
 
-	// --- Act ---
-	// 3. Webhookリクエストを送信
-	paymentIntentID := "pi_test_" + strconv.FormatInt(time.Now().Unix(), 10)
-	payload := fmt.Sprintf(`{"id": "evt_test", "type": "payment_intent.succeeded", "data": {"object": {"id": "%s", "amount": 3000, "currency": "jpy", "metadata": {"user_id": "%s"}, "payment_method_types": ["card"]}}}`, paymentIntentID, testUserID)
-	req := createTestRequest(t, payload, testWebhookSecret)
+	// 3. PaymentIntent作成時と同じように、カートのスナップショットを保留中の注文として記録
+	paymentIntentID := "pi_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	cartItems, err := store.GetCartItemsByUserID(ctx, testUserID)
+	assert.NoError(t, err)
+	order, err := store.CreateOrder(ctx, &Order{UserID: testUserID, Status: OrderStatusPending, TotalAmount: 3000, Currency: "jpy", StripePaymentIntentID: paymentIntentID}, cartItems)
+	assert.NoError(t, err)
+	// テスト終了時に作成した注文を削除
+	defer testDbpool.Exec(ctx, "DELETE FROM orders WHERE id = $1", order.ID)
+	defer testDbpool.Exec(ctx, "DELETE FROM order_items WHERE order_id = $1", order.ID)
 
-	rr := httptest.NewRecorder()
-	api.handleStripeWebhook(rr, req)
+	// 4. 支払い後にカートを変更しても、注文内容は変わらないことを確認するため数量を増やす
+	_, err = store.AddOrUpdateCartItem(ctx, testUserID, AddCartItemRequest{BeanID: bean.ID, Quantity: 1})
+	assert.NoError(t, err)
+
+	// --- Act ---
+	// 5. Webhookリクエストを送信（同じイベントを2回送っても結果は変わらない）
+	payload := fmt.Sprintf(`{"id": "evt_%s", "type": "payment_intent.succeeded", "data": {"object": {"id": "%s", "amount": 3000, "currency": "jpy", "metadata": {"user_id": "%s"}, "payment_method_types": ["card"]}}}`, paymentIntentID, paymentIntentID, testUserID)
+	for i := 0; i < 2; i++ {
+		req := createTestRequest(t, payload, testWebhookSecret)
+		rr := httptest.NewRecorder()
+		api.handleStripeWebhook(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
 
 	// --- Assert ---
-	// 4. 結果を検証
+	// 6a. カートが空になっていることを確認
+	cartItems, err = store.GetCartItemsByUserID(ctx, testUserID)
+	assert.NoError(t, err)
+	assert.Empty(t, cartItems, "カートが空にされていません")
+
+	// 6b. 注文が支払い済みになっていることを確認
+	completed, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	assert.NoError(t, err)
+	assert.Equal(t, order.ID, completed.ID)
+	assert.Equal(t, testUserID, completed.UserID)
+	assert.Equal(t, OrderStatusSucceeded, completed.Status)
+	assert.Equal(t, "card", completed.PaymentMethodType)
+	assert.Equal(t, 3000, completed.TotalAmount)
+
+	// 6c. 注文明細は支払い時点のカートの内容のままであることを確認
+	orderItems, err := store.GetOrderItemsByOrderID(ctx, order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, orderItems, 1) {
+		assert.Equal(t, 2, orderItems[0].Quantity)
+		assert.Equal(t, 1500, orderItems[0].PriceAtPurchase)
+	}
+
+	// 6d. 在庫数が注文数量だけ減っていることを確認
+	updatedBean, err := store.GetBeanByID(ctx, bean.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, updatedBean.Stock)
+}
+
+func TestHandleStripeWebhook_PaymentFailed(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	ctx := context.Background()
+	store := NewStore(testDbpool)
+	api := &Api{store: store, dbpool: testDbpool}
+
+	testUserID := "00000000-0000-0000-0000-000000000000"
+	paymentIntentID := "pi_test_failed_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	order, err := store.CreateOrder(ctx, &Order{UserID: testUserID, Status: OrderStatusPending, TotalAmount: 1000, Currency: "jpy", StripePaymentIntentID: paymentIntentID}, nil)
+	assert.NoError(t, err)
+	defer testDbpool.Exec(ctx, "DELETE FROM orders WHERE id = $1", order.ID)
+
+	// 同じ失敗イベントが再送されても、注文が重複して作成されないことを確認
+	payload := fmt.Sprintf(`{"id": "evt_%[1]s", "type": "payment_intent.payment_failed", "data": {"object": {"id": "%[1]s", "amount": 1000, "currency": "jpy", "last_payment_error": {"message": "Your card was declined."}, "payment_method_types": ["card"]}}}`, paymentIntentID)
+	for i := 0; i < 2; i++ {
+		req := createTestRequest(t, payload, testWebhookSecret)
+		rr := httptest.NewRecorder()
+		api.handleStripeWebhook(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	var count int
+	err = testDbpool.QueryRow(ctx, "SELECT COUNT(*) FROM orders WHERE stripe_payment_intent_id = $1", paymentIntentID).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	failed, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	assert.NoError(t, err)
+	assert.Equal(t, OrderStatusFailed, failed.Status)
+}
+
+func TestHandleStripeWebhook_ReplayedEvent(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	ctx := context.Background()
+	store := NewStore(testDbpool)
+	api := &Api{store: store, dbpool: testDbpool}
+
+	testUserID := "00000000-0000-0000-0000-000000000000"
+	paymentIntentID := "pi_test_replay_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	order, err := store.CreateOrder(ctx, &Order{UserID: testUserID, Status: OrderStatusPending, TotalAmount: 1000, Currency: "jpy", StripePaymentIntentID: paymentIntentID}, nil)
+	assert.NoError(t, err)
+	defer testDbpool.Exec(ctx, "DELETE FROM orders WHERE id = $1", order.ID)
+
+	eventID := "evt_" + paymentIntentID
+	defer testDbpool.Exec(ctx, "DELETE FROM stripe_webhook_events WHERE id = $1", eventID)
+	payload := fmt.Sprintf(`{"id": "%s", "type": "payment_intent.processing", "data": {"object": {"id": "%s", "amount": 1000, "currency": "jpy", "payment_method_types": ["konbini"]}}}`, eventID, paymentIntentID)
+
+	// 1回目: 注文が処理中になる
+	rr := httptest.NewRecorder()
+	api.handleStripeWebhook(rr, createTestRequest(t, payload, testWebhookSecret))
 	assert.Equal(t, http.StatusOK, rr.Code)
+	processing, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	assert.NoError(t, err)
+	assert.Equal(t, OrderStatusProcessing, processing.Status)
 
-	// 4a. カートが空になっていることを確認
-	cartItems, err := store.GetCartItemsByUserID(ctx, testUserID)
+	// 注文の状態を手動で戻してから同じイベントを再送しても、処理されないことを確認
+	_, err = store.UpdateOrderStatus(ctx, order.ID, OrderStatusPending, "")
 	assert.NoError(t, err)
-	assert.Empty(t, cartItems, "カートが空にされていません")
 
-	// 4b. 注文が作成されていることを確認
-	order, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	rr = httptest.NewRecorder()
+	api.handleStripeWebhook(rr, createTestRequest(t, payload, testWebhookSecret))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	replayed, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	assert.NoError(t, err)
+	assert.Equal(t, OrderStatusPending, replayed.Status)
+}
+
+func TestHandleStripeWebhook_OrderTimeline(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	ctx := context.Background()
+	store := NewStore(testDbpool)
+	api := &Api{store: store, dbpool: testDbpool}
+
+	testUserID := "00000000-0000-0000-0000-000000000000"
+	paymentIntentID := "pi_test_timeline_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	order, err := store.CreateOrder(ctx, &Order{UserID: testUserID, Status: OrderStatusPending, TotalAmount: 1000, Currency: "jpy", StripePaymentIntentID: paymentIntentID}, nil)
 	assert.NoError(t, err)
-	assert.NotNil(t, order)
-	assert.Equal(t, testUserID, order.UserID)
-	assert.Equal(t, "succeeded", order.Status)
-	assert.Equal(t, 3000, order.TotalAmount)
-	// テスト終了時に作成した注文を削除
-	defer testDbpool.Exec(ctx, "DELETE FROM order_items WHERE order_id = $1", order.ID)
 	defer testDbpool.Exec(ctx, "DELETE FROM orders WHERE id = $1", order.ID)
+
+	events := []struct {
+		eventType string
+		object    string
+		want      string
+	}{
+		{"payment_intent.requires_action", fmt.Sprintf(`{"id": "%s", "payment_method_types": ["konbini"]}`, paymentIntentID), OrderStatusRequiresAction},
+		{"payment_intent.succeeded", fmt.Sprintf(`{"id": "%s", "payment_method_types": ["konbini"]}`, paymentIntentID), OrderStatusSucceeded},
+		{"charge.refunded", fmt.Sprintf(`{"id": "ch_test", "amount": 1000, "amount_refunded": 400, "refunded": false, "currency": "jpy", "payment_intent": "%s"}`, paymentIntentID), OrderStatusPartiallyRefunded},
+		{"charge.dispute.created", fmt.Sprintf(`{"id": "dp_test", "amount": 600, "currency": "jpy", "reason": "fraudulent", "payment_intent": "%s"}`, paymentIntentID), OrderStatusDisputed},
+		// 遅れて届いたイベントでは、確定した注文の状態は戻らない
+		{"payment_intent.processing", fmt.Sprintf(`{"id": "%s", "payment_method_types": ["konbini"]}`, paymentIntentID), OrderStatusDisputed},
+	}
+	for i, e := range events {
+		payload := fmt.Sprintf(`{"id": "evt_%s_%d", "type": "%s", "data": {"object": %s}}`, paymentIntentID, i, e.eventType, e.object)
+		rr := httptest.NewRecorder()
+		api.handleStripeWebhook(rr, createTestRequest(t, payload, testWebhookSecret))
+		assert.Equal(t, http.StatusOK, rr.Code, e.eventType)
+
+		current, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+		assert.NoError(t, err)
+		assert.Equal(t, e.want, current.Status, e.eventType)
+	}
+
+	// 注文のタイムラインが、作成から順にすべて記録されていることを確認
+	history, err := store.GetOrderStatusHistory(ctx, order.ID)
+	assert.NoError(t, err)
+	var statuses []string
+	for _, h := range history {
+		statuses = append(statuses, h.ToStatus)
+	}
+	assert.Equal(t, []string{OrderStatusPending, OrderStatusRequiresAction, OrderStatusSucceeded, OrderStatusPartiallyRefunded, OrderStatusDisputed}, statuses)
+	if assert.Len(t, history, 5) {
+		assert.Equal(t, OrderStatusSucceeded, history[3].FromStatus)
+		assert.Equal(t, "evt_"+paymentIntentID+"_2", history[3].StripeEventID)
+	}
+}
+
+func TestOrdersAPI(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	otherUserID := "11111111-1111-1111-1111-111111111111"
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Order History Bean", Origin: "Test", Price: 1200, Process: "washed", RoastProfile: "medium", UserID: otherUserID, Stock: 10})
+	assert.NoError(t, err)
+
+	items := []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 2}}
+	pending, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 2400, Currency: "jpy", StripePaymentIntentID: "pi_test_history_pending"}, items)
+	assert.NoError(t, err)
+	succeeded, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 2400, Currency: "jpy", StripePaymentIntentID: "pi_test_history_succeeded"}, items)
+	assert.NoError(t, err)
+	othersOrder, err := store.CreateOrder(ctx, &Order{UserID: otherUserID, Status: OrderStatusSucceeded, TotalAmount: 2400, Currency: "jpy", StripePaymentIntentID: "pi_test_history_other"}, items)
+	assert.NoError(t, err)
+
+	// withUser はリクエストに認証済みユーザーを設定します
+	withUser := func(req *http.Request, userID string) *http.Request {
+		return req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: userID}))
+	}
+
+	t.Run("GET /api/orders - 状態で絞り込み", func(t *testing.T) {
+		req := withUser(httptest.NewRequest("GET", "/api/orders?status=succeeded", nil), buyerID)
+		rr := httptest.NewRecorder()
+		api.getOrdersHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var page OrderPage
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+		for _, o := range page.Items {
+			assert.Equal(t, buyerID, o.UserID)
+			assert.Equal(t, OrderStatusSucceeded, o.Status)
+			assert.NotEqual(t, othersOrder.ID, o.ID)
+		}
+		assert.Contains(t, orderIDs(page.Items), succeeded.ID)
+		assert.NotContains(t, orderIDs(page.Items), pending.ID)
+	})
+
+	t.Run("GET /api/orders - 不正な状態", func(t *testing.T) {
+		req := withUser(httptest.NewRequest("GET", "/api/orders?status=shipped", nil), buyerID)
+		rr := httptest.NewRecorder()
+		api.getOrdersHandler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("GET /api/orders/{id} - 自分の注文", func(t *testing.T) {
+		req := withUser(httptest.NewRequest("GET", "/api/orders/"+strconv.Itoa(succeeded.ID), nil), buyerID)
+		req.SetPathValue("id", strconv.Itoa(succeeded.ID))
+		rr := httptest.NewRecorder()
+		api.getOrderHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var detail OrderDetail
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&detail))
+		assert.Equal(t, succeeded.ID, detail.ID)
+		if assert.Len(t, detail.SubOrders, 1) && assert.Len(t, detail.SubOrders[0].Items, 1) {
+			item := detail.SubOrders[0].Items[0]
+			assert.Equal(t, "Order History Bean", item.BeanName)
+			assert.Equal(t, 1200, item.PriceAtPurchase)
+			assert.Equal(t, 2400, item.Subtotal)
+		}
+	})
+
+	t.Run("GET /api/orders/{id} - 他人の注文は見えない", func(t *testing.T) {
+		req := withUser(httptest.NewRequest("GET", "/api/orders/"+strconv.Itoa(othersOrder.ID), nil), buyerID)
+		req.SetPathValue("id", strconv.Itoa(othersOrder.ID))
+		rr := httptest.NewRecorder()
+		api.getOrderHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("GET /api/orders - 認証なし", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		api.getOrdersHandler(rr, httptest.NewRequest("GET", "/api/orders", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
+
+// orderIDs は注文のIDの一覧を返します
+func orderIDs(orders []Order) []int {
+	ids := []int{}
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	return ids
+}
+
+func TestCreateOrder_SplitsBySeller(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerA := "00000000-0000-0000-0000-000000000000"
+	sellerB := "11111111-1111-1111-1111-111111111111"
+	beanA1, err := store.CreateBean(ctx, &Bean{Name: "Seller A Bean 1", Origin: "Test", Price: 1000, Process: "washed", RoastProfile: "light", UserID: sellerA, Stock: 10})
+	assert.NoError(t, err)
+	beanB, err := store.CreateBean(ctx, &Bean{Name: "Seller B Bean", Origin: "Test", Price: 2000, Process: "natural", RoastProfile: "medium", UserID: sellerB, Stock: 10})
+	assert.NoError(t, err)
+	beanA2, err := store.CreateBean(ctx, &Bean{Name: "Seller A Bean 2", Origin: "Test", Price: 1500, Process: "honey", RoastProfile: "city", UserID: sellerA, Stock: 10})
+	assert.NoError(t, err)
+
+	items := []CartItemDetail{
+		{BeanID: beanA1.ID, Price: beanA1.Price, Quantity: 1},
+		{BeanID: beanB.ID, Price: beanB.Price, Quantity: 2},
+		{BeanID: beanA2.ID, Price: beanA2.Price, Quantity: 1},
+	}
+	order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 6500, Currency: "jpy", StripePaymentIntentID: "pi_test_split_by_seller"}, items)
+	assert.NoError(t, err)
+
+	detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+	assert.NoError(t, err)
+	assert.Equal(t, 6500, detail.TotalAmount)
+	if assert.Len(t, detail.SubOrders, 2) {
+		// 出品者はカート内で最初に現れた順に並ぶ
+		assert.Equal(t, sellerA, detail.SubOrders[0].SellerID)
+		assert.Equal(t, 2500, detail.SubOrders[0].Subtotal)
+		assert.Len(t, detail.SubOrders[0].Items, 2)
+		assert.Equal(t, FulfillmentStatusUnfulfilled, detail.SubOrders[0].FulfillmentStatus)
+
+		assert.Equal(t, sellerB, detail.SubOrders[1].SellerID)
+		assert.Equal(t, 4000, detail.SubOrders[1].Subtotal)
+		assert.Len(t, detail.SubOrders[1].Items, 1)
+	}
+}
+
+func TestSellerFulfillment(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Fulfillment Bean", Origin: "Test", Price: 1500, Process: "natural", RoastProfile: "medium", UserID: sellerID, Stock: 10})
+	assert.NoError(t, err)
+
+	items := []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 1}}
+	paid, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 1500, Currency: "jpy", StripePaymentIntentID: "pi_test_fulfillment_paid"}, items)
+	assert.NoError(t, err)
+	unpaid, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 1500, Currency: "jpy", StripePaymentIntentID: "pi_test_fulfillment_unpaid"}, items)
+	assert.NoError(t, err)
+
+	// subOrderIDOf は注文の最初の子注文IDを返します
+	subOrderIDOf := func(t *testing.T, orderID int) int {
+		t.Helper()
+		detail, err := store.GetOrderDetail(ctx, orderID, buyerID)
+		assert.NoError(t, err)
+		return detail.SubOrders[0].ID
+	}
+	paidSubOrderID := subOrderIDOf(t, paid.ID)
+	unpaidSubOrderID := subOrderIDOf(t, unpaid.ID)
+
+	t.Run("GET /api/seller/orders - 支払い済みの受注のみ", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/seller/orders", nil)
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr := httptest.NewRecorder()
+		api.getSellerOrdersHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var page SellerOrderPage
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+		ids := []int{}
+		for _, o := range page.Items {
+			ids = append(ids, o.ID)
+		}
+		assert.Contains(t, ids, paidSubOrderID)
+		assert.NotContains(t, ids, unpaidSubOrderID)
+	})
+
+	t.Run("正常系: 順番に発送まで進める", func(t *testing.T) {
+		_, err := store.UpdateFulfillmentStatus(ctx, paidSubOrderID, sellerID, FulfillmentStatusAccepted, "", "")
+		assert.NoError(t, err)
+		_, err = store.UpdateFulfillmentStatus(ctx, paidSubOrderID, sellerID, FulfillmentStatusRoasting, "", "")
+		assert.NoError(t, err)
+		subOrder, err := store.UpdateFulfillmentStatus(ctx, paidSubOrderID, sellerID, FulfillmentStatusShipped, "ヤマト運輸", "1234-5678-9012")
+		assert.NoError(t, err)
+		assert.Equal(t, FulfillmentStatusShipped, subOrder.FulfillmentStatus)
+		assert.Equal(t, "ヤマト運輸", subOrder.Carrier)
+		assert.Equal(t, "1234-5678-9012", subOrder.TrackingNumber)
+		assert.NotNil(t, subOrder.ShippedAt)
+		assert.Len(t, subOrder.Items, 1)
+	})
+
+	t.Run("異常系: 工程を飛ばせない", func(t *testing.T) {
+		other, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 1500, Currency: "jpy", StripePaymentIntentID: "pi_test_fulfillment_skip"}, items)
+		assert.NoError(t, err)
+		_, err = store.UpdateFulfillmentStatus(ctx, subOrderIDOf(t, other.ID), sellerID, FulfillmentStatusDelivered, "", "")
+		assert.ErrorIs(t, err, ErrInvalidFulfillmentTransition)
+	})
+
+	t.Run("異常系: 他の出品者の子注文は更新できない", func(t *testing.T) {
+		_, err := store.UpdateFulfillmentStatus(ctx, paidSubOrderID, buyerID, FulfillmentStatusDelivered, "", "")
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("異常系: 未払いの注文は発送できない", func(t *testing.T) {
+		_, err := store.UpdateFulfillmentStatus(ctx, unpaidSubOrderID, sellerID, FulfillmentStatusAccepted, "", "")
+		assert.ErrorIs(t, err, ErrOrderNotFulfillable)
+	})
+
+	t.Run("異常系: 追跡番号なしで発送済みにできない", func(t *testing.T) {
+		body := strings.NewReader(`{"status": "shipped", "carrier": "ヤマト運輸"}`)
+		req := httptest.NewRequest("PUT", "/api/seller/orders/1/fulfillment", body)
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		req.SetPathValue("id", strconv.Itoa(paidSubOrderID))
+		rr := httptest.NewRecorder()
+		api.updateFulfillmentHandler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestStripeConnectPayouts(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	onboardedSellerID := "11111111-1111-1111-1111-111111111111"
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, stripe_account_id, stripe_account_status)
+		VALUES ($1, 'Onboarded Seller', '', '', '', '', 'acct_test_onboarded', 'enabled')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = EXCLUDED.stripe_account_id, stripe_account_status = EXCLUDED.stripe_account_status
+	`, onboardedSellerID)
+	assert.NoError(t, err)
+
+	onboardedBean, err := store.CreateBean(ctx, &Bean{Name: "Onboarded Bean", Origin: "Test", Price: 2000, Process: "washed", RoastProfile: "medium", UserID: onboardedSellerID, Stock: 10})
+	assert.NoError(t, err)
+	otherBean, err := store.CreateBean(ctx, &Bean{Name: "Not Onboarded Bean", Origin: "Test", Price: 1000, Process: "natural", RoastProfile: "light", UserID: buyerID, Stock: 10})
+	assert.NoError(t, err)
+	items := []CartItemDetail{
+		{BeanID: onboardedBean.ID, Price: onboardedBean.Price, Quantity: 1},
+		{BeanID: otherBean.ID, Price: otherBean.Price, Quantity: 1},
+	}
+
+	t.Run("出品者ごとに入金先を確認できる", func(t *testing.T) {
+		sellers, err := store.GroupCartItemsBySeller(ctx, items)
+		assert.NoError(t, err)
+		if assert.Len(t, sellers, 2) {
+			assert.True(t, sellers[0].PayoutsEnabled())
+			assert.Equal(t, "acct_test_onboarded", sellers[0].StripeAccountID)
+			assert.False(t, sellers[1].PayoutsEnabled())
+		}
+	})
+
+	t.Run("子注文ごとのTransferで入金する注文", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 3000, Currency: "jpy", StripePaymentIntentID: "pi_test_payout_transfer", StripeTransferGroup: "checkout_test_transfer"}, items)
+		assert.NoError(t, err)
+
+		// 入金先の無い子注文は対象外
+		transfers, err := store.GetPendingSubOrderTransfers(ctx, order.ID)
+		assert.NoError(t, err)
+		if assert.Len(t, transfers, 1) {
+			assert.Equal(t, "acct_test_onboarded", transfers[0].StripeAccountID)
+			assert.Equal(t, "checkout_test_transfer", transfers[0].TransferGroup)
+			assert.Equal(t, 2000, transfers[0].Amount)
+
+			// 送信待ちとして記録すると対象外になる
+			assert.NoError(t, queueSellerPayouts(ctx, store, order, "ch_test_payout", 3000))
+			assert.NoError(t, queueSellerPayouts(ctx, store, order, "ch_test_payout", 3000))
+			transfers, err = store.GetPendingSubOrderTransfers(ctx, order.ID)
+			assert.NoError(t, err)
+			assert.Empty(t, transfers)
+		}
+
+		// 送信待ちの入金は1件だけ記録され、取得すると送信中の間は他から取得されない
+		now := time.Now()
+		claimed, err := store.ClaimPayoutTransfers(ctx, now.Add(time.Second), 1000, payoutTransferLease)
+		assert.NoError(t, err)
+		var payout *PayoutTransfer
+		for i := range claimed {
+			if claimed[i].TransferGroup == "checkout_test_transfer" {
+				assert.Nil(t, payout)
+				payout = &claimed[i]
+			}
+		}
+		if !assert.NotNil(t, payout) {
+			return
+		}
+		assert.Equal(t, 2000, payout.Amount)
+		assert.Equal(t, "ch_test_payout", payout.SourceTransaction)
+		assert.Equal(t, 1, payout.Attempts)
+		claimed, err = store.ClaimPayoutTransfers(ctx, now.Add(time.Second), 1000, payoutTransferLease)
+		assert.NoError(t, err)
+		for _, c := range claimed {
+			assert.NotEqual(t, payout.ID, c.ID)
+		}
+
+		// 送信を記録すると子注文にTransfer IDが記録される
+		assert.NoError(t, store.MarkPayoutTransferSent(ctx, payout.ID, "tr_test_payout"))
+		payouts, err := store.GetSubOrderPayouts(ctx, order.ID)
+		assert.NoError(t, err)
+		transferIDs := []string{}
+		for _, p := range payouts {
+			transferIDs = append(transferIDs, p.StripeTransferID)
+		}
+		assert.Contains(t, transferIDs, "tr_test_payout")
+	})
+
+	t.Run("返金に応じて送信前の入金を減らし、送信済みの入金は取り消す", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 3000, Currency: "jpy", StripePaymentIntentID: "pi_test_payout_refund", StripeTransferGroup: "checkout_test_refund"}, items)
+		assert.NoError(t, err)
+		assert.NoError(t, queueSellerPayouts(ctx, store, order, "ch_test_payout_refund", 3000))
+		subOrderID := 0
+		payouts, err := store.GetSubOrderPayouts(ctx, order.ID)
+		assert.NoError(t, err)
+		for _, p := range payouts {
+			if p.SellerID == onboardedSellerID {
+				subOrderID = p.SubOrderID
+			}
+		}
+		// payoutOf は子注文の送信待ちの入金を返します
+		payoutOf := func() (id int, amount int, status string) {
+			err := tx.QueryRow(ctx, "SELECT id, amount, status FROM payout_transfers WHERE sub_order_id = $1", subOrderID).Scan(&id, &amount, &status)
+			assert.NoError(t, err)
+			return id, amount, status
+		}
+
+		// 全額を返金すると送信を取りやめ、返金が失敗すると元に戻す
+		target, err := store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		r, err := refundSubOrder(ctx, store, target, remainingItems(target), false, false, "damaged", onboardedSellerID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2000, r.PayoutReduction)
+		_, amount, status := payoutOf()
+		assert.Equal(t, 0, amount)
+		assert.Equal(t, PayoutTransferStatusCanceled, status)
+		assert.NoError(t, store.RevertRefund(ctx, r.ID))
+		payoutID, amount, status := payoutOf()
+		assert.Equal(t, 2000, amount)
+		assert.Equal(t, PayoutTransferStatusPending, status)
+
+		// 送信済みの入金は、返金が成功してから取り消す
+		assert.NoError(t, store.MarkPayoutTransferSent(ctx, payoutID, "tr_test_payout_refund"))
+		target, err = store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		r, err = refundSubOrder(ctx, store, target, remainingItems(target), false, false, "damaged", onboardedSellerID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, r.PayoutReduction)
+		reversals, err := store.ClaimTransferReversals(ctx, time.Now(), 1000, payoutTransferLease)
+		assert.NoError(t, err)
+		for _, c := range reversals {
+			assert.NotEqual(t, r.ID, c.RefundID)
+		}
+		_, err = store.RecordStripeRefund(ctx, r.ID, "re_test_payout_refund", RefundStatusSucceeded)
+		assert.NoError(t, err)
+		reversals, err = store.ClaimTransferReversals(ctx, time.Now(), 1000, payoutTransferLease)
+		assert.NoError(t, err)
+		var reversal *TransferReversal
+		for i := range reversals {
+			if reversals[i].RefundID == r.ID {
+				reversal = &reversals[i]
+			}
+		}
+		if assert.NotNil(t, reversal) {
+			assert.Equal(t, "tr_test_payout_refund", reversal.TransferID)
+			assert.Equal(t, 2000, reversal.Amount)
+			assert.NoError(t, store.MarkTransferReversalSent(ctx, reversal.ID, "trr_test_payout_refund"))
+		}
+	})
+
+	t.Run("APIバージョン2020-08-27のWebhookでは、charges.dataのChargeを入金元にする", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 3000, Currency: "jpy", StripePaymentIntentID: "pi_test_payout_legacy", StripeTransferGroup: "checkout_test_legacy"}, items)
+		if !assert.NoError(t, err) {
+			return
+		}
+		payments := newFakePaymentProvider()
+		api := &Api{store: store, dbpool: tx, payments: payments}
+
+		// 2022-11-15より前のAPIバージョンでは、latest_chargeの代わりにcharges（Chargeの一覧）が届く
+		req := payments.webhookRequest(t, "payment_intent.succeeded", map[string]interface{}{
+			"id":                   "pi_test_payout_legacy",
+			"object":               "payment_intent",
+			"amount":               3000,
+			"amount_received":      3000,
+			"currency":             "jpy",
+			"status":               "succeeded",
+			"metadata":             map[string]string{"order_id": strconv.Itoa(order.ID)},
+			"payment_method_types": []string{"card"},
+			"transfer_group":       "checkout_test_legacy",
+			"charges": map[string]interface{}{
+				"object":   "list",
+				"has_more": false,
+				"url":      "/v1/charges?payment_intent=pi_test_payout_legacy",
+				"data":     []map[string]interface{}{{"id": "ch_test_payout_legacy", "object": "charge", "amount": 3000, "paid": true}},
+			},
+		})
+		rr := httptest.NewRecorder()
+		api.handleStripeWebhook(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var sourceTransaction string
+		err = tx.QueryRow(ctx, `
+			SELECT COALESCE(pt.source_transaction, '')
+			FROM payout_transfers pt JOIN sub_orders so ON so.id = pt.sub_order_id
+			WHERE so.order_id = $1
+		`, order.ID).Scan(&sourceTransaction)
+		assert.NoError(t, err)
+		assert.Equal(t, "ch_test_payout_legacy", sourceTransaction)
+	})
+
+	t.Run("Destination Chargeの注文はTransferを作成しない", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 2000, Currency: "jpy", StripePaymentIntentID: "pi_test_payout_destination"}, items[:1])
+		assert.NoError(t, err)
+
+		transfers, err := store.GetPendingSubOrderTransfers(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, transfers)
+	})
+}
+
+func TestPlatformFee(t *testing.T) {
+	testCases := []struct {
+		name        string
+		amount      int
+		basisPoints int
+		want        int
+	}{
+		{"5%", 2000, 500, 100},
+		{"1円未満は切り捨て", 1999, 500, 99},
+		{"3.5%", 1000, 350, 35},
+		{"手数料なし", 1500, 0, 0},
+		{"100%", 1500, 10000, 1500},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, platformFee(tc.amount, tc.basisPoints))
+		})
+	}
+
+	t.Run("異常系: 範囲外の手数料率", func(t *testing.T) {
+		_, err := parseFeeBasisPoints("10001")
+		assert.Error(t, err)
+		_, err = parseFeeBasisPoints("-1")
+		assert.Error(t, err)
+	})
+}
+
+func TestCreateOrder_PlatformFee(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	discountedSellerID := "11111111-1111-1111-1111-111111111111"
+	// 実績のある出品者の手数料率を3%に下げる
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, stripe_account_id, stripe_account_status, platform_fee_basis_points)
+		VALUES ($1, 'Established Roaster', '', '', '', '', 'acct_test_established', 'enabled', 300)
+		ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = EXCLUDED.stripe_account_id, stripe_account_status = EXCLUDED.stripe_account_status, platform_fee_basis_points = EXCLUDED.platform_fee_basis_points
+	`, discountedSellerID)
+	assert.NoError(t, err)
+
+	discountedBean, err := store.CreateBean(ctx, &Bean{Name: "Established Bean", Origin: "Test", Price: 2000, Process: "washed", RoastProfile: "medium", UserID: discountedSellerID, Stock: 10})
+	assert.NoError(t, err)
+	defaultBean, err := store.CreateBean(ctx, &Bean{Name: "Default Fee Bean", Origin: "Test", Price: 1999, Process: "natural", RoastProfile: "light", UserID: buyerID, Stock: 10})
+	assert.NoError(t, err)
+	items := []CartItemDetail{
+		{BeanID: discountedBean.ID, Price: discountedBean.Price, Quantity: 1},
+		{BeanID: defaultBean.ID, Price: defaultBean.Price, Quantity: 1},
+	}
+
+	order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 3999, Currency: "jpy", StripePaymentIntentID: "pi_test_platform_fee", StripeTransferGroup: "checkout_test_fee", PlatformFeeBasisPoints: 500}, items)
+	assert.NoError(t, err)
+	// 2000円の3% + 1999円の5%（切り捨て）
+	assert.Equal(t, 60+99, order.PlatformFee)
+
+	detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+	assert.NoError(t, err)
+	assert.Equal(t, 159, detail.PlatformFee)
+	assert.Equal(t, 500, detail.PlatformFeeBasisPoints)
+	if assert.Len(t, detail.SubOrders, 2) {
+		assert.Equal(t, 300, detail.SubOrders[0].PlatformFeeBasisPoints)
+		assert.Equal(t, 60, detail.SubOrders[0].PlatformFee)
+		assert.Equal(t, 500, detail.SubOrders[1].PlatformFeeBasisPoints)
+		assert.Equal(t, 99, detail.SubOrders[1].PlatformFee)
+	}
+
+	// 出品者への入金額は手数料を差し引いた額になる
+	transfers, err := store.GetPendingSubOrderTransfers(ctx, order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, 1940, transfers[0].Amount)
+	}
+}
+
+func TestSellerStripeAccount(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	payments := newFakePaymentProvider()
+	api := &Api{store: store, payments: payments}
+	sellerID := "11111111-1111-1111-1111-111111111111"
+
+	// withUser はリクエストに認証済みユーザーを設定します
+	withUser := func(req *http.Request) *http.Request {
+		return req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+	}
+
+	t.Run("異常系: プロフィールが無い", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		api.sellerStripeAccountHandler(rr, withUser(httptest.NewRequest("GET", "/api/seller/stripe-account", nil)))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+		VALUES ($1, 'Seller', '', '', '', '')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = NULL, stripe_account_status = 'restricted'
+	`, sellerID)
+	assert.NoError(t, err)
+
+	t.Run("異常系: アカウント作成前は登録ページのURLを発行できない", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		api.createOnboardingLinkHandler(rr, withUser(httptest.NewRequest("POST", "/api/seller/stripe-account/onboarding-link", nil)))
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("正常系: アカウントを作成して登録ページのURLを発行する", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		api.sellerStripeAccountHandler(rr, withUser(httptest.NewRequest("POST", "/api/seller/stripe-account", nil)))
+		if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+			return
+		}
+		var created SellerStripeAccount
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+		assert.Equal(t, payments.accountIDs[sellerID], created.StripeAccountID)
+		assert.Equal(t, StripeAccountStatusRestricted, created.Status)
+
+		// 作成済みの場合は新たに作成しない
+		rr = httptest.NewRecorder()
+		api.sellerStripeAccountHandler(rr, withUser(httptest.NewRequest("POST", "/api/seller/stripe-account", nil)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Len(t, payments.accounts, 1)
+
+		rr = httptest.NewRecorder()
+		api.createOnboardingLinkHandler(rr, withUser(httptest.NewRequest("POST", "/api/seller/stripe-account/onboarding-link", nil)))
+		if assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+			var link AccountLink
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&link))
+			assert.Contains(t, link.URL, created.StripeAccountID)
+			assert.NotZero(t, link.ExpiresAt)
+		}
+
+		// 登録が完了していなければ、取得時に最新の状態を取得し直す
+		payments.accounts[created.StripeAccountID].Status = StripeAccountStatusPending
+		rr = httptest.NewRecorder()
+		api.sellerStripeAccountHandler(rr, withUser(httptest.NewRequest("GET", "/api/seller/stripe-account", nil)))
+		var refreshed SellerStripeAccount
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&refreshed))
+		assert.Equal(t, StripeAccountStatusPending, refreshed.Status)
+	})
+
+	_, err = store.SetSellerStripeAccount(ctx, sellerID, "acct_test_onboarding", StripeAccountStatusRestricted)
+	assert.NoError(t, err)
+
+	t.Run("account.updatedで状態が同期される", func(t *testing.T) {
+		event := &WebhookEvent{
+			ID:   "evt_test_account_updated",
+			Type: "account.updated",
+			Data: json.RawMessage(`{"id": "acct_test_onboarding", "object": "account", "charges_enabled": true, "payouts_enabled": true, "details_submitted": true}`),
+		}
+		assert.NoError(t, api.processStripeEvent(ctx, store, event))
+
+		rr := httptest.NewRecorder()
+		api.sellerStripeAccountHandler(rr, withUser(httptest.NewRequest("GET", "/api/seller/stripe-account", nil)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var account SellerStripeAccount
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&account))
+		assert.Equal(t, "acct_test_onboarding", account.StripeAccountID)
+		assert.Equal(t, StripeAccountStatusEnabled, account.Status)
+	})
+
+	t.Run("審査待ちの状態", func(t *testing.T) {
+		acct := &stripe.Account{DetailsSubmitted: true}
+		assert.Equal(t, StripeAccountStatusPending, stripeAccountStatusOf(acct))
+		assert.Equal(t, StripeAccountStatusRestricted, stripeAccountStatusOf(&stripe.Account{}))
+	})
+}
+
+func TestPrefectureCodeFromPostCode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		postCode string
+		want     int
+	}{
+		{"東京都", "100-0001", 13},
+		{"北海道", "0600000", 1},
+		{"大阪府", "530-0001", 27},
+		{"沖縄県", "900-0000", 47},
+		{"全角数字", "９８０－０８１１", 4},
+		{"郵便番号マーク付き", "〒 812-0011", 40},
+		{"桁数不足", "100-001", 0},
+		{"数字以外", "abc-defg", 0},
+		{"未入力", "", 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, prefectureCodeFromPostCode(tc.postCode))
+		})
+	}
+}
+
+func TestShippingSettingsFee(t *testing.T) {
+	threshold := 5000
+	flat := &ShippingSettings{RateType: ShippingRateTypeFlat, FlatFee: 500, FreeShippingThreshold: &threshold}
+	byWeight := &ShippingSettings{RateType: ShippingRateTypeWeight, WeightRates: []ShippingWeightRate{
+		{MaxWeightGrams: 2000, Fee: 1000},
+		{MaxWeightGrams: 500, Fee: 400},
+	}}
+	byPrefecture := &ShippingSettings{RateType: ShippingRateTypePrefecture, PrefectureRates: []ShippingPrefectureRate{
+		{PrefectureCode: 13, Fee: 600},
+		{PrefectureCode: 47, Fee: 1500},
+	}}
+
+	t.Run("正常系: 全国一律", func(t *testing.T) {
+		fee, err := flat.Fee(4999, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 500, fee)
+	})
+
+	t.Run("正常系: 送料無料の下限以上は0円", func(t *testing.T) {
+		fee, err := flat.Fee(5000, 0, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, fee)
+	})
+
+	t.Run("正常系: 重さが収まる最も軽い区分", func(t *testing.T) {
+		fee, err := byWeight.Fee(3000, 500, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, fee)
+		fee, err = byWeight.Fee(3000, 501, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, fee)
+	})
+
+	t.Run("異常系: 重さの上限を超える", func(t *testing.T) {
+		_, err := byWeight.Fee(3000, 2001, 0)
+		assert.ErrorIs(t, err, ErrShippingUnavailable)
+	})
+
+	t.Run("正常系: 都道府県ごと", func(t *testing.T) {
+		fee, err := byPrefecture.Fee(3000, 0, 47)
+		assert.NoError(t, err)
+		assert.Equal(t, 1500, fee)
+	})
+
+	t.Run("異常系: 配送対象外の都道府県", func(t *testing.T) {
+		_, err := byPrefecture.Fee(3000, 0, 1)
+		assert.ErrorIs(t, err, ErrShippingUnavailable)
+	})
+
+	t.Run("異常系: 配送先の郵便番号が無い", func(t *testing.T) {
+		_, err := byPrefecture.Fee(3000, 0, 0)
+		assert.ErrorIs(t, err, ErrShippingAddressRequired)
+	})
+
+	t.Run("異常系: 不正な送料表", func(t *testing.T) {
+		assert.Error(t, (&ShippingSettings{RateType: "express"}).Validate())
+		assert.Error(t, (&ShippingSettings{RateType: ShippingRateTypeWeight}).Validate())
+		assert.Error(t, (&ShippingSettings{RateType: ShippingRateTypePrefecture, PrefectureRates: []ShippingPrefectureRate{{PrefectureCode: 48, Fee: 100}}}).Validate())
+		assert.NoError(t, byWeight.Validate())
+	})
+}
+
+func TestCreateOrder_ShippingFee(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	// 購入者の配送先は沖縄県
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+		VALUES ($1, 'Buyer', '', '900-0000', '', '')
+		ON CONFLICT (user_id) DO UPDATE SET post_code = EXCLUDED.post_code
+	`, buyerID)
+	assert.NoError(t, err)
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Heavy Bean", Origin: "Test", Price: 1500, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 10, WeightGrams: 500})
+	assert.NoError(t, err)
+	items := []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 2}}
+
+	t.Run("正常系: 送料表が無ければ送料0円", func(t *testing.T) {
+		groups, err := store.GroupCartItemsBySeller(ctx, items)
+		assert.NoError(t, err)
+		assert.NoError(t, store.QuoteShipping(ctx, buyerID, groups))
+		if assert.Len(t, groups, 1) {
+			assert.Equal(t, 1000, groups[0].WeightGrams)
+			assert.Equal(t, 0, groups[0].ShippingFee)
+		}
+	})
+
+	err = store.SaveShippingSettings(ctx, &ShippingSettings{
+		SellerID: sellerID,
+		RateType: ShippingRateTypePrefecture,
+		PrefectureRates: []ShippingPrefectureRate{
+			{PrefectureCode: 13, Fee: 600},
+			{PrefectureCode: 47, Fee: 1500},
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("正常系: 配送先の都道府県の送料が子注文と注文に記録される", func(t *testing.T) {
+		order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 4500, Currency: "jpy", StripePaymentIntentID: "pi_test_shipping", PlatformFeeBasisPoints: 500}, items)
+		assert.NoError(t, err)
+		assert.Equal(t, 1500, order.ShippingFee)
+		// 手数料は送料を除いた小計にのみかかる
+		assert.Equal(t, 150, order.PlatformFee)
+
+		detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1500, detail.ShippingFee)
+		if assert.Len(t, detail.SubOrders, 1) {
+			assert.Equal(t, 3000, detail.SubOrders[0].Subtotal)
+			assert.Equal(t, 1500, detail.SubOrders[0].ShippingFee)
+			assert.Equal(t, 4500, detail.SubOrders[0].TotalAmount)
+		}
+	})
+
+	t.Run("異常系: 配送対象外の都道府県", func(t *testing.T) {
+		_, err := tx.Exec(ctx, "UPDATE profiles SET post_code = '060-0000' WHERE user_id = $1", buyerID)
+		assert.NoError(t, err)
+		groups, err := store.GroupCartItemsBySeller(ctx, items)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, store.QuoteShipping(ctx, buyerID, groups), ErrShippingUnavailable)
+	})
+
+	t.Run("正常系: 送料表の取得", func(t *testing.T) {
+		settings, err := store.GetShippingSettings(ctx, sellerID)
+		assert.NoError(t, err)
+		assert.Equal(t, ShippingRateTypePrefecture, settings.RateType)
+		if assert.Len(t, settings.PrefectureRates, 2) {
+			assert.Equal(t, "東京都", settings.PrefectureRates[0].Prefecture)
+		}
+	})
+}
+
+func TestTaxBreakdown(t *testing.T) {
+	t.Run("正常系: 税率ごとに1回だけ切り捨てる", func(t *testing.T) {
+		tax := newTaxBreakdown(1999, 550)
+		assert.Equal(t, 148, tax.ReducedTax) // 1999 * 8 / 108 = 148.07...
+		assert.Equal(t, 50, tax.StandardTax) // 550 * 10 / 110 = 50
+	})
+
+	t.Run("正常系: 送料は標準税率の対象", func(t *testing.T) {
+		group := &SellerCartItems{
+			Items: []CartItemDetail{
+				{Price: 1080, Quantity: 2, TaxCategory: TaxCategoryReduced},
+				{Price: 3300, Quantity: 1, TaxCategory: TaxCategoryStandard},
+			},
+			ShippingFee: 550,
+		}
+		tax := group.TaxBreakdown()
+		assert.Equal(t, TaxBreakdown{ReducedTaxableAmount: 2160, ReducedTax: 160, StandardTaxableAmount: 3850, StandardTax: 350}, tax)
+	})
+
+	t.Run("登録番号の形式", func(t *testing.T) {
+		assert.True(t, isValidInvoiceRegistrationNumber(normalizeInvoiceRegistrationNumber(" t1234-5678-90123 ")))
+		assert.False(t, isValidInvoiceRegistrationNumber("1234567890123"))
+		assert.False(t, isValidInvoiceRegistrationNumber("T123456789012"))
+	})
+}
+
+func TestCreateOrder_ConsumptionTax(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, invoice_registration_number)
+		VALUES ($1, 'Registered Roaster', '', '', '', '', 'T1234567890123')
+		ON CONFLICT (user_id) DO UPDATE SET invoice_registration_number = EXCLUDED.invoice_registration_number
+	`, sellerID)
+	assert.NoError(t, err)
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Reduced Rate Bean", Origin: "Test", Price: 1080, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, TaxCategoryReduced, bean.TaxCategory)
+	dripper, err := store.CreateBean(ctx, &Bean{Name: "Dripper", Origin: "Test", Price: 3300, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 10, TaxCategory: TaxCategoryStandard})
+	assert.NoError(t, err)
+	assert.Equal(t, TaxCategoryStandard, dripper.TaxCategory)
+
+	items := []CartItemDetail{
+		{BeanID: bean.ID, Price: bean.Price, Quantity: 2},
+		{BeanID: dripper.ID, Price: dripper.Price, Quantity: 1},
+	}
+	order, err := store.CreateOrder(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 5460, Currency: "jpy", StripePaymentIntentID: "pi_test_consumption_tax", PlatformFeeBasisPoints: 500}, items)
+	assert.NoError(t, err)
+	assert.Equal(t, TaxBreakdown{ReducedTaxableAmount: 2160, ReducedTax: 160, StandardTaxableAmount: 3300, StandardTax: 300}, order.Tax)
+
+	detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+	assert.NoError(t, err)
+	assert.Equal(t, order.Tax, detail.Tax)
+	if assert.Len(t, detail.SubOrders, 1) {
+		subOrder := detail.SubOrders[0]
+		assert.Equal(t, "T1234567890123", subOrder.SellerInvoiceRegistrationNumber)
+		assert.Equal(t, order.Tax, subOrder.Tax)
+		if assert.Len(t, subOrder.Items, 2) {
+			assert.Equal(t, TaxCategoryReduced, subOrder.Items[0].TaxCategory)
+			assert.Equal(t, TaxCategoryStandard, subOrder.Items[1].TaxCategory)
+		}
+	}
+
+	t.Run("異常系: 登録番号の形式が不正", func(t *testing.T) {
+		api := &Api{store: store}
+		req := httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"display_name": "Registered Roaster", "invoice_registration_number": "T123"}`))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr := httptest.NewRecorder()
+		api.profileHandler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("正常系: 登録番号を省略した更新では登録番号を維持する", func(t *testing.T) {
+		api := &Api{store: store}
+		req := httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"display_name": "Renamed Roaster"}`))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr := httptest.NewRecorder()
+		api.profileHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var updated Profile
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &updated))
+		assert.Equal(t, "Renamed Roaster", updated.DisplayName)
+		assert.Equal(t, "T1234567890123", updated.InvoiceRegistrationNumber)
+
+		req = httptest.NewRequest("PUT", "/api/profile", strings.NewReader(`{"display_name": "Renamed Roaster", "invoice_registration_number": ""}`))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr = httptest.NewRecorder()
+		api.profileHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &updated))
+		assert.Equal(t, "", updated.InvoiceRegistrationNumber)
+	})
+
+	t.Run("異常系: 不正な消費税区分", func(t *testing.T) {
+		api := &Api{store: store}
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/api/beans/%d", bean.ID), strings.NewReader(`{"name": "Bean", "origin": "Test", "price": 1080, "process": "washed", "roast_profile": "medium", "tax_category": "exempt"}`))
+		req.SetPathValue("id", strconv.Itoa(bean.ID))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr := httptest.NewRecorder()
+		api.updateBeanHandler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestApplyCoupon(t *testing.T) {
+	sellerA := "00000000-0000-0000-0000-000000000000"
+	sellerB := "11111111-1111-1111-1111-111111111111"
+	newGroups := func() []SellerCartItems {
+		return []SellerCartItems{
+			{SellerID: sellerA, Items: []CartItemDetail{
+				{BeanID: 1, Price: 1000, Quantity: 2, TaxCategory: TaxCategoryReduced},
+				{BeanID: 2, Price: 1000, Quantity: 1, TaxCategory: TaxCategoryStandard},
+			}, ShippingFee: 500},
+			{SellerID: sellerB, Items: []CartItemDetail{
+				{BeanID: 3, Price: 1000, Quantity: 1, TaxCategory: TaxCategoryReduced},
+			}},
+		}
+	}
+
+	t.Run("正常系: 定率の値引きを対象商品の金額で按分する", func(t *testing.T) {
+		groups := newGroups()
+		discount, err := applyCoupon(&Coupon{DiscountType: CouponDiscountTypePercentage, DiscountValue: 10, FundedBy: CouponFundedByPlatform}, groups)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, discount)
+		assert.Equal(t, map[string]int{TaxCategoryReduced: 200, TaxCategoryStandard: 100}, groups[0].DiscountByTaxCategory)
+		assert.Equal(t, 100, groups[1].Discount())
+		// 送料は値引きしない
+		assert.Equal(t, 3500-300, groups[0].Total())
+		assert.Equal(t, CouponFundedByPlatform, groups[0].DiscountFundedBy)
+	})
+
+	t.Run("正常系: 1円未満の端数も値引き額の合計と一致する", func(t *testing.T) {
+		groups := newGroups()
+		discount, err := applyCoupon(&Coupon{DiscountType: CouponDiscountTypeFixed, DiscountValue: 1001, FundedBy: CouponFundedByPlatform}, groups)
+		assert.NoError(t, err)
+		assert.Equal(t, 1001, discount)
+		assert.Equal(t, 1001, groups[0].Discount()+groups[1].Discount())
+	})
+
+	t.Run("正常系: 出品者負担のクーポンは発行した出品者の商品だけが対象", func(t *testing.T) {
+		groups := newGroups()
+		discount, err := applyCoupon(&Coupon{DiscountType: CouponDiscountTypeFixed, DiscountValue: 5000, FundedBy: CouponFundedBySeller, SellerID: sellerB}, groups)
+		assert.NoError(t, err)
+		// 値引き額は対象商品の小計を超えない
+		assert.Equal(t, 1000, discount)
+		assert.Equal(t, 0, groups[0].Discount())
+		assert.Equal(t, "", groups[0].DiscountFundedBy)
+		assert.Equal(t, 1000, groups[1].Discount())
+	})
+
+	t.Run("正常系: 負担者によって手数料と入金額が変わる", func(t *testing.T) {
+		seller := SellerCartItems{Items: []CartItemDetail{{BeanID: 1, Price: 2000, Quantity: 1}}, ShippingFee: 500,
+			DiscountByTaxCategory: map[string]int{TaxCategoryReduced: 200}, DiscountFundedBy: CouponFundedBySeller}
+		assert.Equal(t, 90, seller.PlatformFee(500))
+		assert.Equal(t, 2300-90, seller.Payout(500))
+		assert.Equal(t, TaxBreakdown{ReducedTaxableAmount: 1800, ReducedTax: 133, StandardTaxableAmount: 500, StandardTax: 45}, seller.TaxBreakdown())
+
+		seller.DiscountFundedBy = CouponFundedByPlatform
+		assert.Equal(t, 100, seller.PlatformFee(500))
+		assert.Equal(t, 2500-100, seller.Payout(500))
+	})
+
+	t.Run("異常系: 対象商品が無い", func(t *testing.T) {
+		_, err := applyCoupon(&Coupon{DiscountType: CouponDiscountTypeFixed, DiscountValue: 100, FundedBy: CouponFundedByPlatform, EligibleBeanIDs: []int{99}}, newGroups())
+		assert.ErrorIs(t, err, ErrCouponNotApplicable)
+	})
+
+	t.Run("異常系: 最低利用金額に満たない", func(t *testing.T) {
+		_, err := applyCoupon(&Coupon{DiscountType: CouponDiscountTypeFixed, DiscountValue: 100, FundedBy: CouponFundedByPlatform, EligibleSellerIDs: []string{sellerB}, MinSpend: 2000}, newGroups())
+		assert.ErrorIs(t, err, ErrCouponMinSpend)
+	})
+
+	t.Run("利用期間", func(t *testing.T) {
+		now := time.Now()
+		expired := now.Add(-time.Hour)
+		assert.True(t, (&Coupon{Active: true}).IsAvailableAt(now))
+		assert.False(t, (&Coupon{Active: true, ExpiresAt: &expired}).IsAvailableAt(now))
+		assert.False(t, (&Coupon{Active: false}).IsAvailableAt(now))
+	})
+}
+
+func TestCreateOrder_Coupon(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, stripe_account_id, stripe_account_status)
+		VALUES ($1, 'Coupon Roaster', '', '', '', '', 'acct_test_coupon', 'enabled')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = EXCLUDED.stripe_account_id, stripe_account_status = EXCLUDED.stripe_account_status, platform_fee_basis_points = NULL
+	`, sellerID)
+	assert.NoError(t, err)
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Coupon Bean", Origin: "Test", Price: 2000, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 10})
+	assert.NoError(t, err)
+	otherBean, err := store.CreateBean(ctx, &Bean{Name: "Buyer's Bean", Origin: "Test", Price: 1000, Process: "natural", RoastProfile: "light", UserID: buyerID, Stock: 10})
+	assert.NoError(t, err)
+	items := []CartItemDetail{
+		{BeanID: bean.ID, Price: bean.Price, Quantity: 1},
+		{BeanID: otherBean.ID, Price: otherBean.Price, Quantity: 1},
+	}
+
+	maxUsesPerUser := 1
+	coupon, err := store.CreateCoupon(ctx, &Coupon{Code: "ROASTER10", DiscountType: CouponDiscountTypePercentage, DiscountValue: 10, FundedBy: CouponFundedBySeller, SellerID: sellerID,
+		MaxUsesPerUser: &maxUsesPerUser, EligibleBeanIDs: []int{bean.ID}, Active: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{bean.ID}, coupon.EligibleBeanIDs)
+
+	groups, err := store.GroupCartItemsBySeller(ctx, items)
+	assert.NoError(t, err)
+	redeemed, err := redeemCoupon(ctx, store, buyerID, "ROASTER10", groups, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, coupon.ID, redeemed.ID)
+
+	order, err := store.CreateOrderForSellers(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 2800, Currency: "jpy", StripePaymentIntentID: "pi_test_coupon",
+		StripeTransferGroup: "checkout_test_coupon", PlatformFeeBasisPoints: 500, CouponID: coupon.ID, CouponCode: coupon.Code}, groups)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, order.DiscountAmount)
+	// 出品者負担の値引きは、値引き後の小計に手数料をかける
+	assert.Equal(t, 90+50, order.PlatformFee)
+
+	detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+	assert.NoError(t, err)
+	assert.Equal(t, "ROASTER10", detail.CouponCode)
+	assert.Equal(t, 200, detail.DiscountAmount)
+	if assert.Len(t, detail.SubOrders, 2) {
+		assert.Equal(t, 200, detail.SubOrders[0].DiscountAmount)
+		assert.Equal(t, CouponFundedBySeller, detail.SubOrders[0].DiscountFundedBy)
+		assert.Equal(t, 1800, detail.SubOrders[0].TotalAmount)
+		assert.Equal(t, 1800, detail.SubOrders[0].Tax.ReducedTaxableAmount)
+		assert.Equal(t, 0, detail.SubOrders[1].DiscountAmount)
+	}
+
+	// 出品者への入金額は値引き後の合計から手数料を差し引いた額になる
+	transfers, err := store.GetPendingSubOrderTransfers(ctx, order.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, transfers, 1) {
+		assert.Equal(t, 1800-90, transfers[0].Amount)
+	}
+
+	t.Run("異常系: 購入者ごとの利用回数の上限", func(t *testing.T) {
+		groups, err := store.GroupCartItemsBySeller(ctx, items)
+		assert.NoError(t, err)
+		_, err = redeemCoupon(ctx, store, buyerID, "ROASTER10", groups, time.Now())
+		assert.ErrorIs(t, err, ErrCouponUsageLimit)
+	})
+
+	t.Run("正常系: 全額返金された注文は利用回数に数えない", func(t *testing.T) {
+		_, err := tx.Exec(ctx, "UPDATE orders SET status = 'refunded' WHERE id = $1", order.ID)
+		assert.NoError(t, err)
+		total, byUser, err := store.CountCouponUses(ctx, coupon.ID, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, total)
+		assert.Equal(t, 0, byUser)
+	})
+
+	t.Run("異常系: 停止したクーポン", func(t *testing.T) {
+		assert.NoError(t, store.DeactivateCoupon(ctx, coupon.ID, sellerID))
+		groups, err := store.GroupCartItemsBySeller(ctx, items)
+		assert.NoError(t, err)
+		_, err = redeemCoupon(ctx, store, buyerID, "ROASTER10", groups, time.Now())
+		assert.ErrorIs(t, err, ErrCouponNotAvailable)
+		assert.ErrorIs(t, store.DeactivateCoupon(ctx, coupon.ID, buyerID), pgx.ErrNoRows)
+	})
+
+	t.Run("異常系: 存在しないクーポン", func(t *testing.T) {
+		_, err := redeemCoupon(ctx, store, buyerID, "NOSUCHCODE", groups, time.Now())
+		assert.ErrorIs(t, err, ErrCouponNotFound)
+	})
+
+	t.Run("正常系: プラットフォーム負担のクーポン", func(t *testing.T) {
+		platform, err := store.CreateCoupon(ctx, &Coupon{Code: "WELCOME500", DiscountType: CouponDiscountTypeFixed, DiscountValue: 500, FundedBy: CouponFundedByPlatform,
+			EligibleSellerIDs: []string{sellerID}, Active: true})
+		assert.NoError(t, err)
+		assert.Equal(t, CouponFundedByPlatform, platform.FundedBy)
+		assert.Equal(t, []string{sellerID}, platform.EligibleSellerIDs)
+	})
+
+	t.Run("異常系: 管理者以外はプラットフォーム負担のクーポンを発行できない", func(t *testing.T) {
+		api := &Api{store: store}
+		req := httptest.NewRequest("POST", "/api/admin/coupons", strings.NewReader(`{"code": "FREE100", "discount_type": "percentage", "discount_value": 100}`))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID, Roles: []string{RoleSeller, RoleModerator}}))
+		rr := httptest.NewRecorder()
+		api.createAdminCouponHandler(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	// 一意制約違反でトランザクションが中断されるため、最後に確認する
+	t.Run("異常系: 同じコードのクーポン", func(t *testing.T) {
+		_, err := store.CreateCoupon(ctx, &Coupon{Code: "ROASTER10", DiscountType: CouponDiscountTypeFixed, DiscountValue: 100, FundedBy: CouponFundedByPlatform, Active: true})
+		assert.ErrorIs(t, err, ErrCouponCodeTaken)
+	})
+}
+
+func TestPlanRefund(t *testing.T) {
+	target := &RefundTarget{SubOrderID: 1, OrderID: 1, TotalAmount: 3000 - 100 + 500, ShippingFee: 500, Items: []RefundableItem{
+		{ID: 10, BeanID: 100, PriceAtPurchase: 1000, Quantity: 3, DiscountAmount: 100},
+	}}
+
+	t.Run("正常系: 数量ごとの返金額の合計は値引き後の金額と一致する", func(t *testing.T) {
+		amounts := []int{}
+		remaining := *target
+		remaining.Items = append([]RefundableItem(nil), target.Items...)
+		for i := 0; i < 3; i++ {
+			r, err := planRefund(&remaining, []RefundItemRequest{{OrderItemID: 10, Quantity: 1}}, false)
+			assert.NoError(t, err)
+			amounts = append(amounts, r.Amount)
+			remaining.Items[0].RefundedQuantity++
+			remaining.RefundedAmount += r.Amount
+		}
+		assert.Equal(t, []int{967, 967, 966}, amounts)
+	})
+
+	t.Run("正常系: 送料を含めて全額返金", func(t *testing.T) {
+		r, err := planRefund(target, remainingItems(target), true)
+		assert.NoError(t, err)
+		assert.Equal(t, 3400, r.Amount)
+		assert.Equal(t, 500, r.ShippingAmount)
+	})
+
+	t.Run("異常系: 不正な明細・数量", func(t *testing.T) {
+		_, err := planRefund(target, []RefundItemRequest{{OrderItemID: 99, Quantity: 1}}, false)
+		assert.ErrorIs(t, err, ErrInvalidRefund)
+		_, err = planRefund(target, []RefundItemRequest{{OrderItemID: 10, Quantity: 4}}, false)
+		assert.ErrorIs(t, err, ErrInvalidRefund)
+		_, err = planRefund(target, []RefundItemRequest{{OrderItemID: 10, Quantity: 1}, {OrderItemID: 10, Quantity: 1}}, false)
+		assert.ErrorIs(t, err, ErrInvalidRefund)
+		_, err = planRefund(target, nil, false)
+		assert.ErrorIs(t, err, ErrInvalidRefund)
+	})
+
+	t.Run("異常系: 返金済みの送料", func(t *testing.T) {
+		refunded := *target
+		refunded.ShippingRefunded = true
+		_, err := planRefund(&refunded, nil, true)
+		assert.ErrorIs(t, err, ErrInvalidRefund)
+	})
+}
+
+func TestRefundsAndCancellations(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Refund Bean", Origin: "Test", Price: 1000, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 7})
+	assert.NoError(t, err)
+	groups, err := store.GroupCartItemsBySeller(ctx, []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 3}})
+	assert.NoError(t, err)
+	order, err := store.CreateOrderForSellers(ctx, &Order{UserID: buyerID, Status: OrderStatusSucceeded, TotalAmount: 3000, Currency: "jpy", StripePaymentIntentID: "pi_test_refund"}, groups)
+	assert.NoError(t, err)
+
+	detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+	assert.NoError(t, err)
+	if !assert.Len(t, detail.SubOrders, 1) || !assert.Len(t, detail.SubOrders[0].Items, 1) {
+		return
+	}
+	subOrderID := detail.SubOrders[0].ID
+	itemID := detail.SubOrders[0].Items[0].ID
+
+	t.Run("正常系: 購入者のキャンセル依頼", func(t *testing.T) {
+		requests, err := store.CreateCancellationRequests(ctx, order.ID, buyerID, 0, "changed my mind")
+		assert.NoError(t, err)
+		if assert.Len(t, requests, 1) {
+			assert.Equal(t, subOrderID, requests[0].SubOrderID)
+			assert.Equal(t, CancellationStatusPending, requests[0].Status)
+		}
+
+		// 対応を待っている依頼がある子注文には、重ねて依頼できない
+		_, err = store.CreateCancellationRequests(ctx, order.ID, buyerID, 0, "again")
+		assert.ErrorIs(t, err, ErrSubOrderNotCancelable)
+		// 他のユーザーの注文は存在しないものとして扱う
+		_, err = store.CreateCancellationRequests(ctx, order.ID, sellerID, 0, "")
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+		pending, err := store.GetPendingCancellationRequest(ctx, subOrderID)
+		assert.NoError(t, err)
+		resolved, err := store.ResolveCancellationRequest(ctx, pending.ID, CancellationStatusRejected, sellerID, "already roasted")
+		assert.NoError(t, err)
+		assert.Equal(t, CancellationStatusRejected, resolved.Status)
+		assert.NotNil(t, resolved.ResolvedAt)
+	})
+
+	t.Run("正常系: 明細の一部返金と在庫の戻し", func(t *testing.T) {
+		target, err := store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		assert.Equal(t, sellerID, target.SellerID)
+		assert.Equal(t, buyerID, target.BuyerID)
+		assert.Equal(t, FulfillmentStatusUnfulfilled, target.FulfillmentStatus)
+
+		r, err := planRefund(target, []RefundItemRequest{{OrderItemID: itemID, Quantity: 2}}, false)
+		assert.NoError(t, err)
+		r.RequestedBy = sellerID
+		r.Items[0].Restocked = true
+		assert.NoError(t, store.CreateRefund(ctx, r, time.Now()))
+		assert.NoError(t, store.RestockBeans(ctx, []OrderItem{{BeanID: bean.ID, Quantity: 2}}))
+
+		// Stripeに送信できていない返金は再送の対象になる
+		claimed, err := store.ClaimPendingRefunds(ctx, time.Now(), 10, time.Minute)
+		assert.NoError(t, err)
+		if assert.Len(t, claimed, 1) {
+			assert.Equal(t, r.ID, claimed[0].ID)
+			assert.Equal(t, "pi_test_refund", claimed[0].PaymentIntentID)
+			assert.Equal(t, 2000, claimed[0].Amount)
+		}
+		recorded, err := store.RecordStripeRefund(ctx, r.ID, "re_test_refund", RefundStatusPending)
+		assert.NoError(t, err)
+		assert.True(t, recorded)
+
+		updated, err := store.UpdateRefundStatus(ctx, "re_test_refund", 0, RefundStatusSucceeded)
+		assert.NoError(t, err)
+		assert.Equal(t, r.ID, updated)
+
+		restocked, err := store.GetBeanByID(ctx, bean.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 9, restocked.Stock)
+
+		target, err = store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2000, target.RefundedAmount)
+		assert.Equal(t, 1, target.Items[0].RemainingQuantity())
+	})
+
+	t.Run("正常系: 失敗した返金は返金額と在庫の戻しを元に戻す", func(t *testing.T) {
+		target, err := store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		r, err := planRefund(target, []RefundItemRequest{{OrderItemID: itemID, Quantity: 1}}, false)
+		assert.NoError(t, err)
+		r.Items[0].Restocked = true
+		assert.NoError(t, store.CreateRefund(ctx, r, time.Now()))
+		assert.NoError(t, store.RestockBeans(ctx, []OrderItem{{BeanID: bean.ID, Quantity: 1}}))
+
+		// 送信直後に届いたWebhookは、メタデータの返金のIDで対応する返金を探す
+		updated, err := store.UpdateRefundStatus(ctx, "re_test_failed", r.ID, RefundStatusFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, r.ID, updated)
+		assert.NoError(t, store.RevertRefund(ctx, r.ID))
+		// 再送されたWebhookでは二重に元に戻さない
+		updated, err = store.UpdateRefundStatus(ctx, "re_test_failed", r.ID, RefundStatusFailed)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, updated)
+		// Webhookで記録済みの返金は、送信結果で上書きしない
+		recorded, err := store.RecordStripeRefund(ctx, r.ID, "re_test_failed", RefundStatusSucceeded)
+		assert.NoError(t, err)
+		assert.False(t, recorded)
+
+		reverted, err := store.GetBeanByID(ctx, bean.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 9, reverted.Stock)
+		target, err = store.GetRefundTarget(ctx, subOrderID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2000, target.RefundedAmount)
+		assert.Equal(t, 1, target.Items[0].RemainingQuantity())
+	})
+
+	t.Run("正常系: 子注文のキャンセル", func(t *testing.T) {
+		assert.NoError(t, store.MarkSubOrderCanceled(ctx, subOrderID))
+		active, err := store.GetActiveSubOrderIDs(ctx, order.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, active)
+
+		detail, err := store.GetOrderDetail(ctx, order.ID, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, FulfillmentStatusCanceled, detail.SubOrders[0].FulfillmentStatus)
+		assert.NotNil(t, detail.SubOrders[0].CanceledAt)
+		assert.Equal(t, 2000, detail.SubOrders[0].RefundedAmount)
+		assert.Equal(t, 2, detail.SubOrders[0].Items[0].RefundedQuantity)
+		if assert.Len(t, detail.Refunds, 2) {
+			assert.Equal(t, RefundStatusSucceeded, detail.Refunds[0].Status)
+			assert.Equal(t, RefundStatusFailed, detail.Refunds[1].Status)
+			assert.Equal(t, []RefundItem{{OrderItemID: itemID, BeanID: bean.ID, Quantity: 2, Amount: 2000, Restocked: true}}, detail.Refunds[0].Items)
+		}
+		assert.Len(t, detail.CancellationRequests, 1)
+
+		// キャンセルした子注文には依頼できない
+		_, err = store.CreateCancellationRequests(ctx, order.ID, buyerID, subOrderID, "")
+		assert.ErrorIs(t, err, ErrSubOrderNotCancelable)
+	})
+
+	t.Run("正常系: キャンセルした注文でもチャージバックを記録する", func(t *testing.T) {
+		_, err := store.TransitionOrderStatus(ctx, order.ID, OrderStatusCanceled, "", "", "all sub-orders canceled")
+		assert.NoError(t, err)
+		_, err = store.TransitionOrderStatus(ctx, order.ID, OrderStatusDisputed, "", "", "dispute dp_test: fraudulent")
+		assert.NoError(t, err)
+	})
+}
+
+func TestSavedPaymentMethods(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+	buyerID := "00000000-0000-0000-0000-000000000000"
+
+	// withUser はリクエストに認証済みユーザーを設定します
+	withUser := func(req *http.Request) *http.Request {
+		return req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: buyerID}))
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+		VALUES ($1, 'Buyer', '', '', '', '')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_customer_id = NULL
+	`, buyerID)
+	assert.NoError(t, err)
+
+	t.Run("正常系: Customerが未作成の場合は空のリスト", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		api.paymentMethodsHandler(rr, withUser(httptest.NewRequest("GET", "/api/payment-methods", nil)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `[]`, rr.Body.String())
+	})
+
+	t.Run("異常系: Customerが未作成の場合はカードを削除できない", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("DELETE", "/api/payment-methods/pm_test_card", nil)
+		req.SetPathValue("id", "pm_test_card")
+		api.detachPaymentMethodHandler(rr, withUser(req))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("正常系: 作成済みのCustomerを使い回す", func(t *testing.T) {
+		linked, err := store.SetStripeCustomerID(ctx, buyerID, "cus_test_saved_cards")
+		assert.NoError(t, err)
+		assert.Equal(t, "cus_test_saved_cards", linked)
+		customerID, err := ensureStripeCustomer(ctx, store, newFakePaymentProvider(), buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, "cus_test_saved_cards", customerID)
+
+		// 同時に作成された別のCustomerでは上書きしない
+		linked, err = store.SetStripeCustomerID(ctx, buyerID, "cus_test_other")
+		assert.NoError(t, err)
+		assert.Equal(t, "cus_test_saved_cards", linked)
+	})
+
+	t.Run("正常系: プロフィールが無い場合は作成してCustomerを紐づける", func(t *testing.T) {
+		_, err := tx.Exec(ctx, "DELETE FROM profiles WHERE user_id = $1", buyerID)
+		assert.NoError(t, err)
+		payments := newFakePaymentProvider()
+		customerID, err := ensureStripeCustomer(ctx, store, payments, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, payments.customers[buyerID], customerID)
+		linked, err := store.GetStripeCustomerID(ctx, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, customerID, linked)
+
+		// 決済時に作成した空のプロフィールは、後から登録できる
+		created, err := store.CreateProfile(ctx, &Profile{UserID: buyerID, DisplayName: "Buyer", PostCode: "1000001", Address: "Tokyo"})
+		assert.NoError(t, err)
+		assert.Equal(t, "Buyer", created.DisplayName)
+		_, err = store.CreateProfile(ctx, &Profile{UserID: buyerID, DisplayName: "Again"})
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+		// 決済するユーザーには購入者のロールが付与される
+		roles, err := store.GetUserRoles(ctx, buyerID)
+		assert.NoError(t, err)
+		assert.Contains(t, roles, RoleBuyer)
+	})
+
+	t.Run("正常系: 定期便用に登録したカードを一覧に表示し、削除する", func(t *testing.T) {
+		payments := newFakePaymentProvider()
+		api := &Api{store: store, payments: payments}
+		customerID, err := ensureStripeCustomer(ctx, store, payments, buyerID)
+		assert.NoError(t, err)
+
+		// 購入者がいない状態（off_session）で請求するカードの、登録の手続きを作成する
+		rr := httptest.NewRecorder()
+		api.createSetupIntentHandler(rr, withUser(httptest.NewRequest("POST", "/api/payment-methods/setup-intent", nil)))
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var created struct {
+			SetupIntentID string `json:"setup_intent_id"`
+			ClientSecret  string `json:"client_secret"`
+		}
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+		assert.NotEmpty(t, created.ClientSecret)
+		if assert.Contains(t, payments.setupIntents, created.SetupIntentID) {
+			assert.Equal(t, customerID, payments.setupIntents[created.SetupIntentID].CustomerID)
+			assert.Equal(t, "off_session", payments.setupIntents[created.SetupIntentID].Usage)
+		}
+
+		// 登録が完了するまでは使えず、完了したら登録したカードを使う
+		cardID := payments.addCard("4242")
+		_, err = verifySetupIntent(ctx, store, payments, buyerID, created.SetupIntentID)
+		assert.ErrorIs(t, err, ErrPaymentMethodNotUsable)
+		payments.confirmSetupIntent(t, created.SetupIntentID, cardID)
+		paymentMethodID, err := verifySetupIntent(ctx, store, payments, buyerID, created.SetupIntentID)
+		assert.NoError(t, err)
+		assert.Equal(t, cardID, paymentMethodID)
+
+		// 購入者がいる状態での支払い用に登録したカードは使えない
+		onSessionCardID := payments.addCard("1111")
+		payments.setupIntents["seti_test_on_session"] = &SetupIntent{ID: "seti_test_on_session", Status: "succeeded", Usage: "on_session", CustomerID: customerID, PaymentMethodID: onSessionCardID}
+		_, err = verifySetupIntent(ctx, store, payments, buyerID, "seti_test_on_session")
+		assert.ErrorIs(t, err, ErrPaymentMethodNotUsable)
+		assert.ErrorContains(t, err, "off-session")
+
+		// 他の顧客の手続きや存在しない手続き、カードのIDそのものは使えない
+		otherCardID := payments.addCard("0005")
+		payments.paymentMethods[otherCardID].CustomerID = "cus_test_other"
+		payments.setupIntents["seti_test_other"] = &SetupIntent{ID: "seti_test_other", Status: "succeeded", Usage: "off_session", CustomerID: "cus_test_other", PaymentMethodID: otherCardID}
+		for _, id := range []string{"seti_test_other", "seti_test_missing", cardID} {
+			_, err := verifySetupIntent(ctx, store, payments, buyerID, id)
+			assert.ErrorIs(t, err, ErrPaymentMethodNotUsable, id)
+		}
+
+		rr = httptest.NewRecorder()
+		api.paymentMethodsHandler(rr, withUser(httptest.NewRequest("GET", "/api/payment-methods", nil)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var cards []SavedCard
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&cards))
+		if assert.Len(t, cards, 1) {
+			assert.Equal(t, cardID, cards[0].ID)
+			assert.Equal(t, "4242", cards[0].Last4)
+		}
+
+		detach := func(id string) int {
+			req := httptest.NewRequest("DELETE", "/api/payment-methods/"+id, nil)
+			req.SetPathValue("id", id)
+			rr := httptest.NewRecorder()
+			api.detachPaymentMethodHandler(rr, withUser(req))
+			return rr.Code
+		}
+		assert.Equal(t, http.StatusNotFound, detach(otherCardID))
+		assert.Equal(t, http.StatusNoContent, detach(cardID))
+		assert.Empty(t, payments.paymentMethods[cardID].CustomerID)
+		assert.Equal(t, "cus_test_other", payments.paymentMethods[otherCardID].CustomerID)
+
+		// 削除したカードは、登録の手続きが完了していても使えない
+		_, err = verifySetupIntent(ctx, store, payments, buyerID, created.SetupIntentID)
+		assert.ErrorIs(t, err, ErrPaymentMethodNotUsable)
+	})
+
+	t.Run("カード以外の支払い方法は表示しない", func(t *testing.T) {
+		card := savedCardOf(&stripe.PaymentMethod{ID: "pm_test_card", Card: &stripe.PaymentMethodCard{Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030}})
+		assert.Equal(t, &SavedCard{ID: "pm_test_card", Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030}, card)
+		assert.Nil(t, savedCardOf(&stripe.PaymentMethod{ID: "pm_test_konbini"}))
+	})
+}
+
+func TestApplySubscriptionAction(t *testing.T) {
+	newSub := func(status string) *Subscription {
+		return &Subscription{Status: status, NextDeliveryDate: "2025-11-01", FailedAttempts: 2, LastPaymentError: "card declined", Plan: SubscriptionPlan{IntervalDays: 14}}
+	}
+
+	t.Run("スキップは次のお届けを1回分先に進める", func(t *testing.T) {
+		sub := newSub(SubscriptionStatusActive)
+		assert.NoError(t, applySubscriptionAction(sub, SubscriptionActionSkip, "2025-10-20"))
+		assert.Equal(t, "2025-11-15", sub.NextDeliveryDate)
+		assert.Equal(t, SubscriptionStatusActive, sub.Status)
+	})
+
+	t.Run("再開すると過ぎたお届け日は今日に繰り下げる", func(t *testing.T) {
+		sub := newSub(SubscriptionStatusPaused)
+		assert.NoError(t, applySubscriptionAction(sub, SubscriptionActionResume, "2025-11-10"))
+		assert.Equal(t, SubscriptionStatusActive, sub.Status)
+		assert.Equal(t, "2025-11-10", sub.NextDeliveryDate)
+		assert.Equal(t, 0, sub.FailedAttempts)
+		assert.Equal(t, "", sub.LastPaymentError)
+	})
+
+	t.Run("異常系: 行えない操作", func(t *testing.T) {
+		assert.ErrorIs(t, applySubscriptionAction(newSub(SubscriptionStatusPaused), SubscriptionActionPause, "2025-10-20"), ErrInvalidSubscriptionAction)
+		assert.ErrorIs(t, applySubscriptionAction(newSub(SubscriptionStatusActive), SubscriptionActionResume, "2025-10-20"), ErrInvalidSubscriptionAction)
+		assert.ErrorIs(t, applySubscriptionAction(newSub(SubscriptionStatusCanceled), SubscriptionActionSkip, "2025-10-20"), ErrInvalidSubscriptionAction)
+		assert.ErrorIs(t, applySubscriptionAction(newSub(SubscriptionStatusCanceled), SubscriptionActionCancel, "2025-10-20"), ErrInvalidSubscriptionAction)
+		assert.ErrorIs(t, applySubscriptionAction(newSub(SubscriptionStatusActive), "upgrade", "2025-10-20"), ErrInvalidSubscriptionAction)
+	})
+
+	t.Run("お届け日は日本時間で数える", func(t *testing.T) {
+		assert.Equal(t, "2025-11-02", todayInJST(time.Date(2025, 11, 1, 15, 0, 0, 0, time.UTC)))
+	})
+}
+
+func TestSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+		VALUES ($1, 'Subscriber', '', '', '', '')
+		ON CONFLICT (user_id) DO UPDATE SET display_name = EXCLUDED.display_name
+	`, buyerID)
+	assert.NoError(t, err)
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Subscription Bean", Origin: "Test", Price: 1200, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 10})
+	assert.NoError(t, err)
+
+	t.Run("異常系: 他の出品者のコーヒー豆にはプランを作成できない", func(t *testing.T) {
+		_, err := store.CreateSubscriptionPlan(ctx, &SubscriptionPlan{BeanID: bean.ID, Quantity: 1, IntervalDays: 14}, buyerID)
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+
+	plan, err := store.CreateSubscriptionPlan(ctx, &SubscriptionPlan{BeanID: bean.ID, Name: "2週間ごと", Quantity: 2, IntervalDays: 14}, sellerID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2400, plan.Price)
+	assert.Equal(t, sellerID, plan.SellerID)
+	assert.True(t, plan.Active)
+
+	sub, err := store.CreateSubscription(ctx, &Subscription{UserID: buyerID, Plan: *plan, StripePaymentMethodID: "pm_test_subscription", NextDeliveryDate: "2025-11-01"})
+	assert.NoError(t, err)
+	assert.Equal(t, SubscriptionStatusActive, sub.Status)
+	assert.Equal(t, "2025-11-01", sub.NextDeliveryDate)
+	assert.Equal(t, plan.ID, sub.Plan.ID)
+
+	t.Run("正常系: 出品者のお届け予定", func(t *testing.T) {
+		deliveries, err := store.GetUpcomingDeliveries(ctx, sellerID, "2025-11-30")
+		assert.NoError(t, err)
+		dates := []string{}
+		for _, d := range deliveries {
+			if d.SubscriptionID == sub.ID {
+				dates = append(dates, d.DeliveryDate)
+				assert.Equal(t, "Subscriber", d.BuyerName)
+				assert.Equal(t, 2, d.Quantity)
+			}
+		}
+		assert.Equal(t, []string{"2025-11-01", "2025-11-15", "2025-11-29"}, dates)
+	})
+
+	t.Run("正常系: 請求する時期が来た定期便", func(t *testing.T) {
+		now := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+		ids, err := store.GetDueSubscriptionIDs(ctx, "2025-10-31", now, 100)
+		assert.NoError(t, err)
+		assert.NotContains(t, ids, sub.ID)
+		ids, err = store.GetDueSubscriptionIDs(ctx, "2025-11-01", now, 100)
+		assert.NoError(t, err)
+		assert.Contains(t, ids, sub.ID)
+
+		locked, err := store.LockDueSubscription(ctx, sub.ID, "2025-11-01", now)
+		assert.NoError(t, err)
+		assert.Equal(t, bean.ID, locked.Plan.BeanID)
+	})
+
+	t.Run("正常系: 定期便の注文の在庫確保はカートの決済で解放しない", func(t *testing.T) {
+		groups, err := store.GroupCartItemsBySeller(ctx, []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 2}})
+		assert.NoError(t, err)
+		subscriptionID := sub.ID
+		order, err := store.CreateOrderForSellers(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 2400, Currency: "jpy", StripePaymentIntentID: "pi_test_subscription",
+			SubscriptionID: &subscriptionID, SubscriptionDeliveryDate: "2025-11-01"}, groups)
+		assert.NoError(t, err)
+		assert.NoError(t, store.CreateStockReservations(ctx, buyerID, order.ID, []OrderItem{{BeanID: bean.ID, Quantity: 2}}, time.Now().Add(time.Hour)))
+
+		checkouts, err := store.GetReservedCheckoutOrders(ctx, buyerID)
+		assert.NoError(t, err)
+		for _, checkout := range checkouts {
+			assert.NotEqual(t, order.ID, checkout.ID)
+		}
+
+		found, err := store.GetOrderByPaymentIntentID(ctx, "pi_test_subscription")
+		assert.NoError(t, err)
+		assert.Equal(t, order.ID, found.ID)
+		if assert.NotNil(t, found.SubscriptionID) {
+			assert.Equal(t, sub.ID, *found.SubscriptionID)
+		}
+		assert.Equal(t, "2025-11-01", found.SubscriptionDeliveryDate)
+
+		assert.NoError(t, store.AdvanceSubscription(ctx, sub.ID, "2025-11-01", "2025-11-15"))
+	})
+
+	t.Run("正常系: 注文に紐づける前に届いたPaymentIntentはメタデータの注文IDで注文を特定する", func(t *testing.T) {
+		groups, err := store.GroupCartItemsBySeller(ctx, []CartItemDetail{{BeanID: bean.ID, Price: bean.Price, Quantity: 2}})
+		assert.NoError(t, err)
+		subscriptionID := sub.ID
+		order, err := store.CreateOrderForSellers(ctx, &Order{UserID: buyerID, Status: OrderStatusPending, TotalAmount: 2400, Currency: "jpy",
+			SubscriptionID: &subscriptionID, SubscriptionDeliveryDate: "2025-11-15"}, groups)
+		assert.NoError(t, err)
+
+		// 請求中の回の注文は、同じお届け日の請求をやり直すときに見つかる
+		open, err := store.GetOpenSubscriptionOrder(ctx, sub.ID, "2025-11-15")
+		if assert.NoError(t, err) {
+			assert.Equal(t, order.ID, open.ID)
+			assert.Empty(t, open.StripePaymentIntentID)
+		}
+
+		_, err = store.GetOrderForPaymentIntent(ctx, "pi_test_subscription_early", nil)
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+		found, err := store.GetOrderForPaymentIntent(ctx, "pi_test_subscription_early", map[string]string{"order_id": strconv.Itoa(order.ID)})
+		if assert.NoError(t, err) {
+			assert.Equal(t, order.ID, found.ID)
+			assert.Equal(t, "pi_test_subscription_early", found.StripePaymentIntentID)
+		}
+		// 他のPaymentIntentが紐づいた注文は、メタデータで指定されても返さない
+		_, err = store.GetOrderForPaymentIntent(ctx, "pi_test_subscription_other", map[string]string{"order_id": strconv.Itoa(order.ID)})
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+		// 請求中に購入者が次のお届け日を変えていた場合は、請求済みの回から進めない
+		assert.NoError(t, store.AdvanceSubscription(ctx, sub.ID, "2025-11-01", "2025-11-29"))
+		current, err := store.GetSubscriptionForUpdate(ctx, sub.ID, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, "2025-11-15", current.NextDeliveryDate)
+
+		// キャンセルした回は、同じお届け日の注文を作り直せる
+		_, err = store.TransitionOrderStatus(ctx, order.ID, OrderStatusCanceled, "", "", "card declined")
+		assert.NoError(t, err)
+		_, err = store.GetOpenSubscriptionOrder(ctx, sub.ID, "2025-11-15")
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("正常系: 請求の失敗が続くと一時停止する", func(t *testing.T) {
+		retryAfter := time.Now().Add(subscriptionRetryDelay)
+		for i := 1; i <= maxSubscriptionPaymentAttempts; i++ {
+			paused, err := store.RecordSubscriptionFailure(ctx, sub.ID, "card declined", retryAfter, maxSubscriptionPaymentAttempts)
+			assert.NoError(t, err)
+			assert.Equal(t, i == maxSubscriptionPaymentAttempts, paused)
+		}
+
+		locked, err := store.GetSubscriptionForUpdate(ctx, sub.ID, buyerID)
+		assert.NoError(t, err)
+		assert.Equal(t, SubscriptionStatusPaused, locked.Status)
+		assert.Equal(t, "2025-11-15", locked.NextDeliveryDate)
+		assert.Equal(t, "card declined", locked.LastPaymentError)
+		assert.NotNil(t, locked.PausedAt)
+
+		// 再開すると請求の失敗の記録が消える
+		assert.NoError(t, applySubscriptionAction(locked, SubscriptionActionResume, "2025-11-20"))
+		updated, err := store.UpdateSubscription(ctx, locked)
+		assert.NoError(t, err)
+		assert.Equal(t, SubscriptionStatusActive, updated.Status)
+		assert.Equal(t, "2025-11-20", updated.NextDeliveryDate)
+		assert.Equal(t, 0, updated.FailedAttempts)
+		assert.Nil(t, updated.PausedAt)
+
+		// 他のユーザーの定期便は存在しないものとして扱う
+		_, err = store.GetSubscriptionForUpdate(ctx, sub.ID, sellerID)
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("正常系: 停止したプランは申し込めるプランに含めない", func(t *testing.T) {
+		assert.NoError(t, store.DeactivateSubscriptionPlan(ctx, plan.ID, sellerID))
+		assert.ErrorIs(t, store.DeactivateSubscriptionPlan(ctx, plan.ID, buyerID), pgx.ErrNoRows)
+		plans, err := store.GetSubscriptionPlansByBeanID(ctx, bean.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, plans)
+		plans, err = store.GetSubscriptionPlansBySellerID(ctx, sellerID)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, plans)
+	})
+}
+
+func TestCheckoutWithFakePaymentProvider(t *testing.T) {
+	// ハンドラが開始するトランザクションは、テストのトランザクションのセーブポイントになるため、最後にまとめてロールバックされます
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	payments := newFakePaymentProvider()
+	api := &Api{store: store, dbpool: tx, platformFeeBasisPoints: 1000, payments: payments}
+
+	buyerID := "00000000-0000-0000-0000-000000000000"
+	sellerID := "11111111-1111-1111-1111-111111111111"
+	withUser := func(req *http.Request, userID string) *http.Request {
+		return req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: userID}))
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+		VALUES ($1, 'Buyer', '', '', '', '')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_customer_id = NULL
+	`, buyerID)
+	assert.NoError(t, err)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, stripe_account_id, stripe_account_status)
+		VALUES ($1, 'Seller', '', '', '', '', 'acct_test_fake_checkout', 'enabled')
+		ON CONFLICT (user_id) DO UPDATE SET stripe_account_id = EXCLUDED.stripe_account_id, stripe_account_status = EXCLUDED.stripe_account_status
+	`, sellerID)
+	assert.NoError(t, err)
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Fake Checkout Bean", Origin: "Test", Price: 2000, Process: "washed", RoastProfile: "medium", UserID: sellerID, Stock: 5})
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.ClearCart(ctx, buyerID))
+	_, err = store.AddOrUpdateCartItem(ctx, buyerID, AddCartItemRequest{BeanID: bean.ID, Quantity: 2})
+	assert.NoError(t, err)
+
+	// --- チェックアウト ---
+	rr := httptest.NewRecorder()
+	api.createPaymentIntentHandler(rr, withUser(httptest.NewRequest("POST", "/api/checkout/payment-intent", nil), buyerID))
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		return
+	}
+	var checkout struct {
+		ClientSecret string `json:"client_secret"`
+		Amount       int64  `json:"amount"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &checkout))
+	assert.Equal(t, int64(4000), checkout.Amount)
+
+	// 出品者が1人なので、Destination Chargeで手数料を差し引いて入金する
+	if !assert.Len(t, payments.paymentIntents, 1) {
+		return
+	}
+	var paymentIntentID string
+	for id, params := range payments.paymentIntents {
+		paymentIntentID = id
+		assert.Equal(t, id+"_secret", checkout.ClientSecret)
+		assert.Equal(t, int64(4000), params.Amount)
+		assert.Equal(t, payments.customers[buyerID], params.CustomerID)
+		// カードの保存は購入者が選んだ場合のみ
+		assert.False(t, params.SavePaymentMethod)
+		assert.Equal(t, "acct_test_fake_checkout", params.TransferDestination)
+		assert.Equal(t, int64(400), params.ApplicationFeeAmount)
+		assert.Equal(t, buyerID, params.Metadata["user_id"])
+	}
+	pending, err := store.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, OrderStatusPending, pending.Status)
+	// PaymentIntentは保留中の注文をコミットしてから、注文IDを冪等キーにして作成する
+	assert.Equal(t, strconv.Itoa(pending.ID), payments.paymentIntents[paymentIntentID].Metadata["order_id"])
+	assert.Equal(t, fmt.Sprintf("checkout_order_%d", pending.ID), payments.paymentIntents[paymentIntentID].IdempotencyKey)
+
+	// --- 支払いの完了のWebhook（署名を検証し、同じ支払いの完了が2回届いても在庫は1回だけ減らす） ---
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+		api.handleStripeWebhook(rr, payments.succeedPaymentIntent(t, paymentIntentID))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	completed, err := store.GetOrderDetail(ctx, pending.ID, buyerID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, OrderStatusSucceeded, completed.Status)
+	assert.Equal(t, "card", completed.PaymentMethodType)
+	cartItems, err := store.GetCartItemsByUserID(ctx, buyerID)
+	assert.NoError(t, err)
+	assert.Empty(t, cartItems)
+	updatedBean, err := store.GetBeanByID(ctx, bean.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, updatedBean.Stock)
+	// Destination Chargeの入金はStripeが行うので、子注文ごとのTransferは作成しない
+	assert.Empty(t, payments.transfers)
+
+	// Stripeが自動で作成した入金は、Chargeのイベントで子注文に記録する
+	chargeSucceeded, transferID := payments.succeedCharge(t, paymentIntentID)
+	rr = httptest.NewRecorder()
+	api.handleStripeWebhook(rr, chargeSucceeded)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var recordedTransferID string
+	assert.NoError(t, tx.QueryRow(ctx, "SELECT COALESCE(stripe_transfer_id, '') FROM sub_orders WHERE order_id = $1", pending.ID).Scan(&recordedTransferID))
+	assert.Equal(t, transferID, recordedTransferID)
+
+	t.Run("異常系: 署名が一致しないWebhookは処理しない", func(t *testing.T) {
+		other := newFakePaymentProvider()
+		other.webhookSecret = "whsec_other_secret"
+		rr := httptest.NewRecorder()
+		api.handleStripeWebhook(rr, other.webhookRequest(t, "payment_intent.succeeded", map[string]interface{}{"id": paymentIntentID}))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("正常系: 出品者が明細を返金する", func(t *testing.T) {
+		if !assert.Len(t, completed.SubOrders, 1) || !assert.Len(t, completed.SubOrders[0].Items, 1) {
+			return
+		}
+		subOrder := completed.SubOrders[0]
+		body := fmt.Sprintf(`{"items": [{"order_item_id": %d, "quantity": 1}], "restock": true, "reason": "damaged"}`, subOrder.Items[0].ID)
+		req := httptest.NewRequest("POST", "/api/seller/orders/"+strconv.Itoa(subOrder.ID)+"/refunds", strings.NewReader(body))
+		req.SetPathValue("id", strconv.Itoa(subOrder.ID))
+		rr := httptest.NewRecorder()
+		api.createSellerRefundHandler(rr, withUser(req, sellerID))
+		assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+		if assert.Len(t, payments.refunds, 1) {
+			assert.Equal(t, paymentIntentID, payments.refunds[0].PaymentIntentID)
+			assert.Equal(t, int64(2000), payments.refunds[0].Amount)
+			assert.True(t, payments.refunds[0].ReverseTransfer)
+		}
+		restocked, err := store.GetBeanByID(ctx, bean.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, restocked.Stock)
+	})
+
+	t.Run("正常系: 管理者は他のユーザーの注文をStripeでの支払いの状態とともに確認できる", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/admin/orders/"+strconv.Itoa(completed.ID), nil)
+		req.SetPathValue("id", strconv.Itoa(completed.ID))
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID, Roles: []string{RoleAdmin}}))
+		rr := httptest.NewRecorder()
+		api.adminOrderDetailHandler(rr, req)
+		if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+			return
+		}
+
+		var detail AdminOrderDetail
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &detail))
+		assert.Equal(t, completed.ID, detail.ID)
+		assert.Empty(t, detail.PaymentError)
+		if assert.NotNil(t, detail.Payment) {
+			assert.Equal(t, paymentIntentID, detail.Payment.ID)
+			assert.Equal(t, "succeeded", detail.Payment.Status)
+			assert.Empty(t, detail.Payment.ClientSecret)
+		}
+		if assert.Len(t, detail.Payouts, 1) {
+			assert.Equal(t, sellerID, detail.Payouts[0].SellerID)
+		}
+
+		// 購入者自身でもロールが無ければ確認できない
+		req = httptest.NewRequest("GET", "/api/admin/orders/"+strconv.Itoa(completed.ID), nil)
+		req.SetPathValue("id", strconv.Itoa(completed.ID))
+		rr = httptest.NewRecorder()
+		api.adminOrderDetailHandler(rr, withUser(req, buyerID))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("異常系: 保存済みのカードが拒否された場合は理由を記録する", func(t *testing.T) {
+		payments.declineOffSession = true
+		defer func() { payments.declineOffSession = false }()
+		_, err := payments.CreatePaymentIntent(ctx, &PaymentIntentParams{Amount: 2000, Currency: "jpy", PaymentMethodID: "pm_test_declined"})
+		assert.Equal(t, "Your card was declined.", paymentErrorMessage(err))
+	})
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	userID := "00000000-0000-0000-0000-000000000000"
+	hmacSecret := "test_jwt_secret"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// writeJWKS はRSAとECの公開鍵を、Supabaseと同じ形式のJWKSファイルとして書き出します
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS := func(t *testing.T, rsaKeys map[string]*rsa.PublicKey, ecKeys map[string]*ecdsa.PublicKey) {
+		t.Helper()
+		b64 := base64.RawURLEncoding.EncodeToString
+		keys := []map[string]string{}
+		for kid, k := range rsaKeys {
+			keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())})
+		}
+		for kid, k := range ecKeys {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			keys = append(keys, map[string]string{"kty": "EC", "kid": kid, "use": "sig", "alg": "ES256", "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, size))), "y": b64(k.Y.FillBytes(make([]byte, size)))})
+		}
+		data, err := json.Marshal(map[string]interface{}{"keys": keys})
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(jwksPath, data, 0o600))
+	}
+	writeJWKS(t, map[string]*rsa.PublicKey{"rsa-key-1": &rsaKey.PublicKey}, map[string]*ecdsa.PublicKey{"ec-key-1": &ecKey.PublicKey})
+
+	// sign は指定した署名方式と鍵でトークンを作成します
+	sign := func(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+		t.Helper()
+		now := time.Now()
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": userID, "aud": "authenticated", "role": "authenticated", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	keys := newJWKSKeySetFromFile(jwksPath)
+	keys.minRefreshInterval = 0
+	auth := newJWTAuthenticator(keys, hmacSecret, defaultJWTClaimsPolicy())
+
+	// request は認証が任意のルートにトークンを付けてリクエストし、ステータスコードとハンドラが受け取ったユーザーIDを返します
+	request := func(auth *jwtAuthenticator, token string) (int, string) {
+		var gotUserID string
+		handler := auth.protect(routePolicy{anyMethod: authOptional}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if principal, ok := principalFromContext(r.Context()); ok {
+				gotUserID = principal.UserID
+			}
+		}))
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, gotUserID
+	}
+
+	t.Run("正常系: RS256とES256のトークンをJWKSの公開鍵で検証する", func(t *testing.T) {
+		code, got := request(auth, sign(t, jwt.SigningMethodRS256, "rsa-key-1", rsaKey))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, userID, got)
+
+		code, got = request(auth, sign(t, jwt.SigningMethodES256, "ec-key-1", ecKey))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, userID, got)
+	})
+
+	t.Run("正常系: HS256のトークンも共有シークレットで検証する", func(t *testing.T) {
+		code, got := request(auth, sign(t, jwt.SigningMethodHS256, "", []byte(hmacSecret)))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, userID, got)
+	})
+
+	t.Run("正常系: トークンが無ければ未認証のまま次のハンドラを呼ぶ", func(t *testing.T) {
+		code, got := request(auth, "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "", got)
+	})
+
+	t.Run("異常系: 検証できないトークン", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		for name, token := range map[string]string{
+			"別の鍵で署名":            sign(t, jwt.SigningMethodRS256, "rsa-key-1", otherKey),
+			"未知のkid":             sign(t, jwt.SigningMethodRS256, "unknown-key", rsaKey),
+			"kidが無い":             sign(t, jwt.SigningMethodRS256, "", rsaKey),
+			"別のシークレットで署名したHS256": sign(t, jwt.SigningMethodHS256, "", []byte("wrong_secret")),
+			"none":               sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType),
+		} {
+			code, _ := request(auth, token)
+			assert.Equal(t, http.StatusUnauthorized, code, name)
+		}
+	})
+
+	t.Run("異常系: 設定されていない署名方式は受け付けない", func(t *testing.T) {
+		code, _ := request(newJWTAuthenticator(nil, hmacSecret, defaultJWTClaimsPolicy()), sign(t, jwt.SigningMethodRS256, "rsa-key-1", rsaKey))
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = request(newJWTAuthenticator(keys, "", defaultJWTClaimsPolicy()), sign(t, jwt.SigningMethodHS256, "", []byte("")))
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("正常系: 鍵がローテーションされたらJWKSを取得し直す", func(t *testing.T) {
+		writeJWKS(t, map[string]*rsa.PublicKey{"rsa-key-1": &rsaKey.PublicKey, "rsa-key-2": &rotatedKey.PublicKey}, nil)
+		code, got := request(auth, sign(t, jwt.SigningMethodRS256, "rsa-key-2", rotatedKey))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, userID, got)
+
+		// 取り下げられた鍵は、キャッシュの期限が切れると使えなくなる
+		writeJWKS(t, map[string]*rsa.PublicKey{"rsa-key-2": &rotatedKey.PublicKey}, nil)
+		keys.ttl = 0
+		code, _ = request(auth, sign(t, jwt.SigningMethodES256, "ec-key-1", ecKey))
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("異常系: 未知のkidでは最短の間隔を空けずにJWKSを取得し直さない", func(t *testing.T) {
+		throttled := newJWKSKeySetFromFile(jwksPath)
+		assert.NoError(t, throttled.Refresh(context.Background()))
+		writeJWKS(t, map[string]*rsa.PublicKey{"rsa-key-3": &rsaKey.PublicKey}, nil)
+		_, err := throttled.Key(context.Background(), "rsa-key-3")
+		assert.ErrorIs(t, err, ErrUnknownSigningKey)
+	})
+
+	t.Run("JWKSの署名用でない鍵や扱えない鍵は無視する", func(t *testing.T) {
+		parsed, err := parseJWKS([]byte(`{"keys": [{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"}, {"kty": "oct", "kid": "sym", "k": "c2VjcmV0"}]}`))
+		assert.NoError(t, err)
+		assert.Empty(t, parsed)
+		_, err = parseJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQAB", "y": "AQAB"}]}`))
+		assert.Error(t, err)
+
+		// 扱えない曲線の鍵があっても、他の鍵は使える
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		b64 := base64.RawURLEncoding.EncodeToString
+		data := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k256", "crv": "secp256k1", "x": "AQAB", "y": "AQAB"}, {"kty": "EC", "kid": "ec-key-1", "crv": "P-256", "x": %q, "y": %q}]}`,
+			b64(ecKey.X.FillBytes(make([]byte, size))), b64(ecKey.Y.FillBytes(make([]byte, size))))
+		parsed, err = parseJWKS([]byte(data))
+		assert.NoError(t, err)
+		assert.Len(t, parsed, 1)
+		assert.Contains(t, parsed, "ec-key-1")
+	})
+
+	t.Run("正常系: JWKSの取得中はキャッシュ済みの公開鍵を使い、取得は1回にまとめる", func(t *testing.T) {
+		data, err := os.ReadFile(jwksPath)
+		assert.NoError(t, err)
+		var loads atomic.Int32
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		slow := newJWKSKeySet("test", func(ctx context.Context) ([]byte, error) {
+			if loads.Add(1) > 1 {
+				started <- struct{}{}
+				<-release
+			}
+			return data, nil
+		})
+		assert.NoError(t, slow.Refresh(context.Background()))
+		slow.ttl = 0
+		slow.minRefreshInterval = 0
+
+		// 期限切れのキャッシュを取得し直している間に届いたリクエスト
+		done := make(chan error, 1)
+		go func() {
+			_, err := slow.Key(context.Background(), "rsa-key-3")
+			done <- err
+		}()
+		<-started
+		key, err := slow.Key(context.Background(), "rsa-key-3")
+		assert.NoError(t, err)
+		assert.NotNil(t, key)
+		close(release)
+		assert.NoError(t, <-done)
+		assert.Equal(t, int32(2), loads.Load())
+	})
+}
+
+func TestJWTClaimsValidation(t *testing.T) {
+	userID := "00000000-0000-0000-0000-000000000000"
+	hmacSecret := "test_jwt_secret"
+	issuer := "https://example.supabase.co/auth/v1"
+	policy := defaultJWTClaimsPolicy()
+	policy.Issuer = issuer
+	auth := newJWTAuthenticator(nil, hmacSecret, policy)
+
+	// validClaims はSupabaseがログインしたユーザーに発行するトークンと同じクレームを返します
+	validClaims := func() jwt.MapClaims {
+		now := time.Now()
+		return jwt.MapClaims{"iss": issuer, "sub": userID, "aud": "authenticated", "role": "authenticated", "email": "test@example.com", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	}
+
+	// request はクレームをHS256で署名したトークンを付けてリクエストし、ステータスコードとハンドラが受け取った利用者を返します
+	request := func(t *testing.T, claims jwt.MapClaims) (int, *Principal) {
+		t.Helper()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(hmacSecret))
+		assert.NoError(t, err)
+
+		var got *Principal
+		handler := auth.protect(requireAuth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = principalFromContext(r.Context())
+		}))
+		req := httptest.NewRequest("GET", "/api/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code, got
+	}
+
+	t.Run("正常系: 検証した利用者をコンテキストに設定する", func(t *testing.T) {
+		code, got := request(t, validClaims())
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, &Principal{UserID: userID, JWTRole: "authenticated", Email: "test@example.com"}, got)
+	})
+
+	t.Run("正常系: 許容する範囲の時刻のずれ", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = time.Now().Add(-10 * time.Second).Unix()
+		code, _ := request(t, claims)
+		assert.Equal(t, http.StatusOK, code)
+
+		claims = validClaims()
+		claims["aud"] = []string{"other", "authenticated"}
+		code, _ = request(t, claims)
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("異常系: 検証に失敗するクレーム", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			modify func(jwt.MapClaims)
+		}{
+			{"有効期限切れ", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+			{"有効期限が無い", func(c jwt.MapClaims) { delete(c, "exp") }},
+			{"未来に発行された", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Minute).Unix() }},
+			{"別の発行者", func(c jwt.MapClaims) { c["iss"] = "https://other.supabase.co/auth/v1" }},
+			{"別の対象者", func(c jwt.MapClaims) { c["aud"] = "anon" }},
+			{"対象者が無い", func(c jwt.MapClaims) { delete(c, "aud") }},
+			{"匿名キーのロール", func(c jwt.MapClaims) { c["role"] = "anon" }},
+			{"service_roleのロール", func(c jwt.MapClaims) { c["role"] = "service_role" }},
+			{"subがUUIDでない", func(c jwt.MapClaims) { c["sub"] = "not-a-uuid" }},
+			{"subが文字列でない", func(c jwt.MapClaims) { c["sub"] = 12345 }},
+			{"subが無い", func(c jwt.MapClaims) { delete(c, "sub") }},
+		}
+		for _, tt := range tests {
+			claims := validClaims()
+			tt.modify(claims)
+			code, got := request(t, claims)
+			assert.Equal(t, http.StatusUnauthorized, code, tt.name)
+			assert.Nil(t, got, tt.name)
+		}
+	})
+
+	t.Run("異常系: 未認証のリクエストはハンドラでパニックせず401を返す", func(t *testing.T) {
+		api := &Api{}
+		rr := httptest.NewRecorder()
+		api.createProfileHandler(rr, httptest.NewRequest("POST", "/api/profile", strings.NewReader(`{}`)))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+		rr = httptest.NewRecorder()
+		api.createBeanHandler(rr, httptest.NewRequest("POST", "/api/beans", strings.NewReader(`{}`)))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
+
+func TestRoutePolicy(t *testing.T) {
+	userID := "00000000-0000-0000-0000-000000000000"
+	hmacSecret := "test_jwt_secret"
+	auth := newJWTAuthenticator(nil, hmacSecret, defaultJWTClaimsPolicy())
+
+	now := time.Now()
+	validToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": userID, "aud": "authenticated", "role": "authenticated", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}).SignedString([]byte(hmacSecret))
+	assert.NoError(t, err)
+	expiredToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": userID, "aud": "authenticated", "role": "authenticated", "iat": now.Add(-2 * time.Hour).Unix(), "exp": now.Add(-time.Hour).Unix()}).SignedString([]byte(hmacSecret))
+	assert.NoError(t, err)
+
+	// request はルートの認証の要否に従ってリクエストし、レスポンスとハンドラが呼ばれたかどうかを返します
+	request := func(policy routePolicy, method string, token string) (*httptest.ResponseRecorder, bool) {
+		called := false
+		handler := auth.protect(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		req := httptest.NewRequest(method, "/api/beans", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr, called
+	}
+
+	t.Run("正常系: 認証が任意のメソッドはトークンが無くても受け付ける", func(t *testing.T) {
+		rr, called := request(browseBeans, "GET", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, called)
+	})
+
+	t.Run("異常系: 指定の無いメソッドは認証必須として扱う", func(t *testing.T) {
+		for _, method := range []string{"POST", "PUT", "DELETE"} {
+			rr, called := request(browseBeans, method, "")
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, method)
+			assert.False(t, called, method)
+			assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"), method)
+			assert.Equal(t, "Authentication required\n", rr.Body.String(), method)
+		}
+
+		rr, called := request(browseBeans, "POST", validToken)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, called)
+	})
+
+	t.Run("異常系: 認証が任意のルートでも無効なトークンは401", func(t *testing.T) {
+		rr, called := request(browseBeans, "GET", expiredToken)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.False(t, called)
+		assert.Equal(t, "Invalid token\n", rr.Body.String())
+	})
+
+	t.Run("正常系: 認証不要のルートはトークンを検証しない", func(t *testing.T) {
+		rr, called := request(publicRoute, "POST", expiredToken)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, called)
+	})
+
+	t.Run("異常系: 認証必須のルートはハンドラを呼ばずに401を返す", func(t *testing.T) {
+		for _, token := range []string{"", expiredToken, "not-a-jwt"} {
+			rr, called := request(requireAuth, "GET", token)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code)
+			assert.False(t, called)
+		}
+	})
+
+	t.Run("全てのルートの認証の要否", func(t *testing.T) {
+		// 認証必須でないメソッドを持つルートの、メソッドごとの認証の要否（ここに無いルート・メソッドは全て認証必須）
+		notRequired := map[string]map[string]authPolicy{
+			"/":                                  {"GET": authPublic, "POST": authPublic, "PUT": authPublic, "DELETE": authPublic},
+			"/api/beans":                         {"GET": authOptional},
+			"/api/beans/{id}":                    {"GET": authOptional},
+			"/api/beans/{id}/subscription-plans": {"GET": authOptional},
+			"POST /api/webhooks/stripe":          {"GET": authPublic, "POST": authPublic, "PUT": authPublic, "DELETE": authPublic},
+		}
+
+		routes := (&Api{}).routes()
+		patterns := map[string]bool{}
+		for _, rt := range routes {
+			assert.False(t, patterns[rt.pattern], "duplicate route %s", rt.pattern)
+			patterns[rt.pattern] = true
+			assert.NotNil(t, rt.handler, rt.pattern)
+			for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+				want, ok := notRequired[rt.pattern][method]
+				if !ok {
+					want = authRequired
+				}
+				assert.Equal(t, want, rt.policy.forMethod(method), "%s %s", method, rt.pattern)
+			}
+		}
+		for pattern := range notRequired {
+			assert.True(t, patterns[pattern], pattern)
+		}
+		// 管理者・出品者・購入者のAPIが登録されていて、認証必須であること
+		for _, pattern := range []string{"/api/admin/coupons", "/api/admin/orders/{id}/refunds", "/api/admin/users/{id}/roles/{role}", "/api/seller/coupons", "/api/checkout/payment-intent", "/api/profile"} {
+			assert.True(t, patterns[pattern], pattern)
+		}
+	})
+}
+
+func TestRolePermissions(t *testing.T) {
+	t.Run("ロールごとの権限", func(t *testing.T) {
+		buyer := &Principal{UserID: "buyer", Roles: []string{RoleBuyer, RoleSeller, RoleRoaster}}
+		moderator := &Principal{UserID: "moderator", Roles: []string{RoleModerator}}
+		admin := &Principal{UserID: "admin", Roles: []string{RoleBuyer, RoleAdmin}}
+
+		for _, permission := range []Permission{PermissionModerateBeans, PermissionManageOrders, PermissionManageRoles, PermissionViewAuditLogs} {
+			assert.False(t, buyer.Can(permission), permission)
+			assert.True(t, admin.Can(permission), permission)
+		}
+		assert.True(t, moderator.Can(PermissionModerateBeans))
+		assert.True(t, moderator.Can(PermissionViewAuditLogs))
+		assert.False(t, moderator.Can(PermissionManageOrders))
+		assert.False(t, moderator.Can(PermissionManageRoles))
+
+		assert.True(t, admin.HasRole(RoleBuyer))
+		assert.False(t, moderator.HasRole(RoleAdmin))
+
+		var anonymous *Principal
+		assert.False(t, anonymous.Can(PermissionModerateBeans))
+		assert.False(t, anonymous.HasRole(RoleBuyer))
+	})
+
+	t.Run("異常系: 権限の無い利用者は403、未認証は401", func(t *testing.T) {
+		api := &Api{}
+		for _, tt := range []struct {
+			principal *Principal
+			want      int
+		}{
+			{nil, http.StatusUnauthorized},
+			{&Principal{UserID: "00000000-0000-0000-0000-000000000000", Roles: []string{RoleSeller}}, http.StatusForbidden},
+			{&Principal{UserID: "00000000-0000-0000-0000-000000000000", Roles: []string{RoleModerator}}, http.StatusForbidden},
+		} {
+			req := httptest.NewRequest("POST", "/api/admin/orders/1/cancel", nil)
+			if tt.principal != nil {
+				req = req.WithContext(contextWithPrincipal(req.Context(), tt.principal))
+			}
+			rr := httptest.NewRecorder()
+			api.adminCancelOrderHandler(rr, req)
+			assert.Equal(t, tt.want, rr.Code)
+		}
+	})
+
+	t.Run("認証ミドルウェアはロールを取得せず、権限の確認が必要な場合だけ取得する", func(t *testing.T) {
+		userID := "00000000-0000-0000-0000-000000000000"
+		hmacSecret := "test_jwt_secret"
+		auth := newJWTAuthenticator(nil, hmacSecret, defaultJWTClaimsPolicy())
+
+		now := time.Now()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": userID, "aud": "authenticated", "role": "authenticated", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}).SignedString([]byte(hmacSecret))
+		assert.NoError(t, err)
+
+		var got *Principal
+		handler := auth.protect(requireAuth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = principalFromContext(r.Context())
+		}))
+		req := httptest.NewRequest("GET", "/api/cart", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		if assert.NotNil(t, got) {
+			assert.Equal(t, userID, got.UserID)
+			assert.Nil(t, got.Roles)
+		}
+
+		// 取得済みのロールはDBから取得し直さない
+		api := &Api{}
+		principal := &Principal{UserID: userID, Roles: []string{RoleModerator}}
+		assert.NoError(t, api.loadRoles(context.Background(), principal))
+		assert.Equal(t, []string{RoleModerator}, principal.Roles)
+	})
+}
+
+// TestBeanModeration は、モデレーターによる他のユーザーの豆の更新・削除と、監査ログの記録の統合テストです
+func TestBeanModeration(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store}
+	handler := http.HandlerFunc(api.beanDetailHandler)
+
+	ownerUserID := "00000000-0000-0000-0000-000000000000"
+	moderator := &Principal{UserID: "11111111-1111-1111-1111-111111111111", Roles: []string{RoleModerator}}
+	seller := &Principal{UserID: "11111111-1111-1111-1111-111111111111", Roles: []string{RoleSeller}}
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Suspicious Bean", Origin: "Unknown", Process: "washed", RoastProfile: "medium", UserID: ownerUserID})
+	if err != nil {
+		t.Fatalf("テストデータの作成に失敗しました: %v", err)
+	}
+
+	// request は利用者として豆の詳細APIにリクエストします
+	request := func(principal *Principal, method string, query string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, fmt.Sprintf("/api/beans/%d%s", bean.ID, query), strings.NewReader(body))
+		req.SetPathValue("id", strconv.Itoa(bean.ID))
+		req = req.WithContext(contextWithPrincipal(req.Context(), principal))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("異常系: ロールの無い出品者は他のユーザーの豆を削除できない", func(t *testing.T) {
+		rr := request(seller, "DELETE", "", "")
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("正常系: モデレーターは他のユーザーの豆を更新でき、監査ログに記録される", func(t *testing.T) {
+		rr := request(moderator, "PUT", "?reason=misleading+origin", `{"name": "Suspicious Bean", "origin": "Corrected", "process": "washed", "roast_profile": "medium"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var updated Bean
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &updated))
+		assert.Equal(t, "Corrected", updated.Origin)
+		assert.Equal(t, ownerUserID, updated.UserID)
+
+		logs, err := store.GetAuditLogs(ctx, "bean", strconv.Itoa(bean.ID), "", PageParams{})
+		assert.NoError(t, err)
+		if assert.Len(t, logs.Items, 1) {
+			assert.Equal(t, AuditActionBeanUpdate, logs.Items[0].Action)
+			assert.Equal(t, moderator.UserID, logs.Items[0].ActorID)
+			assert.Equal(t, []string{RoleModerator}, logs.Items[0].ActorRoles)
+			assert.Equal(t, ownerUserID, *logs.Items[0].TargetOwnerID)
+			assert.Equal(t, "misleading origin", logs.Items[0].Reason)
+			assert.Equal(t, "Corrected", logs.Items[0].Details["origin"])
+		}
+	})
+
+	t.Run("正常系: 所有者自身の更新は監査ログに記録しない", func(t *testing.T) {
+		rr := request(&Principal{UserID: ownerUserID}, "PUT", "", `{"name": "Suspicious Bean", "origin": "Owner Edit", "process": "washed", "roast_profile": "medium"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		logs, err := store.GetAuditLogs(ctx, "bean", strconv.Itoa(bean.ID), "", PageParams{})
+		assert.NoError(t, err)
+		assert.Len(t, logs.Items, 1)
+	})
+
+	t.Run("正常系: モデレーターは不正な出品を削除でき、削除した内容が監査ログに残る", func(t *testing.T) {
+		rr := request(moderator, "DELETE", "?reason=fraud", "")
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+
+		_, err := store.GetBeanByID(ctx, bean.ID)
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+		logs, err := store.GetAuditLogs(ctx, "bean", strconv.Itoa(bean.ID), moderator.UserID, PageParams{})
+		assert.NoError(t, err)
+		if assert.Len(t, logs.Items, 2) {
+			assert.Equal(t, AuditActionBeanDelete, logs.Items[0].Action)
+			assert.Equal(t, "fraud", logs.Items[0].Reason)
+			assert.Equal(t, "Owner Edit", logs.Items[0].Details["origin"])
+		}
+	})
+
+	t.Run("ロールの付与と削除", func(t *testing.T) {
+		changed, err := store.GrantUserRole(ctx, ownerUserID, RoleRoaster, moderator.UserID)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		changed, err = store.GrantUserRole(ctx, ownerUserID, RoleRoaster, moderator.UserID)
+		assert.NoError(t, err)
+		assert.False(t, changed)
+
+		roles, err := store.GetUserRoles(ctx, ownerUserID)
+		assert.NoError(t, err)
+		assert.Contains(t, roles, RoleRoaster)
+
+		changed, err = store.RevokeUserRole(ctx, ownerUserID, RoleRoaster)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+
+		_, err = store.GrantUserRole(ctx, "99999999-9999-9999-9999-999999999999", RoleSeller, moderator.UserID)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("出品したユーザーには出品者のロールが付与され、権限の確認時にDBから取得する", func(t *testing.T) {
+		owner := &Principal{UserID: ownerUserID}
+		assert.NoError(t, api.loadRoles(ctx, owner))
+		assert.True(t, owner.HasRole(RoleSeller))
+		assert.False(t, owner.Can(PermissionModerateBeans))
+
+		// ADMIN_USER_IDS に含まれるユーザーは、DBにロールが無くても管理者として扱う
+		adminAPI := &Api{store: store, adminUserIDs: parseAdminUserIDs(ownerUserID)}
+		owner = &Principal{UserID: ownerUserID}
+		assert.NoError(t, adminAPI.loadRoles(ctx, owner))
+		assert.True(t, owner.HasRole(RoleAdmin))
+		assert.True(t, owner.Can(PermissionManageOrders))
+	})
+}
+
+func TestListingModeration(t *testing.T) {
+	ctx := context.Background()
+	tx, err := testDbpool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+
+	store := NewStore(tx)
+	api := &Api{store: store, dbpool: tx}
+
+	sellerID := "00000000-0000-0000-0000-000000000000"
+	buyerID := "11111111-1111-1111-1111-111111111111"
+	moderator := &Principal{UserID: buyerID, Roles: []string{RoleModerator}}
+	admin := &Principal{UserID: buyerID, Roles: []string{RoleAdmin}}
+
+	bean, err := store.CreateBean(ctx, &Bean{Name: "Moderated Bean", Origin: "Kenya", Process: "washed", RoastProfile: "light", UserID: sellerID, Stock: 10})
+	if err != nil {
+		t.Fatalf("テストデータの作成に失敗しました: %v", err)
+	}
+
+	// listed は購入者向けの一覧に豆が含まれるかを返します
+	listed := func() bool {
+		page, err := store.SearchBeans(ctx, BeanFilter{Keyword: "Moderated Bean", Sort: BeanSortNewest}, PageParams{})
+		assert.NoError(t, err)
+		for _, b := range page.Items {
+			if b.ID == bean.ID {
+				return true
+			}
+		}
+		return false
+	}
+	// getBean は利用者として豆の詳細APIにリクエストします（principalがnilの場合は未ログイン）
+	getBean := func(principal *Principal) int {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/beans/%d", bean.ID), nil)
+		req.SetPathValue("id", strconv.Itoa(bean.ID))
+		if principal != nil {
+			req = req.WithContext(contextWithPrincipal(req.Context(), principal))
+		}
+		rr := httptest.NewRecorder()
+		api.getBeanHandler(rr, req)
+		return rr.Code
+	}
+
+	assert.True(t, listed())
+
+	t.Run("正常系: 非公開にした豆は購入者に表示されず、カートにも追加できない", func(t *testing.T) {
+		unpublished, err := store.SetBeanUnpublished(ctx, bean.ID, true, moderator.UserID, "counterfeit")
+		assert.NoError(t, err)
+		assert.NotNil(t, unpublished.UnpublishedAt)
+		assert.Equal(t, "counterfeit", unpublished.UnpublishedReason)
+		assert.False(t, unpublished.Listed())
+
+		assert.False(t, listed())
+		assert.Equal(t, http.StatusNotFound, getBean(nil))
+		assert.Equal(t, http.StatusOK, getBean(&Principal{UserID: sellerID}))
+		assert.Equal(t, http.StatusOK, getBean(moderator))
+
+		_, err = store.AddOrUpdateCartItem(ctx, buyerID, AddCartItemRequest{BeanID: bean.ID, Quantity: 1})
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+		ok, err := store.IsBeanListed(ctx, bean.ID)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("正常系: 管理者向けの一覧では非公開の豆を検索できる", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/admin/beans?q=Moderated+Bean&visibility=unpublished", nil)
+		req = req.WithContext(contextWithPrincipal(req.Context(), moderator))
+		rr := httptest.NewRecorder()
+		api.adminBeansHandler(rr, req)
+		if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+			return
+		}
+		var page BeanPage
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		if assert.Len(t, page.Items, 1) {
+			assert.Equal(t, bean.ID, page.Items[0].ID)
+			assert.Equal(t, "counterfeit", page.Items[0].UnpublishedReason)
+		}
+
+		// 購入者に表示されている豆だけに絞り込むと、非公開の豆は含まれない
+		req = httptest.NewRequest("GET", "/api/admin/beans?q=Moderated+Bean&visibility=listed", nil)
+		req = req.WithContext(contextWithPrincipal(req.Context(), moderator))
+		rr = httptest.NewRecorder()
+		api.adminBeansHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		page = BeanPage{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		assert.Empty(t, page.Items)
+
+		req = httptest.NewRequest("GET", "/api/admin/beans?visibility=hidden", nil)
+		req = req.WithContext(contextWithPrincipal(req.Context(), moderator))
+		rr = httptest.NewRecorder()
+		api.adminBeansHandler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+		req = httptest.NewRequest("GET", "/api/admin/beans", nil)
+		req = req.WithContext(contextWithPrincipal(req.Context(), &Principal{UserID: sellerID}))
+		rr = httptest.NewRecorder()
+		api.adminBeansHandler(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("正常系: 公開に戻した豆は再び表示される", func(t *testing.T) {
+		restored, err := store.SetBeanUnpublished(ctx, bean.ID, false, moderator.UserID, "")
+		assert.NoError(t, err)
+		assert.Nil(t, restored.UnpublishedAt)
+		assert.Empty(t, restored.UnpublishedReason)
+		assert.True(t, listed())
+		assert.Equal(t, http.StatusOK, getBean(nil))
+	})
+
+	t.Run("正常系: 停止した出品者の豆はすべて表示されず、停止を解除すると戻る", func(t *testing.T) {
+		changed, err := store.SuspendSeller(ctx, sellerID, admin.UserID, "fraud")
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		changed, err = store.SuspendSeller(ctx, sellerID, admin.UserID, "fraud")
+		assert.NoError(t, err)
+		assert.False(t, changed)
+
+		assert.False(t, listed())
+		assert.Equal(t, http.StatusNotFound, getBean(nil))
+		_, err = store.AddOrUpdateCartItem(ctx, buyerID, AddCartItemRequest{BeanID: bean.ID, Quantity: 1})
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+		// 出品者本人の一覧には停止中であることが表示される
+		own, err := store.GetBeansByUserID(ctx, sellerID, PageParams{})
+		assert.NoError(t, err)
+		for _, b := range own.Items {
+			assert.True(t, b.SellerSuspended)
+		}
+
+		changed, err = store.UnsuspendSeller(ctx, sellerID)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		assert.True(t, listed())
+
+		_, err = store.SuspendSeller(ctx, "99999999-9999-9999-9999-999999999999", admin.UserID, "fraud")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("正常系: カートに入れた後に非公開にされた豆は購入できない状態になる", func(t *testing.T) {
+		assert.NoError(t, store.ClearCart(ctx, buyerID))
+		item, err := store.AddOrUpdateCartItem(ctx, buyerID, AddCartItemRequest{BeanID: bean.ID, Quantity: 1})
+		assert.NoError(t, err)
+		_, err = store.SetBeanUnpublished(ctx, bean.ID, true, moderator.UserID, "counterfeit")
+		assert.NoError(t, err)
+
+		items, err := store.GetCartItemsByUserID(ctx, buyerID)
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.False(t, items[0].Available)
+		}
+
+		// 数量も変更できない（カートへの追加と同じくNot Found）
+		_, err = store.UpdateCartItemQuantity(ctx, item.ID, buyerID, 2)
+		assert.ErrorIs(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("異常系: モデレーターは出品者を停止できず、理由の無い停止は受け付けない", func(t *testing.T) {
+		request := func(principal *Principal, body string) int {
+			req := httptest.NewRequest("PUT", "/api/admin/sellers/"+sellerID+"/suspension", strings.NewReader(body))
+			req.SetPathValue("id", sellerID)
+			req = req.WithContext(contextWithPrincipal(req.Context(), principal))
+			rr := httptest.NewRecorder()
+			api.adminSellerSuspensionHandler(rr, req)
+			return rr.Code
+		}
+		assert.Equal(t, http.StatusForbidden, request(moderator, `{"reason": "fraud"}`))
+		assert.Equal(t, http.StatusBadRequest, request(admin, `{"reason": "  "}`))
+	})
+
+	t.Run("正常系: 非公開にした豆・停止した出品者の定期便はすぐに一時停止し、監査ログに記録する", func(t *testing.T) {
+		_, err := store.SetBeanUnpublished(ctx, bean.ID, false, moderator.UserID, "")
+		assert.NoError(t, err)
+		plan, err := store.CreateSubscriptionPlan(ctx, &SubscriptionPlan{BeanID: bean.ID, Quantity: 1, IntervalDays: 14}, sellerID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		sub, err := store.CreateSubscription(ctx, &Subscription{UserID: buyerID, Plan: *plan, StripePaymentMethodID: "pm_test_moderation", NextDeliveryDate: "2025-11-01"})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// status は定期便の現在の状態を返します
+		status := func() string {
+			subs, err := store.GetSubscriptionsByUserID(ctx, buyerID)
+			assert.NoError(t, err)
+			for _, s := range subs {
+				if s.ID == sub.ID {
+					return s.Status
+				}
+			}
+			return ""
+		}
+		// pauseLogs は定期便の一時停止の監査ログを返します
+		pauseLogs := func() []AuditLog {
+			logs, err := store.GetAuditLogs(ctx, "subscription", strconv.Itoa(sub.ID), "", PageParams{})
+			assert.NoError(t, err)
+			return logs.Items
+		}
+		// resume は購入者が定期便を再開した状態に戻します
+		resume := func() {
+			_, err := tx.Exec(ctx, "UPDATE subscriptions SET status = 'active', paused_at = NULL WHERE id = $1", sub.ID)
+			assert.NoError(t, err)
+		}
+		// request は利用者として管理者向けのAPIにリクエストします
+		request := func(handler http.HandlerFunc, principal *Principal, method string, target string, id string, body string) int {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			req.SetPathValue("id", id)
+			req = req.WithContext(contextWithPrincipal(req.Context(), principal))
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			return rr.Code
+		}
+
+		unpublishURL := fmt.Sprintf("/api/admin/beans/%d/unpublish", bean.ID)
+		assert.Equal(t, http.StatusOK, request(api.adminBeanVisibilityHandler(true), moderator, "POST", unpublishURL, strconv.Itoa(bean.ID), `{"reason": "mislabeled"}`))
+		assert.Equal(t, SubscriptionStatusPaused, status())
+		if logs := pauseLogs(); assert.Len(t, logs, 1) {
+			assert.Equal(t, AuditActionSubscriptionPause, logs[0].Action)
+			assert.Equal(t, moderator.UserID, logs[0].ActorID)
+			assert.Equal(t, buyerID, *logs[0].TargetOwnerID)
+			assert.Equal(t, "mislabeled", logs[0].Reason)
+			assert.Equal(t, AuditActionBeanUnpublish, logs[0].Details["cause"])
+		}
+
+		// 公開に戻しても、定期便は自動では再開しない
+		restoreURL := fmt.Sprintf("/api/admin/beans/%d/restore", bean.ID)
+		assert.Equal(t, http.StatusOK, request(api.adminBeanVisibilityHandler(false), moderator, "POST", restoreURL, strconv.Itoa(bean.ID), ""))
+		assert.Equal(t, SubscriptionStatusPaused, status())
+
+		resume()
+		suspensionURL := "/api/admin/sellers/" + sellerID + "/suspension"
+		assert.Equal(t, http.StatusOK, request(api.adminSellerSuspensionHandler, admin, "PUT", suspensionURL, sellerID, `{"reason": "fraud"}`))
+		assert.Equal(t, SubscriptionStatusPaused, status())
+		if logs := pauseLogs(); assert.Len(t, logs, 2) {
+			assert.Equal(t, admin.UserID, logs[0].ActorID)
+			assert.Equal(t, AuditActionSellerSuspend, logs[0].Details["cause"])
+		}
+
+		// 停止を解除しても、定期便は自動では再開しない
+		assert.Equal(t, http.StatusOK, request(api.adminSellerSuspensionHandler, admin, "DELETE", suspensionURL, sellerID, ""))
+		assert.Equal(t, SubscriptionStatusPaused, status())
+		assert.Len(t, pauseLogs(), 2)
+	})
 }
 
 func TestProfileAPI(t *testing.T) {
@@ -327,7 +3466,7 @@ func TestProfileAPI(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/profile", strings.NewReader(profileData))
 		req.Header.Set("Content-Type", "application/json")
 
-		ctxWithUser := context.WithValue(req.Context(), userIDKey, dummyUserID)
+		ctxWithUser := contextWithPrincipal(req.Context(), &Principal{UserID: dummyUserID})
 		req = req.WithContext(ctxWithUser)
 
 		rr := httptest.NewRecorder()
@@ -361,7 +3500,7 @@ func TestProfileAPI(t *testing.T) {
 		updateData := `{"display_name": "Updated User", "icon_url": "updated.png", "post_code": "222-2222", "address": "Updated Address", "about_me": "Updated."}`
 		putReq := httptest.NewRequest("PUT", "/api/profile", strings.NewReader(updateData))
 		putReq.Header.Set("Content-Type", "application/json")
-		ctxWithUser := context.WithValue(putReq.Context(), userIDKey, dummyUserID)
+		ctxWithUser := contextWithPrincipal(putReq.Context(), &Principal{UserID: dummyUserID})
 		putReq = putReq.WithContext(ctxWithUser)
 
 		putRR := httptest.NewRecorder()
@@ -395,7 +3534,7 @@ func TestProfileAPI(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/profile", strings.NewReader(duplicateProfileData))
 		req.Header.Set("Content-Type", "application/json")
 
-		ctxWithUser := context.WithValue(req.Context(), userIDKey, dummyUserID)
+		ctxWithUser := contextWithPrincipal(req.Context(), &Principal{UserID: dummyUserID})
 		req = req.WithContext(ctxWithUser)
 
 		rr := httptest.NewRecorder()
@@ -0,0 +1,287 @@
+// backend/jwks.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksCacheTTL は取得したJWKSを使い回す期間です
+const jwksCacheTTL = 10 * time.Minute
+
+// jwksMinRefreshInterval は未知のkidのトークンが届いた場合に、JWKSを取得し直す最短の間隔です
+// 不正なkidのトークンを大量に送られても、JWKSのエンドポイントに負荷をかけないようにします
+const jwksMinRefreshInterval = 30 * time.Second
+
+// ErrUnknownSigningKey はトークンのkidに対応する公開鍵がJWKSに無い場合に返されます
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// jwksKeySet はJWKS（JSON Web Key Set）の公開鍵をkidごとにキャッシュします
+// キャッシュの期限が切れた場合や、未知のkidのトークンが届いた場合（鍵のローテーション）は、JWKSを取得し直します
+type jwksKeySet struct {
+	// source はログ出力用の取得元（URLまたはファイルのパス）です
+	source string
+	load   func(ctx context.Context) ([]byte, error)
+
+	ttl                time.Duration
+	minRefreshInterval time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// fetching は取得中のJWKSです（取得中でなければnil）
+	fetching *jwksFetch
+}
+
+// jwksFetch は取得中のJWKSの結果を、同時に取得し直そうとした他のリクエストに伝えます
+// doneが閉じられた後は、errで取得の結果を参照できます
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// newJWKSKeySetFromURL はJWKSのエンドポイントから公開鍵を取得するjwksKeySetを作成します
+func newJWKSKeySetFromURL(url string) *jwksKeySet {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return newJWKSKeySet(url, func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	})
+}
+
+// newJWKSKeySetFromFile はローカルのファイルから公開鍵を読み込むjwksKeySetを作成します（テストやネットワークの無い環境向け）
+func newJWKSKeySetFromFile(path string) *jwksKeySet {
+	return newJWKSKeySet(path, func(ctx context.Context) ([]byte, error) {
+		return os.ReadFile(path)
+	})
+}
+
+func newJWKSKeySet(source string, load func(ctx context.Context) ([]byte, error)) *jwksKeySet {
+	return &jwksKeySet{
+		source:             source,
+		load:               load,
+		ttl:                jwksCacheTTL,
+		minRefreshInterval: jwksMinRefreshInterval,
+		keys:               map[string]crypto.PublicKey{},
+	}
+}
+
+// newJWKSKeySetFromEnv は環境変数の設定からjwksKeySetを作成します
+// SUPABASE_JWKS_FILE、SUPABASE_JWKS_URL、SUPABASE_URL（/auth/v1/.well-known/jwks.json）の順に取得元を決め、
+// どれも設定されていない場合はnilを返します
+func newJWKSKeySetFromEnv() *jwksKeySet {
+	if path := os.Getenv("SUPABASE_JWKS_FILE"); path != "" {
+		return newJWKSKeySetFromFile(path)
+	}
+	if url := os.Getenv("SUPABASE_JWKS_URL"); url != "" {
+		return newJWKSKeySetFromURL(url)
+	}
+	if url := os.Getenv("SUPABASE_URL"); url != "" {
+		return newJWKSKeySetFromURL(strings.TrimRight(url, "/") + "/auth/v1/.well-known/jwks.json")
+	}
+	return nil
+}
+
+// Key はkidに対応する公開鍵を返します
+// キャッシュの期限が切れている場合や、kidがキャッシュに無い場合はJWKSを取得し直します
+// 他のリクエストが取得中の場合は、キャッシュ済みの公開鍵があればそれを使い、無ければ取得の完了を待ちます
+// 取得に失敗した場合は、期限切れでもキャッシュ済みの公開鍵を使います
+func (s *jwksKeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	now := time.Now()
+	key, ok := s.keys[kid]
+	expired := now.Sub(s.fetchedAt) >= s.ttl
+	fetching := s.fetching != nil
+	due := (!ok || expired) && now.Sub(s.attemptedAt) >= s.minRefreshInterval
+	s.mu.Unlock()
+
+	if ok && fetching {
+		return key, nil
+	}
+	if fetching || due {
+		if err := s.refresh(ctx); err != nil {
+			log.Printf("WARN: Failed to refresh JWKS from %s: %v", s.source, err)
+		}
+		s.mu.Lock()
+		key, ok = s.keys[kid]
+		s.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownSigningKey, kid)
+	}
+	return key, nil
+}
+
+// Refresh はJWKSを取得し直します
+func (s *jwksKeySet) Refresh(ctx context.Context) error {
+	return s.refresh(ctx)
+}
+
+// refresh はJWKSを取得してキャッシュを置き換えます
+// 取得中に他のリクエストを待たせないよう、取得はロックを外して行います
+// 他のリクエストが既に取得中の場合は、新たに取得せずにその結果を待ちます
+func (s *jwksKeySet) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	if f := s.fetching; f != nil {
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	now := time.Now()
+	f := &jwksFetch{done: make(chan struct{})}
+	s.fetching = f
+	s.attemptedAt = now
+	s.mu.Unlock()
+
+	keys, err := s.fetch(ctx)
+
+	s.mu.Lock()
+	if err == nil {
+		s.keys = keys
+		s.fetchedAt = now
+	}
+	s.fetching = nil
+	f.err = err
+	close(f.done)
+	s.mu.Unlock()
+	return err
+}
+
+// fetch はJWKSを取得して、kidごとの公開鍵に変換します
+func (s *jwksKeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	data, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// jsonWebKey はJWKSに含まれる1つの鍵です（RSAとECの公開鍵のみ扱います）
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSAの公開鍵
+	N string `json:"n"`
+	E string `json:"e"`
+	// ECの公開鍵
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS はJWKSをkidごとの公開鍵に変換します
+// 署名用でない鍵や、扱えない種類・曲線の鍵は無視します（他の鍵で署名されたトークンは検証できるようにします）
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kid == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey はJWKを公開鍵に変換します（扱えない種類・曲線の鍵の場合はnilを返します）
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > int64(^uint32(0)>>1) {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// decodeJWKInt はJWKの整数（Base64URLでエンコードされたビッグエンディアンのバイト列）を変換します
+func decodeJWKInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -7,6 +7,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -16,8 +21,17 @@ import (
 
 // Api はStore（DB接続）とDB接続プールを保持する、私たちのアプリケーションの本体です
 type Api struct {
-	store  *Store
-	dbpool *pgxpool.Pool
+	store *Store
+	// dbpool はトランザクションを開始するDB接続です（通常はDB接続プール）
+	dbpool TxBeginner
+	// reservationTTL は決済中の在庫確保の有効期限です（0の場合は既定値を使う）
+	reservationTTL time.Duration
+	// platformFeeBasisPoints は出品者ごとの上書きが無い場合のプラットフォーム手数料率です（ベーシスポイント）
+	platformFeeBasisPoints int
+	// adminUserIDs はDBのロールに関わらず管理者（admin）として扱うユーザーIDです
+	adminUserIDs map[string]bool
+	// payments は決済代行サービスです（未設定の場合は環境変数の設定でStripeを使う）
+	payments PaymentProvider
 }
 
 func main() {
@@ -50,65 +64,113 @@ func main() {
 
 	log.Println("Successfully initialized Supabase client!") // 接続準備ができたことをログに出力
 
-	store := NewStore(dbpool)
-	api := &Api{store: store, dbpool: dbpool}
+	// 在庫確保の有効期限を環境変数から取得（例: "30m"）
+	reservationTTL := defaultReservationTTL
+	if v := os.Getenv("STOCK_RESERVATION_TTL"); v != "" {
+		reservationTTL, err = time.ParseDuration(v)
+		if err != nil || reservationTTL <= 0 {
+			log.Fatalf("環境変数 STOCK_RESERVATION_TTL の値が不正です: %s", v)
+		}
+	}
 
-	// ルーティング設定
-	// 1. 各URLで何をするかのハンドラを定義する
+	// プラットフォーム手数料率を環境変数から取得（ベーシスポイント。例: "500" = 5%）
+	platformFeeBasisPoints := defaultPlatformFeeBasisPoints
+	if v := os.Getenv("PLATFORM_FEE_BASIS_POINTS"); v != "" {
+		platformFeeBasisPoints, err = parseFeeBasisPoints(v)
+		if err != nil {
+			log.Fatalf("環境変数 PLATFORM_FEE_BASIS_POINTS の値が不正です: %s", v)
+		}
+	}
 
-	// "/" へのリクエスト担当
-	healthCheckHandler := http.HandlerFunc(api.healthCheckHandler)
+	// DBのロールに関わらず管理者として扱うユーザーIDを環境変数から取得（カンマ区切り）
+	// 最初の管理者にロールを付与するために使う
+	adminUserIDs := parseAdminUserIDs(os.Getenv("ADMIN_USER_IDS"))
 
-	// "/api/beans" へのリクエスト担当 (GETとPOSTを振り分ける)
-	beansHandler := http.HandlerFunc(api.beansHandler)
+	// JWTの検証に使う鍵を環境変数から設定する
+	// 非対称鍵（RS256/ES256）のトークンはJWKSの公開鍵で、HS256のトークンは SUPABASE_JWT_SECRET で検証する
+	jwks := newJWKSKeySetFromEnv()
+	jwtSecret := os.Getenv("SUPABASE_JWT_SECRET")
+	if jwks == nil && jwtSecret == "" {
+		log.Fatal("環境変数 SUPABASE_URL、SUPABASE_JWKS_URL、SUPABASE_JWKS_FILE、SUPABASE_JWT_SECRET のいずれかを設定してください")
+	}
+	if jwks != nil {
+		// 起動時に一度取得しておく（失敗した場合は、最初のリクエストで取得し直す）
+		if err := jwks.Refresh(context.Background()); err != nil {
+			log.Printf("Warning: JWKSの取得に失敗しました（%s）: %v", jwks.source, err)
+		}
+	}
 
-	// "/api/beans/{id}" へのリクエスト担当 (GET, PUT, DELETEなどを振り分ける)
-	beanDetailHandler := http.HandlerFunc(api.beanDetailHandler)
+	// トークンのクレームの検証方法を環境変数から設定する
+	// 発行者（iss）は SUPABASE_JWT_ISSUER（省略時は {SUPABASE_URL}/auth/v1。どちらも無ければ検証しない）、
+	// 対象者（aud）は SUPABASE_JWT_AUDIENCE、受け付けるロールは SUPABASE_JWT_ROLES（カンマ区切り）で変更できる
+	claimsPolicy := defaultJWTClaimsPolicy()
+	claimsPolicy.Issuer = os.Getenv("SUPABASE_JWT_ISSUER")
+	if supabaseURL := os.Getenv("SUPABASE_URL"); claimsPolicy.Issuer == "" && supabaseURL != "" {
+		claimsPolicy.Issuer = strings.TrimRight(supabaseURL, "/") + "/auth/v1"
+	}
+	if v := os.Getenv("SUPABASE_JWT_AUDIENCE"); v != "" {
+		claimsPolicy.Audience = v
+	}
+	if v := os.Getenv("SUPABASE_JWT_ROLES"); v != "" {
+		claimsPolicy.Roles = strings.Split(strings.ReplaceAll(v, " ", ""), ",")
+	}
+	// 有効期限などの検証で許容する時刻のずれ（例: "30s"）
+	if v := os.Getenv("JWT_CLOCK_SKEW"); v != "" {
+		claimsPolicy.ClockSkew, err = time.ParseDuration(v)
+		if err != nil || claimsPolicy.ClockSkew < 0 {
+			log.Fatalf("環境変数 JWT_CLOCK_SKEW の値が不正です: %s", v)
+		}
+	}
+	auth := newJWTAuthenticator(jwks, jwtSecret, claimsPolicy)
 
-	// "/api/my/beans" へのリクエスト担当
-	myBeansHandler := http.HandlerFunc(api.getMyBeansHandler)
+	// 決済代行サービス（Stripe）のクライアントを作成
+	payments := newStripePaymentProviderFromEnv()
 
-	// "/api/cart/items" へのリクエスト担当
-	addCartItemHandler := http.HandlerFunc(api.addCartItemHandler)
+	store := NewStore(dbpool)
+	api := &Api{store: store, dbpool: dbpool, reservationTTL: reservationTTL, platformFeeBasisPoints: platformFeeBasisPoints, adminUserIDs: adminUserIDs, payments: payments}
 
-	// "/api/cart" へのリクエスト担当
-	getCartHandler := http.HandlerFunc(api.getCartHandler)
+	// 終了シグナル（Ctrl+C、SIGTERM）を受け取るとキャンセルされるcontext
+	// バックグラウンドの処理はこのcontextで止め、DB接続を閉じる前に終了を待つ
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
+	defer workers.Wait()
 
-	// "/api/cart/items/{id}" へのリクエスト担当 (PUT, DELETEなどを振り分ける)
-	cartItemDetailHandler := http.HandlerFunc(api.cartItemDetailHandler)
+	// 期限切れの在庫確保を定期的に解放する
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.runReservationSweeper(ctx, reservationSweepInterval)
+	}()
 
-	// "/api/checkout/payment-intent" へのリクエスト担当
-	paymentIntentHandler := http.HandlerFunc(api.createPaymentIntentHandler)
+	// 支払いの完了のWebhookで記録した出品者への入金を定期的に送信する（送信に失敗した入金の再送も行う）
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.runPayoutSender(ctx, payoutTransferInterval)
+	}()
 
-	// "POST /api/webhooks/stripe" へのリクエスト担当
-	stripeWebhookHandler := http.HandlerFunc(api.handleStripeWebhook)
+	// Stripeに送信できなかった返金を定期的に再送する
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.runRefundSender(ctx, refundSendInterval)
+	}()
 
-	// "/api/profile" へのリクエスト担当
-	profileHandler := http.HandlerFunc(api.profileHandler)
+	// 請求する時期が来た定期便を定期的に請求する
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		api.runSubscriptionBiller(ctx, subscriptionBillingInterval)
+	}()
 
-	// 2. URLとハンドラを結びつける
+	// ルーティング設定
+	// 各APIをルートごとの認証の要否に従ってミドルウェアで保護する
+	// requireAuth のルートに未認証のリクエストが届いた場合は、ハンドラを呼び出さずに401を返す
 	mux := http.NewServeMux()
-	mux.Handle("/", healthCheckHandler)
-
-	// 各APIをミドルウェアで保護する
-	// コーヒー豆関連API
-	mux.Handle("/api/beans", jwtAuthMiddleware(beansHandler))
-	mux.Handle("/api/beans/{id}", jwtAuthMiddleware(beanDetailHandler))
-	mux.Handle("/api/my/beans", jwtAuthMiddleware(myBeansHandler))
-
-	// カート関連API
-	mux.Handle("/api/cart/items", jwtAuthMiddleware(addCartItemHandler))
-	mux.Handle("/api/cart/items/{id}", jwtAuthMiddleware(cartItemDetailHandler))
-	mux.Handle("/api/cart", jwtAuthMiddleware(getCartHandler))
-
-	// プロフィール関連API
-	mux.Handle("/api/profile", jwtAuthMiddleware(profileHandler))
-
-	// 決済関連API
-	mux.Handle("/api/checkout/payment-intent", jwtAuthMiddleware(paymentIntentHandler))
-
-	// Stripe Webhook（認証不要）
-	mux.Handle("POST /api/webhooks/stripe", stripeWebhookHandler)
+	for _, rt := range api.routes() {
+		mux.Handle(rt.pattern, auth.protect(rt.policy, rt.handler))
+	}
 
 	// CORS設定
 	handler := cors.New(cors.Options{
@@ -117,6 +179,112 @@ func main() {
 		AllowedHeaders: []string{"Content-Type", "Authorization"},
 	}).Handler(mux)
 
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		// 終了シグナルを受け取ったら、処理中のリクエストを待ってからサーバーを止める
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("ERROR: Failed to shut down server: %v", err)
+		}
+	}()
+
 	fmt.Println("Backend server is running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Println("Backend server stopped")
+}
+
+// route はURLのパターンと、そのハンドラ・認証の要否です
+type route struct {
+	pattern string
+	policy  routePolicy
+	handler http.Handler
+}
+
+// browseBeans はコーヒー豆の一覧・詳細の閲覧（GET）だけをログインしていなくてもできるルートの設定です
+var browseBeans = routePolicy{http.MethodGet: authOptional}
+
+// routes はAPIのURLと、ハンドラ・認証の要否の一覧を返します
+func (a *Api) routes() []route {
+	return []route{
+		// ヘルスチェック
+		{"/", publicRoute, http.HandlerFunc(a.healthCheckHandler)},
+
+		// コーヒー豆関連API（一覧・詳細の閲覧はログインしていなくてもできる）
+		{"/api/beans", browseBeans, http.HandlerFunc(a.beansHandler)},
+		{"/api/beans/{id}", browseBeans, http.HandlerFunc(a.beanDetailHandler)},
+		{"/api/beans/{id}/subscription-plans", browseBeans, http.HandlerFunc(a.beanSubscriptionPlansHandler)},
+		{"/api/my/beans", requireAuth, http.HandlerFunc(a.getMyBeansHandler)},
+
+		// カート関連API
+		{"/api/cart/items", requireAuth, http.HandlerFunc(a.addCartItemHandler)},
+		{"/api/cart/items/{id}", requireAuth, http.HandlerFunc(a.cartItemDetailHandler)},
+		{"/api/cart", requireAuth, http.HandlerFunc(a.getCartHandler)},
+
+		// 注文履歴関連API
+		{"/api/orders", requireAuth, http.HandlerFunc(a.getOrdersHandler)},
+		{"/api/orders/{id}", requireAuth, http.HandlerFunc(a.getOrderHandler)},
+		{"/api/orders/{id}/cancellation", requireAuth, http.HandlerFunc(a.createCancellationRequestHandler)},
+
+		// 出品者の受注・発送関連API
+		{"/api/seller/orders", requireAuth, http.HandlerFunc(a.getSellerOrdersHandler)},
+		{"/api/seller/orders/{id}/fulfillment", requireAuth, http.HandlerFunc(a.updateFulfillmentHandler)},
+		{"/api/seller/orders/{id}/cancellation", requireAuth, http.HandlerFunc(a.resolveCancellationRequestHandler)},
+		{"/api/seller/orders/{id}/refunds", requireAuth, http.HandlerFunc(a.createSellerRefundHandler)},
+
+		// 管理者の出品・出品者の管理API
+		{"/api/admin/beans", requireAuth, http.HandlerFunc(a.adminBeansHandler)},
+		{"/api/admin/beans/{id}/unpublish", requireAuth, a.adminBeanVisibilityHandler(true)},
+		{"/api/admin/beans/{id}/restore", requireAuth, a.adminBeanVisibilityHandler(false)},
+		{"/api/admin/sellers/{id}/suspension", requireAuth, http.HandlerFunc(a.adminSellerSuspensionHandler)},
+
+		// 管理者の注文の確認・キャンセル・返金API
+		{"/api/admin/orders/{id}", requireAuth, http.HandlerFunc(a.adminOrderDetailHandler)},
+		{"/api/admin/orders/{id}/cancel", requireAuth, http.HandlerFunc(a.adminCancelOrderHandler)},
+		{"/api/admin/orders/{id}/refunds", requireAuth, http.HandlerFunc(a.createAdminRefundHandler)},
+
+		// 管理者のロール管理・監査ログAPI
+		{"/api/admin/users/{id}/roles", requireAuth, http.HandlerFunc(a.userRolesHandler)},
+		{"/api/admin/users/{id}/roles/{role}", requireAuth, http.HandlerFunc(a.userRoleHandler)},
+		{"/api/admin/audit-logs", requireAuth, http.HandlerFunc(a.auditLogsHandler)},
+
+		// 管理者のクーポン発行API
+		{"/api/admin/coupons", requireAuth, http.HandlerFunc(a.createAdminCouponHandler)},
+
+		// 出品者のStripe Connect登録関連API
+		{"/api/seller/stripe-account", requireAuth, http.HandlerFunc(a.sellerStripeAccountHandler)},
+		{"/api/seller/stripe-account/onboarding-link", requireAuth, http.HandlerFunc(a.createOnboardingLinkHandler)},
+
+		// 出品者の送料設定API
+		{"/api/seller/shipping", requireAuth, http.HandlerFunc(a.sellerShippingHandler)},
+
+		// 出品者のクーポン発行API
+		{"/api/seller/coupons", requireAuth, http.HandlerFunc(a.sellerCouponsHandler)},
+		{"/api/seller/coupons/{id}", requireAuth, http.HandlerFunc(a.deactivateSellerCouponHandler)},
+
+		// 定期便関連API
+		{"/api/seller/subscription-plans", requireAuth, http.HandlerFunc(a.sellerSubscriptionPlansHandler)},
+		{"/api/seller/subscription-plans/{id}", requireAuth, http.HandlerFunc(a.deactivateSubscriptionPlanHandler)},
+		{"/api/seller/subscriptions/upcoming", requireAuth, http.HandlerFunc(a.getUpcomingDeliveriesHandler)},
+		{"/api/subscriptions", requireAuth, http.HandlerFunc(a.subscriptionsHandler)},
+		{"/api/subscriptions/{id}", requireAuth, http.HandlerFunc(a.updateSubscriptionHandler)},
+
+		// プロフィール関連API
+		{"/api/profile", requireAuth, http.HandlerFunc(a.profileHandler)},
+
+		// 決済関連API
+		{"/api/checkout/payment-intent", requireAuth, http.HandlerFunc(a.createPaymentIntentHandler)},
+		{"/api/payment-methods", requireAuth, http.HandlerFunc(a.paymentMethodsHandler)},
+		{"/api/payment-methods/{id}", requireAuth, http.HandlerFunc(a.detachPaymentMethodHandler)},
+		{"/api/payment-methods/setup-intent", requireAuth, http.HandlerFunc(a.createSetupIntentHandler)},
+
+		// Stripe Webhook（認証不要、署名はハンドラで検証する）
+		{"POST /api/webhooks/stripe", publicRoute, http.HandlerFunc(a.handleStripeWebhook)},
+	}
 }
@@ -4,9 +4,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -15,54 +16,272 @@ import (
 // stringの衝突を避けるために独自の型を定義します。
 type contextKey string
 
-const userIDKey contextKey = "userID"
+const principalKey contextKey = "principal"
 
-// jwtAuthMiddleware は、JWTを検証するミドルウェアです
-func jwtAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// リクエストヘッダーから "Authorization" を取得
-		authHeader := r.Header.Get("Authorization")
+// Principal 構造体は、認証ミドルウェアが検証したトークンの利用者を保持します
+type Principal struct {
+	// UserID はトークンのsub（Supabaseのユーザーの、UUID形式のID）です
+	UserID string
+	// JWTRole はトークンのroleクレーム（Supabaseの"authenticated"など）です
+	// アプリケーションのロール（Roles）とは別物で、権限の確認には使いません
+	JWTRole string
+	Email   string
+	// Roles はユーザーに付与されたロール（buyer・seller・roaster・moderator・admin）です
+	// 認証ミドルウェアは設定せず、権限の確認が必要なハンドラがloadRolesでDBから取得します（nilの場合は未取得）
+	Roles []string
+}
+
+// contextWithPrincipal は、認証済みの利用者を設定したコンテキストを返します
+func contextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// principalFromContext は、認証ミドルウェアが設定した利用者を返します（未認証の場合はfalse）
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// mustPrincipal は、認証が必要なハンドラで認証ミドルウェアが設定した利用者を返します
+// 利用者が無い場合は401を書き込み、falseを返します（認証必須のルートではミドルウェアが先に401を返します）
+func mustPrincipal(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok || strings.TrimSpace(principal.UserID) == "" {
+		writeUnauthorized(w, false)
+		return nil, false
+	}
+	return principal, true
+}
+
+// defaultJWTAudience はSupabaseがログインしたユーザーのトークンに設定するaud・roleの値です
+const defaultJWTAudience = "authenticated"
+
+// defaultJWTClockSkew はトークンの有効期限などの検証で、サーバー間の時刻のずれとして許容する時間の既定値です
+const defaultJWTClockSkew = 30 * time.Second
+
+// jwtClaimsPolicy は、署名を検証したトークンのクレームの検証方法を保持します
+type jwtClaimsPolicy struct {
+	// Issuer はissの期待値です（空の場合は検証しない）
+	Issuer string
+	// Audience はaudに含まれている必要がある値です（空の場合は検証しない）
+	Audience string
+	// Roles はroleとして受け付ける値です（空の場合は検証しない）
+	Roles []string
+	// ClockSkew はexp・nbf・iatの検証で許容する時刻のずれです
+	ClockSkew time.Duration
+}
+
+// defaultJWTClaimsPolicy は、Supabaseでログインしたユーザーのトークンだけを受け付ける検証方法を返します
+func defaultJWTClaimsPolicy() jwtClaimsPolicy {
+	return jwtClaimsPolicy{
+		Audience:  defaultJWTAudience,
+		Roles:     []string{defaultJWTAudience},
+		ClockSkew: defaultJWTClockSkew,
+	}
+}
+
+// parserOptions は、登録済みのクレーム（exp・nbf・iat・iss・aud）の検証方法を返します
+// 有効期限の無いトークンは受け付けません
+func (p jwtClaimsPolicy) parserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired(), jwt.WithIssuedAt(), jwt.WithLeeway(p.ClockSkew)}
+	if p.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(p.Issuer))
+	}
+	if p.Audience != "" {
+		opts = append(opts, jwt.WithAudience(p.Audience))
+	}
+	return opts
+}
+
+// supabaseClaims は、Supabaseが発行するトークンのクレームです
+type supabaseClaims struct {
+	jwt.RegisteredClaims
+	Role  string `json:"role"`
+	Email string `json:"email"`
+}
+
+// principalOf は、登録済みのクレームを検証したトークンのsubとroleを検証し、利用者を返します
+func (p jwtClaimsPolicy) principalOf(claims *supabaseClaims) (*Principal, error) {
+	if !uuidPattern.MatchString(claims.Subject) {
+		return nil, fmt.Errorf("sub %q is not a user ID", claims.Subject)
+	}
+	if len(p.Roles) > 0 && !containsString(p.Roles, claims.Role) {
+		return nil, fmt.Errorf("role %q is not allowed", claims.Role)
+	}
+	return &Principal{UserID: strings.ToLower(claims.Subject), JWTRole: claims.Role, Email: claims.Email}, nil
+}
+
+// jwtVerifier は、Supabaseが発行したJWTの署名を検証するための鍵を保持します
+// 非対称鍵（RS256/ES256）のトークンはJWKSの公開鍵で検証し、HS256のトークンは共有シークレットで検証します
+type jwtVerifier struct {
+	// keys はJWKSの公開鍵です（nilの場合は非対称鍵のトークンを受け付けない）
+	keys *jwksKeySet
+	// hmacSecret はHS256のトークンを検証する共有シークレットです（空の場合はHS256のトークンを受け付けない）
+	hmacSecret []byte
+}
+
+// keyFunc はトークンの署名方式に応じて、署名を検証する鍵を返します
+func (v *jwtVerifier) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+			if v.keys == nil {
+				return nil, fmt.Errorf("asymmetric signing method %v is not configured", token.Header["alg"])
+			}
+			// 鍵のローテーション中は複数の鍵が公開されているので、kidで検証に使う鍵を選ぶ
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				return nil, fmt.Errorf("token has no kid")
+			}
+			return v.keys.Key(ctx, kid)
+		case *jwt.SigningMethodHMAC:
+			if len(v.hmacSecret) == 0 {
+				return nil, fmt.Errorf("HMAC signing method is not configured")
+			}
+			return v.hmacSecret, nil
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+	}
+}
 
-		// ヘッダーが空、またはBearer形式でなければ、
-		// 何もせず、そのまま次のハンドラを呼び出す
-		if authHeader == "" {
+// authPolicy はルートの認証の要否です
+type authPolicy int
+
+const (
+	// authRequired は認証済みのリクエストだけを受け付けます（トークンが無い、または無効な場合は401）
+	authRequired authPolicy = iota
+	// authOptional はトークンがあれば検証し、無ければ未認証のまま受け付けます（無効なトークンは401）
+	authOptional
+	// authPublic はトークンを検証せずに受け付けます
+	authPublic
+)
+
+// anyMethod はroutePolicyで、個別に指定していない全てのHTTPメソッドを表すキーです
+const anyMethod = "*"
+
+// routePolicy はルートのHTTPメソッドごとの認証の要否です
+// メソッドもanyMethodも指定されていない場合は、認証必須として扱います
+type routePolicy map[string]authPolicy
+
+// 全てのメソッドで同じ認証の要否を使うルートの設定
+var (
+	requireAuth = routePolicy{anyMethod: authRequired}
+	publicRoute = routePolicy{anyMethod: authPublic}
+)
+
+// forMethod はHTTPメソッドの認証の要否を返します
+func (p routePolicy) forMethod(method string) authPolicy {
+	if policy, ok := p[method]; ok {
+		return policy
+	}
+	if policy, ok := p[anyMethod]; ok {
+		return policy
+	}
+	return authRequired
+}
+
+// jwtAuthenticator は、JWTの署名とクレームを検証し、利用者をコンテキストに設定します
+type jwtAuthenticator struct {
+	verifier      *jwtVerifier
+	policy        jwtClaimsPolicy
+	parserOptions []jwt.ParserOption
+}
+
+// newJWTAuthenticator はjwtAuthenticatorを作成します
+// keysがnilの場合はHS256のトークンのみ、hmacSecretが空の場合は非対称鍵のトークンのみを受け付けます
+func newJWTAuthenticator(keys *jwksKeySet, hmacSecret string, policy jwtClaimsPolicy) *jwtAuthenticator {
+	return &jwtAuthenticator{
+		verifier:      &jwtVerifier{keys: keys, hmacSecret: []byte(hmacSecret)},
+		policy:        policy,
+		parserOptions: policy.parserOptions(),
+	}
+}
+
+// authenticate はAuthorizationヘッダーのトークンを検証し、利用者を返します
+// ヘッダーが無い場合は (nil, nil) を返し、ヘッダーの形式やトークンが不正な場合はエラーを返します
+func (a *jwtAuthenticator) authenticate(r *http.Request) (*Principal, error) {
+	// リクエストヘッダーから "Authorization" を取得
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, nil
+	}
+
+	// ヘッダーが "Bearer <token>" の形式になっているか検証
+	headerParts := strings.Split(authHeader, " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return nil, fmt.Errorf("invalid Authorization header format")
+	}
+	tokenString := headerParts[1]
+
+	// トークンの署名と、有効期限・発行者・対象者を検証
+	claims := &supabaseClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, a.verifier.keyFunc(r.Context()), a.parserOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("token is invalid")
+	}
+
+	// ユーザーIDとロールを検証
+	return a.policy.principalOf(claims)
+}
+
+// protect は、ルートの認証の要否に従ってリクエストを認証してから、次のハンドラを呼び出すミドルウェアです
+// 認証が必要なルートに未認証のリクエストが届いた場合は、ハンドラを呼び出さずに401を返します
+func (a *jwtAuthenticator) protect(policy routePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := policy.forMethod(r.Method)
+		if required == authPublic {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// ヘッダーが "Bearer <token>" の形式になっているか検証
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
+		principal, err := a.authenticate(r)
+		// トークンが無効な場合は、認証が任意のルートでもエラー
+		if err != nil {
+			log.Printf("WARN: Rejected token: %v", err)
+			writeUnauthorized(w, true)
 			return
 		}
-		tokenString := headerParts[1]
-
-		// トークンをパースして検証
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// 署名メソッドがHMACであることを確認
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		if principal == nil {
+			if required == authRequired {
+				writeUnauthorized(w, false)
+				return
 			}
-			// 環境変数からJWTのシークレットキーを取得
-			secret := os.Getenv("SUPABASE_JWT_SECRET")
-			return []byte(secret), nil
-		})
-
-		// トークンが無効な場合はエラー
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// トークンからクレーム（特に "sub" クレーム）を取得し、コンテキストにユーザーIDをセット
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if ok && claims["sub"] != nil {
-			ctx := context.WithValue(r.Context(), userIDKey, claims["sub"])
-			r = r.WithContext(ctx)
-		}
+		// 検証した利用者をコンテキストにセット
+		r = r.WithContext(contextWithPrincipal(r.Context(), principal))
 
 		// 次のハンドラへ処理を渡す
 		next.ServeHTTP(w, r)
 	})
 }
+
+// writeUnauthorized は、全てのルートで同じ形式の401を返します
+// invalidTokenがtrueの場合はトークンが無効、falseの場合はトークンが無いことを示します
+func writeUnauthorized(w http.ResponseWriter, invalidToken bool) {
+	if invalidToken {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Authentication required", http.StatusUnauthorized)
+}
+
+// parseAdminUserIDs は環境変数 ADMIN_USER_IDS の値（カンマ区切りのユーザーID）を解釈します
+// 利用者のユーザーIDと比較するため、小文字に揃えます
+func parseAdminUserIDs(v string) map[string]bool {
+	ids := map[string]bool{}
+	for _, id := range strings.Split(v, ",") {
+		if id = strings.ToLower(strings.TrimSpace(id)); id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
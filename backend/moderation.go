@@ -0,0 +1,383 @@
+// backend/moderation.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ModerationRequest は出品の非公開化・出品者の停止など、管理者の操作時に受け取るリクエストボディです
+type ModerationRequest struct {
+	Reason string `json:"reason"`
+}
+
+// decodeModerationRequest はリクエストボディを読み込みます
+// requireReasonがtrueの場合は、理由が空のリクエストをエラーにします
+func decodeModerationRequest(w http.ResponseWriter, r *http.Request, requireReason bool) (*ModerationRequest, bool) {
+	var req ModerationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if requireReason && req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// recordPausedSubscriptions は、管理者の操作で一時停止した定期便を、定期便ごとに監査ログに記録します
+// causeは一時停止のきっかけになった操作（bean.unpublish, seller.suspend）で、操作と同じトランザクションで呼び出します
+func recordPausedSubscriptions(ctx context.Context, store *Store, actor *Principal, paused []PausedSubscription, cause string, reason string) error {
+	for _, sub := range paused {
+		audit := newAuditLog(actor, AuditActionSubscriptionPause, "subscription", strconv.Itoa(sub.ID), reason)
+		userID := sub.UserID
+		audit.TargetOwnerID = &userID
+		audit.Details["bean_id"] = sub.BeanID
+		audit.Details["cause"] = cause
+		if err := store.RecordAuditLog(ctx, audit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubOrderPayout 構造体は、子注文の出品者への入金の状態を保持します（管理者向け）
+type SubOrderPayout struct {
+	SubOrderID      int    `json:"sub_order_id"`
+	SellerID        string `json:"seller_id"`
+	StripeAccountID string `json:"stripe_account_id"`
+	// StripeTransferID は入金済みの場合のTransferのIDです（未入金の場合は空）
+	StripeTransferID string `json:"stripe_transfer_id"`
+	Amount           int    `json:"amount"`
+	// TransferStatus は子注文ごとのTransferで入金する場合の送信の状態です（pending, sent, failed, canceled。Destination Chargeの場合は空）
+	TransferStatus string `json:"transfer_status"`
+	// TransferError は直近の送信の失敗の理由です
+	TransferError string `json:"transfer_error,omitempty"`
+}
+
+// AdminOrderDetail 構造体は、管理者向けの注文の詳細で、Stripeでの支払いと出品者への入金の状態を含みます
+type AdminOrderDetail struct {
+	OrderDetail
+	// Payment はStripeから取得した支払いの現在の状態です（取得できなかった場合はnilで、PaymentErrorに理由が入ります）
+	Payment      *PaymentIntent   `json:"payment"`
+	PaymentError string           `json:"payment_error,omitempty"`
+	Payouts      []SubOrderPayout `json:"payouts"`
+}
+
+// adminBeansHandler は管理者・モデレーターが、非公開の豆や停止中の出品者の豆も含めて豆を検索します
+// 購入者向けの一覧と同じ検索条件に加えて、クエリパラメータ "visibility"（all, listed, unpublished, suspended。省略時はall）で絞り込めます
+func (a *Api) adminBeansHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.requirePermission(w, r, PermissionModerateBeans); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseBeanFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Visibility = r.URL.Query().Get("visibility")
+	if filter.Visibility == "" {
+		filter.Visibility = BeanVisibilityAll
+	}
+	if !containsString(validBeanVisibilities, filter.Visibility) {
+		http.Error(w, "Invalid visibility", http.StatusBadRequest)
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	beans, err := a.store.SearchBeans(r.Context(), filter, page)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		log.Printf("ERROR: Failed to search beans from DB: %v", err)
+		http.Error(w, "Failed to get beans", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(beans); err != nil {
+		log.Printf("ERROR: Failed to encode beans to JSON: %v", err)
+	}
+}
+
+// adminBeanVisibilityHandler は管理者・モデレーターが豆を理由とともに非公開にし（unpublish）、または公開に戻します（restore）
+// 非公開にした豆の継続中の定期便は一時停止し、操作と一時停止した定期便は同じトランザクションで監査ログに記録します
+func (a *Api) adminBeanVisibilityHandler(unpublish bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := a.requirePermission(w, r, PermissionModerateBeans)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid bean ID", http.StatusBadRequest)
+			return
+		}
+
+		// 非公開にする場合は、出品者に説明できるよう理由を必須にする
+		req, ok := decodeModerationRequest(w, r, unpublish)
+		if !ok {
+			return
+		}
+
+		tx, err := a.dbpool.Begin(r.Context())
+		if err != nil {
+			log.Printf("ERROR: Failed to begin transaction: %v", err)
+			http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback(r.Context())
+		store := NewStore(tx)
+
+		bean, err := store.SetBeanUnpublished(r.Context(), id, unpublish, actor.UserID, req.Reason)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.Error(w, "Bean not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("ERROR: Failed to update bean visibility in DB: %v", err)
+			http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+			return
+		}
+
+		action := AuditActionBeanRestore
+		if unpublish {
+			action = AuditActionBeanUnpublish
+		}
+		audit := newAuditLog(actor, action, "bean", strconv.Itoa(bean.ID), req.Reason)
+		if bean.UserID != "" {
+			audit.TargetOwnerID = &bean.UserID
+		}
+		audit.Details["name"] = bean.Name
+
+		// 非公開にした豆の定期便は、次の請求を待たずに一時停止する
+		paused := []PausedSubscription{}
+		if unpublish {
+			paused, err = store.PauseBeanSubscriptions(r.Context(), bean.ID)
+			if err != nil {
+				log.Printf("ERROR: Failed to pause subscriptions in DB: %v", err)
+				http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+				return
+			}
+			audit.Details["paused_subscriptions"] = len(paused)
+		}
+		if err := store.RecordAuditLog(r.Context(), audit); err != nil {
+			log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+			http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+			return
+		}
+		if err := recordPausedSubscriptions(r.Context(), store, actor, paused, action, req.Reason); err != nil {
+			log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+			http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(r.Context()); err != nil {
+			log.Printf("ERROR: Failed to commit transaction: %v", err)
+			http.Error(w, "Failed to update bean", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("🛡️ Bean %d was updated (%s) by %s", bean.ID, action, shortID(actor.UserID))
+		if len(paused) > 0 {
+			log.Printf("⏸️ %d subscriptions of bean %d were paused", len(paused), bean.ID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(bean); err != nil {
+			log.Printf("ERROR: Failed to encode bean to JSON: %v", err)
+		}
+	}
+}
+
+// adminSellerSuspensionHandler は管理者が出品者を停止（PUT）・停止を解除（DELETE）します
+// 停止中の出品者の豆はすべて購入者に表示されなくなり、継続中の定期便は一時停止します
+// 操作と一時停止した定期便は同じトランザクションで監査ログに記録します
+func (a *Api) adminSellerSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := a.requirePermission(w, r, PermissionSuspendSellers)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sellerID := strings.ToLower(r.PathValue("id"))
+	if !uuidPattern.MatchString(sellerID) {
+		http.Error(w, "Invalid seller ID", http.StatusBadRequest)
+		return
+	}
+	if sellerID == actor.UserID {
+		http.Error(w, "You cannot suspend yourself", http.StatusConflict)
+		return
+	}
+
+	suspend := r.Method == http.MethodPut
+	req, ok := decodeModerationRequest(w, r, suspend)
+	if !ok {
+		return
+	}
+
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	action := AuditActionSellerSuspend
+	var changed bool
+	if suspend {
+		changed, err = store.SuspendSeller(r.Context(), sellerID, actor.UserID, req.Reason)
+	} else {
+		action = AuditActionSellerUnsuspend
+		changed, err = store.UnsuspendSeller(r.Context(), sellerID)
+	}
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "Seller not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to update seller suspension in DB: %v", err)
+		http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+		return
+	}
+
+	beanCount, err := store.CountBeansBySeller(r.Context(), sellerID)
+	if err != nil {
+		log.Printf("ERROR: Failed to count beans of seller from DB: %v", err)
+		http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+		return
+	}
+
+	// 停止した出品者の定期便は、次の請求を待たずに一時停止する
+	paused := []PausedSubscription{}
+	if suspend {
+		paused, err = store.PauseSellerSubscriptions(r.Context(), sellerID)
+		if err != nil {
+			log.Printf("ERROR: Failed to pause subscriptions in DB: %v", err)
+			http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 既に停止中（停止されていない）の場合は何も変わらないので、監査ログに記録しない
+	if changed {
+		audit := newAuditLog(actor, action, "seller", sellerID, req.Reason)
+		audit.TargetOwnerID = &sellerID
+		audit.Details["bean_count"] = beanCount
+		if suspend {
+			audit.Details["paused_subscriptions"] = len(paused)
+		}
+		if err := store.RecordAuditLog(r.Context(), audit); err != nil {
+			log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+			http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordPausedSubscriptions(r.Context(), store, actor, paused, action, req.Reason); err != nil {
+		log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+		http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to update seller suspension", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		log.Printf("🛡️ Seller %s was updated (%s) by %s", shortID(sellerID), action, shortID(actor.UserID))
+	}
+	if len(paused) > 0 {
+		log.Printf("⏸️ %d subscriptions of seller %s were paused", len(paused), shortID(sellerID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"seller_id": sellerID, "suspended": suspend, "bean_count": beanCount}); err != nil {
+		log.Printf("ERROR: Failed to encode seller suspension to JSON: %v", err)
+	}
+}
+
+// adminOrderDetailHandler は管理者が購入者に関わらず注文の詳細を、Stripeでの支払いと出品者への入金の状態とともに取得します
+// Stripeから支払いの状態を取得できなかった場合も、DBの注文の詳細は返します
+func (a *Api) adminOrderDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.requirePermission(w, r, PermissionManageOrders); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := a.store.GetOrderDetailByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get order detail from DB: %v", err)
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	payouts, err := a.store.GetSubOrderPayouts(r.Context(), id)
+	if err != nil {
+		log.Printf("ERROR: Failed to get sub-order payouts from DB: %v", err)
+		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		return
+	}
+
+	detail := &AdminOrderDetail{OrderDetail: *order, Payouts: payouts}
+	if order.StripePaymentIntentID != "" {
+		detail.Payment, err = a.paymentProvider().GetPaymentIntent(r.Context(), order.StripePaymentIntentID)
+		if err != nil {
+			log.Printf("WARN: Failed to get PaymentIntent %s: %v", order.StripePaymentIntentID, err)
+			detail.PaymentError = "Failed to get payment from Stripe"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(detail); err != nil {
+		log.Printf("ERROR: Failed to encode order detail to JSON: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// backend/payment_method.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SavedCard 構造体は、購入者のStripe Customerに保存されたカードを保持します
+// カード番号などはStripeが保持し、表示に必要な情報だけを返します
+type SavedCard struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+}
+
+// ensureStripeCustomer はユーザーのStripe CustomerのIDを返し、未作成の場合は作成してプロフィールに紐づけます
+// プロフィールが無い場合は、Customerを紐づける空のプロフィールを作成します
+// Stripeを呼び出す間にDBの行をロックしないよう、トランザクションの外で呼び出してください
+// 同時に呼び出されても、Customerの作成はユーザーIDを冪等キーにして同じCustomerを返し、先に紐づけたCustomerを使います
+func ensureStripeCustomer(ctx context.Context, store *Store, payments PaymentProvider, userID string) (string, error) {
+	if err := store.EnsureProfile(ctx, userID); err != nil {
+		return "", fmt.Errorf("failed to create profile for user %s: %w", shortID(userID), err)
+	}
+	customerID, err := store.GetStripeCustomerID(ctx, userID)
+	if err != nil || customerID != "" {
+		return customerID, err
+	}
+
+	created, err := payments.CreateCustomer(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to create stripe customer for user %s: %w", shortID(userID), err)
+	}
+
+	customerID, err = store.SetStripeCustomerID(ctx, userID, created)
+	if err != nil {
+		return "", fmt.Errorf("failed to record stripe customer %s: %w", created, err)
+	}
+	if customerID == created {
+		log.Printf("👤 Created Stripe customer %s for user %s", customerID, shortID(userID))
+	}
+	return customerID, nil
+}
+
+// paymentMethodsHandler は認証されているユーザーの保存済みのカードを返します
+// Stripe Customerが未作成の場合は、空のリストを返します
+func (a *Api) paymentMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	customerID, err := a.store.GetStripeCustomerID(r.Context(), userID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("ERROR: Failed to get stripe customer from DB: %v", err)
+		http.Error(w, "Failed to get payment methods", http.StatusInternalServerError)
+		return
+	}
+
+	cards := []SavedCard{}
+	if customerID != "" {
+		cards, err = a.paymentProvider().ListCards(r.Context(), customerID)
+		if err != nil {
+			log.Printf("ERROR: Failed to list payment methods of customer %s: %v", customerID, err)
+			http.Error(w, "Failed to get payment methods", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cards); err != nil {
+		log.Printf("ERROR: Failed to encode payment methods to JSON: %v", err)
+	}
+}
+
+// detachPaymentMethodHandler は認証されているユーザーの保存済みのカードを削除（Customerから切り離し）します
+func (a *Api) detachPaymentMethodHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	paymentMethodID := r.PathValue("id")
+	if !strings.HasPrefix(paymentMethodID, "pm_") {
+		http.Error(w, "Invalid payment method ID", http.StatusBadRequest)
+		return
+	}
+
+	customerID, err := a.store.GetStripeCustomerID(r.Context(), userID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("ERROR: Failed to get stripe customer from DB: %v", err)
+		http.Error(w, "Failed to delete payment method", http.StatusInternalServerError)
+		return
+	}
+	if customerID == "" {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+
+	// 他のユーザーのカードである可能性を示唆しないよう、一般的なNot Foundを返す
+	payments := a.paymentProvider()
+	pm, err := payments.GetPaymentMethod(r.Context(), paymentMethodID)
+	if err != nil {
+		if errors.Is(err, ErrPaymentMethodNotFound) {
+			http.Error(w, "Payment method not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get payment method %s: %v", paymentMethodID, err)
+		http.Error(w, "Failed to delete payment method", http.StatusInternalServerError)
+		return
+	}
+	if pm.CustomerID == "" || pm.CustomerID != customerID {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+
+	if err := payments.DetachPaymentMethod(r.Context(), paymentMethodID); err != nil {
+		log.Printf("ERROR: Failed to detach payment method %s: %v", paymentMethodID, err)
+		http.Error(w, "Failed to delete payment method", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createSetupIntentHandler は定期便の請求に使うカードを、購入者がいない状態（off_session）でも使えるよう登録する手続きを作成します
+// フロントエンドはclient_secretでカードを登録し、完了後にsetup_intent_idを定期便の申し込みに指定します
+func (a *Api) createSetupIntentHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payments := a.paymentProvider()
+	customerID, err := ensureStripeCustomer(r.Context(), a.store, payments, userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get stripe customer: %v", err)
+		http.Error(w, "Failed to create setup intent", http.StatusInternalServerError)
+		return
+	}
+
+	si, err := payments.CreateSetupIntent(r.Context(), customerID)
+	if err != nil {
+		log.Printf("ERROR: Failed to create setup intent for customer %s: %v", customerID, err)
+		http.Error(w, "Failed to create setup intent", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"setup_intent_id": si.ID,
+		"client_secret":   si.ClientSecret,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("ERROR: Failed to encode setup intent to JSON: %v", err)
+	}
+}
@@ -0,0 +1,542 @@
+// backend/payment_provider.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// PaymentProvider は決済代行サービスとのやりとり（支払い・返金・出品者への入金・Webhookの検証）をまとめたインターフェースです
+// 本番ではStripe（stripePaymentProvider）を使い、テストではネットワークに接続しない偽物に差し替えます
+// Webhookのイベントのデータは、注文の処理がStripeのオブジェクトの形で読み取るため、他のサービスの場合もその形に変換して返します
+type PaymentProvider interface {
+	// CreateCustomer は購入者を顧客として登録し、顧客IDを返します（同じユーザーには同じ顧客を返します）
+	CreateCustomer(ctx context.Context, userID string) (string, error)
+	// CreatePaymentIntent は支払いを作成します
+	CreatePaymentIntent(ctx context.Context, params *PaymentIntentParams) (*PaymentIntent, error)
+	// GetPaymentIntent は支払いの現在の状態を取得します
+	GetPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error)
+	// CancelPaymentIntent は支払いを取り消し、取り消し後の状態を返します（既に取り消し済みの場合もその状態を返します）
+	CancelPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error)
+	// CreateRefund は支払いを返金し、返金のIDとrefunds.statusの値を返します
+	CreateRefund(ctx context.Context, params *RefundParams) (refundID string, status string, err error)
+	// CreateTransfer は出品者のアカウントに入金し、入金のIDを返します
+	CreateTransfer(ctx context.Context, params *TransferParams) (string, error)
+	// ReverseTransfer は出品者への入金を取り消し、取り消しのIDを返します
+	ReverseTransfer(ctx context.Context, params *TransferReversalParams) (string, error)
+	// CreateConnectAccount は出品者の入金先のアカウントを作成します（同じユーザーには同じアカウントを返します）
+	CreateConnectAccount(ctx context.Context, userID string) (*ConnectAccount, error)
+	// GetConnectAccount は出品者の入金先のアカウントの現在の状態を取得します
+	GetConnectAccount(ctx context.Context, accountID string) (*ConnectAccount, error)
+	// CreateAccountLink は出品者がアカウントの登録を行うページのURLを発行します
+	CreateAccountLink(ctx context.Context, accountID string, refreshURL string, returnURL string) (*AccountLink, error)
+	// ListCards は顧客に保存されたカードを返します
+	ListCards(ctx context.Context, customerID string) ([]SavedCard, error)
+	// GetPaymentMethod は支払い方法を取得します（存在しない場合はErrPaymentMethodNotFoundを返します）
+	GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error)
+	// DetachPaymentMethod は支払い方法を顧客から切り離します
+	DetachPaymentMethod(ctx context.Context, paymentMethodID string) error
+	// CreateSetupIntent は購入者がいない状態（off_session）で請求するカードを、顧客に登録する手続きを作成します
+	CreateSetupIntent(ctx context.Context, customerID string) (*SetupIntent, error)
+	// GetSetupIntent はカードの登録の手続きを取得します（存在しない場合はErrSetupIntentNotFoundを返します）
+	GetSetupIntent(ctx context.Context, setupIntentID string) (*SetupIntent, error)
+	// ConstructWebhookEvent はWebhookの署名を検証し、イベントを返します
+	ConstructWebhookEvent(payload []byte, header http.Header) (*WebhookEvent, error)
+}
+
+// ErrPaymentMethodNotFound は支払い方法が存在しない場合に返されます
+var ErrPaymentMethodNotFound = errors.New("payment method not found")
+
+// ErrSetupIntentNotFound はカードの登録の手続きが存在しない場合に返されます
+var ErrSetupIntentNotFound = errors.New("setup intent not found")
+
+// WebhookEvent 構造体は、署名を検証したWebhookのイベントを保持します
+type WebhookEvent struct {
+	ID   string
+	Type string
+	// Data はイベントの対象のオブジェクトです（Stripeのオブジェクトと同じ形式のJSON）
+	Data json.RawMessage
+}
+
+// PaymentIntentParams 構造体は、支払いの作成に必要な情報を保持します
+type PaymentIntentParams struct {
+	Amount     int64
+	Currency   string
+	CustomerID string
+	// SavePaymentMethod がtrueの場合、支払いが完了したカードを顧客に保存し、次回の購入で選べるようにする
+	SavePaymentMethod bool
+	// PaymentMethodID が設定されている場合は、保存済みのカードで購入者がいない状態（off_session）のまま支払いを確定する
+	PaymentMethodID string
+	// TransferDestination が設定されている場合は、出品者のアカウントに直接入金し、ApplicationFeeAmountを差し引く（Destination Charge）
+	TransferDestination  string
+	ApplicationFeeAmount int64
+	// TransferGroup は支払い後に子注文ごとのTransferで入金する場合の、Transferをまとめるグループ
+	TransferGroup  string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// PaymentIntent 構造体は、作成・取得した支払いを保持します
+type PaymentIntent struct {
+	ID string `json:"id"`
+	// ClientSecret はフロントエンドで支払いを確定するために使う（購入者以外には返さない）
+	ClientSecret string `json:"-"`
+	Status       string `json:"status"`
+	Amount       int64  `json:"amount"`
+	// AmountReceived は実際に支払われた額です
+	AmountReceived int64  `json:"amount_received"`
+	Currency       string `json:"currency"`
+	// LastPaymentError は直近の支払いの失敗の理由です（失敗していない場合は空）
+	LastPaymentError string `json:"last_payment_error"`
+}
+
+// RefundParams 構造体は、返金に必要な情報を保持します
+type RefundParams struct {
+	PaymentIntentID string
+	Amount          int64
+	// ReverseTransfer がtrueの場合、Destination Chargeの入金と手数料を返金額に応じて取り消す
+	ReverseTransfer bool
+	Metadata        map[string]string
+	IdempotencyKey  string
+}
+
+// TransferParams 構造体は、出品者への入金に必要な情報を保持します
+type TransferParams struct {
+	Amount        int64
+	Currency      string
+	Destination   string
+	TransferGroup string
+	// SourceTransaction が設定されている場合は、支払いの売上が確定する前でも入金を予約できるよう、元の支払いに紐づける
+	SourceTransaction string
+	Metadata          map[string]string
+	IdempotencyKey    string
+}
+
+// TransferReversalParams 構造体は、出品者への入金の取り消しに必要な情報を保持します
+type TransferReversalParams struct {
+	TransferID     string
+	Amount         int64
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// ConnectAccount 構造体は、出品者の入金先のアカウントを保持します
+type ConnectAccount struct {
+	ID string
+	// Status はprofiles.stripe_account_statusの値です
+	Status string
+}
+
+// AccountLink 構造体は、出品者がアカウントの登録を行うページのURLを保持します
+type AccountLink struct {
+	URL string `json:"url"`
+	// ExpiresAt はURLが失効する日時（UNIX時刻）です
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// PaymentMethod 構造体は、購入者の支払い方法を保持します
+type PaymentMethod struct {
+	ID string
+	// CustomerID は紐づいている顧客のIDです（どの顧客にも紐づいていない場合は空）
+	CustomerID string
+	// Card はカードの表示用の情報です（カード以外の支払い方法の場合はnil）
+	Card *SavedCard
+}
+
+// SetupIntent 構造体は、購入者がいない状態（off_session）で請求するカードの登録の手続きを保持します
+type SetupIntent struct {
+	ID string
+	// ClientSecret はフロントエンドでカードを登録するために使う（購入者以外には返さない）
+	ClientSecret string
+	Status       string
+	// Usage は登録したカードの使い方です（定期便の請求には"off_session"が必要）
+	Usage      string
+	CustomerID string
+	// PaymentMethodID は登録が完了したカードのIDです（完了していない場合は空）
+	PaymentMethodID string
+}
+
+// CardError はカードが拒否されたなど、購入者の対応が必要な支払いの失敗です
+type CardError struct {
+	Code    string
+	Message string
+}
+
+func (e *CardError) Error() string {
+	return fmt.Sprintf("card error: %s: %s", e.Code, e.Message)
+}
+
+// paymentProvider は決済代行サービスを返します（未設定の場合は環境変数の設定でStripeを使う）
+func (a *Api) paymentProvider() PaymentProvider {
+	if a.payments == nil {
+		return newStripePaymentProviderFromEnv()
+	}
+	return a.payments
+}
+
+// stripePaymentProvider はStripeを使うPaymentProviderです
+// APIキーはクライアントごとに保持するので、リクエストのたびにstripe.Keyを設定する必要はありません
+type stripePaymentProvider struct {
+	client *client.API
+	// webhookSecret はプラットフォームのイベント用、connectWebhookSecret は出品者のアカウントのイベント用の署名シークレット
+	webhookSecret        string
+	connectWebhookSecret string
+}
+
+// newStripePaymentProvider はAPIキーとWebhookの署名シークレットから、stripePaymentProviderを作成します
+func newStripePaymentProvider(secretKey string, webhookSecret string, connectWebhookSecret string) *stripePaymentProvider {
+	return &stripePaymentProvider{
+		client:               client.New(secretKey, nil),
+		webhookSecret:        webhookSecret,
+		connectWebhookSecret: connectWebhookSecret,
+	}
+}
+
+// newStripePaymentProviderFromEnv は環境変数の設定から、stripePaymentProviderを作成します
+func newStripePaymentProviderFromEnv() *stripePaymentProvider {
+	return newStripePaymentProvider(os.Getenv("STRIPE_SECRET_KEY"), os.Getenv("STRIPE_WEBHOOK_SECRET"), os.Getenv("STRIPE_CONNECT_WEBHOOK_SECRET"))
+}
+
+// stripeParams はリクエストに共通するcontext・メタデータ・冪等キーを設定します
+func stripeParams(p *stripe.Params, ctx context.Context, metadata map[string]string, idempotencyKey string) {
+	p.Context = ctx
+	for k, v := range metadata {
+		p.AddMetadata(k, v)
+	}
+	if idempotencyKey != "" {
+		p.SetIdempotencyKey(idempotencyKey)
+	}
+}
+
+// stripeError はカードが拒否されたエラーをCardErrorに変換し、それ以外のエラーはそのまま返します
+func stripeError(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+		return &CardError{Code: string(stripeErr.Code), Message: stripeErr.Msg}
+	}
+	return err
+}
+
+func (p *stripePaymentProvider) CreateCustomer(ctx context.Context, userID string) (string, error) {
+	params := &stripe.CustomerParams{}
+	// トランザクションがロールバックされて作成し直す場合も、同じCustomerを返すようにする
+	stripeParams(&params.Params, ctx, map[string]string{"user_id": userID}, fmt.Sprintf("customer_%s", userID))
+	c, err := p.client.Customers.New(params)
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func (p *stripePaymentProvider) CreatePaymentIntent(ctx context.Context, req *PaymentIntentParams) (*PaymentIntent, error) {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(req.Amount),
+		Currency: stripe.String(req.Currency),
+	}
+	if req.CustomerID != "" {
+		params.Customer = stripe.String(req.CustomerID)
+	}
+	if req.PaymentMethodID != "" {
+		// 保存済みのカードで、購入者がいない状態のまま支払いを確定する
+		params.PaymentMethod = stripe.String(req.PaymentMethodID)
+		params.PaymentMethodTypes = stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)})
+		params.Confirm = stripe.Bool(true)
+		params.OffSession = stripe.Bool(true)
+	} else {
+		params.AutomaticPaymentMethods = &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		}
+	}
+	if req.SavePaymentMethod {
+		// 保存したカードは定期便でも使えるよう、購入者がいない状態での請求にも使える形で保存する
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	}
+	if req.TransferDestination != "" {
+		params.TransferData = &stripe.PaymentIntentTransferDataParams{
+			Destination: stripe.String(req.TransferDestination),
+		}
+		params.ApplicationFeeAmount = stripe.Int64(req.ApplicationFeeAmount)
+	}
+	if req.TransferGroup != "" {
+		params.TransferGroup = stripe.String(req.TransferGroup)
+	}
+	stripeParams(&params.Params, ctx, req.Metadata, req.IdempotencyKey)
+
+	pi, err := p.client.PaymentIntents.New(params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return paymentIntentOf(pi), nil
+}
+
+func (p *stripePaymentProvider) GetPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error) {
+	params := &stripe.PaymentIntentParams{}
+	params.Context = ctx
+	pi, err := p.client.PaymentIntents.Get(paymentIntentID, params)
+	if err != nil {
+		return nil, stripeError(err)
+	}
+	return paymentIntentOf(pi), nil
+}
+
+func (p *stripePaymentProvider) CancelPaymentIntent(ctx context.Context, paymentIntentID string) (*PaymentIntent, error) {
+	params := &stripe.PaymentIntentCancelParams{}
+	params.Context = ctx
+	pi, err := p.client.PaymentIntents.Cancel(paymentIntentID, params)
+	if err != nil {
+		// 既に取り消し済みの支払いは取り消せないので、現在の状態を返す
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodePaymentIntentUnexpectedState {
+			return p.GetPaymentIntent(ctx, paymentIntentID)
+		}
+		return nil, stripeError(err)
+	}
+	return paymentIntentOf(pi), nil
+}
+
+// paymentIntentOf はStripeのPaymentIntentをPaymentIntentに変換します
+func paymentIntentOf(pi *stripe.PaymentIntent) *PaymentIntent {
+	result := &PaymentIntent{
+		ID:             pi.ID,
+		ClientSecret:   pi.ClientSecret,
+		Status:         string(pi.Status),
+		Amount:         pi.Amount,
+		AmountReceived: pi.AmountReceived,
+		Currency:       string(pi.Currency),
+	}
+	if pi.LastPaymentError != nil {
+		result.LastPaymentError = pi.LastPaymentError.Msg
+	}
+	return result
+}
+
+func (p *stripePaymentProvider) CreateRefund(ctx context.Context, req *RefundParams) (string, string, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(req.PaymentIntentID),
+		Amount:        stripe.Int64(req.Amount),
+	}
+	if req.ReverseTransfer {
+		params.ReverseTransfer = stripe.Bool(true)
+		params.RefundApplicationFee = stripe.Bool(true)
+	}
+	stripeParams(&params.Params, ctx, req.Metadata, req.IdempotencyKey)
+
+	re, err := p.client.Refunds.New(params)
+	if err != nil {
+		return "", "", err
+	}
+	return re.ID, refundStatusOf(string(re.Status)), nil
+}
+
+func (p *stripePaymentProvider) CreateTransfer(ctx context.Context, req *TransferParams) (string, error) {
+	params := &stripe.TransferParams{
+		Amount:      stripe.Int64(req.Amount),
+		Currency:    stripe.String(req.Currency),
+		Destination: stripe.String(req.Destination),
+	}
+	if req.TransferGroup != "" {
+		params.TransferGroup = stripe.String(req.TransferGroup)
+	}
+	if req.SourceTransaction != "" {
+		params.SourceTransaction = stripe.String(req.SourceTransaction)
+	}
+	stripeParams(&params.Params, ctx, req.Metadata, req.IdempotencyKey)
+
+	tr, err := p.client.Transfers.New(params)
+	if err != nil {
+		return "", err
+	}
+	return tr.ID, nil
+}
+
+func (p *stripePaymentProvider) ReverseTransfer(ctx context.Context, req *TransferReversalParams) (string, error) {
+	params := &stripe.ReversalParams{
+		Transfer: stripe.String(req.TransferID),
+		Amount:   stripe.Int64(req.Amount),
+	}
+	stripeParams(&params.Params, ctx, req.Metadata, req.IdempotencyKey)
+
+	rev, err := p.client.Reversals.New(params)
+	if err != nil {
+		return "", err
+	}
+	return rev.ID, nil
+}
+
+// stripeAccountStatusOf はStripe Connectアカウントの状態を、profiles.stripe_account_statusの値に変換します
+func stripeAccountStatusOf(acct *stripe.Account) string {
+	return connectAccountStatus(acct.ChargesEnabled, acct.PayoutsEnabled, acct.DetailsSubmitted)
+}
+
+func (p *stripePaymentProvider) CreateConnectAccount(ctx context.Context, userID string) (*ConnectAccount, error) {
+	params := &stripe.AccountParams{
+		Type:    stripe.String(string(stripe.AccountTypeExpress)),
+		Country: stripe.String("JP"),
+		Capabilities: &stripe.AccountCapabilitiesParams{
+			CardPayments: &stripe.AccountCapabilitiesCardPaymentsParams{Requested: stripe.Bool(true)},
+			Transfers:    &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+		},
+	}
+	// 同時にリクエストされても、アカウントが二重に作成されないようにする
+	stripeParams(&params.Params, ctx, map[string]string{"user_id": userID}, "connect_account_"+userID)
+
+	acct, err := p.client.Account.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectAccount{ID: acct.ID, Status: stripeAccountStatusOf(acct)}, nil
+}
+
+func (p *stripePaymentProvider) GetConnectAccount(ctx context.Context, accountID string) (*ConnectAccount, error) {
+	params := &stripe.AccountParams{}
+	params.Context = ctx
+	acct, err := p.client.Account.GetByID(accountID, params)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectAccount{ID: acct.ID, Status: stripeAccountStatusOf(acct)}, nil
+}
+
+func (p *stripePaymentProvider) CreateAccountLink(ctx context.Context, accountID string, refreshURL string, returnURL string) (*AccountLink, error) {
+	params := &stripe.AccountLinkParams{
+		Account:    stripe.String(accountID),
+		RefreshURL: stripe.String(refreshURL),
+		ReturnURL:  stripe.String(returnURL),
+		Type:       stripe.String(string(stripe.AccountLinkTypeAccountOnboarding)),
+	}
+	params.Context = ctx
+	link, err := p.client.AccountLinks.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &AccountLink{URL: link.URL, ExpiresAt: link.ExpiresAt}, nil
+}
+
+// savedCardOf はStripeのPaymentMethodを、SavedCardに変換します
+// カード以外の支払い方法の場合はnilを返します
+func savedCardOf(pm *stripe.PaymentMethod) *SavedCard {
+	if pm.Card == nil {
+		return nil
+	}
+	return &SavedCard{
+		ID:       pm.ID,
+		Brand:    string(pm.Card.Brand),
+		Last4:    pm.Card.Last4,
+		ExpMonth: int(pm.Card.ExpMonth),
+		ExpYear:  int(pm.Card.ExpYear),
+	}
+}
+
+func (p *stripePaymentProvider) ListCards(ctx context.Context, customerID string) ([]SavedCard, error) {
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	}
+	params.Context = ctx
+	cards := []SavedCard{}
+	iter := p.client.PaymentMethods.List(params)
+	for iter.Next() {
+		if card := savedCardOf(iter.PaymentMethod()); card != nil {
+			cards = append(cards, *card)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+func (p *stripePaymentProvider) GetPaymentMethod(ctx context.Context, paymentMethodID string) (*PaymentMethod, error) {
+	params := &stripe.PaymentMethodParams{}
+	params.Context = ctx
+	pm, err := p.client.PaymentMethods.Get(paymentMethodID, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			return nil, ErrPaymentMethodNotFound
+		}
+		return nil, err
+	}
+	result := &PaymentMethod{ID: pm.ID, Card: savedCardOf(pm)}
+	if pm.Customer != nil {
+		result.CustomerID = pm.Customer.ID
+	}
+	return result, nil
+}
+
+func (p *stripePaymentProvider) DetachPaymentMethod(ctx context.Context, paymentMethodID string) error {
+	params := &stripe.PaymentMethodDetachParams{}
+	params.Context = ctx
+	_, err := p.client.PaymentMethods.Detach(paymentMethodID, params)
+	return err
+}
+
+func (p *stripePaymentProvider) CreateSetupIntent(ctx context.Context, customerID string) (*SetupIntent, error) {
+	params := &stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)}),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+	}
+	params.Context = ctx
+	si, err := p.client.SetupIntents.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return setupIntentOf(si), nil
+}
+
+func (p *stripePaymentProvider) GetSetupIntent(ctx context.Context, setupIntentID string) (*SetupIntent, error) {
+	params := &stripe.SetupIntentParams{}
+	params.Context = ctx
+	si, err := p.client.SetupIntents.Get(setupIntentID, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+			return nil, ErrSetupIntentNotFound
+		}
+		return nil, err
+	}
+	return setupIntentOf(si), nil
+}
+
+// setupIntentOf はStripeのSetupIntentを、SetupIntentに変換します
+func setupIntentOf(si *stripe.SetupIntent) *SetupIntent {
+	result := &SetupIntent{ID: si.ID, ClientSecret: si.ClientSecret, Status: string(si.Status), Usage: string(si.Usage)}
+	if si.Customer != nil {
+		result.CustomerID = si.Customer.ID
+	}
+	if si.PaymentMethod != nil {
+		result.PaymentMethodID = si.PaymentMethod.ID
+	}
+	return result
+}
+
+// webhookEventOf はStripeのイベントをWebhookEventに変換します
+func webhookEventOf(event *stripe.Event) *WebhookEvent {
+	result := &WebhookEvent{ID: event.ID, Type: string(event.Type)}
+	if event.Data != nil {
+		result.Data = event.Data.Raw
+	}
+	return result
+}
+
+func (p *stripePaymentProvider) ConstructWebhookEvent(payload []byte, header http.Header) (*WebhookEvent, error) {
+	signatureHeader := header.Get("Stripe-Signature")
+	event, err := webhook.ConstructEvent(payload, signatureHeader, p.webhookSecret)
+	// 出品者のアカウントのイベント（account.updatedなど）は、Connect用のエンドポイントの署名で届く
+	if err != nil && p.connectWebhookSecret != "" {
+		event, err = webhook.ConstructEvent(payload, signatureHeader, p.connectWebhookSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return webhookEventOf(&event), nil
+}
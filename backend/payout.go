@@ -0,0 +1,192 @@
+// backend/payout.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// routePayouts は支払いに、出品者への入金方法を設定します
+// 出品者が1人であればDestination Chargeで直接入金し、請求額と入金額の差をApplication Feeとして差し引きます
+// 手数料は商品の小計にのみかかり、送料はそのまま出品者に入金します
+// 複数の場合や、プラットフォーム負担の値引きが手数料を上回る場合は、支払い後に入金額を子注文ごとのTransferで入金するため、
+// transferGroupを設定して返します（Destination Chargeの場合は空文字列を返します）
+func routePayouts(params *PaymentIntentParams, sellers []SellerCartItems, defaultBasisPoints int, transferGroup string) string {
+	if len(sellers) == 1 && sellers[0].Total() >= sellers[0].Payout(defaultBasisPoints) {
+		seller := sellers[0]
+		params.TransferDestination = seller.StripeAccountID
+		params.ApplicationFeeAmount = int64(seller.Total() - seller.Payout(defaultBasisPoints))
+		return ""
+	}
+	params.TransferGroup = transferGroup
+	return transferGroup
+}
+
+// payoutTransferBatchSize は1回の間隔で送信する、出品者への入金の最大件数です
+const payoutTransferBatchSize = 100
+
+// payoutTransferInterval は送信待ちの出品者への入金を送信する間隔です
+const payoutTransferInterval = time.Minute
+
+// payoutTransferLease は送信中の入金を、他のサーバーが取得しないようにする時間です（送信に失敗した場合の再送の間隔にもなります）
+const payoutTransferLease = 5 * time.Minute
+
+// payoutTransferRetryWindow は最初の送信から自動で再送する期間です
+// Stripeの冪等キーは24時間で期限切れになるため、それより前に再送をやめて手動での確認に回します
+const payoutTransferRetryWindow = 20 * time.Hour
+
+// queueSellerPayouts は支払いが完了した注文について、子注文ごとの出品者への入金を送信待ちとして記録します
+// Destination Chargeの注文はStripeが自動で入金するので何もしません
+// storeはWebhookのトランザクションに紐づいている必要があり、入金はrunPayoutSenderが定期的に送信します
+func queueSellerPayouts(ctx context.Context, store *Store, order *Order, chargeID string, amountReceived int64) error {
+	transfers, err := store.GetPendingSubOrderTransfers(ctx, order.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get pending transfers for order %d: %w", order.ID, err)
+	}
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	// 元の支払いに紐づけたTransferの合計は支払い額を超えられない
+	// プラットフォーム負担の値引きで入金額が支払い額を上回る場合や、Chargeが分からない場合は、プラットフォームの残高から入金する
+	totalTransferAmount := 0
+	for _, t := range transfers {
+		totalTransferAmount += t.Amount
+	}
+	sourceTransaction := ""
+	if chargeID != "" && int64(totalTransferAmount) <= amountReceived {
+		sourceTransaction = chargeID
+	}
+
+	for _, t := range transfers {
+		payout := &PayoutTransfer{
+			SubOrderID:        t.SubOrderID,
+			Amount:            t.Amount,
+			Currency:          order.Currency,
+			Destination:       t.StripeAccountID,
+			TransferGroup:     t.TransferGroup,
+			SourceTransaction: sourceTransaction,
+		}
+		if err := store.QueuePayoutTransfer(ctx, payout); err != nil {
+			return fmt.Errorf("failed to queue transfer for sub-order %d: %w", t.SubOrderID, err)
+		}
+	}
+	return nil
+}
+
+// sendPayoutTransfers は送信する時期が来た出品者への入金を送信します
+// 入金はpayout_transfersの行のIDを冪等キーにするため、送信後の記録に失敗して再送しても二重に入金されません
+// 戻り値は送信した件数です
+func (a *Api) sendPayoutTransfers(ctx context.Context, now time.Time) (int, error) {
+	failed, err := a.store.FailStalePayoutTransfers(ctx, now.Add(-payoutTransferRetryWindow))
+	if err != nil {
+		return 0, err
+	}
+	if failed > 0 {
+		log.Printf("ERROR: %d payout transfers could not be sent in time, manual check required", failed)
+	}
+
+	transfers, err := a.store.ClaimPayoutTransfers(ctx, now, payoutTransferBatchSize, payoutTransferLease)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, t := range transfers {
+		params := &TransferParams{
+			Amount:        int64(t.Amount),
+			Currency:      t.Currency,
+			Destination:   t.Destination,
+			TransferGroup: t.TransferGroup,
+			// 支払いの売上が確定する前でも入金を予約できるよう、元の支払いに紐づける
+			SourceTransaction: t.SourceTransaction,
+			Metadata: map[string]string{
+				"sub_order_id":       strconv.Itoa(t.SubOrderID),
+				"payout_transfer_id": strconv.Itoa(t.ID),
+			},
+			IdempotencyKey: fmt.Sprintf("payout_transfer_%d", t.ID),
+		}
+		transferID, err := a.paymentProvider().CreateTransfer(ctx, params)
+		if err != nil {
+			log.Printf("WARN: Failed to send transfer for sub-order %d (attempt %d): %v", t.SubOrderID, t.Attempts, err)
+			if err := a.store.RecordPayoutTransferFailure(ctx, t.ID, err.Error(), now.Add(payoutTransferLease)); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err := a.store.MarkPayoutTransferSent(ctx, t.ID, transferID); err != nil {
+			return sent, fmt.Errorf("failed to record transfer %s for sub-order %d: %w", transferID, t.SubOrderID, err)
+		}
+		sent++
+		log.Printf("💴 Transferred %d %s to %s for sub-order %d", t.Amount, t.Currency, t.Destination, t.SubOrderID)
+	}
+	return sent, nil
+}
+
+// sendTransferReversals は送信する時期が来た、返金に応じた出品者への入金の取り消しを送信します
+// 取り消しはtransfer_reversalsの行のIDを冪等キーにするため、送信後の記録に失敗して再送しても二重に取り消されません
+// 戻り値は送信した件数です
+func (a *Api) sendTransferReversals(ctx context.Context, now time.Time) (int, error) {
+	failed, err := a.store.FailStaleTransferReversals(ctx, now.Add(-payoutTransferRetryWindow))
+	if err != nil {
+		return 0, err
+	}
+	if failed > 0 {
+		log.Printf("ERROR: %d transfer reversals could not be sent in time, manual check required", failed)
+	}
+
+	reversals, err := a.store.ClaimTransferReversals(ctx, now, payoutTransferBatchSize, payoutTransferLease)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, t := range reversals {
+		reversalID, err := a.paymentProvider().ReverseTransfer(ctx, &TransferReversalParams{
+			TransferID: t.TransferID,
+			Amount:     int64(t.Amount),
+			Metadata: map[string]string{
+				"refund_id":            strconv.Itoa(t.RefundID),
+				"transfer_reversal_id": strconv.Itoa(t.ID),
+			},
+			IdempotencyKey: fmt.Sprintf("transfer_reversal_%d", t.ID),
+		})
+		if err != nil {
+			log.Printf("WARN: Failed to reverse transfer %s for refund %d (attempt %d): %v", t.TransferID, t.RefundID, t.Attempts, err)
+			if err := a.store.RecordTransferReversalFailure(ctx, t.ID, err.Error(), now.Add(payoutTransferLease)); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err := a.store.MarkTransferReversalSent(ctx, t.ID, reversalID); err != nil {
+			return sent, fmt.Errorf("failed to record transfer reversal %s for refund %d: %w", reversalID, t.RefundID, err)
+		}
+		sent++
+		log.Printf("↩️ Reversed %d of transfer %s for sub-order %d (refund %d)", t.Amount, t.TransferID, t.SubOrderID, t.RefundID)
+	}
+	return sent, nil
+}
+
+// runPayoutSender は一定間隔で送信待ちの出品者への入金と、入金の取り消しを送信します
+// ctxがキャンセルされるまで処理を続けるので、goroutineとして起動してください
+func (a *Api) runPayoutSender(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := a.sendPayoutTransfers(ctx, time.Now()); err != nil {
+				log.Printf("ERROR: Failed to send payout transfers: %v", err)
+			}
+			if _, err := a.sendTransferReversals(ctx, time.Now()); err != nil {
+				log.Printf("ERROR: Failed to send transfer reversals: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// backend/rbac.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ユーザーのロール（user_role型）
+// buyer・seller・roasterはユーザーの立場を表し、moderator・adminは運営スタッフとして他のユーザーの出品や注文を操作できます
+// buyerはプロフィールの登録・決済時に、sellerは豆の出品時に自動で付与されます
+// roaster（自家焙煎の出品者）とmoderator・adminは、管理者がロール管理APIで付与します
+const (
+	RoleBuyer     = "buyer"
+	RoleSeller    = "seller"
+	RoleRoaster   = "roaster"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// validRoles は付与できるロールです
+var validRoles = []string{RoleBuyer, RoleSeller, RoleRoaster, RoleModerator, RoleAdmin}
+
+// Permission は所有者でなくても行える操作の権限です
+type Permission string
+
+const (
+	// PermissionModerateBeans は他のユーザーの出品（コーヒー豆）を修正・削除する権限です
+	PermissionModerateBeans Permission = "beans:moderate"
+	// PermissionManageOrders は注文を強制的にキャンセル・返金する権限です
+	PermissionManageOrders Permission = "orders:manage"
+	// PermissionManageRoles はユーザーにロールを付与・削除する権限です
+	PermissionManageRoles Permission = "roles:manage"
+	// PermissionViewAuditLogs は監査ログを閲覧する権限です
+	PermissionViewAuditLogs Permission = "audit_logs:view"
+	// PermissionSuspendSellers は出品者を停止し、その出品をすべて非表示にする権限です
+	PermissionSuspendSellers Permission = "sellers:suspend"
+	// PermissionManageCoupons はプラットフォームが負担するクーポンを発行する権限です
+	PermissionManageCoupons Permission = "coupons:manage"
+)
+
+// rolePermissions はロールごとの権限です（buyer・seller・roasterは自分の出品や注文しか操作できない）
+var rolePermissions = map[string][]Permission{
+	RoleModerator: {PermissionModerateBeans, PermissionViewAuditLogs},
+	RoleAdmin:     {PermissionModerateBeans, PermissionManageOrders, PermissionManageRoles, PermissionViewAuditLogs, PermissionSuspendSellers, PermissionManageCoupons},
+}
+
+// HasRole は利用者がロールを持つかを返します
+// ロールは認証ミドルウェアでは取得しないため、loadRoles（またはrequirePermission）の後に呼び出してください（未取得の場合はfalse）
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && containsString(p.Roles, role)
+}
+
+// Can は利用者がいずれかのロールで権限を持つかを返します
+// HasRoleと同じく、loadRoles（またはrequirePermission）の後に呼び出してください（未取得の場合はfalse）
+func (p *Principal) Can(permission Permission) bool {
+	if p == nil {
+		return false
+	}
+	for _, role := range p.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 監査ログに記録する操作の種類
+const (
+	AuditActionBeanUpdate        = "bean.update"
+	AuditActionBeanDelete        = "bean.delete"
+	AuditActionBeanUnpublish     = "bean.unpublish"
+	AuditActionBeanRestore       = "bean.restore"
+	AuditActionSellerSuspend     = "seller.suspend"
+	AuditActionSellerUnsuspend   = "seller.unsuspend"
+	AuditActionOrderCancel       = "order.cancel"
+	AuditActionOrderRefund       = "order.refund"
+	AuditActionRoleGrant         = "user_role.grant"
+	AuditActionRoleRevoke        = "user_role.revoke"
+	AuditActionCouponCreate      = "coupon.create"
+	AuditActionSubscriptionPause = "subscription.pause"
+)
+
+// AuditLog 構造体は、管理者・モデレーターが他のユーザーの出品や注文を操作した記録を保持します
+type AuditLog struct {
+	ID      int    `json:"id"`
+	ActorID string `json:"actor_id"`
+	// ActorRoles は操作した時点での、操作したユーザーのロールです
+	ActorRoles []string `json:"actor_roles"`
+	Action     string   `json:"action"`
+	TargetType string   `json:"target_type"`
+	TargetID   string   `json:"target_id"`
+	// TargetOwnerID は操作の対象の所有者（出品者や購入者）です
+	TargetOwnerID *string                `json:"target_owner_id"`
+	Reason        string                 `json:"reason"`
+	Details       map[string]interface{} `json:"details"`
+	CreatedAt     time.Time              `json:"created_at"`
+}
+
+// AuditLogPage は監査ログ一覧の1ページ分の結果です
+// NextCursorは次のページが無い場合にnilになります
+type AuditLogPage struct {
+	Items      []AuditLog `json:"items"`
+	NextCursor *string    `json:"next_cursor"`
+}
+
+// newAuditLog は利用者による操作の監査ログを作成します
+func newAuditLog(actor *Principal, action string, targetType string, targetID string, reason string) *AuditLog {
+	return &AuditLog{
+		ActorID:    actor.UserID,
+		ActorRoles: actor.roleList(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Reason:     reason,
+		Details:    map[string]interface{}{},
+	}
+}
+
+// roleList は監査ログに記録するロールを返します（ロールが無い場合も空の配列にする）
+func (p *Principal) roleList() []string {
+	return append([]string{}, p.Roles...)
+}
+
+// ErrUserNotFound は存在しないユーザーを指定した場合に返されます
+var ErrUserNotFound = errors.New("user not found")
+
+// loadRoles は利用者のロールをDBから取得し、利用者に設定します（取得済みの場合は何もしない）
+// 全てのリクエストで取得しないよう、権限の確認が必要な場合だけ呼び出します
+// 環境変数 ADMIN_USER_IDS に含まれるユーザーは、DBにロールが無くても管理者として扱います
+func (a *Api) loadRoles(ctx context.Context, principal *Principal) error {
+	if principal.Roles != nil {
+		return nil
+	}
+	roles, err := a.store.GetUserRoles(ctx, principal.UserID)
+	if err != nil {
+		return err
+	}
+	if a.adminUserIDs[principal.UserID] && !containsString(roles, RoleAdmin) {
+		roles = append(roles, RoleAdmin)
+	}
+	principal.Roles = roles
+	return nil
+}
+
+// requirePermission は認証されているユーザーが権限を持つことを確認し、利用者を返します
+// 権限が無い場合はエラーを書き込み、falseを返します
+func (a *Api) requirePermission(w http.ResponseWriter, r *http.Request, permission Permission) (*Principal, bool) {
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return nil, false
+	}
+	if err := a.loadRoles(r.Context(), principal); err != nil {
+		log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+		http.Error(w, "Failed to get user roles", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !principal.Can(permission) {
+		http.Error(w, "Insufficient privileges", http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// UpdateUserRoleRequest はロールの付与・削除時に受け取るリクエストボディです（省略できます）
+type UpdateUserRoleRequest struct {
+	Reason string `json:"reason"`
+}
+
+// userRolesHandler は管理者がユーザーのロールを取得します
+func (a *Api) userRolesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.requirePermission(w, r, PermissionManageRoles); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := strings.ToLower(r.PathValue("id"))
+	if !uuidPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	roles, err := a.store.GetUserRoles(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+		http.Error(w, "Failed to get user roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"user_id": userID, "roles": roles}); err != nil {
+		log.Printf("ERROR: Failed to encode user roles to JSON: %v", err)
+	}
+}
+
+// userRoleHandler は管理者がユーザーにロールを付与（PUT）・削除（DELETE）し、監査ログに記録します
+func (a *Api) userRoleHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := a.requirePermission(w, r, PermissionManageRoles)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := strings.ToLower(r.PathValue("id"))
+	if !uuidPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	role := r.PathValue("role")
+	if !containsString(validRoles, role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	// 管理者が自分自身の管理者のロールを外して、管理者がいなくなることを防ぐ
+	if r.Method == http.MethodDelete && userID == actor.UserID && role == RoleAdmin {
+		http.Error(w, "You cannot revoke your own admin role", http.StatusConflict)
+		return
+	}
+
+	// リクエストボディは省略できる
+	var req UpdateUserRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update user role", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	action := AuditActionRoleGrant
+	var changed bool
+	if r.Method == http.MethodPut {
+		changed, err = store.GrantUserRole(r.Context(), userID, role, actor.UserID)
+	} else {
+		action = AuditActionRoleRevoke
+		changed, err = store.RevokeUserRole(r.Context(), userID, role)
+	}
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to update user role in DB: %v", err)
+		http.Error(w, "Failed to update user role", http.StatusInternalServerError)
+		return
+	}
+
+	// 既に付与（削除）されていた場合は何も変わらないので、監査ログに記録しない
+	if changed {
+		audit := newAuditLog(actor, action, "user", userID, strings.TrimSpace(req.Reason))
+		audit.TargetOwnerID = &userID
+		audit.Details["role"] = role
+		if err := store.RecordAuditLog(r.Context(), audit); err != nil {
+			log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+			http.Error(w, "Failed to update user role", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	roles, err := store.GetUserRoles(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get user roles from DB: %v", err)
+		http.Error(w, "Failed to update user role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to update user role", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		log.Printf("🛡️ Role %s of user %s was updated (%s) by %s", role, shortID(userID), action, shortID(actor.UserID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"user_id": userID, "roles": roles}); err != nil {
+		log.Printf("ERROR: Failed to encode user roles to JSON: %v", err)
+	}
+}
+
+// auditLogsHandler は管理者・モデレーターが監査ログを新しい順に1ページ分取得します
+// クエリパラメータ "target_type"・"target_id"・"actor_id" で絞り込めます
+func (a *Api) auditLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.requirePermission(w, r, PermissionViewAuditLogs); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	actorID := strings.ToLower(query.Get("actor_id"))
+	if actorID != "" && !uuidPattern.MatchString(actorID) {
+		http.Error(w, "Invalid actor_id", http.StatusBadRequest)
+		return
+	}
+
+	logs, err := a.store.GetAuditLogs(r.Context(), query.Get("target_type"), query.Get("target_id"), actorID, page)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		log.Printf("ERROR: Failed to get audit logs from DB: %v", err)
+		http.Error(w, "Failed to get audit logs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(logs); err != nil {
+		log.Printf("ERROR: Failed to encode audit logs to JSON: %v", err)
+	}
+}
+
+// recordAdminOrderAudit は管理者による注文の操作を監査ログに記録します
+func recordAdminOrderAudit(ctx context.Context, store *Store, actor *Principal, action string, orderID int, buyerID string, reason string, refunds []Refund) error {
+	audit := newAuditLog(actor, action, "order", strconv.Itoa(orderID), reason)
+	if buyerID != "" {
+		audit.TargetOwnerID = &buyerID
+	}
+	refundIDs := []int{}
+	amount := 0
+	for _, refunded := range refunds {
+		refundIDs = append(refundIDs, refunded.ID)
+		amount += refunded.Amount
+	}
+	audit.Details["refund_ids"] = refundIDs
+	audit.Details["refunded_amount"] = amount
+	return store.RecordAuditLog(ctx, audit)
+}
@@ -0,0 +1,915 @@
+// backend/refund.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 返金の状態（StripeのRefundの状態に対応します）
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+	RefundStatusCanceled  = "canceled"
+)
+
+// キャンセル依頼の状態
+const (
+	CancellationStatusPending  = "pending"
+	CancellationStatusApproved = "approved"
+	CancellationStatusRejected = "rejected"
+)
+
+// ErrInvalidRefund は返金する明細や数量が不正な場合に返されます
+var ErrInvalidRefund = errors.New("invalid refund")
+
+// ErrOrderNotRefundable は支払いが完了していない、または全額返金・チャージバック中の注文を返金しようとした場合に返されます
+var ErrOrderNotRefundable = errors.New("order is not refundable")
+
+// ErrSubOrderNotCancelable は発送済み、またはキャンセル済みの子注文をキャンセルしようとした場合に返されます
+var ErrSubOrderNotCancelable = errors.New("sub-order is not cancelable")
+
+// refundableOrderStatuses は返金・キャンセルできる注文の状態です
+var refundableOrderStatuses = map[string]bool{
+	OrderStatusSucceeded:         true,
+	OrderStatusPartiallyRefunded: true,
+}
+
+// cancelableFulfillmentStatuses は購入者の依頼で子注文をキャンセルできる、発送前の進捗の状態です
+var cancelableFulfillmentStatuses = []string{FulfillmentStatusUnfulfilled, FulfillmentStatusAccepted, FulfillmentStatusRoasting}
+
+// RefundItemRequest は返金する明細と数量です
+type RefundItemRequest struct {
+	OrderItemID int `json:"order_item_id"`
+	Quantity    int `json:"quantity"`
+}
+
+// CreateRefundRequest は返金の作成時に受け取るリクエストボディです
+type CreateRefundRequest struct {
+	// SubOrderID は返金する子注文のIDです（管理者のAPIでのみ使います）
+	SubOrderID      int                 `json:"sub_order_id"`
+	Items           []RefundItemRequest `json:"items"`
+	IncludeShipping bool                `json:"include_shipping"` // 子注文の送料も返金するか
+	Restock         bool                `json:"restock"`          // 返金した数量を在庫に戻すか
+	Reason          string              `json:"reason"`
+}
+
+// Refund 構造体は、子注文の1回の返金を保持します
+type Refund struct {
+	ID             int    `json:"id"`
+	OrderID        int    `json:"order_id"`
+	SubOrderID     int    `json:"sub_order_id"`
+	Amount         int    `json:"amount"`          // 返金額（送料を含みます）
+	ShippingAmount int    `json:"shipping_amount"` // 返金額のうち送料の額
+	Reason         string `json:"reason"`
+	RequestedBy    string `json:"requested_by"`
+	Status         string `json:"status"`
+	StripeRefundID string `json:"stripe_refund_id"`
+	// PayoutReduction は返金に応じて、送信前の出品者への入金から差し引いた額です
+	PayoutReduction int          `json:"-"`
+	CreatedAt       time.Time    `json:"created_at"`
+	UpdatedAt       time.Time    `json:"updated_at"`
+	Items           []RefundItem `json:"items"`
+}
+
+// RefundItem 構造体は、返金した明細と数量を保持します
+type RefundItem struct {
+	OrderItemID int  `json:"order_item_id"`
+	BeanID      int  `json:"bean_id"`
+	Quantity    int  `json:"quantity"`
+	Amount      int  `json:"amount"`
+	Restocked   bool `json:"restocked"`
+}
+
+// CancellationRequest 構造体は、購入者からの子注文のキャンセル依頼を保持します
+type CancellationRequest struct {
+	ID             int        `json:"id"`
+	OrderID        int        `json:"order_id"`
+	SubOrderID     int        `json:"sub_order_id"`
+	RequestedBy    string     `json:"requested_by"`
+	Reason         string     `json:"reason"`
+	Status         string     `json:"status"`
+	ResolvedBy     string     `json:"resolved_by"`
+	ResolutionNote string     `json:"resolution_note"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// RefundTarget 構造体は、返金額の計算に必要な子注文の状態と明細を保持します
+type RefundTarget struct {
+	SubOrderID        int
+	OrderID           int
+	SellerID          string
+	BuyerID           string
+	OrderStatus       string
+	FulfillmentStatus string
+	Currency          string
+	PaymentIntentID   string
+	// DestinationCharge は出品者への入金をDestination Chargeで行った注文かです
+	DestinationCharge bool
+	StripeTransferID  string
+	TotalAmount       int
+	ShippingFee       int
+	RefundedAmount    int
+	ShippingRefunded  bool
+	// PayoutAmount は子注文の出品者への入金額です
+	PayoutAmount int
+	Items        []RefundableItem
+}
+
+// RefundableItem 構造体は、子注文の明細と返金済みの数量を保持します
+type RefundableItem struct {
+	ID               int
+	BeanID           int
+	PriceAtPurchase  int
+	Quantity         int
+	RefundedQuantity int
+	DiscountAmount   int
+}
+
+// netAmount は明細のうちk個分の、値引き後の金額を返します
+// 値引きは数量に比例して割り当て、端数は最後に返金する分に含めるため、全数量を返金すると値引き後の金額と一致します
+func (i RefundableItem) netAmount(k int) int {
+	return i.PriceAtPurchase*k - i.DiscountAmount*k/i.Quantity
+}
+
+// refundAmount は明細のうち、まだ返金していない分からq個を返金する場合の返金額を返します
+func (i RefundableItem) refundAmount(q int) int {
+	return i.netAmount(i.RefundedQuantity+q) - i.netAmount(i.RefundedQuantity)
+}
+
+// RemainingQuantity はまだ返金していない数量を返します
+func (i RefundableItem) RemainingQuantity() int {
+	return i.Quantity - i.RefundedQuantity
+}
+
+// planRefund は返金する明細と数量を検証し、返金額を計算したRefundを返します
+// 送料は子注文ごとに1回だけ返金できます
+func planRefund(target *RefundTarget, items []RefundItemRequest, includeShipping bool) (*Refund, error) {
+	byID := make(map[int]RefundableItem, len(target.Items))
+	for _, item := range target.Items {
+		byID[item.ID] = item
+	}
+
+	r := &Refund{OrderID: target.OrderID, SubOrderID: target.SubOrderID, Status: RefundStatusPending, Items: []RefundItem{}}
+	seen := map[int]bool{}
+	for _, req := range items {
+		item, ok := byID[req.OrderItemID]
+		if !ok {
+			return nil, fmt.Errorf("%w: order item %d is not in sub-order %d", ErrInvalidRefund, req.OrderItemID, target.SubOrderID)
+		}
+		if seen[req.OrderItemID] {
+			return nil, fmt.Errorf("%w: duplicate order item %d", ErrInvalidRefund, req.OrderItemID)
+		}
+		seen[req.OrderItemID] = true
+		if req.Quantity <= 0 || req.Quantity > item.RemainingQuantity() {
+			return nil, fmt.Errorf("%w: quantity of order item %d must be between 1 and %d", ErrInvalidRefund, req.OrderItemID, item.RemainingQuantity())
+		}
+
+		amount := item.refundAmount(req.Quantity)
+		r.Items = append(r.Items, RefundItem{OrderItemID: item.ID, BeanID: item.BeanID, Quantity: req.Quantity, Amount: amount})
+		r.Amount += amount
+	}
+
+	if includeShipping {
+		if target.ShippingRefunded {
+			return nil, fmt.Errorf("%w: shipping fee of sub-order %d is already refunded", ErrInvalidRefund, target.SubOrderID)
+		}
+		r.ShippingAmount = target.ShippingFee
+		r.Amount += r.ShippingAmount
+	}
+
+	if r.Amount <= 0 {
+		return nil, fmt.Errorf("%w: nothing to refund", ErrInvalidRefund)
+	}
+	if r.Amount > target.TotalAmount-target.RefundedAmount {
+		return nil, fmt.Errorf("%w: refund amount %d exceeds the remaining amount %d", ErrInvalidRefund, r.Amount, target.TotalAmount-target.RefundedAmount)
+	}
+	return r, nil
+}
+
+// remainingItems は子注文の明細のうち、まだ返金していないすべての数量を返します
+func remainingItems(target *RefundTarget) []RefundItemRequest {
+	items := []RefundItemRequest{}
+	for _, item := range target.Items {
+		if item.RemainingQuantity() > 0 {
+			items = append(items, RefundItemRequest{OrderItemID: item.ID, Quantity: item.RemainingQuantity()})
+		}
+	}
+	return items
+}
+
+// reversalAmount は返金額に応じて、出品者への入金から取り消す額を返します
+// 子注文の合計に対する入金額の割合（手数料と値引きの負担を反映したもの）で按分します
+func reversalAmount(target *RefundTarget, amount int) int {
+	if target.TotalAmount <= 0 {
+		return 0
+	}
+	return int(int64(amount) * int64(target.PayoutAmount) / int64(target.TotalAmount))
+}
+
+// refundStatusOf は決済代行サービスの返金の状態（Stripeの値）を、refunds.statusの値に変換します
+// 購入者の操作を待っている返金は処理中として扱います
+func refundStatusOf(status string) string {
+	switch status {
+	case "succeeded":
+		return RefundStatusSucceeded
+	case "failed":
+		return RefundStatusFailed
+	case "canceled":
+		return RefundStatusCanceled
+	default:
+		return RefundStatusPending
+	}
+}
+
+// refundSendLease は送信中の返金を、他のサーバーが取得しないようにする時間です（送信に失敗した場合の再送の間隔にもなります）
+const refundSendLease = 5 * time.Minute
+
+// refundSendBatchSize は1回の間隔で再送する、返金の最大件数です
+const refundSendBatchSize = 100
+
+// refundSendInterval はStripeに送信できなかった返金を再送する間隔です
+const refundSendInterval = time.Minute
+
+// refundRetryWindow は返金を記録してから自動で再送する期間です
+// Stripeの冪等キーは24時間で期限切れになるため、それより前に再送をやめて返金を失敗にします
+const refundRetryWindow = 20 * time.Hour
+
+// refundSubOrder は子注文の明細と送料の返金を、Stripeへの送信待ちとして記録します
+// 返金額・返金済みの数量を先に記録し、コミット後にsubmitRefundでStripeに送信します（失敗した場合は記録を元に戻します）
+// 子注文ごとのTransferで入金した注文は、出品者への入金を送信前であれば返金額に応じて減らし、送信済みであれば取り消しを送信待ちにします
+// restockがtrueの場合は、返金した数量を在庫に戻します
+// storeはGetRefundTargetでtargetをロックしたトランザクションに紐づいている必要があります
+func refundSubOrder(ctx context.Context, store *Store, target *RefundTarget, items []RefundItemRequest, includeShipping bool, restock bool, reason string, requestedBy string) (*Refund, error) {
+	if !refundableOrderStatuses[target.OrderStatus] {
+		return nil, fmt.Errorf("%w: order status is %s", ErrOrderNotRefundable, target.OrderStatus)
+	}
+	r, err := planRefund(target, items, includeShipping)
+	if err != nil {
+		return nil, err
+	}
+	r.Reason = reason
+	r.RequestedBy = requestedBy
+
+	restockItems := []OrderItem{}
+	for i := range r.Items {
+		r.Items[i].Restocked = restock
+		if restock {
+			restockItems = append(restockItems, OrderItem{BeanID: r.Items[i].BeanID, Quantity: r.Items[i].Quantity})
+		}
+	}
+
+	// Destination Chargeの入金と手数料は、返金時にStripeが取り消す
+	reversal := 0
+	if !target.DestinationCharge {
+		reversal = reversalAmount(target, r.Amount)
+		if reversal > 0 {
+			reduced, err := store.ReduceUnsentPayoutTransfer(ctx, target.SubOrderID, reversal)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reduce payout of sub-order %d: %w", target.SubOrderID, err)
+			}
+			if reduced {
+				r.PayoutReduction = reversal
+				reversal = 0
+			}
+		}
+	}
+
+	// コミット直後に送信するので、その間に再送の処理が同じ返金を取得しないよう、再送はleaseの後にする
+	if err := store.CreateRefund(ctx, r, time.Now().Add(refundSendLease)); err != nil {
+		return nil, fmt.Errorf("failed to record refund for sub-order %d: %w", target.SubOrderID, err)
+	}
+	if len(restockItems) > 0 {
+		if err := store.RestockBeans(ctx, restockItems); err != nil {
+			return nil, fmt.Errorf("failed to restock beans for sub-order %d: %w", target.SubOrderID, err)
+		}
+	}
+	if reversal > 0 {
+		queued, err := store.QueueTransferReversal(ctx, r.ID, target.SubOrderID, reversal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to queue transfer reversal for refund %d: %w", r.ID, err)
+		}
+		if !queued {
+			log.Printf("WARN: Sub-order %d has no transfer to reverse for refund %d", target.SubOrderID, r.ID)
+		}
+	}
+	return r, nil
+}
+
+// pendingRefundOf は記録した返金を、Stripeへの送信待ちの返金として返します
+func pendingRefundOf(target *RefundTarget, r *Refund) *PendingRefund {
+	return &PendingRefund{
+		ID:                r.ID,
+		OrderID:           r.OrderID,
+		SubOrderID:        r.SubOrderID,
+		Amount:            r.Amount,
+		PaymentIntentID:   target.PaymentIntentID,
+		DestinationCharge: target.DestinationCharge,
+		Attempts:          1,
+	}
+}
+
+// isRefundUnsuccessful は返金が失敗・取り消しになったかを返します
+func isRefundUnsuccessful(status string) bool {
+	return status == RefundStatusFailed || status == RefundStatusCanceled
+}
+
+// submitRefund は記録した返金をStripeに送信し、結果を記録します
+// 返金のIDを冪等キーにするため、送信後の記録に失敗して再送しても二重に返金されません
+// 送信できなかった場合は失敗を記録してsendPendingRefundsで再送し、空のIDと送信待ち（pending）の状態を返します
+func (a *Api) submitRefund(ctx context.Context, p *PendingRefund, now time.Time) (string, string, error) {
+	params := &RefundParams{
+		PaymentIntentID: p.PaymentIntentID,
+		Amount:          int64(p.Amount),
+		ReverseTransfer: p.DestinationCharge,
+		Metadata: map[string]string{
+			"order_id":     strconv.Itoa(p.OrderID),
+			"sub_order_id": strconv.Itoa(p.SubOrderID),
+			"refund_id":    strconv.Itoa(p.ID),
+		},
+		IdempotencyKey: fmt.Sprintf("refund_%d", p.ID),
+	}
+	stripeRefundID, status, err := a.paymentProvider().CreateRefund(ctx, params)
+	if err != nil {
+		log.Printf("WARN: Failed to send refund %d for sub-order %d (attempt %d): %v", p.ID, p.SubOrderID, p.Attempts, err)
+		if err := a.store.RecordRefundFailure(ctx, p.ID, err.Error(), now.Add(refundSendLease)); err != nil {
+			return "", "", err
+		}
+		return "", RefundStatusPending, nil
+	}
+
+	tx, err := a.dbpool.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+	store := NewStore(tx)
+
+	recorded, err := store.RecordStripeRefund(ctx, p.ID, stripeRefundID, status)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to record stripe refund %s: %w", stripeRefundID, err)
+	}
+	if recorded && isRefundUnsuccessful(status) {
+		if err := store.RevertRefund(ctx, p.ID); err != nil {
+			return "", "", fmt.Errorf("failed to revert refund %d: %w", p.ID, err)
+		}
+		log.Printf("ERROR: Refund %d for sub-order %d was %s by Stripe, manual refund required", p.ID, p.SubOrderID, status)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", "", err
+	}
+	log.Printf("💸 Refunded %d for sub-order %d (refund %d, %s)", p.Amount, p.SubOrderID, p.ID, status)
+	return stripeRefundID, status, nil
+}
+
+// submitRefunds はトランザクションのコミット後に、記録した返金をStripeに送信し、結果をrefundsに設定します
+// 送信・記録に失敗した返金は、送信待ちのままsendPendingRefundsで再送します
+func (a *Api) submitRefunds(ctx context.Context, targets []*RefundTarget, refunds []*Refund) {
+	for i, r := range refunds {
+		stripeRefundID, status, err := a.submitRefund(ctx, pendingRefundOf(targets[i], r), time.Now())
+		if err != nil {
+			log.Printf("ERROR: Failed to submit refund %d: %v", r.ID, err)
+			continue
+		}
+		r.StripeRefundID = stripeRefundID
+		r.Status = status
+	}
+}
+
+// failUnsentRefund はStripeに送信できなかった返金を失敗にし、返金額・在庫の記録を元に戻します
+func (a *Api) failUnsentRefund(ctx context.Context, refundID int, message string) error {
+	tx, err := a.dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	store := NewStore(tx)
+
+	failed, err := store.FailUnsentRefund(ctx, refundID, message)
+	if err != nil {
+		return err
+	}
+	if !failed {
+		return nil
+	}
+	if err := store.RevertRefund(ctx, refundID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// sendPendingRefunds はStripeに送信できなかった返金のうち、再送する時期が来たものを送信します
+// 冪等キーの有効期限までに送信できなかった返金は失敗にし、返金額・在庫の記録を元に戻します
+// 戻り値は送信した件数です
+func (a *Api) sendPendingRefunds(ctx context.Context, now time.Time) (int, error) {
+	stale, err := a.store.GetStaleUnsentRefundIDs(ctx, now.Add(-refundRetryWindow))
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range stale {
+		if err := a.failUnsentRefund(ctx, id, "could not be sent to Stripe in time"); err != nil {
+			return 0, fmt.Errorf("failed to fail refund %d: %w", id, err)
+		}
+		log.Printf("ERROR: Refund %d could not be sent in time, manual refund required", id)
+	}
+
+	refunds, err := a.store.ClaimPendingRefunds(ctx, now, refundSendBatchSize, refundSendLease)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i := range refunds {
+		stripeRefundID, _, err := a.submitRefund(ctx, &refunds[i], now)
+		if err != nil {
+			return sent, err
+		}
+		if stripeRefundID != "" {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// runRefundSender は一定間隔でStripeに送信できなかった返金を再送します
+// ctxがキャンセルされるまで処理を続けるので、goroutineとして起動してください
+func (a *Api) runRefundSender(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := a.sendPendingRefunds(ctx, time.Now()); err != nil {
+				log.Printf("ERROR: Failed to send pending refunds: %v", err)
+			}
+		}
+	}
+}
+
+// cancelSubOrder は子注文をキャンセルし、まだ返金していない明細と送料をすべて返金します
+// 発送前の子注文は在庫を戻します。forceがtrueの場合（管理者による強制キャンセル）は発送後でもキャンセルできます
+// 注文のすべての子注文がキャンセルされた場合は、注文もキャンセル済みにします
+// 返金はStripeへの送信待ちとして記録するので、コミット後にsubmitRefundsで送信してください
+// 返金が無い（全額返金済みの）場合はnilのRefundを返します
+func cancelSubOrder(ctx context.Context, store *Store, target *RefundTarget, force bool, reason string, requestedBy string) (*Refund, error) {
+	if target.FulfillmentStatus == FulfillmentStatusCanceled {
+		return nil, fmt.Errorf("%w: sub-order %d is already canceled", ErrSubOrderNotCancelable, target.SubOrderID)
+	}
+	beforeShipment := containsString(cancelableFulfillmentStatuses, target.FulfillmentStatus)
+	if !force && !beforeShipment {
+		return nil, fmt.Errorf("%w: fulfillment status is %s", ErrSubOrderNotCancelable, target.FulfillmentStatus)
+	}
+	if !refundableOrderStatuses[target.OrderStatus] {
+		return nil, fmt.Errorf("%w: order status is %s", ErrOrderNotRefundable, target.OrderStatus)
+	}
+
+	if err := store.MarkSubOrderCanceled(ctx, target.SubOrderID); err != nil {
+		return nil, fmt.Errorf("failed to cancel sub-order %d: %w", target.SubOrderID, err)
+	}
+	active, err := store.GetActiveSubOrderIDs(ctx, target.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(active) == 0 {
+		if _, err := store.TransitionOrderStatus(ctx, target.OrderID, OrderStatusCanceled, "", "", "all sub-orders canceled: "+reason); err != nil {
+			return nil, err
+		}
+	}
+
+	items := remainingItems(target)
+	includeShipping := !target.ShippingRefunded && target.ShippingFee > 0
+	if len(items) == 0 && !includeShipping {
+		return nil, nil
+	}
+	return refundSubOrder(ctx, store, target, items, includeShipping, beforeShipment, reason, requestedBy)
+}
+
+// writeRefundError は返金・キャンセルのエラーをHTTPのステータスに変換して返します
+func writeRefundError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Sub-order not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidRefund):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrOrderNotRefundable), errors.Is(err, ErrSubOrderNotCancelable):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("ERROR: Failed to %s: %v", action, err)
+		http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+	}
+}
+
+// CreateCancellationRequestBody はキャンセル依頼の作成時に受け取るリクエストボディです
+type CreateCancellationRequestBody struct {
+	// SubOrderID はキャンセルする子注文のIDです（0の場合は注文のすべての発送前の子注文）
+	SubOrderID int    `json:"sub_order_id"`
+	Reason     string `json:"reason"`
+}
+
+// createCancellationRequestHandler は購入者自身の注文について、発送前の子注文のキャンセルを依頼します
+// 依頼は出品者が承認すると返金されます
+func (a *Api) createCancellationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	// リクエストボディは省略できる
+	var req CreateCancellationRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to request cancellation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	requests, err := NewStore(tx).CreateCancellationRequests(r.Context(), id, userID, req.SubOrderID, strings.TrimSpace(req.Reason))
+	if err != nil {
+		switch {
+		// 他のユーザーの注文である可能性を示唆しないよう、一般的なNot Foundを返す
+		case errors.Is(err, pgx.ErrNoRows):
+			http.Error(w, "Order not found", http.StatusNotFound)
+		case errors.Is(err, ErrOrderNotRefundable):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrSubOrderNotCancelable):
+			http.Error(w, "No sub-order can be canceled (already shipped, canceled or requested)", http.StatusConflict)
+		default:
+			log.Printf("ERROR: Failed to create cancellation requests in DB: %v", err)
+			http.Error(w, "Failed to request cancellation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to request cancellation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		log.Printf("ERROR: Failed to encode cancellation requests to JSON: %v", err)
+	}
+}
+
+// ResolveCancellationRequestBody はキャンセル依頼への対応時に受け取るリクエストボディです
+type ResolveCancellationRequestBody struct {
+	Approve bool   `json:"approve"`
+	Note    string `json:"note"`
+}
+
+// resolveCancellationRequestHandler は出品者自身の子注文へのキャンセル依頼を承認または却下します
+// 承認すると子注文をキャンセルし、まだ返金していない明細と送料を返金して在庫を戻します
+func (a *Api) resolveCancellationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid sub-order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ResolveCancellationRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+
+	// 状態の判定・返金の記録・依頼の更新を同じトランザクションで行い、コミット後にStripeで返金する
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to resolve cancellation request", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	target, err := store.GetRefundTarget(r.Context(), id)
+	// 他の出品者の子注文である可能性を示唆しないよう、一般的なNot Foundを返す
+	if err == nil && target.SellerID != userID {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		writeRefundError(w, err, "resolve cancellation request")
+		return
+	}
+
+	pending, err := store.GetPendingCancellationRequest(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "No pending cancellation request", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get cancellation request from DB: %v", err)
+		http.Error(w, "Failed to resolve cancellation request", http.StatusInternalServerError)
+		return
+	}
+
+	status := CancellationStatusRejected
+	if req.Approve {
+		status = CancellationStatusApproved
+	}
+	resolved, err := store.ResolveCancellationRequest(r.Context(), pending.ID, status, userID, req.Note)
+	if err != nil {
+		log.Printf("ERROR: Failed to resolve cancellation request in DB: %v", err)
+		http.Error(w, "Failed to resolve cancellation request", http.StatusInternalServerError)
+		return
+	}
+
+	var refunded *Refund
+	if req.Approve {
+		refunded, err = cancelSubOrder(r.Context(), store, target, false, pending.Reason, userID)
+		if err != nil {
+			writeRefundError(w, err, "resolve cancellation request")
+			return
+		}
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to resolve cancellation request", http.StatusInternalServerError)
+		return
+	}
+	if refunded != nil {
+		a.submitRefunds(r.Context(), []*RefundTarget{target}, []*Refund{refunded})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{"cancellation_request": resolved, "refund": refunded}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("ERROR: Failed to encode cancellation request to JSON: %v", err)
+	}
+}
+
+// createSellerRefundHandler は出品者自身の子注文について、明細の数量ごとに返金します
+func (a *Api) createSellerRefundHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid sub-order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req CreateRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a.refundSubOrderInTx(w, r, id, func(target *RefundTarget) bool { return target.SellerID == userID }, req, userID, nil)
+}
+
+// refundSubOrderInTx は子注文をロックして返金を記録し、コミット後にStripeで返金して、作成したRefundを返します
+// allowedがfalseを返す子注文は、存在しない場合と同じくNot Foundにします
+// auditActorが指定されている場合は、管理者による返金として同じトランザクションで監査ログに記録します
+func (a *Api) refundSubOrderInTx(w http.ResponseWriter, r *http.Request, subOrderID int, allowed func(*RefundTarget) bool, req CreateRefundRequest, userID string, auditActor *Principal) {
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to create refund", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	target, err := store.GetRefundTarget(r.Context(), subOrderID)
+	if err == nil && !allowed(target) {
+		err = pgx.ErrNoRows
+	}
+	if err != nil {
+		writeRefundError(w, err, "create refund")
+		return
+	}
+
+	refunded, err := refundSubOrder(r.Context(), store, target, req.Items, req.IncludeShipping, req.Restock, strings.TrimSpace(req.Reason), userID)
+	if err != nil {
+		writeRefundError(w, err, "create refund")
+		return
+	}
+
+	if auditActor != nil {
+		if err := recordAdminOrderAudit(r.Context(), store, auditActor, AuditActionOrderRefund, target.OrderID, target.BuyerID, strings.TrimSpace(req.Reason), []Refund{*refunded}); err != nil {
+			log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+			http.Error(w, "Failed to create refund", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to create refund", http.StatusInternalServerError)
+		return
+	}
+	a.submitRefunds(r.Context(), []*RefundTarget{target}, []*Refund{refunded})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(refunded); err != nil {
+		log.Printf("ERROR: Failed to encode refund to JSON: %v", err)
+	}
+}
+
+// AdminCancelOrderRequest は管理者による強制キャンセル時に受け取るリクエストボディです
+type AdminCancelOrderRequest struct {
+	Reason string `json:"reason"`
+}
+
+// adminCancelOrderHandler は管理者が注文を強制的にキャンセルします
+// 発送済みの子注文も含めて、キャンセルしていないすべての子注文を返金します（発送前の子注文のみ在庫を戻します）
+// 対応を待っているキャンセル依頼は承認済みにします
+func (a *Api) adminCancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := a.requirePermission(w, r, PermissionManageOrders)
+	if !ok {
+		return
+	}
+	userID := actor.UserID
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	// リクエストボディは省略できる
+	var req AdminCancelOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	subOrderIDs, err := store.GetActiveSubOrderIDs(r.Context(), id)
+	if err != nil {
+		log.Printf("ERROR: Failed to get sub-orders from DB: %v", err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+	if len(subOrderIDs) == 0 {
+		http.Error(w, "Order not found or already canceled", http.StatusNotFound)
+		return
+	}
+
+	refunds := []Refund{}
+	refundTargets := []*RefundTarget{}
+	buyerID := ""
+	for _, subOrderID := range subOrderIDs {
+		target, err := store.GetRefundTarget(r.Context(), subOrderID)
+		if err != nil {
+			writeRefundError(w, err, "cancel order")
+			return
+		}
+		buyerID = target.BuyerID
+
+		pending, err := store.GetPendingCancellationRequest(r.Context(), subOrderID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("ERROR: Failed to get cancellation request from DB: %v", err)
+			http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+			return
+		}
+		if pending != nil {
+			if _, err := store.ResolveCancellationRequest(r.Context(), pending.ID, CancellationStatusApproved, userID, req.Reason); err != nil {
+				log.Printf("ERROR: Failed to resolve cancellation request in DB: %v", err)
+				http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		refunded, err := cancelSubOrder(r.Context(), store, target, true, req.Reason, userID)
+		if err != nil {
+			writeRefundError(w, err, "cancel order")
+			return
+		}
+		if refunded != nil {
+			refunds = append(refunds, *refunded)
+			refundTargets = append(refundTargets, target)
+		}
+	}
+
+	if err := recordAdminOrderAudit(r.Context(), store, actor, AuditActionOrderCancel, id, buyerID, req.Reason, refunds); err != nil {
+		log.Printf("ERROR: Failed to record audit log in DB: %v", err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("🚫 Order %d was canceled by admin %s", id, shortID(userID))
+
+	// すべての子注文の返金をコミットしてから、Stripeで返金する
+	submitted := make([]*Refund, len(refunds))
+	for i := range refunds {
+		submitted[i] = &refunds[i]
+	}
+	a.submitRefunds(r.Context(), refundTargets, submitted)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(refunds); err != nil {
+		log.Printf("ERROR: Failed to encode refunds to JSON: %v", err)
+	}
+}
+
+// createAdminRefundHandler は管理者が注文の子注文を、明細の数量ごとに返金します
+func (a *Api) createAdminRefundHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := a.requirePermission(w, r, PermissionManageOrders)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req CreateRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SubOrderID <= 0 {
+		http.Error(w, "sub_order_id is required", http.StatusBadRequest)
+		return
+	}
+
+	a.refundSubOrderInTx(w, r, req.SubOrderID, func(target *RefundTarget) bool { return target.OrderID == id }, req, actor.UserID, actor)
+}
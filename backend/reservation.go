@@ -0,0 +1,142 @@
+// backend/reservation.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultReservationTTL は在庫確保の有効期限の既定値です
+// 環境変数 STOCK_RESERVATION_TTL で変更できます
+const defaultReservationTTL = 30 * time.Minute
+
+// reservationSweepInterval は期限切れの在庫確保を解放する間隔です
+const reservationSweepInterval = time.Minute
+
+// abandonedOrderBatchSize は1回の間隔でキャンセルする、支払われないまま放置された注文の最大件数です
+const abandonedOrderBatchSize = 100
+
+// stockReservationTTL は在庫確保の有効期限を返します
+func (a *Api) stockReservationTTL() time.Duration {
+	if a.reservationTTL <= 0 {
+		return defaultReservationTTL
+	}
+	return a.reservationTTL
+}
+
+// runReservationSweeper は一定間隔で期限切れの在庫確保を解放して在庫数を戻し、支払われないまま放置された注文をキャンセルします
+// ctxがキャンセルされるまで処理を続けるので、goroutineとして起動してください
+func (a *Api) runReservationSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := a.store.ExpireStockReservations(ctx, time.Now())
+			if err != nil {
+				log.Printf("ERROR: Failed to expire stock reservations: %v", err)
+				continue
+			}
+			if released > 0 {
+				log.Printf("⏰ Expired stock reservations restored stock for %d beans", released)
+			}
+			if err := a.expireAbandonedOrders(ctx, time.Now()); err != nil {
+				log.Printf("ERROR: Failed to expire abandoned orders: %v", err)
+			}
+		}
+	}
+}
+
+// cancelReservedCheckouts は購入者が決済をやり直す前に、在庫を確保したまま残っている以前の決済を取り消します
+// 支払い中・支払い済みで取り消せなかった注文は、購入者がまだ支払える（または支払った）ので在庫を確保したままにします
+func (a *Api) cancelReservedCheckouts(ctx context.Context, userID string) error {
+	orders, err := a.store.GetReservedCheckoutOrders(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		if _, err := a.cancelUnpaidOrder(ctx, &orders[i], "superseded by a new checkout"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireAbandonedOrders は在庫の確保が期限切れになっても支払われていない注文をキャンセルします
+func (a *Api) expireAbandonedOrders(ctx context.Context, now time.Time) error {
+	orders, err := a.store.GetAbandonedOrders(ctx, now.Add(-a.stockReservationTTL()), abandonedOrderBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		canceled, err := a.cancelUnpaidOrder(ctx, &orders[i], "expired without payment")
+		if err != nil {
+			return err
+		}
+		if canceled {
+			log.Printf("⏰ Order %d expired without payment", orders[i].ID)
+		}
+	}
+	return nil
+}
+
+// cancelUnpaidOrder は後から支払われないよう注文のPaymentIntentを取り消し、取り消せた場合に注文をキャンセルして在庫を解放します
+// PaymentIntentの作成前に失敗した注文は、支払われることが無いのでそのままキャンセルします
+// 支払い中・支払い済みなどで取り消せなかった場合は何もせず、その支払いのWebhookに任せます。戻り値は注文をキャンセルしたかです
+func (a *Api) cancelUnpaidOrder(ctx context.Context, order *Order, reason string) (bool, error) {
+	if order.StripePaymentIntentID != "" {
+		pi, err := a.paymentProvider().CancelPaymentIntent(ctx, order.StripePaymentIntentID)
+		if err != nil {
+			log.Printf("WARN: Failed to cancel payment intent %s of order %d: %v", order.StripePaymentIntentID, order.ID, err)
+			return false, nil
+		}
+		if pi.Status != "canceled" {
+			log.Printf("INFO: Keeping order %d: payment intent %s is %s", order.ID, pi.ID, pi.Status)
+			return false, nil
+		}
+	}
+	return a.cancelPendingOrder(ctx, order.ID, reason)
+}
+
+// cancelPendingOrder は支払われなかった注文をキャンセルにし、確保していた在庫を解放します
+// 既に支払い中・支払い済みなどでキャンセルに遷移できない場合は、在庫を解放せずに何もしません。戻り値は注文をキャンセルしたかです
+func (a *Api) cancelPendingOrder(ctx context.Context, orderID int, reason string) (bool, error) {
+	tx, err := a.dbpool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	storeWithTx := NewStore(tx)
+	if _, err := storeWithTx.TransitionOrderStatus(ctx, orderID, OrderStatusCanceled, "", "", reason); err != nil {
+		if errors.Is(err, ErrInvalidOrderTransition) {
+			log.Printf("INFO: Not canceling order %d: %v", orderID, err)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to cancel order %d: %w", orderID, err)
+	}
+	if _, err := storeWithTx.ReleaseStockReservations(ctx, orderID); err != nil {
+		return false, fmt.Errorf("failed to release stock reservations of order %d: %w", orderID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// abandonCheckout は保留中の注文を作成した後にPaymentIntentの作成や紐づけに失敗した場合に、
+// 作成済みのPaymentIntentを取り消し、注文をキャンセルして確保した在庫を解放します
+// ここで失敗しても、在庫の確保は有効期限で解放され、注文は期限切れでキャンセルされます
+func (a *Api) abandonCheckout(ctx context.Context, orderID int, paymentIntentID string) {
+	if _, err := a.cancelUnpaidOrder(ctx, &Order{ID: orderID, StripePaymentIntentID: paymentIntentID}, "checkout failed"); err != nil {
+		log.Printf("ERROR: Failed to cancel abandoned order %d: %v", orderID, err)
+	}
+}
@@ -0,0 +1,306 @@
+// backend/shipping.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 送料の計算方法（shipping_settings.rate_type）
+const (
+	// ShippingRateTypeFlat は全国一律の送料です
+	ShippingRateTypeFlat = "flat"
+	// ShippingRateTypeWeight は荷物の重さの区分ごとの送料です
+	ShippingRateTypeWeight = "weight"
+	// ShippingRateTypePrefecture は配送先の都道府県ごとの送料です
+	ShippingRateTypePrefecture = "prefecture"
+)
+
+// validShippingRateTypes はshipping_rate_type型で定義されている送料の計算方法です
+var validShippingRateTypes = map[string]bool{
+	ShippingRateTypeFlat:       true,
+	ShippingRateTypeWeight:     true,
+	ShippingRateTypePrefecture: true,
+}
+
+// ErrShippingUnavailable は出品者の送料表で配送できない荷物（重さの上限超え、対象外の都道府県）の場合のエラーです
+var ErrShippingUnavailable = errors.New("shipping is not available")
+
+// ErrShippingAddressRequired は都道府県ごとの送料の計算に、購入者の郵便番号が必要な場合のエラーです
+var ErrShippingAddressRequired = errors.New("a valid post code is required to calculate shipping")
+
+// prefectureNames はJIS X 0401の都道府県コード（1〜47）に対応する都道府県名です
+var prefectureNames = [...]string{
+	"", "北海道", "青森県", "岩手県", "宮城県", "秋田県", "山形県", "福島県",
+	"茨城県", "栃木県", "群馬県", "埼玉県", "千葉県", "東京都", "神奈川県",
+	"新潟県", "富山県", "石川県", "福井県", "山梨県", "長野県", "岐阜県",
+	"静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県",
+	"奈良県", "和歌山県", "鳥取県", "島根県", "岡山県", "広島県", "山口県",
+	"徳島県", "香川県", "愛媛県", "高知県", "福岡県", "佐賀県", "長崎県",
+	"熊本県", "大分県", "宮崎県", "鹿児島県", "沖縄県",
+}
+
+// prefectureName は都道府県コードに対応する都道府県名を返します（範囲外の場合は空）
+func prefectureName(code int) string {
+	if code < 1 || code >= len(prefectureNames) {
+		return ""
+	}
+	return prefectureNames[code]
+}
+
+// postCodePrefixRanges は郵便番号の上3桁の範囲と都道府県コードの対応です
+// 郵便番号は上3桁でほぼ都道府県が決まるため、送料の計算にはこの対応を使います
+// （県境の一部の地域では実際の都道府県と異なる場合があります）
+var postCodePrefixRanges = []struct {
+	from, to       int
+	prefectureCode int
+}{
+	{1, 9, 1}, {10, 19, 5}, {20, 29, 3}, {30, 39, 2}, {40, 99, 1},
+	{100, 209, 13}, {210, 259, 14}, {260, 299, 12}, {300, 319, 8}, {320, 329, 9},
+	{330, 369, 11}, {370, 379, 10}, {380, 399, 20}, {400, 409, 19}, {410, 439, 22},
+	{440, 499, 23}, {500, 509, 21}, {510, 519, 24}, {520, 529, 25}, {530, 599, 27},
+	{600, 629, 26}, {630, 639, 29}, {640, 649, 30}, {650, 679, 28}, {680, 689, 31},
+	{690, 699, 32}, {700, 719, 33}, {720, 739, 34}, {740, 759, 35}, {760, 769, 37},
+	{770, 779, 36}, {780, 789, 39}, {790, 799, 38}, {800, 839, 40}, {840, 849, 41},
+	{850, 859, 42}, {860, 869, 43}, {870, 879, 44}, {880, 889, 45}, {890, 899, 46},
+	{900, 909, 47}, {910, 919, 18}, {920, 929, 17}, {930, 939, 16}, {940, 959, 15},
+	{960, 979, 7}, {980, 989, 4}, {990, 999, 6},
+}
+
+// prefectureCodeFromPostCode は郵便番号（"123-4567"、"1234567"、全角数字など）から都道府県コードを返します
+// 郵便番号として解釈できない場合は0を返します
+func prefectureCodeFromPostCode(postCode string) int {
+	digits := make([]byte, 0, 7)
+	for _, r := range strings.TrimSpace(postCode) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r >= '０' && r <= '９':
+			digits = append(digits, byte('0'+(r-'０')))
+		case r == '-' || r == '－' || r == 'ー' || r == '〒' || r == ' ':
+			// 区切り文字は無視する
+		default:
+			return 0
+		}
+	}
+	if len(digits) != 7 {
+		return 0
+	}
+
+	prefix := int(digits[0]-'0')*100 + int(digits[1]-'0')*10 + int(digits[2]-'0')
+	for _, r := range postCodePrefixRanges {
+		if prefix >= r.from && prefix <= r.to {
+			return r.prefectureCode
+		}
+	}
+	return 0
+}
+
+// ShippingWeightRate 構造体は、重さの区分ごとの送料です
+// 荷物の重さがMaxWeightGrams以下となる最も軽い区分の送料を適用します
+type ShippingWeightRate struct {
+	MaxWeightGrams int `json:"max_weight_grams"`
+	Fee            int `json:"fee"`
+}
+
+// ShippingPrefectureRate 構造体は、配送先の都道府県ごとの送料です
+type ShippingPrefectureRate struct {
+	PrefectureCode int    `json:"prefecture_code"`
+	Prefecture     string `json:"prefecture"` // 表示用の都道府県名
+	Fee            int    `json:"fee"`
+}
+
+// ShippingSettings 構造体は、出品者の送料表を保持します
+type ShippingSettings struct {
+	SellerID string `json:"seller_id"`
+	RateType string `json:"rate_type"`
+	FlatFee  int    `json:"flat_fee"`
+	// FreeShippingThreshold は送料が無料になる小計の下限です（nilの場合は送料無料なし）
+	FreeShippingThreshold *int                     `json:"free_shipping_threshold"`
+	WeightRates           []ShippingWeightRate     `json:"weight_rates"`
+	PrefectureRates       []ShippingPrefectureRate `json:"prefecture_rates"`
+}
+
+// Validate は送料表の内容が正しいかを検証します
+func (s *ShippingSettings) Validate() error {
+	if !validShippingRateTypes[s.RateType] {
+		return fmt.Errorf("invalid rate_type: %s", s.RateType)
+	}
+	if s.FlatFee < 0 {
+		return errors.New("flat_fee must not be negative")
+	}
+	if s.FreeShippingThreshold != nil && *s.FreeShippingThreshold < 0 {
+		return errors.New("free_shipping_threshold must not be negative")
+	}
+
+	seenWeights := map[int]bool{}
+	for _, rate := range s.WeightRates {
+		if rate.MaxWeightGrams <= 0 || rate.Fee < 0 {
+			return errors.New("weight_rates must have a positive max_weight_grams and a non-negative fee")
+		}
+		if seenWeights[rate.MaxWeightGrams] {
+			return fmt.Errorf("duplicate max_weight_grams in weight_rates: %d", rate.MaxWeightGrams)
+		}
+		seenWeights[rate.MaxWeightGrams] = true
+	}
+	if s.RateType == ShippingRateTypeWeight && len(s.WeightRates) == 0 {
+		return errors.New("weight_rates are required for weight-based shipping")
+	}
+
+	seenPrefectures := map[int]bool{}
+	for _, rate := range s.PrefectureRates {
+		if prefectureName(rate.PrefectureCode) == "" || rate.Fee < 0 {
+			return errors.New("prefecture_rates must have a prefecture_code between 1 and 47 and a non-negative fee")
+		}
+		if seenPrefectures[rate.PrefectureCode] {
+			return fmt.Errorf("duplicate prefecture_code in prefecture_rates: %d", rate.PrefectureCode)
+		}
+		seenPrefectures[rate.PrefectureCode] = true
+	}
+	if s.RateType == ShippingRateTypePrefecture && len(s.PrefectureRates) == 0 {
+		return errors.New("prefecture_rates are required for prefecture-based shipping")
+	}
+	return nil
+}
+
+// Fee は出品者の商品の小計・重さ・配送先の都道府県コードから送料を計算します
+// 小計が送料無料の下限以上であれば、計算方法にかかわらず0円です
+func (s *ShippingSettings) Fee(subtotal int, weightGrams int, prefectureCode int) (int, error) {
+	if s.FreeShippingThreshold != nil && subtotal >= *s.FreeShippingThreshold {
+		return 0, nil
+	}
+
+	switch s.RateType {
+	case ShippingRateTypeFlat:
+		return s.FlatFee, nil
+
+	case ShippingRateTypeWeight:
+		found := false
+		fee, maxWeight := 0, 0
+		for _, rate := range s.WeightRates {
+			if weightGrams <= rate.MaxWeightGrams && (!found || rate.MaxWeightGrams < maxWeight) {
+				found, fee, maxWeight = true, rate.Fee, rate.MaxWeightGrams
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("%w: %dg exceeds the heaviest weight bracket", ErrShippingUnavailable, weightGrams)
+		}
+		return fee, nil
+
+	case ShippingRateTypePrefecture:
+		if prefectureCode == 0 {
+			return 0, ErrShippingAddressRequired
+		}
+		for _, rate := range s.PrefectureRates {
+			if rate.PrefectureCode == prefectureCode {
+				return rate.Fee, nil
+			}
+		}
+		return 0, fmt.Errorf("%w: %s", ErrShippingUnavailable, prefectureName(prefectureCode))
+
+	default:
+		return 0, fmt.Errorf("invalid rate_type: %s", s.RateType)
+	}
+}
+
+// sellerShippingHandler は "/api/seller/shipping" へのリクエストをHTTPメソッドによって振り分ける
+func (a *Api) sellerShippingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.getShippingSettingsHandler(w, r)
+	case http.MethodPut:
+		a.updateShippingSettingsHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getShippingSettingsHandler は認証されているユーザーの送料表を返します
+// 送料表を設定していない場合は、送料0円の全国一律として返します
+func (a *Api) getShippingSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	settings, err := a.store.GetShippingSettings(r.Context(), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		settings = &ShippingSettings{
+			SellerID:        userID,
+			RateType:        ShippingRateTypeFlat,
+			WeightRates:     []ShippingWeightRate{},
+			PrefectureRates: []ShippingPrefectureRate{},
+		}
+	} else if err != nil {
+		log.Printf("ERROR: Failed to get shipping settings from DB: %v", err)
+		http.Error(w, "Failed to get shipping settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		log.Printf("ERROR: Failed to encode shipping settings to JSON: %v", err)
+	}
+}
+
+// updateShippingSettingsHandler は認証されているユーザーの送料表を、リクエストの内容で置き換えます
+func (a *Api) updateShippingSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// contextから、認証ミドルウェアが設定したユーザーIDを取得
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	var settings ShippingSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	settings.SellerID = userID
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 送料表と重さ・都道府県ごとの送料を1つのトランザクションで置き換える
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update shipping settings", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context()) // エラー発生時にロールバック
+
+	storeWithTx := NewStore(tx)
+	if err := storeWithTx.SaveShippingSettings(r.Context(), &settings); err != nil {
+		log.Printf("ERROR: Failed to save shipping settings for user %s: %v", userID, err)
+		http.Error(w, "Failed to update shipping settings", http.StatusInternalServerError)
+		return
+	}
+	saved, err := storeWithTx.GetShippingSettings(r.Context(), userID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get shipping settings from DB: %v", err)
+		http.Error(w, "Failed to update shipping settings", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit shipping settings for user %s: %v", userID, err)
+		http.Error(w, "Failed to update shipping settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(saved); err != nil {
+		log.Printf("ERROR: Failed to encode shipping settings to JSON: %v", err)
+	}
+}
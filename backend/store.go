@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +23,13 @@ type Querier interface {
 	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
 }
 
+// TxBeginnerインターフェースは、トランザクションを開始できるDB接続を定義します（pgxpool.Poolとpgx.Txの両方が満たします）
+// pgx.Txから開始したトランザクションはセーブポイントになるため、テストではロールバックするトランザクションの中でハンドラを実行できます
+type TxBeginner interface {
+	Querier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 // Bean 構造体
 type Bean struct {
 	ID           int       `json:"id"`
@@ -25,10 +37,49 @@ type Bean struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 	Name         string    `json:"name"`
 	Origin       string    `json:"origin"`
-	Price        int       `json:"price"`
+	Price        int       `json:"price"` // 税込価格
 	Process      string    `json:"process"`
 	RoastProfile string    `json:"roast_profile"`
 	UserID       string    `json:"user_id"`
+	Stock        int       `json:"stock"`        // 在庫数（袋単位。カートの数量と同じ単位）
+	WeightGrams  int       `json:"weight_grams"` // 1袋あたりの重さ（グラム）。送料の計算に使う
+	TaxCategory  string    `json:"tax_category"` // 消費税の区分（reduced: 8%, standard: 10%）
+	// UnpublishedAt・UnpublishedReason は管理者・モデレーターが出品を非公開にした日時と理由です（公開中はnil・空）
+	UnpublishedAt     *time.Time `json:"unpublished_at"`
+	UnpublishedReason string     `json:"unpublished_reason"`
+	// SellerSuspended は出品者が停止されているかです（停止中の出品者の豆は購入者に表示しない）
+	SellerSuspended bool `json:"seller_suspended"`
+}
+
+// Listed は豆が購入者に表示される（非公開にされておらず、出品者が停止されていない）かを返します
+func (b *Bean) Listed() bool {
+	return b.UnpublishedAt == nil && !b.SellerSuspended
+}
+
+// ErrBeanUnavailable は非公開にされた豆や、停止中の出品者の豆を購入しようとした場合に返されます
+var ErrBeanUnavailable = errors.New("bean is not available")
+
+// listedBeanCondition は購入者に表示する豆（非公開にされておらず、出品者が停止されていない）の条件です
+// aliasはbeansテーブルの別名です
+func listedBeanCondition(alias string) string {
+	return fmt.Sprintf("(%[1]s.unpublished_at IS NULL AND NOT %[2]s)", alias, sellerSuspendedColumn(alias))
+}
+
+// sellerSuspendedColumn は豆の出品者が停止されているかを返す式です
+func sellerSuspendedColumn(alias string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM seller_suspensions ss WHERE ss.user_id = %s.user_id)", alias)
+}
+
+// beanColumns は豆を取得する際の列です（aliasはbeansテーブルの別名）
+func beanColumns(alias string) string {
+	return fmt.Sprintf("%[1]s.id, %[1]s.created_at, %[1]s.updated_at, %[1]s.name, %[1]s.origin, %[1]s.price, %[1]s.process, %[1]s.roast_profile, COALESCE(%[1]s.user_id::text, ''), %[1]s.stock, %[1]s.weight_grams, %[1]s.tax_category, %[1]s.unpublished_at, %[1]s.unpublished_reason, %[2]s",
+		alias, sellerSuspendedColumn(alias))
+}
+
+// scanTargets はbeanColumnsの列を読み込む先を返します
+func (b *Bean) scanTargets() []interface{} {
+	return []interface{}{&b.ID, &b.CreatedAt, &b.UpdatedAt, &b.Name, &b.Origin, &b.Price, &b.Process, &b.RoastProfile, &b.UserID, &b.Stock, &b.WeightGrams, &b.TaxCategory,
+		&b.UnpublishedAt, &b.UnpublishedReason, &b.SellerSuspended}
 }
 
 // Store はデータベース接続またはトランザクションを保持します
@@ -41,10 +92,255 @@ func NewStore(db Querier) *Store {
 	return &Store{db: db}
 }
 
-// GetAllBeans はbeansテーブルから全ての豆を取得します
-func (s *Store) GetAllBeans(ctx context.Context) ([]Bean, error) {
-	// 標準的なSQLクエリを記述
-	rows, err := s.db.Query(ctx, "SELECT id, created_at, updated_at, name, origin, price, process, roast_profile FROM beans ORDER BY id DESC")
+// 豆の並び替え順を表す定数です
+const (
+	BeanSortNewest    = "newest"
+	BeanSortUpdated   = "updated"
+	BeanSortPriceAsc  = "price_asc"
+	BeanSortPriceDesc = "price_desc"
+)
+
+// beanSortOrders は並び替え順ごとのORDER BY句です
+// 同じ値の行の順序が安定するように、最後にidで並べます
+var beanSortOrders = map[string]string{
+	BeanSortNewest:    "id DESC",
+	BeanSortUpdated:   "updated_at DESC, id DESC",
+	BeanSortPriceAsc:  "price ASC, id ASC",
+	BeanSortPriceDesc: "price DESC, id DESC",
+}
+
+// validProcesses はprocess_enumで定義されている精製方法です
+var validProcesses = map[string]bool{
+	"natural": true,
+	"washed":  true,
+	"honey":   true,
+}
+
+// validRoastProfiles はroast_profile_enumで定義されている焙煎度です
+var validRoastProfiles = map[string]bool{
+	"light":     true,
+	"cinnamon":  true,
+	"medium":    true,
+	"high":      true,
+	"city":      true,
+	"full_city": true,
+	"french":    true,
+	"italian":   true,
+}
+
+// BeanFilter は豆の検索条件を保持します
+// 値が空（ポインタの場合はnil）の条件は絞り込みに使いません
+type BeanFilter struct {
+	Origin       string
+	Process      string
+	RoastProfile string
+	MinPrice     *int
+	MaxPrice     *int
+	SellerID     string
+	Keyword      string
+	Sort         string
+	// Visibility は公開状態での絞り込みです（空の場合はBeanVisibilityListedと同じく、購入者に表示する豆のみ）
+	Visibility string
+}
+
+// 豆の公開状態での絞り込み（BeanFilter.Visibility）
+const (
+	// BeanVisibilityListed は購入者に表示する豆のみです
+	BeanVisibilityListed = "listed"
+	// BeanVisibilityAll は非公開の豆や、停止中の出品者の豆も含めたすべての豆です
+	BeanVisibilityAll = "all"
+	// BeanVisibilityUnpublished は管理者・モデレーターが非公開にした豆です
+	BeanVisibilityUnpublished = "unpublished"
+	// BeanVisibilitySuspended は停止中の出品者の豆です
+	BeanVisibilitySuspended = "suspended"
+)
+
+// validBeanVisibilities は管理者向けの一覧で指定できる公開状態です
+var validBeanVisibilities = []string{BeanVisibilityListed, BeanVisibilityAll, BeanVisibilityUnpublished, BeanVisibilitySuspended}
+
+// escapeLikePattern はLIKE検索で特別な意味を持つ文字をエスケープします
+func escapeLikePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(s)
+}
+
+// buildBeanFilterConditions は検索条件からWHERE句の条件とプレースホルダの引数を組み立てます
+func buildBeanFilterConditions(filter BeanFilter) ([]string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	// addCondition は引数を追加し、その引数を参照するプレースホルダ番号を条件に埋め込みます
+	addCondition := func(format string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+
+	if filter.Origin != "" {
+		addCondition("LOWER(origin) = LOWER($%d)", filter.Origin)
+	}
+	if filter.Process != "" {
+		addCondition("process = $%d", strings.ToLower(filter.Process))
+	}
+	if filter.RoastProfile != "" {
+		addCondition("roast_profile = $%d", strings.ToLower(filter.RoastProfile))
+	}
+	if filter.MinPrice != nil {
+		addCondition("price >= $%d", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		addCondition("price <= $%d", *filter.MaxPrice)
+	}
+	if filter.SellerID != "" {
+		addCondition("user_id = $%d", filter.SellerID)
+	}
+	if filter.Keyword != "" {
+		// 同じプレースホルダを名前と産地の両方で使う
+		addCondition("(name ILIKE $%[1]d OR origin ILIKE $%[1]d)", "%"+escapeLikePattern(filter.Keyword)+"%")
+	}
+	switch filter.Visibility {
+	case BeanVisibilityAll:
+	case BeanVisibilityUnpublished:
+		conditions = append(conditions, "beans.unpublished_at IS NOT NULL")
+	case BeanVisibilitySuspended:
+		conditions = append(conditions, sellerSuspendedColumn("beans"))
+	default:
+		conditions = append(conditions, listedBeanCondition("beans"))
+	}
+
+	return conditions, args
+}
+
+// ページングの既定値と上限です
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+// ErrInvalidCursor はページングのカーソルが解釈できない場合に返されます
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrInsufficientStock は要求された数量が豆の在庫数を超えている場合に返されます
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// PageParams はキーセットページングの指定を保持します
+// Cursorは前のページのレスポンスに含まれるnext_cursorをそのまま渡します
+type PageParams struct {
+	Limit  int
+	Cursor string
+}
+
+// BeanPage は豆一覧の1ページ分の結果です
+// NextCursorは次のページが無い場合にnilになります
+type BeanPage struct {
+	Items      []Bean  `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+	TotalCount int     `json:"total_count"`
+}
+
+// beanCursor はカーソルに埋め込む、ページ末尾の行の並び替えキーです
+// クライアントからは中身の見えない文字列として扱われます
+type beanCursor struct {
+	Sort      string     `json:"s"`
+	ID        int        `json:"id"`
+	Price     int        `json:"p,omitempty"`
+	UpdatedAt *time.Time `json:"u,omitempty"`
+}
+
+// encodeBeanCursor はページ末尾の豆からカーソル文字列を作成します
+func encodeBeanCursor(sort string, last Bean) (string, error) {
+	c := beanCursor{Sort: sort, ID: last.ID}
+	switch sort {
+	case BeanSortUpdated:
+		c.UpdatedAt = &last.UpdatedAt
+	case BeanSortPriceAsc, BeanSortPriceDesc:
+		c.Price = last.Price
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeBeanCursor はカーソル文字列を解釈します
+// 並び替え順が異なるカーソルは、キーの意味が変わってしまうため受け付けません
+func decodeBeanCursor(sort string, cursor string) (*beanCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c beanCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != sort || c.ID <= 0 || (sort == BeanSortUpdated && c.UpdatedAt == nil) {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// beanCursorCondition はカーソルより後ろの行だけを取得するための条件を返します
+// 並び替えキーとidの行値比較にすることで、同じ値の行があっても取りこぼしません
+func beanCursorCondition(sort string, c *beanCursor, argIndex int) (string, []interface{}) {
+	switch sort {
+	case BeanSortUpdated:
+		return fmt.Sprintf("(updated_at, id) < ($%d, $%d)", argIndex, argIndex+1), []interface{}{*c.UpdatedAt, c.ID}
+	case BeanSortPriceAsc:
+		return fmt.Sprintf("(price, id) > ($%d, $%d)", argIndex, argIndex+1), []interface{}{c.Price, c.ID}
+	case BeanSortPriceDesc:
+		return fmt.Sprintf("(price, id) < ($%d, $%d)", argIndex, argIndex+1), []interface{}{c.Price, c.ID}
+	default:
+		return fmt.Sprintf("id < $%d", argIndex), []interface{}{c.ID}
+	}
+}
+
+// SearchBeans は検索条件に一致する豆を、指定された順序で1ページ分取得します
+func (s *Store) SearchBeans(ctx context.Context, filter BeanFilter, page PageParams) (*BeanPage, error) {
+	if _, ok := beanSortOrders[filter.Sort]; !ok {
+		filter.Sort = BeanSortNewest
+	}
+	orderBy := beanSortOrders[filter.Sort]
+
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	conditions, args := buildBeanFilterConditions(filter)
+
+	// 1. 検索条件に一致する総件数を取得（カーソルの位置には依存しない）
+	countQuery := "SELECT COUNT(*) FROM beans"
+	if len(conditions) > 0 {
+		countQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	var totalCount int
+	if err := s.db.QueryRow(ctx, countQuery, args...).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	// 2. カーソルが指定されていれば、その位置より後ろに絞り込む
+	if page.Cursor != "" {
+		c, err := decodeBeanCursor(filter.Sort, page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cond, cursorArgs := beanCursorCondition(filter.Sort, c, len(args)+1)
+		conditions = append(conditions, cond)
+		args = append(args, cursorArgs...)
+	}
+
+	query := "SELECT " + beanColumns("beans") + " FROM beans"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// 次のページがあるかを判定するため、1件多く取得する
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", orderBy, len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -54,18 +350,31 @@ func (s *Store) GetAllBeans(ctx context.Context) ([]Bean, error) {
 	for rows.Next() {
 		var b Bean
 		// 取得したデータをBean構造体にスキャン
-		if err := rows.Scan(&b.ID, &b.CreatedAt, &b.UpdatedAt, &b.Name, &b.Origin, &b.Price, &b.Process, &b.RoastProfile); err != nil {
+		if err := rows.Scan(b.scanTargets()...); err != nil {
 			return nil, err
 		}
 		beans = append(beans, b)
 	}
-	return beans, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &BeanPage{Items: beans, TotalCount: totalCount}
+	if len(beans) > limit {
+		result.Items = beans[:limit]
+		next, err := encodeBeanCursor(filter.Sort, result.Items[limit-1])
+		if err != nil {
+			return nil, err
+		}
+		result.NextCursor = &next
+	}
+	return result, nil
 }
 
-// GetBeanByID は指定されたIDの豆を1件取得します
+// GetBeanByID は指定されたIDの豆を1件取得します（非公開の豆も取得するので、表示してよいかは呼び出し側でListedを確認してください）
 func (s *Store) GetBeanByID(ctx context.Context, id int) (*Bean, error) {
 	var b Bean
-	err := s.db.QueryRow(ctx, "SELECT id, created_at, updated_at, name, origin, price, process, roast_profile FROM beans WHERE id = $1", id).Scan(&b.ID, &b.CreatedAt, &b.UpdatedAt, &b.Name, &b.Origin, &b.Price, &b.Process, &b.RoastProfile)
+	err := s.db.QueryRow(ctx, "SELECT "+beanColumns("beans")+" FROM beans WHERE id = $1", id).Scan(b.scanTargets()...)
 	if err != nil {
 		// データが見つからない場合もエラーになるので、それをハンドリングする必要がある（今後の課題）
 		return nil, err
@@ -77,11 +386,20 @@ func (s *Store) GetBeanByID(ctx context.Context, id int) (*Bean, error) {
 func (s *Store) CreateBean(ctx context.Context, bean *Bean) (*Bean, error) {
 	var newBean Bean
 	// SQLクエリ: 新しいデータを挿入し、その結果（IDなど）を返す
-	query := `INSERT INTO beans (name, origin, price, process, roast_profile, user_id, updated_at)
-			   VALUES ($1, $2, $3, $4, $5, $6, NOW())
-			   RETURNING id, created_at, updated_at, name, origin, price, process, roast_profile, user_id`
+	// 消費税の区分が未指定の場合は、コーヒー豆として軽減税率の対象とする
+	// 出品したユーザーには、同じSQL文で出品者（seller）のロールを付与する
+	query := `WITH inserted AS (
+			       INSERT INTO beans (name, origin, price, process, roast_profile, user_id, stock, weight_grams, tax_category, updated_at)
+			       VALUES ($1, $2, $3, $4, $5, $6, $7, $8, COALESCE(NULLIF($9, ''), 'reduced')::tax_category, NOW())
+			       RETURNING id, created_at, updated_at, name, origin, price, process, roast_profile, user_id, stock, weight_grams, tax_category
+			   ), granted AS (
+			       INSERT INTO user_roles (user_id, role)
+			       SELECT user_id, 'seller' FROM inserted
+			       ON CONFLICT (user_id, role) DO NOTHING
+			   )
+			   SELECT id, created_at, updated_at, name, origin, price, process, roast_profile, user_id, stock, weight_grams, tax_category FROM inserted`
 
-	err := s.db.QueryRow(ctx, query, bean.Name, bean.Origin, bean.Price, strings.ToLower(bean.Process), strings.ToLower(bean.RoastProfile), bean.UserID).Scan(
+	err := s.db.QueryRow(ctx, query, bean.Name, bean.Origin, bean.Price, strings.ToLower(bean.Process), strings.ToLower(bean.RoastProfile), bean.UserID, bean.Stock, bean.WeightGrams, bean.TaxCategory).Scan(
 		&newBean.ID,
 		&newBean.CreatedAt,
 		&newBean.UpdatedAt,
@@ -91,6 +409,9 @@ func (s *Store) CreateBean(ctx context.Context, bean *Bean) (*Bean, error) {
 		&newBean.Process,
 		&newBean.RoastProfile,
 		&newBean.UserID,
+		&newBean.Stock,
+		&newBean.WeightGrams,
+		&newBean.TaxCategory,
 	)
 
 	if err != nil {
@@ -101,27 +422,30 @@ func (s *Store) CreateBean(ctx context.Context, bean *Bean) (*Bean, error) {
 }
 
 // UpdateBean は指定されたIDのコーヒー豆の情報を更新します
-func (s *Store) UpdateBean(ctx context.Context, id int, userID string, bean *Bean) (*Bean, error) {
+// stock・weightGramsがnilの場合は、現在の在庫数・重量を維持します
+// 所有者のみが更新できますが、actorが出品を管理する権限（PermissionModerateBeans）を持つ場合は他のユーザーの豆も更新でき、
+// その操作をreasonとともに同じSQL文で監査ログに記録します
+// actorのロールはloadRolesで取得済みである必要があります
+func (s *Store) UpdateBean(ctx context.Context, id int, actor *Principal, bean *Bean, stock *int, weightGrams *int, reason string) (*Bean, error) {
 	var updatedBean Bean
 
 	// SQLクエリ: 既存のデータを更新し、その結果を返す
-	// WHERE句でidとuser_idの両方をチェックすることで、所有者のみが更新できるようにする
-	query := `UPDATE beans
-			   SET name = $1, origin = $2, price = $3, process = $4, roast_profile = $5, updated_at = NOW()
-			   WHERE id = $6 AND user_id = $7
-			   RETURNING id, created_at, updated_at, name, origin, price, process, roast_profile, user_id`
-
-	err := s.db.QueryRow(ctx, query, bean.Name, bean.Origin, bean.Price, strings.ToLower(bean.Process), strings.ToLower(bean.RoastProfile), id, userID).Scan(
-		&updatedBean.ID,
-		&updatedBean.CreatedAt,
-		&updatedBean.UpdatedAt,
-		&updatedBean.Name,
-		&updatedBean.Origin,
-		&updatedBean.Price,
-		&updatedBean.Process,
-		&updatedBean.RoastProfile,
-		&updatedBean.UserID,
-	)
+	// WHERE句でidとuser_idの両方をチェックすることで、所有者のみが更新できるようにする（権限がある場合は所有者の条件を外す）
+	query := `WITH updated AS (
+			       UPDATE beans
+			       SET name = $1, origin = $2, price = $3, process = $4, roast_profile = $5, stock = COALESCE($6::integer, stock), weight_grams = COALESCE($7::integer, weight_grams),
+			           tax_category = COALESCE(NULLIF($8, '')::tax_category, tax_category), updated_at = NOW()
+			       WHERE id = $9 AND (user_id = $10 OR $11)
+			       RETURNING *
+			   ), audited AS (
+			       INSERT INTO audit_logs (actor_id, actor_roles, action, target_type, target_id, target_owner_id, reason, details)
+			       SELECT $10, $12, $13, 'bean', updated.id::text, updated.user_id, $14, to_jsonb(updated)
+			       FROM updated WHERE updated.user_id IS DISTINCT FROM $10
+			   )
+			   SELECT ` + beanColumns("updated") + ` FROM updated`
+
+	err := s.db.QueryRow(ctx, query, bean.Name, bean.Origin, bean.Price, strings.ToLower(bean.Process), strings.ToLower(bean.RoastProfile), stock, weightGrams, bean.TaxCategory,
+		id, actor.UserID, actor.Can(PermissionModerateBeans), actor.roleList(), AuditActionBeanUpdate, reason).Scan(updatedBean.scanTargets()...)
 
 	if err != nil {
 		// pgx.ErrNoRowsは、行が見つからなかった（つまり、IDが違うか、ユーザーが所有者でない）場合に返される
@@ -135,42 +459,37 @@ func (s *Store) UpdateBean(ctx context.Context, id int, userID string, bean *Bea
 }
 
 // DeleteBean は指定されたIDのコーヒー豆の情報を削除します
-func (s *Store) DeleteBean(ctx context.Context, id int, userID string) error {
+// 所有者のみが削除できますが、actorが出品を管理する権限（PermissionModerateBeans）を持つ場合は他のユーザーの豆も削除でき、
+// 削除した豆の内容をreasonとともに同じSQL文で監査ログに記録します
+// actorのロールはloadRolesで取得済みである必要があります
+func (s *Store) DeleteBean(ctx context.Context, id int, actor *Principal, reason string) error {
 	// SQLクエリ: 既存のデータを削除する
-	// WHERE句でidとuser_idの両方をチェックすることで、所有者のみが削除できるようにする
-	query := `DELETE FROM beans WHERE id = $1 AND user_id = $2`
+	// WHERE句でidとuser_idの両方をチェックすることで、所有者のみが削除できるようにする（権限がある場合は所有者の条件を外す）
+	query := `WITH deleted AS (
+			       DELETE FROM beans WHERE id = $1 AND (user_id = $2 OR $3)
+			       RETURNING *
+			   ), audited AS (
+			       INSERT INTO audit_logs (actor_id, actor_roles, action, target_type, target_id, target_owner_id, reason, details)
+			       SELECT $2, $4, $5, 'bean', deleted.id::text, deleted.user_id, $6, to_jsonb(deleted)
+			       FROM deleted WHERE deleted.user_id IS DISTINCT FROM $2
+			   )
+			   SELECT id FROM deleted`
 
-	ct, err := s.db.Exec(ctx, query, id, userID)
+	var deletedID int
+	err := s.db.QueryRow(ctx, query, id, actor.UserID, actor.Can(PermissionModerateBeans), actor.roleList(), AuditActionBeanDelete, reason).Scan(&deletedID)
 	if err != nil {
+		// 1行も削除されなかった場合、それは対象が見つからなかったことを意味する
+		// (IDが違うか、userIDが違う)
 		return err
 	}
 
-	// Execで、1行も影響がなかった場合、それは対象が見つからなかったことを意味する
-	// (IDが違うか、userIDが違う)
-	if ct.RowsAffected() == 0 {
-		return pgx.ErrNoRows
-	}
-
 	return nil
 }
 
-// GetBeansByUserID は指定されたユーザーIDの豆を全件取得します
-func (s *Store) GetBeansByUserID(ctx context.Context, userID string) ([]Bean, error) {
-	rows, err := s.db.Query(ctx, "SELECT id, created_at, updated_at, name, origin, price, process, roast_profile, user_id FROM beans WHERE user_id = $1 ORDER BY id DESC", userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	beans := []Bean{}
-	for rows.Next() {
-		var b Bean
-		if err := rows.Scan(&b.ID, &b.CreatedAt, &b.UpdatedAt, &b.Name, &b.Origin, &b.Price, &b.Process, &b.RoastProfile, &b.UserID); err != nil {
-			return nil, err
-		}
-		beans = append(beans, b)
-	}
-	return beans, nil
+// GetBeansByUserID は指定されたユーザーIDの豆を新しい順に1ページ分取得します
+func (s *Store) GetBeansByUserID(ctx context.Context, userID string, page PageParams) (*BeanPage, error) {
+	// 出品者自身には、非公開にされた豆も表示する
+	return s.SearchBeans(ctx, BeanFilter{SellerID: userID, Sort: BeanSortNewest, Visibility: BeanVisibilityAll}, page)
 }
 
 // CartItem 構造体
@@ -208,19 +527,31 @@ func (s *Store) AddOrUpdateCartItem(ctx context.Context, userID string, req AddC
 	var existingItemID string
 	var currentQuantity int
 	err = s.db.QueryRow(ctx, "SELECT id, quantity FROM cart_items WHERE cart_id = $1 AND bean_id = $2", cartID, req.BeanID).Scan(&existingItemID, &currentQuantity)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	itemExists := err == nil
+
+	// 3. 追加後の数量が在庫数を超えないか確認
+	var stock int
+	if err := s.db.QueryRow(ctx, "SELECT stock FROM beans b WHERE b.id = $1 AND "+listedBeanCondition("b"), req.BeanID).Scan(&stock); err != nil {
+		// 豆が存在しない（非公開にされた豆や、停止中の出品者の豆を含む）場合はpgx.ErrNoRowsをそのまま返す
+		return nil, err
+	}
+	if currentQuantity+req.Quantity > stock {
+		return nil, ErrInsufficientStock
+	}
 
 	var resultItem CartItem
-	if err == pgx.ErrNoRows {
-		// 3a. 存在しない場合は新規追加
+	if !itemExists {
+		// 4a. 存在しない場合は新規追加
 		query := `INSERT INTO cart_items (cart_id, bean_id, quantity) VALUES ($1, $2, $3)
 				  RETURNING id, cart_id, bean_id, quantity, created_at, updated_at`
 		err = s.db.QueryRow(ctx, query, cartID, req.BeanID, req.Quantity).Scan(
 			&resultItem.ID, &resultItem.CartID, &resultItem.BeanID, &resultItem.Quantity, &resultItem.CreatedAt, &resultItem.UpdatedAt,
 		)
-	} else if err != nil {
-		return nil, err
 	} else {
-		// 3b. 存在する場合は数量を更新
+		// 4b. 存在する場合は数量を更新
 		newQuantity := currentQuantity + req.Quantity
 		query := `UPDATE cart_items SET quantity = $1, updated_at = NOW() WHERE id = $2
 				  RETURNING id, cart_id, bean_id, quantity, created_at, updated_at`
@@ -245,6 +576,10 @@ type CartItemDetail struct {
 	Quantity     int    `json:"quantity"`
 	Process      string `json:"process"`
 	RoastProfile string `json:"roast_profile"`
+	Stock        int    `json:"stock"`
+	TaxCategory  string `json:"tax_category"` // 消費税の区分（価格は税込）
+	// Available はカートに入れた後に豆が非公開にされたり、出品者が停止されたりしていないかです（falseの場合は購入できない）
+	Available bool `json:"available"`
 	// 必要に応じて他のBeanのフィールドも追加
 }
 
@@ -270,7 +605,10 @@ func (s *Store) GetCartItemsByUserID(ctx context.Context, userID string) ([]Cart
 			b.price,
 			ci.quantity,
 			b.process,
-			b.roast_profile
+			b.roast_profile,
+			b.stock,
+			b.tax_category,
+			` + listedBeanCondition("b") + `
 		FROM
 			cart_items ci
 		JOIN
@@ -289,7 +627,7 @@ func (s *Store) GetCartItemsByUserID(ctx context.Context, userID string) ([]Cart
 	var items []CartItemDetail
 	for rows.Next() {
 		var item CartItemDetail
-		if err := rows.Scan(&item.ID, &item.BeanID, &item.Name, &item.Price, &item.Quantity, &item.Process, &item.RoastProfile); err != nil {
+		if err := rows.Scan(&item.ID, &item.BeanID, &item.Name, &item.Price, &item.Quantity, &item.Process, &item.RoastProfile, &item.Stock, &item.TaxCategory, &item.Available); err != nil {
 			return nil, err
 		}
 		items = append(items, item)
@@ -309,8 +647,25 @@ type UpdateCartItemRequest struct {
 	Quantity int `json:"quantity"`
 }
 
-// UpdateCartItemQuantity はカート内の商品の数量を更新します。所有権もチェックします。
+// UpdateCartItemQuantity はカート内の商品の数量を更新します。所有権と在庫数もチェックします。
+// 非公開にされた豆や、停止中の出品者の豆は、AddOrUpdateCartItemと同じくpgx.ErrNoRowsを返します
 func (s *Store) UpdateCartItemQuantity(ctx context.Context, cartItemID string, userID string, quantity int) (*CartItem, error) {
+	// 更新後の数量が在庫数を超えないか確認
+	stockQuery := `
+		SELECT b.stock
+		FROM cart_items ci
+		JOIN carts c ON ci.cart_id = c.id
+		JOIN beans b ON ci.bean_id = b.id
+		WHERE ci.id = $1 AND c.user_id = $2 AND ` + listedBeanCondition("b")
+	var stock int
+	if err := s.db.QueryRow(ctx, stockQuery, cartItemID, userID).Scan(&stock); err != nil {
+		// 商品が見つからない（IDが違う、所有者でない、豆が出品されていない）場合はpgx.ErrNoRowsをそのまま返す
+		return nil, err
+	}
+	if quantity > stock {
+		return nil, ErrInsufficientStock
+	}
+
 	query := `
 		UPDATE cart_items ci
 		SET quantity = $1, updated_at = NOW()
@@ -364,17 +719,87 @@ func (s *Store) DeleteCartItem(ctx context.Context, cartItemID string, userID st
 	return nil
 }
 
+// 注文の状態を表す定数です（order_status型の値）
+const (
+	OrderStatusPending    = "pending"
+	OrderStatusProcessing = "processing"
+	OrderStatusSucceeded  = "succeeded"
+	OrderStatusFailed     = "failed"
+	OrderStatusCanceled   = "canceled"
+
+	OrderStatusRequiresAction    = "requires_action"
+	OrderStatusPartiallyRefunded = "partially_refunded"
+	OrderStatusRefunded          = "refunded"
+	OrderStatusDisputed          = "disputed"
+)
+
+// orderStatusTransitions は注文の状態ごとに、次に遷移できる状態を定義します
+// Webhookは順不同・遅延して届くことがあるため、ここに無い遷移（確定した注文を戻すなど）は行いません
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPending:           {OrderStatusRequiresAction, OrderStatusProcessing, OrderStatusSucceeded, OrderStatusFailed, OrderStatusCanceled},
+	OrderStatusRequiresAction:    {OrderStatusProcessing, OrderStatusSucceeded, OrderStatusFailed, OrderStatusCanceled},
+	OrderStatusProcessing:        {OrderStatusRequiresAction, OrderStatusSucceeded, OrderStatusFailed, OrderStatusCanceled},
+	OrderStatusFailed:            {OrderStatusRequiresAction, OrderStatusProcessing, OrderStatusSucceeded, OrderStatusCanceled},
+	OrderStatusSucceeded:         {OrderStatusPartiallyRefunded, OrderStatusRefunded, OrderStatusDisputed, OrderStatusCanceled},
+	OrderStatusPartiallyRefunded: {OrderStatusPartiallyRefunded, OrderStatusRefunded, OrderStatusDisputed, OrderStatusCanceled},
+	OrderStatusDisputed:          {OrderStatusRefunded},
+	// 返金・キャンセルした後でも、購入者はカード会社に異議を申し立てられる
+	OrderStatusRefunded: {OrderStatusDisputed},
+	OrderStatusCanceled: {OrderStatusDisputed},
+}
+
+// canTransitionOrderStatus は注文の状態をfromからtoへ遷移できるかを返します
+func canTransitionOrderStatus(from string, to string) bool {
+	for _, next := range orderStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// validOrderStatuses はorder_status型で定義されている注文の状態です
+var validOrderStatuses = map[string]bool{
+	OrderStatusPending:           true,
+	"awaiting_payment_method":    true,
+	OrderStatusRequiresAction:    true,
+	OrderStatusProcessing:        true,
+	OrderStatusSucceeded:         true,
+	OrderStatusFailed:            true,
+	OrderStatusCanceled:          true,
+	OrderStatusPartiallyRefunded: true,
+	OrderStatusRefunded:          true,
+	OrderStatusDisputed:          true,
+}
+
+// ErrInvalidOrderTransition は許可されていない注文の状態遷移を行おうとした場合に返されます
+var ErrInvalidOrderTransition = errors.New("invalid order status transition")
+
 // Order 構造体
 type Order struct {
-	ID                    int       `json:"id"`
-	UserID                string    `json:"user_id"`
-	Status                string    `json:"status"`
-	TotalAmount           int       `json:"total_amount"`
-	Currency              string    `json:"currency"`
-	PaymentMethodType     string    `json:"payment_method_type"`
-	StripePaymentIntentID string    `json:"stripe_payment_intent_id"`
-	CreatedAt             time.Time `json:"created_at"`
-	UpdatedAt             time.Time `json:"updated_at"`
+	ID                     int          `json:"id"`
+	UserID                 string       `json:"user_id"`
+	Status                 string       `json:"status"`
+	TotalAmount            int          `json:"total_amount"`
+	ShippingFee            int          `json:"shipping_fee"`              // 子注文の送料の合計（total_amountに含まれます）
+	Tax                    TaxBreakdown `json:"tax"`                       // 子注文の税率ごとの消費税の合計（total_amountに含まれます）
+	CouponCode             string       `json:"coupon_code"`               // 注文時点のクーポンコード（利用していない場合は空）
+	DiscountAmount         int          `json:"discount_amount"`           // 子注文の値引き額の合計（total_amountから差し引き済みです）
+	PlatformFee            int          `json:"platform_fee"`              // 子注文の手数料の合計
+	PlatformFeeBasisPoints int          `json:"platform_fee_basis_points"` // 出品者ごとの上書きが無い場合に適用した手数料率
+	Currency               string       `json:"currency"`
+	PaymentMethodType      string       `json:"payment_method_type"`
+	StripePaymentIntentID  string       `json:"stripe_payment_intent_id"`
+	// SubscriptionID は定期便の注文の場合の申し込みのIDです（通常の注文の場合はnil）
+	SubscriptionID *int `json:"subscription_id"`
+	// SubscriptionDeliveryDate は定期便の注文の場合のお届け日です（"2006-01-02"の形式。通常の注文の場合は空）
+	SubscriptionDeliveryDate string    `json:"subscription_delivery_date"`
+	CreatedAt                time.Time `json:"created_at"`
+	UpdatedAt                time.Time `json:"updated_at"`
+	// StripeTransferGroup は子注文ごとのTransferで入金する場合のグループです（注文の作成時にのみ使います）
+	StripeTransferGroup string `json:"-"`
+	// CouponID は利用したクーポンのIDです（注文の作成時にのみ使います。利用していない場合は0）
+	CouponID int `json:"-"`
 }
 
 // OrderItem 構造体
@@ -386,135 +811,2967 @@ type OrderItem struct {
 	Quantity        int `json:"quantity"`
 }
 
-// CreateOrder は新しい注文をDBに作成します
-func (s *Store) CreateOrder(ctx context.Context, order *Order, items []CartItemDetail) (*Order, error) {
-	// 1. ordersテーブルに注文を挿入
-	orderQuery := `
-		INSERT INTO orders (user_id, status, total_amount, currency, payment_method_type, stripe_payment_intent_id)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, created_at, updated_at
-	`
-	err := s.db.QueryRow(ctx, orderQuery, order.UserID, order.Status, order.TotalAmount, order.Currency, order.PaymentMethodType, order.StripePaymentIntentID).Scan(&order.ID, &order.CreatedAt, &order.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-
-	// 2. order_itemsテーブルに注文商品を挿入
-	batch := &pgx.Batch{}
-	itemQuery := `
-		INSERT INTO order_items (order_id, bean_id, price_at_purchase, quantity)
-		VALUES ($1, $2, $3, $4)
-	`
+// orderItemsFromCart はカートの商品を、購入時点の価格を持つ注文明細に変換します
+func orderItemsFromCart(items []CartItemDetail) []OrderItem {
+	orderItems := make([]OrderItem, 0, len(items))
 	for _, item := range items {
-		batch.Queue(itemQuery, order.ID, item.BeanID, item.Price, item.Quantity)
+		orderItems = append(orderItems, OrderItem{BeanID: item.BeanID, PriceAtPurchase: item.Price, Quantity: item.Quantity})
 	}
+	return orderItems
+}
 
-	br := s.db.SendBatch(ctx, batch)
-	defer br.Close()
+// SellerCartItems はカートの商品を出品者ごとにまとめたものです
+// 入金先として、出品者のStripe Connectアカウントを保持します
+type SellerCartItems struct {
+	SellerID            string
+	StripeAccountID     string
+	StripeAccountStatus string
+	// PlatformFeeBasisPoints は出品者ごとに上書きされた手数料率です（nilの場合は全体の手数料率を使う）
+	PlatformFeeBasisPoints *int
+	Items                  []CartItemDetail
+	// WeightGrams は出品者の商品の合計の重さです
+	WeightGrams int
+	// ShippingFee はQuoteShippingで計算した送料です
+	ShippingFee int
+	// InvoiceRegistrationNumber は出品者の適格請求書発行事業者の登録番号です（未登録の場合は空）
+	InvoiceRegistrationNumber string
+	// DiscountByTaxCategory はapplyCouponで割り当てた、消費税の区分ごとのクーポンの値引き額です
+	DiscountByTaxCategory map[string]int
+	// ItemDiscounts はapplyCouponで明細（Items）ごとに割り当てた値引き額です（値引きが無い場合はnil）
+	ItemDiscounts []int
+	// DiscountFundedBy は値引きの負担者です（値引きが無い場合は空）
+	DiscountFundedBy string
+}
 
-	for i := 0; i < len(items); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			return nil, err
-		}
+// Subtotal は出品者の商品の小計を返します
+func (g *SellerCartItems) Subtotal() int {
+	subtotal := 0
+	for _, item := range g.Items {
+		subtotal += item.Price * item.Quantity
 	}
+	return subtotal
+}
 
-	return order, nil
+// Discount は出品者の商品に割り当てたクーポンの値引き額を返します
+func (g *SellerCartItems) Discount() int {
+	return g.DiscountByTaxCategory[TaxCategoryReduced] + g.DiscountByTaxCategory[TaxCategoryStandard]
 }
 
-// ClearCart はユーザーのカートを空にします
-func (s *Store) ClearCart(ctx context.Context, userID string) error {
-	// ユーザーIDに紐づくカートIDを取得
-	var cartID string
-	err := s.db.QueryRow(ctx, "SELECT id FROM carts WHERE user_id = $1", userID).Scan(&cartID)
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			// カートが存在しない場合は、何もせず正常終了
-			return nil
-		}
-		return err
+// Total は出品者の商品の小計と送料から、値引き額を差し引いた請求額を返します
+func (g *SellerCartItems) Total() int {
+	return g.Subtotal() + g.ShippingFee - g.Discount()
+}
+
+// PlatformFee は出品者の商品の小計に対するプラットフォーム手数料を返します
+// 出品者負担の値引きは出品者の売上を減らすため、値引き後の小計に手数料をかけます
+func (g *SellerCartItems) PlatformFee(defaultBasisPoints int) int {
+	base := g.Subtotal()
+	if g.DiscountFundedBy == CouponFundedBySeller {
+		base -= g.Discount()
 	}
+	return platformFee(base, g.FeeBasisPoints(defaultBasisPoints))
+}
 
-	// カートIDに紐づくすべてのカートアイテムを削除
-	_, err = s.db.Exec(ctx, "DELETE FROM cart_items WHERE cart_id = $1", cartID)
-	return err
+// Payout は出品者への入金額（請求額から手数料を差し引いた額）を返します
+// プラットフォーム負担の値引きは、プラットフォームが出品者に補填します
+func (g *SellerCartItems) Payout(defaultBasisPoints int) int {
+	payout := g.Total() - g.PlatformFee(defaultBasisPoints)
+	if g.DiscountFundedBy == CouponFundedByPlatform {
+		payout += g.Discount()
+	}
+	return payout
 }
 
-// GetOrderByPaymentIntentID はStripeのPaymentIntent IDで注文を取得します
-func (s *Store) GetOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (*Order, error) {
-	var order Order
-	query := `SELECT id, user_id, status, total_amount, currency, payment_method_type, stripe_payment_intent_id, created_at, updated_at FROM orders WHERE stripe_payment_intent_id = $1`
-	err := s.db.QueryRow(ctx, query, paymentIntentID).Scan(
-		&order.ID, &order.UserID, &order.Status, &order.TotalAmount, &order.Currency, &order.PaymentMethodType, &order.StripePaymentIntentID, &order.CreatedAt, &order.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
+// FeeBasisPoints は出品者に適用する手数料率を返します
+func (g *SellerCartItems) FeeBasisPoints(defaultBasisPoints int) int {
+	if g.PlatformFeeBasisPoints != nil {
+		return *g.PlatformFeeBasisPoints
 	}
-	return &order, nil
+	return defaultBasisPoints
 }
 
-// Profile 構造体
-type Profile struct {
-	UserID           string    `json:"user_id"`
-	DisplayName      string    `json:"display_name"`
-	IconURL          string    `json:"icon_url"`
-	PostCode         string    `json:"post_code"`
-	Address          string    `json:"address"`
-	AboutMe          string    `json:"about_me"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
-	StripeCustomerID *string    `json:"stripe_customer_id"`
+// TaxBreakdown は出品者の商品と送料の、税率ごとの対象額と消費税額を返します
+// 送料は商品の区分にかかわらず標準税率の対象です
+// クーポンの値引きは、割り当てた区分の対象額から差し引きます
+func (g *SellerCartItems) TaxBreakdown() TaxBreakdown {
+	reduced, standard := -g.DiscountByTaxCategory[TaxCategoryReduced], g.ShippingFee-g.DiscountByTaxCategory[TaxCategoryStandard]
+	for _, item := range g.Items {
+		if item.TaxCategory == TaxCategoryStandard {
+			standard += item.Price * item.Quantity
+		} else {
+			reduced += item.Price * item.Quantity
+		}
+	}
+	return newTaxBreakdown(reduced, standard)
 }
 
-// CreateProfile は新しいプロフィールをDBに挿入します
-func (s *Store) CreateProfile(ctx context.Context, profile *Profile) (*Profile, error) {
-	var newProfile Profile
-	query := `INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
-			   VALUES ($1, $2, $3, $4, $5, $6)
-			   RETURNING user_id, display_name, icon_url, post_code, address, about_me, created_at, updated_at, stripe_customer_id`
+// PayoutsEnabled は出品者が売上を受け取れる状態（Stripe Connectの登録が完了している）かを返します
+func (g *SellerCartItems) PayoutsEnabled() bool {
+	return g.StripeAccountID != "" && g.StripeAccountStatus == StripeAccountStatusEnabled
+}
 
-	err := s.db.QueryRow(ctx, query, profile.UserID, profile.DisplayName, profile.IconURL, profile.PostCode, profile.Address, profile.AboutMe).Scan(
-		&newProfile.UserID,
-		&newProfile.DisplayName,
-		&newProfile.IconURL,
-		&newProfile.PostCode,
-		&newProfile.Address,
-		&newProfile.AboutMe,
-		&newProfile.CreatedAt,
-		&newProfile.UpdatedAt,
-		&newProfile.StripeCustomerID,
-	)
+// GroupCartItemsBySeller はカートの商品を、コーヒー豆の出品者ごとにまとめます
+// 出品者はカートの内容ではなくbeansテーブルから引くため、呼び出し側が指定する必要はありません
+// 出品者の並びは、カート内で最初に現れた順です
+func (s *Store) GroupCartItemsBySeller(ctx context.Context, items []CartItemDetail) ([]SellerCartItems, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	beanIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		beanIDs = append(beanIDs, item.BeanID)
+	}
 
+	query := `
+		SELECT b.id, b.weight_grams, b.tax_category, COALESCE(b.user_id::text, ''), COALESCE(p.stripe_account_id, ''), COALESCE(p.stripe_account_status, ''), p.platform_fee_basis_points,
+			COALESCE(p.invoice_registration_number, '')
+		FROM beans b
+		LEFT JOIN profiles p ON b.user_id = p.user_id
+		WHERE b.id = ANY($1)
+	`
+	rows, err := s.db.Query(ctx, query, beanIDs)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &newProfile, nil
+	sellerOf := map[int]SellerCartItems{}
+	weightOf := map[int]int{}
+	taxCategoryOf := map[int]string{}
+	for rows.Next() {
+		var beanID, weightGrams int
+		var taxCategory string
+		var seller SellerCartItems
+		if err := rows.Scan(&beanID, &weightGrams, &taxCategory, &seller.SellerID, &seller.StripeAccountID, &seller.StripeAccountStatus, &seller.PlatformFeeBasisPoints, &seller.InvoiceRegistrationNumber); err != nil {
+			return nil, err
+		}
+		sellerOf[beanID] = seller
+		weightOf[beanID] = weightGrams
+		taxCategoryOf[beanID] = taxCategory
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := []SellerCartItems{}
+	indexOf := map[string]int{}
+	for _, item := range items {
+		seller, ok := sellerOf[item.BeanID]
+		if !ok {
+			return nil, fmt.Errorf("bean %d: %w", item.BeanID, pgx.ErrNoRows)
+		}
+		i, ok := indexOf[seller.SellerID]
+		if !ok {
+			i = len(groups)
+			indexOf[seller.SellerID] = i
+			groups = append(groups, seller)
+		}
+		// 消費税の区分はカートの内容ではなく、beansテーブルの値を使う
+		item.TaxCategory = taxCategoryOf[item.BeanID]
+		groups[i].Items = append(groups[i].Items, item)
+		groups[i].WeightGrams += weightOf[item.BeanID] * item.Quantity
+	}
+	return groups, nil
 }
 
-// UpdateProfile は既存のプロフィールを更新します
-func (s *Store) UpdateProfile(ctx context.Context, profile *Profile) (*Profile, error) {
-	var updatedProfile Profile
-	query := `UPDATE profiles
-			   SET display_name = $1, icon_url = $2, post_code = $3, address = $4, about_me = $5, updated_at = NOW()
-			   WHERE user_id = $6
-			   RETURNING user_id, display_name, icon_url, post_code, address, about_me, created_at, updated_at, stripe_customer_id`
+// QuoteShipping は購入者のプロフィールの郵便番号を配送先として、出品者ごとの送料を計算しgroupsに設定します
+// 送料表を設定していない出品者の送料は0円です
+func (s *Store) QuoteShipping(ctx context.Context, buyerID string, groups []SellerCartItems) error {
+	var postCode string
+	err := s.db.QueryRow(ctx, "SELECT COALESCE(post_code, '') FROM profiles WHERE user_id = $1", buyerID).Scan(&postCode)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	prefectureCode := prefectureCodeFromPostCode(postCode)
 
-	err := s.db.QueryRow(ctx, query, profile.DisplayName, profile.IconURL, profile.PostCode, profile.Address, profile.AboutMe, profile.UserID).Scan(
-		&updatedProfile.UserID,
-		&updatedProfile.DisplayName,
-		&updatedProfile.IconURL,
-		&updatedProfile.PostCode,
-		&updatedProfile.Address,
-		&updatedProfile.AboutMe,
-		&updatedProfile.CreatedAt,
-		&updatedProfile.UpdatedAt,
-		&updatedProfile.StripeCustomerID,
-	)
+	for i := range groups {
+		groups[i].ShippingFee = 0
+		if groups[i].SellerID == "" {
+			continue
+		}
+		settings, err := s.GetShippingSettings(ctx, groups[i].SellerID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fee, err := settings.Fee(groups[i].Subtotal(), groups[i].WeightGrams, prefectureCode)
+		if err != nil {
+			return err
+		}
+		groups[i].ShippingFee = fee
+	}
+	return nil
+}
 
-	if err != nil {
+// GetShippingSettings は出品者の送料表を取得します
+// 送料表が設定されていない場合はpgx.ErrNoRowsを返します
+func (s *Store) GetShippingSettings(ctx context.Context, sellerID string) (*ShippingSettings, error) {
+	settings := ShippingSettings{
+		SellerID:        sellerID,
+		WeightRates:     []ShippingWeightRate{},
+		PrefectureRates: []ShippingPrefectureRate{},
+	}
+	query := "SELECT rate_type::text, flat_fee, free_shipping_threshold FROM shipping_settings WHERE seller_id = $1"
+	if err := s.db.QueryRow(ctx, query, sellerID).Scan(&settings.RateType, &settings.FlatFee, &settings.FreeShippingThreshold); err != nil {
 		return nil, err
 	}
 
-	return &updatedProfile, nil
-}
\ No newline at end of file
+	rows, err := s.db.Query(ctx, "SELECT max_weight_grams, fee FROM shipping_weight_rates WHERE seller_id = $1 ORDER BY max_weight_grams", sellerID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var rate ShippingWeightRate
+		if err := rows.Scan(&rate.MaxWeightGrams, &rate.Fee); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		settings.WeightRates = append(settings.WeightRates, rate)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.Query(ctx, "SELECT prefecture_code, fee FROM shipping_prefecture_rates WHERE seller_id = $1 ORDER BY prefecture_code", sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rate ShippingPrefectureRate
+		if err := rows.Scan(&rate.PrefectureCode, &rate.Fee); err != nil {
+			return nil, err
+		}
+		rate.Prefecture = prefectureName(rate.PrefectureCode)
+		settings.PrefectureRates = append(settings.PrefectureRates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SaveShippingSettings は出品者の送料表を保存します
+// 重さ・都道府県ごとの送料は、指定された内容で置き換えます
+// 複数のテーブルを更新するため、トランザクション内で呼び出してください
+func (s *Store) SaveShippingSettings(ctx context.Context, settings *ShippingSettings) error {
+	query := `
+		INSERT INTO shipping_settings (seller_id, rate_type, flat_fee, free_shipping_threshold)
+		VALUES ($1, $2::shipping_rate_type, $3, $4)
+		ON CONFLICT (seller_id) DO UPDATE
+		SET rate_type = EXCLUDED.rate_type, flat_fee = EXCLUDED.flat_fee,
+			free_shipping_threshold = EXCLUDED.free_shipping_threshold, updated_at = NOW()
+	`
+	if _, err := s.db.Exec(ctx, query, settings.SellerID, settings.RateType, settings.FlatFee, settings.FreeShippingThreshold); err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue("DELETE FROM shipping_weight_rates WHERE seller_id = $1", settings.SellerID)
+	batch.Queue("DELETE FROM shipping_prefecture_rates WHERE seller_id = $1", settings.SellerID)
+	for _, rate := range settings.WeightRates {
+		batch.Queue("INSERT INTO shipping_weight_rates (seller_id, max_weight_grams, fee) VALUES ($1, $2, $3)", settings.SellerID, rate.MaxWeightGrams, rate.Fee)
+	}
+	for _, rate := range settings.PrefectureRates {
+		batch.Queue("INSERT INTO shipping_prefecture_rates (seller_id, prefecture_code, fee) VALUES ($1, $2, $3)", settings.SellerID, rate.PrefectureCode, rate.Fee)
+	}
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateOrder は新しい注文をDBに作成します
+// カートの商品を出品者ごとにまとめて送料を計算し、CreateOrderForSellersで記録します
+func (s *Store) CreateOrder(ctx context.Context, order *Order, items []CartItemDetail) (*Order, error) {
+	groups, err := s.GroupCartItemsBySeller(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.QuoteShipping(ctx, order.UserID, groups); err != nil {
+		return nil, err
+	}
+	return s.CreateOrderForSellers(ctx, order, groups)
+}
+
+// CreateOrderForSellers は出品者ごとにまとめたカートの商品から注文をDBに作成します
+// 商品は出品者ごとの子注文に分けて記録し、注文のtotal_amountは全体の合計として扱います
+// 明細には、返金額の計算に使うため、明細ごとに割り当てた値引き額も記録します
+// groupsの送料（ShippingFee）は子注文の合計に含め、その合計を注文のshipping_feeとします
+// プラットフォーム手数料は子注文の小計（送料を除く）ごとに計算し、出品者ごとの上書きが無ければorder.PlatformFeeBasisPointsを適用します
+// 消費税は出品者ごとの請求書となる子注文ごとに税率別に計算し、その合計を注文の消費税とします
+// groupsにapplyCouponで割り当てたクーポンの値引きは子注文の合計から差し引き、その合計を注文のdiscount_amountとします
+func (s *Store) CreateOrderForSellers(ctx context.Context, order *Order, groups []SellerCartItems) (*Order, error) {
+	// 1. 出品者ごとの手数料・送料・値引き・消費税を合計
+	order.PlatformFee = 0
+	order.ShippingFee = 0
+	order.DiscountAmount = 0
+	order.Tax = TaxBreakdown{}
+	for _, group := range groups {
+		order.PlatformFee += group.PlatformFee(order.PlatformFeeBasisPoints)
+		order.ShippingFee += group.ShippingFee
+		order.DiscountAmount += group.Discount()
+		order.Tax = order.Tax.Add(group.TaxBreakdown())
+	}
+
+	// 2. ordersテーブルに注文を挿入
+	orderQuery := `
+		INSERT INTO orders (user_id, status, total_amount, shipping_fee, reduced_taxable_amount, reduced_tax, standard_taxable_amount, standard_tax,
+			coupon_id, coupon_code, discount_amount, platform_fee, platform_fee_basis_points, currency, payment_method_type, stripe_payment_intent_id, stripe_transfer_group,
+			subscription_id, subscription_delivery_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, 0), NULLIF($10, ''), $11, $12, $13, $14, $15, $16, NULLIF($17, ''), $18, NULLIF($19, '')::date)
+		RETURNING id, created_at, updated_at
+	`
+	err := s.db.QueryRow(ctx, orderQuery, order.UserID, order.Status, order.TotalAmount, order.ShippingFee,
+		order.Tax.ReducedTaxableAmount, order.Tax.ReducedTax, order.Tax.StandardTaxableAmount, order.Tax.StandardTax, order.CouponID, order.CouponCode, order.DiscountAmount,
+		order.PlatformFee, order.PlatformFeeBasisPoints, order.Currency, order.PaymentMethodType, order.StripePaymentIntentID, order.StripeTransferGroup,
+		order.SubscriptionID, order.SubscriptionDeliveryDate).Scan(&order.ID, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 注文の作成をタイムラインの最初の履歴として記録
+	if err := s.recordOrderStatusChange(ctx, order.ID, "", order.Status, "", "order created"); err != nil {
+		return nil, err
+	}
+
+	// 3. 出品者ごとに子注文を作成
+	subOrderQuery := `
+		INSERT INTO sub_orders (order_id, seller_id, subtotal, shipping_fee, total_amount, reduced_taxable_amount, reduced_tax, standard_taxable_amount, standard_tax,
+			seller_invoice_registration_number, discount_amount, discount_funded_by, platform_fee, platform_fee_basis_points, stripe_account_id)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, NULLIF($12, '')::coupon_funded_by, $13, $14, NULLIF($15, ''))
+		RETURNING id
+	`
+	subOrderIDs := make([]int, len(groups))
+	for i, group := range groups {
+		// 登録番号は注文時点のものを子注文に記録し、後から出品者が変更しても請求書の内容は変わらないようにする
+		tax := group.TaxBreakdown()
+		err := s.db.QueryRow(ctx, subOrderQuery, order.ID, group.SellerID, group.Subtotal(), group.ShippingFee, group.Total(),
+			tax.ReducedTaxableAmount, tax.ReducedTax, tax.StandardTaxableAmount, tax.StandardTax, group.InvoiceRegistrationNumber,
+			group.Discount(), group.DiscountFundedBy, group.PlatformFee(order.PlatformFeeBasisPoints), group.FeeBasisPoints(order.PlatformFeeBasisPoints), group.StripeAccountID).Scan(&subOrderIDs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 4. order_itemsテーブルに注文商品を、子注文に紐づけて挿入
+	batch := &pgx.Batch{}
+	itemQuery := `
+		INSERT INTO order_items (order_id, sub_order_id, bean_id, price_at_purchase, quantity, tax_category, discount_amount)
+		VALUES ($1, $2, $3, $4, $5, COALESCE(NULLIF($6, ''), 'reduced')::tax_category, $7)
+	`
+	for i, group := range groups {
+		for j, item := range group.Items {
+			discount := 0
+			if j < len(group.ItemDiscounts) {
+				discount = group.ItemDiscounts[j]
+			}
+			batch.Queue(itemQuery, order.ID, subOrderIDs[i], item.BeanID, item.Price, item.Quantity, item.TaxCategory, discount)
+		}
+	}
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		_, err := br.Exec()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// DecrementBeanStock は注文された数量だけ豆の在庫数を減らします
+// 在庫数の確認と減算を1つのUPDATE文で行うため、同時に注文が入っても在庫数が負になりません
+// 途中で在庫不足が見つかった場合はErrInsufficientStockを返すので、呼び出し側でトランザクションをロールバックしてください
+func (s *Store) DecrementBeanStock(ctx context.Context, items []OrderItem) error {
+	batch := &pgx.Batch{}
+	query := `UPDATE beans SET stock = stock - $1 WHERE id = $2 AND stock >= $1`
+	for _, item := range items {
+		batch.Queue(query, item.Quantity, item.BeanID)
+	}
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < len(items); i++ {
+		ct, err := br.Exec()
+		if err != nil {
+			return err
+		}
+		if ct.RowsAffected() == 0 {
+			return ErrInsufficientStock
+		}
+	}
+
+	return nil
+}
+
+// StockShortfall 構造体は、支払い済みの注文で在庫が足りなかった数量を表します
+type StockShortfall struct {
+	OrderID  int `json:"order_id"`
+	BeanID   int `json:"bean_id"`
+	Quantity int `json:"quantity"`
+}
+
+// DecrementBeanStockForPaidOrder は支払い済みの注文の数量だけ豆の在庫数を減らします
+// 支払いは取り消せないため在庫不足でもエラーにはせず、在庫数を0まで減らして、足りなかった数量をorder_stock_shortfallsに記録して返します
+func (s *Store) DecrementBeanStockForPaidOrder(ctx context.Context, orderID int, items []OrderItem) ([]StockShortfall, error) {
+	shortfalls := []StockShortfall{}
+	for _, item := range items {
+		var stock int
+		if err := s.db.QueryRow(ctx, "SELECT stock FROM beans WHERE id = $1 FOR UPDATE", item.BeanID).Scan(&stock); err != nil {
+			return nil, err
+		}
+		if _, err := s.db.Exec(ctx, "UPDATE beans SET stock = GREATEST(stock - $1, 0) WHERE id = $2", item.Quantity, item.BeanID); err != nil {
+			return nil, err
+		}
+		if stock >= item.Quantity {
+			continue
+		}
+
+		shortfall := StockShortfall{OrderID: orderID, BeanID: item.BeanID, Quantity: item.Quantity - stock}
+		query := `
+			INSERT INTO order_stock_shortfalls (order_id, bean_id, quantity)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (order_id, bean_id) DO UPDATE SET quantity = order_stock_shortfalls.quantity + EXCLUDED.quantity
+		`
+		if _, err := s.db.Exec(ctx, query, shortfall.OrderID, shortfall.BeanID, shortfall.Quantity); err != nil {
+			return nil, err
+		}
+		shortfalls = append(shortfalls, shortfall)
+	}
+	return shortfalls, nil
+}
+
+// 在庫確保の状態を表す定数です
+const (
+	ReservationStatusActive    = "active"
+	ReservationStatusConverted = "converted"
+	ReservationStatusReleased  = "released"
+	ReservationStatusExpired   = "expired"
+)
+
+// StockReservation 構造体は、決済中に確保している在庫を表します
+type StockReservation struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	UserID    string    `json:"user_id"`
+	BeanID    int       `json:"bean_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateStockReservations は保留中の注文に紐づく在庫確保を記録します
+// 確保する数量は、事前にDecrementBeanStockで在庫数から差し引いておく必要があります
+func (s *Store) CreateStockReservations(ctx context.Context, userID string, orderID int, items []OrderItem, expiresAt time.Time) error {
+	batch := &pgx.Batch{}
+	query := `
+		INSERT INTO stock_reservations (order_id, user_id, bean_id, quantity, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	for _, item := range items {
+		batch.Queue(query, orderID, userID, item.BeanID, item.Quantity, expiresAt)
+	}
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < len(items); i++ {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseStockReservations は条件に一致する確保中の在庫を指定の状態にし、その数量を在庫数に戻します
+// 状態の更新と在庫数の戻しを1つのSQL文で行うため、同じ確保が二重に戻されることはありません
+func (s *Store) releaseStockReservations(ctx context.Context, status string, condition string, args ...interface{}) (int64, error) {
+	query := fmt.Sprintf(`
+		WITH released AS (
+			UPDATE stock_reservations
+			SET status = $1, updated_at = NOW()
+			WHERE status = 'active' AND %s
+			RETURNING bean_id, quantity
+		), totals AS (
+			SELECT bean_id, SUM(quantity) AS quantity FROM released GROUP BY bean_id
+		)
+		UPDATE beans b
+		SET stock = b.stock + totals.quantity
+		FROM totals
+		WHERE b.id = totals.bean_id
+	`, condition)
+
+	ct, err := s.db.Exec(ctx, query, append([]interface{}{status}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// ReleaseStockReservations は注文に紐づく確保中の在庫を解放します
+// 決済の失敗やキャンセル時に呼び出します。戻り値は在庫数を戻した豆の件数です
+func (s *Store) ReleaseStockReservations(ctx context.Context, orderID int) (int64, error) {
+	return s.releaseStockReservations(ctx, ReservationStatusReleased, "order_id = $2", orderID)
+}
+
+// queryOrders はorderColumnsを取得するクエリを実行し、注文のリストを返します
+func (s *Store) queryOrders(ctx context.Context, query string, args ...interface{}) ([]Order, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// GetReservedCheckoutOrders はユーザーのカートの決済のうち、在庫を確保したまま支払いを待っている保留中の注文を取得します
+// 同じユーザーが決済をやり直す場合に、古い決済を取り消して在庫を解放するために使います
+// 定期便の注文は、カートの決済とは関係ないので含めません
+func (s *Store) GetReservedCheckoutOrders(ctx context.Context, userID string) ([]Order, error) {
+	query := `
+		SELECT ` + orderColumns + `
+		FROM orders o
+		WHERE o.user_id = $1 AND o.status = 'pending' AND o.subscription_id IS NULL
+		  AND EXISTS (SELECT 1 FROM stock_reservations sr WHERE sr.order_id = o.id AND sr.status = 'active')
+		ORDER BY o.id
+	`
+	return s.queryOrders(ctx, query, userID)
+}
+
+// GetAbandonedOrders は支払われないまま在庫の確保が無くなった（期限切れ・解放済み）注文を、古い順にlimit件まで取得します
+// 保留中・本人確認待ちの注文のうち、createdBeforeより前に作成されたものが対象です
+func (s *Store) GetAbandonedOrders(ctx context.Context, createdBefore time.Time, limit int) ([]Order, error) {
+	query := `
+		SELECT ` + orderColumns + `
+		FROM orders o
+		WHERE o.status IN ('pending', 'requires_action') AND o.created_at <= $1
+		  AND NOT EXISTS (SELECT 1 FROM stock_reservations sr WHERE sr.order_id = o.id AND sr.status IN ('active', 'converted'))
+		ORDER BY o.created_at, o.id
+		LIMIT $2
+	`
+	return s.queryOrders(ctx, query, createdBefore, limit)
+}
+
+// ExpireStockReservations は有効期限が切れた確保中の在庫を解放します
+func (s *Store) ExpireStockReservations(ctx context.Context, now time.Time) (int64, error) {
+	return s.releaseStockReservations(ctx, ReservationStatusExpired, "expires_at <= $2", now)
+}
+
+// ExtendStockReservations は注文に紐づく確保中の在庫の有効期限を延長します
+// コンビニ決済や銀行振込のように、支払いの完了まで数日かかる場合に使います
+func (s *Store) ExtendStockReservations(ctx context.Context, orderID int, expiresAt time.Time) (int64, error) {
+	query := `
+		UPDATE stock_reservations
+		SET expires_at = GREATEST(expires_at, $1), updated_at = NOW()
+		WHERE order_id = $2 AND status = 'active'
+	`
+	ct, err := s.db.Exec(ctx, query, expiresAt, orderID)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// ConvertStockReservations は注文に紐づく確保中の在庫を注文済みにします
+// 在庫数は確保時に差し引き済みなので、ここでは状態だけを更新します
+// 戻り値が0の場合、確保が無い（または期限切れで解放済み）ため、呼び出し側で在庫数を減らす必要があります
+func (s *Store) ConvertStockReservations(ctx context.Context, orderID int) (int64, error) {
+	query := `
+		UPDATE stock_reservations
+		SET status = $1, updated_at = NOW()
+		WHERE order_id = $2 AND status = 'active'
+	`
+	ct, err := s.db.Exec(ctx, query, ReservationStatusConverted, orderID)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// ClearCart はユーザーのカートを空にします
+func (s *Store) ClearCart(ctx context.Context, userID string) error {
+	// ユーザーIDに紐づくカートIDを取得
+	var cartID string
+	err := s.db.QueryRow(ctx, "SELECT id FROM carts WHERE user_id = $1", userID).Scan(&cartID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			// カートが存在しない場合は、何もせず正常終了
+			return nil
+		}
+		return err
+	}
+
+	// カートIDに紐づくすべてのカートアイテムを削除
+	_, err = s.db.Exec(ctx, "DELETE FROM cart_items WHERE cart_id = $1", cartID)
+	return err
+}
+
+// GetOrderItemsByOrderID は注文の明細を取得します
+func (s *Store) GetOrderItemsByOrderID(ctx context.Context, orderID int) ([]OrderItem, error) {
+	rows, err := s.db.Query(ctx, "SELECT id, order_id, bean_id, price_at_purchase, quantity FROM order_items WHERE order_id = $1 ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.BeanID, &item.PriceAtPurchase, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// UpdateOrderStatus は注文の状態と支払い方法を更新します
+// paymentMethodTypeが空の場合は、既存の支払い方法を維持します
+func (s *Store) UpdateOrderStatus(ctx context.Context, orderID int, status string, paymentMethodType string) (*Order, error) {
+	query := `
+		UPDATE orders
+		SET status = $1, payment_method_type = COALESCE(NULLIF($2, ''), payment_method_type), updated_at = NOW()
+		WHERE id = $3
+		RETURNING ` + orderColumns
+	return scanOrder(s.db.QueryRow(ctx, query, status, paymentMethodType, orderID))
+}
+
+// OrderStatusChange 構造体は、注文の状態遷移の履歴1件を表します
+type OrderStatusChange struct {
+	ID            int       `json:"id"`
+	OrderID       int       `json:"order_id"`
+	FromStatus    string    `json:"from_status,omitempty"` // 注文作成時は空
+	ToStatus      string    `json:"to_status"`
+	StripeEventID string    `json:"stripe_event_id,omitempty"`
+	Reason        string    `json:"reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// recordOrderStatusChange は注文の状態遷移を履歴に記録します
+func (s *Store) recordOrderStatusChange(ctx context.Context, orderID int, fromStatus string, toStatus string, stripeEventID string, reason string) error {
+	query := `
+		INSERT INTO order_status_history (order_id, from_status, to_status, stripe_event_id, reason)
+		VALUES ($1, NULLIF($2, '')::order_status, $3, NULLIF($4, ''), $5)
+	`
+	_, err := s.db.Exec(ctx, query, orderID, fromStatus, toStatus, stripeEventID, reason)
+	return err
+}
+
+// TransitionOrderStatus は遷移が許可されている場合に限り注文の状態を更新し、その遷移を履歴に記録します
+// 同時に届いたイベントで遷移の判定が食い違わないよう、注文の行をロックしてから判定します
+// 許可されていない遷移の場合はErrInvalidOrderTransitionを返します
+func (s *Store) TransitionOrderStatus(ctx context.Context, orderID int, toStatus string, paymentMethodType string, stripeEventID string, reason string) (*Order, error) {
+	var fromStatus string
+	if err := s.db.QueryRow(ctx, "SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&fromStatus); err != nil {
+		return nil, err
+	}
+	if !canTransitionOrderStatus(fromStatus, toStatus) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidOrderTransition, fromStatus, toStatus)
+	}
+
+	order, err := s.UpdateOrderStatus(ctx, orderID, toStatus, paymentMethodType)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.recordOrderStatusChange(ctx, orderID, fromStatus, toStatus, stripeEventID, reason); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// GetOrderStatusHistory は注文の状態遷移の履歴を古い順に取得します
+func (s *Store) GetOrderStatusHistory(ctx context.Context, orderID int) ([]OrderStatusChange, error) {
+	query := `
+		SELECT id, order_id, COALESCE(from_status::text, ''), to_status, COALESCE(stripe_event_id, ''), reason, created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := s.db.Query(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OrderStatusChange{}
+	for rows.Next() {
+		var c OrderStatusChange
+		if err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.StripeEventID, &c.Reason, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// OrderPage は注文一覧の1ページ分の結果です
+// NextCursorは次のページが無い場合にnilになります
+type OrderPage struct {
+	Items      []Order `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+	TotalCount int     `json:"total_count"`
+}
+
+// OrderItemDetail 構造体は、注文明細を豆の名前とともに保持します
+type OrderItemDetail struct {
+	ID              int    `json:"id"`
+	SubOrderID      int    `json:"sub_order_id"`
+	BeanID          int    `json:"bean_id"`
+	BeanName        string `json:"bean_name"`
+	PriceAtPurchase int    `json:"price_at_purchase"`
+	Quantity        int    `json:"quantity"`
+	Subtotal        int    `json:"subtotal"`
+	TaxCategory     string `json:"tax_category"` // 購入時点の消費税の区分
+	// DiscountAmount は明細に割り当てたクーポンの値引き額、RefundedQuantityは返金済みの数量です
+	DiscountAmount   int `json:"discount_amount"`
+	RefundedQuantity int `json:"refunded_quantity"`
+}
+
+// SubOrder 構造体は、注文を出品者ごとに分けた子注文を保持します
+// 発送の進捗や出品者への入金は子注文の単位で管理します
+type SubOrder struct {
+	ID          int          `json:"id"`
+	OrderID     int          `json:"order_id"`
+	SellerID    string       `json:"seller_id"`
+	Subtotal    int          `json:"subtotal"`
+	ShippingFee int          `json:"shipping_fee"`
+	TotalAmount int          `json:"total_amount"`
+	Tax         TaxBreakdown `json:"tax"`
+	// SellerInvoiceRegistrationNumber は注文時点の出品者の適格請求書発行事業者の登録番号です（未登録の場合は空）
+	SellerInvoiceRegistrationNumber string `json:"seller_invoice_registration_number"`
+	// DiscountAmount はクーポンの値引き額（total_amountから差し引き済み）、DiscountFundedByはその負担者です（値引きが無い場合は空）
+	DiscountAmount         int               `json:"discount_amount"`
+	DiscountFundedBy       string            `json:"discount_funded_by"`
+	PlatformFee            int               `json:"platform_fee"`
+	PlatformFeeBasisPoints int               `json:"platform_fee_basis_points"`
+	RefundedAmount         int               `json:"refunded_amount"` // 返金額の合計（送料を含む）
+	CanceledAt             *time.Time        `json:"canceled_at"`
+	FulfillmentStatus      string            `json:"fulfillment_status"`
+	Carrier                string            `json:"carrier"`
+	TrackingNumber         string            `json:"tracking_number"`
+	ShippedAt              *time.Time        `json:"shipped_at"`
+	DeliveredAt            *time.Time        `json:"delivered_at"`
+	CreatedAt              time.Time         `json:"created_at"`
+	UpdatedAt              time.Time         `json:"updated_at"`
+	Items                  []OrderItemDetail `json:"items"`
+}
+
+// subOrderColumns は子注文を取得する際のカラムです（SubOrder.scanTargetsと対応しています）
+const subOrderColumns = `so.id, so.order_id, COALESCE(so.seller_id::text, ''), so.subtotal, so.shipping_fee, so.total_amount,
+	so.reduced_taxable_amount, so.reduced_tax, so.standard_taxable_amount, so.standard_tax, COALESCE(so.seller_invoice_registration_number, ''),
+	so.discount_amount, COALESCE(so.discount_funded_by::text, ''), so.platform_fee, so.platform_fee_basis_points, so.refunded_amount, so.canceled_at,
+	so.fulfillment_status, COALESCE(so.carrier, ''), COALESCE(so.tracking_number, ''), so.shipped_at, so.delivered_at, so.created_at, so.updated_at`
+
+// scanTargets はsubOrderColumnsで取得した行のスキャン先を返します
+func (so *SubOrder) scanTargets() []interface{} {
+	return []interface{}{
+		&so.ID, &so.OrderID, &so.SellerID, &so.Subtotal, &so.ShippingFee, &so.TotalAmount,
+		&so.Tax.ReducedTaxableAmount, &so.Tax.ReducedTax, &so.Tax.StandardTaxableAmount, &so.Tax.StandardTax, &so.SellerInvoiceRegistrationNumber,
+		&so.DiscountAmount, &so.DiscountFundedBy, &so.PlatformFee, &so.PlatformFeeBasisPoints, &so.RefundedAmount, &so.CanceledAt,
+		&so.FulfillmentStatus, &so.Carrier, &so.TrackingNumber, &so.ShippedAt, &so.DeliveredAt, &so.CreatedAt, &so.UpdatedAt,
+	}
+}
+
+// OrderDetail 構造体は、注文とその子注文（明細を含む）・状態遷移の履歴・返金・キャンセル依頼を保持します
+type OrderDetail struct {
+	Order
+	SubOrders            []SubOrder            `json:"sub_orders"`
+	History              []OrderStatusChange   `json:"history"`
+	Refunds              []Refund              `json:"refunds"`
+	CancellationRequests []CancellationRequest `json:"cancellation_requests"`
+}
+
+// orderIDCursor は注文一覧のカーソルに埋め込む、ページ末尾の注文IDです
+type orderIDCursor struct {
+	ID int `json:"id"`
+}
+
+// encodeOrderCursor はページ末尾の注文IDからカーソル文字列を作成します
+func encodeOrderCursor(id int) (string, error) {
+	b, err := json.Marshal(orderIDCursor{ID: id})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeOrderCursor はカーソル文字列を解釈します
+func decodeOrderCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	var c orderIDCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID <= 0 {
+		return 0, ErrInvalidCursor
+	}
+	return c.ID, nil
+}
+
+// orderColumns は注文を取得する際のカラムです（scanOrderと対応しています）
+const orderColumns = "id, user_id, status, total_amount, shipping_fee, reduced_taxable_amount, reduced_tax, standard_taxable_amount, standard_tax, COALESCE(coupon_code, ''), discount_amount, platform_fee, platform_fee_basis_points, currency, COALESCE(payment_method_type, ''), COALESCE(stripe_payment_intent_id, ''), subscription_id, COALESCE(subscription_delivery_date::text, ''), created_at, updated_at"
+
+// scanOrder はorderColumnsで取得した行をOrder構造体にスキャンします
+func scanOrder(row pgx.Row) (*Order, error) {
+	var o Order
+	if err := row.Scan(&o.ID, &o.UserID, &o.Status, &o.TotalAmount, &o.ShippingFee, &o.Tax.ReducedTaxableAmount, &o.Tax.ReducedTax, &o.Tax.StandardTaxableAmount, &o.Tax.StandardTax, &o.CouponCode, &o.DiscountAmount, &o.PlatformFee, &o.PlatformFeeBasisPoints, &o.Currency, &o.PaymentMethodType, &o.StripePaymentIntentID, &o.SubscriptionID, &o.SubscriptionDeliveryDate, &o.CreatedAt, &o.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// GetOrdersByUserID はユーザーの注文を新しい順に1ページ分取得します
+// statusが空でなければ、その状態の注文だけに絞り込みます
+func (s *Store) GetOrdersByUserID(ctx context.Context, userID string, status string, page PageParams) (*OrderPage, error) {
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{userID}
+	if status != "" {
+		args = append(args, status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+
+	// 1. 条件に一致する総件数を取得（カーソルの位置には依存しない）
+	var totalCount int
+	countQuery := "SELECT COUNT(*) FROM orders WHERE " + strings.Join(conditions, " AND ")
+	if err := s.db.QueryRow(ctx, countQuery, args...).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	// 2. カーソルが指定されていれば、その注文より古いものに絞り込む
+	if page.Cursor != "" {
+		cursorID, err := decodeOrderCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cursorID)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(args)))
+	}
+
+	// 次のページがあるかを判定するため、1件多く取得する
+	args = append(args, limit+1)
+	query := fmt.Sprintf("SELECT %s FROM orders WHERE %s ORDER BY id DESC LIMIT $%d", orderColumns, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &OrderPage{Items: orders, TotalCount: totalCount}
+	if len(orders) > limit {
+		result.Items = orders[:limit]
+		next, err := encodeOrderCursor(result.Items[limit-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		result.NextCursor = &next
+	}
+	return result, nil
+}
+
+// getSubOrderItems は子注文の明細を、豆の名前とともに子注文IDごとに取得します
+func (s *Store) getSubOrderItems(ctx context.Context, subOrderIDs []int) (map[int][]OrderItemDetail, error) {
+	query := `
+		SELECT oi.id, oi.sub_order_id, oi.bean_id, COALESCE(b.name, ''), oi.price_at_purchase, oi.quantity, oi.tax_category, oi.discount_amount, oi.refunded_quantity
+		FROM order_items oi
+		LEFT JOIN beans b ON oi.bean_id = b.id
+		WHERE oi.sub_order_id = ANY($1)
+		ORDER BY oi.id
+	`
+	rows, err := s.db.Query(ctx, query, subOrderIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := map[int][]OrderItemDetail{}
+	for rows.Next() {
+		var item OrderItemDetail
+		if err := rows.Scan(&item.ID, &item.SubOrderID, &item.BeanID, &item.BeanName, &item.PriceAtPurchase, &item.Quantity, &item.TaxCategory, &item.DiscountAmount, &item.RefundedQuantity); err != nil {
+			return nil, err
+		}
+		item.Subtotal = item.PriceAtPurchase * item.Quantity
+		items[item.SubOrderID] = append(items[item.SubOrderID], item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// attachSubOrderItems は子注文それぞれに明細を設定します
+func (s *Store) attachSubOrderItems(ctx context.Context, subOrders []*SubOrder) error {
+	if len(subOrders) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(subOrders))
+	for _, so := range subOrders {
+		ids = append(ids, so.ID)
+	}
+	items, err := s.getSubOrderItems(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, so := range subOrders {
+		so.Items = items[so.ID]
+		if so.Items == nil {
+			so.Items = []OrderItemDetail{}
+		}
+	}
+	return nil
+}
+
+// GetOrderDetail はユーザー自身の注文を、出品者ごとの子注文・明細・状態遷移の履歴とともに取得します
+// 他のユーザーの注文を指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) GetOrderDetail(ctx context.Context, orderID int, userID string) (*OrderDetail, error) {
+	order, err := scanOrder(s.db.QueryRow(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1 AND user_id = $2", orderID, userID))
+	if err != nil {
+		return nil, err
+	}
+	return s.getOrderDetail(ctx, order)
+}
+
+// GetOrderDetailByID は購入者に関わらず注文を、子注文・明細・状態遷移の履歴とともに取得します（管理者向け）
+func (s *Store) GetOrderDetailByID(ctx context.Context, orderID int) (*OrderDetail, error) {
+	order, err := scanOrder(s.db.QueryRow(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = $1", orderID))
+	if err != nil {
+		return nil, err
+	}
+	return s.getOrderDetail(ctx, order)
+}
+
+// getOrderDetail は注文の子注文（明細を含む）・状態遷移の履歴・返金・キャンセル依頼を取得します
+func (s *Store) getOrderDetail(ctx context.Context, order *Order) (*OrderDetail, error) {
+	orderID := order.ID
+	rows, err := s.db.Query(ctx, "SELECT "+subOrderColumns+" FROM sub_orders so WHERE so.order_id = $1 ORDER BY so.id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subOrders := []SubOrder{}
+	for rows.Next() {
+		var so SubOrder
+		if err := rows.Scan(so.scanTargets()...); err != nil {
+			return nil, err
+		}
+		subOrders = append(subOrders, so)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	targets := make([]*SubOrder, len(subOrders))
+	for i := range subOrders {
+		targets[i] = &subOrders[i]
+	}
+	if err := s.attachSubOrderItems(ctx, targets); err != nil {
+		return nil, err
+	}
+
+	history, err := s.GetOrderStatusHistory(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := s.GetRefundsByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	cancellationRequests, err := s.GetCancellationRequestsByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrderDetail{Order: *order, SubOrders: subOrders, History: history, Refunds: refunds, CancellationRequests: cancellationRequests}, nil
+}
+
+// AttachPaymentIntent は保留中の注文の作成後に作成したPaymentIntentを、その注文に紐づけます
+// Webhookではこの紐づけから注文を特定します
+func (s *Store) AttachPaymentIntent(ctx context.Context, orderID int, paymentIntentID string) error {
+	ct, err := s.db.Exec(ctx, "UPDATE orders SET stripe_payment_intent_id = $1, updated_at = NOW() WHERE id = $2", paymentIntentID, orderID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetOrderByPaymentIntentID はStripeのPaymentIntent IDで注文を取得します
+func (s *Store) GetOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (*Order, error) {
+	return scanOrder(s.db.QueryRow(ctx, "SELECT "+orderColumns+" FROM orders WHERE stripe_payment_intent_id = $1", paymentIntentID))
+}
+
+// GetOrderForPaymentIntent はPaymentIntentに紐づく注文を取得します
+// PaymentIntentの作成直後で、まだ注文に紐づけていない場合は、メタデータの注文IDで探して紐づけます
+// 他のPaymentIntentが紐づいている注文や、注文が見つからない場合はpgx.ErrNoRowsを返します
+func (s *Store) GetOrderForPaymentIntent(ctx context.Context, paymentIntentID string, metadata map[string]string) (*Order, error) {
+	order, err := s.GetOrderByPaymentIntentID(ctx, paymentIntentID)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return order, err
+	}
+	orderID, convErr := strconv.Atoi(metadata["order_id"])
+	if convErr != nil {
+		return nil, err
+	}
+	query := `
+		UPDATE orders
+		SET stripe_payment_intent_id = $1, updated_at = NOW()
+		WHERE id = $2 AND stripe_payment_intent_id IS NULL
+		RETURNING ` + orderColumns
+	return scanOrder(s.db.QueryRow(ctx, query, paymentIntentID, orderID))
+}
+
+// 出品者による発送までの進捗の状態
+const (
+	FulfillmentStatusUnfulfilled = "unfulfilled"
+	FulfillmentStatusAccepted    = "accepted"
+	FulfillmentStatusRoasting    = "roasting"
+	FulfillmentStatusShipped     = "shipped"
+	FulfillmentStatusDelivered   = "delivered"
+	// FulfillmentStatusCanceled はキャンセルした子注文です（ここから遷移することはありません）
+	FulfillmentStatusCanceled = "canceled"
+)
+
+// fulfillmentStatusTransitions は発送の進捗ごとに、次に遷移できる状態を定義します
+// 焙煎前に発送したり、発送前に配達済みにしたりといった工程の飛ばしは許可しません
+var fulfillmentStatusTransitions = map[string]string{
+	FulfillmentStatusUnfulfilled: FulfillmentStatusAccepted,
+	FulfillmentStatusAccepted:    FulfillmentStatusRoasting,
+	FulfillmentStatusRoasting:    FulfillmentStatusShipped,
+	FulfillmentStatusShipped:     FulfillmentStatusDelivered,
+}
+
+// validFulfillmentStatuses はfulfillment_status型で定義されている発送の進捗の状態です
+var validFulfillmentStatuses = map[string]bool{
+	FulfillmentStatusUnfulfilled: true,
+	FulfillmentStatusAccepted:    true,
+	FulfillmentStatusRoasting:    true,
+	FulfillmentStatusShipped:     true,
+	FulfillmentStatusDelivered:   true,
+	FulfillmentStatusCanceled:    true,
+}
+
+// paidOrderStatuses は出品者の受注一覧に表示する、支払いが完了した注文の状態です
+var paidOrderStatuses = []string{OrderStatusSucceeded, OrderStatusPartiallyRefunded, OrderStatusRefunded, OrderStatusDisputed}
+
+// fulfillableOrderStatuses は発送の作業を進めてよい注文の状態です
+var fulfillableOrderStatuses = map[string]bool{
+	OrderStatusSucceeded:         true,
+	OrderStatusPartiallyRefunded: true,
+}
+
+// ErrInvalidFulfillmentTransition は許可されていない発送の進捗の遷移を試みた場合のエラーです
+var ErrInvalidFulfillmentTransition = errors.New("invalid fulfillment status transition")
+
+// ErrOrderNotFulfillable は支払いが完了していない、または返金・チャージバック中の注文を発送しようとした場合のエラーです
+var ErrOrderNotFulfillable = errors.New("order is not fulfillable")
+
+// SellerOrder 構造体は、出品者から見た子注文（受注）を保持します
+// 発送に必要なため、購入者の配送先を含みます
+type SellerOrder struct {
+	SubOrder
+	OrderStatus   string    `json:"order_status"`
+	BuyerName     string    `json:"buyer_name"`
+	BuyerPostCode string    `json:"buyer_post_code"`
+	BuyerAddress  string    `json:"buyer_address"`
+	OrderedAt     time.Time `json:"ordered_at"`
+}
+
+// SellerOrderPage は出品者の受注一覧の1ページ分の結果です
+// NextCursorは次のページが無い場合にnilになります
+type SellerOrderPage struct {
+	Items      []SellerOrder `json:"items"`
+	NextCursor *string       `json:"next_cursor"`
+	TotalCount int           `json:"total_count"`
+}
+
+// sellerOrderQuery は出品者の受注を取得する際のクエリです（scanSellerOrderと対応しています）
+// 条件は呼び出し側でWHERE句として付け加えます
+const sellerOrderQuery = `
+	SELECT ` + subOrderColumns + `,
+		o.status, COALESCE(p.display_name, ''), COALESCE(p.post_code, ''), COALESCE(p.address, ''), o.created_at
+	FROM sub_orders so
+	JOIN orders o ON so.order_id = o.id
+	LEFT JOIN profiles p ON o.user_id = p.user_id
+`
+
+// scanSellerOrder はsellerOrderQueryで取得した行をSellerOrder構造体にスキャンします
+func scanSellerOrder(row pgx.Row) (*SellerOrder, error) {
+	var o SellerOrder
+	targets := append(o.SubOrder.scanTargets(), &o.OrderStatus, &o.BuyerName, &o.BuyerPostCode, &o.BuyerAddress, &o.OrderedAt)
+	if err := row.Scan(targets...); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// GetSellerOrders は出品者の子注文を、明細とともに新しい順に1ページ分取得します
+// 支払いが完了した注文の子注文だけが対象です
+// fulfillmentStatusが空でなければ、その発送の進捗の子注文だけに絞り込みます
+func (s *Store) GetSellerOrders(ctx context.Context, sellerID string, fulfillmentStatus string, page PageParams) (*SellerOrderPage, error) {
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	conditions := []string{"so.seller_id = $1", "o.status::text = ANY($2)"}
+	args := []interface{}{sellerID, paidOrderStatuses}
+	if fulfillmentStatus != "" {
+		args = append(args, fulfillmentStatus)
+		conditions = append(conditions, fmt.Sprintf("so.fulfillment_status = $%d", len(args)))
+	}
+
+	// 1. 条件に一致する総件数を取得（カーソルの位置には依存しない）
+	var totalCount int
+	countQuery := "SELECT COUNT(*) FROM sub_orders so JOIN orders o ON so.order_id = o.id WHERE " + strings.Join(conditions, " AND ")
+	if err := s.db.QueryRow(ctx, countQuery, args...).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	// 2. カーソルが指定されていれば、その子注文より古いものに絞り込む
+	if page.Cursor != "" {
+		cursorID, err := decodeOrderCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cursorID)
+		conditions = append(conditions, fmt.Sprintf("so.id < $%d", len(args)))
+	}
+
+	// 次のページがあるかを判定するため、1件多く取得する
+	args = append(args, limit+1)
+	query := fmt.Sprintf("%s WHERE %s ORDER BY so.id DESC LIMIT $%d", sellerOrderQuery, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []SellerOrder{}
+	for rows.Next() {
+		order, err := scanSellerOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	result := &SellerOrderPage{Items: orders, TotalCount: totalCount}
+	if len(orders) > limit {
+		result.Items = orders[:limit]
+		next, err := encodeOrderCursor(result.Items[limit-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		result.NextCursor = &next
+	}
+
+	targets := make([]*SubOrder, len(result.Items))
+	for i := range result.Items {
+		targets[i] = &result.Items[i].SubOrder
+	}
+	if err := s.attachSubOrderItems(ctx, targets); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// getSellerOrder は出品者自身の子注文を、明細とともに1件取得します
+func (s *Store) getSellerOrder(ctx context.Context, subOrderID int, sellerID string) (*SellerOrder, error) {
+	order, err := scanSellerOrder(s.db.QueryRow(ctx, sellerOrderQuery+" WHERE so.id = $1 AND so.seller_id = $2", subOrderID, sellerID))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachSubOrderItems(ctx, []*SubOrder{&order.SubOrder}); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// UpdateFulfillmentStatus は出品者自身の子注文について、発送の進捗を1段階進めます
+// 発送済みにする場合は配送業者と追跡番号を記録します
+// 他の出品者の子注文を指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) UpdateFulfillmentStatus(ctx context.Context, subOrderID int, sellerID string, toStatus string, carrier string, trackingNumber string) (*SellerOrder, error) {
+	// 同時に更新されても遷移の判定が食い違わないよう、子注文の行をロックしてから判定する
+	var fromStatus, orderStatus string
+	lockQuery := `
+		SELECT so.fulfillment_status, o.status
+		FROM sub_orders so
+		JOIN orders o ON so.order_id = o.id
+		WHERE so.id = $1 AND so.seller_id = $2
+		FOR UPDATE OF so
+	`
+	if err := s.db.QueryRow(ctx, lockQuery, subOrderID, sellerID).Scan(&fromStatus, &orderStatus); err != nil {
+		return nil, err
+	}
+	if !fulfillableOrderStatuses[orderStatus] {
+		return nil, fmt.Errorf("%w: order status is %s", ErrOrderNotFulfillable, orderStatus)
+	}
+	if fulfillmentStatusTransitions[fromStatus] != toStatus {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidFulfillmentTransition, fromStatus, toStatus)
+	}
+
+	updateQuery := `
+		UPDATE sub_orders
+		SET fulfillment_status = $1,
+			carrier = CASE WHEN $1 = 'shipped' THEN $2 ELSE carrier END,
+			tracking_number = CASE WHEN $1 = 'shipped' THEN $3 ELSE tracking_number END,
+			shipped_at = CASE WHEN $1 = 'shipped' THEN NOW() ELSE shipped_at END,
+			delivered_at = CASE WHEN $1 = 'delivered' THEN NOW() ELSE delivered_at END,
+			updated_at = NOW()
+		WHERE id = $4
+	`
+	if _, err := s.db.Exec(ctx, updateQuery, toStatus, carrier, trackingNumber, subOrderID); err != nil {
+		return nil, err
+	}
+
+	return s.getSellerOrder(ctx, subOrderID, sellerID)
+}
+
+// SubOrderTransfer 構造体は、出品者への入金（Transfer）が済んでいない子注文を表します
+// Amountは子注文の合計からプラットフォーム手数料を差し引き、プラットフォーム負担の値引きを補填した入金額です
+type SubOrderTransfer struct {
+	SubOrderID      int
+	SellerID        string
+	StripeAccountID string
+	TransferGroup   string
+	Amount          int
+}
+
+// subOrderPayoutAmount は子注文の出品者への入金額を求める式です（sub_ordersの別名はsoです）
+// 子注文の合計からプラットフォーム手数料を差し引き、プラットフォーム負担の値引きを補填します
+const subOrderPayoutAmount = `(so.total_amount - so.platform_fee + CASE WHEN so.discount_funded_by = 'platform' THEN so.discount_amount ELSE 0 END)`
+
+// GetPendingSubOrderTransfers は子注文ごとのTransferで入金する注文について、まだ入金も送信待ちの記録もしていない子注文を取得します
+// Destination Chargeの注文や、入金先の無い子注文は対象外です
+func (s *Store) GetPendingSubOrderTransfers(ctx context.Context, orderID int) ([]SubOrderTransfer, error) {
+	query := `
+		SELECT so.id, COALESCE(so.seller_id::text, ''), so.stripe_account_id, o.stripe_transfer_group, ` + subOrderPayoutAmount + `
+		FROM sub_orders so
+		JOIN orders o ON so.order_id = o.id
+		WHERE so.order_id = $1
+		  AND o.stripe_transfer_group IS NOT NULL
+		  AND so.stripe_account_id IS NOT NULL
+		  AND so.stripe_transfer_id IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM payout_transfers pt WHERE pt.sub_order_id = so.id)
+		ORDER BY so.id
+	`
+	rows, err := s.db.Query(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []SubOrderTransfer{}
+	for rows.Next() {
+		var t SubOrderTransfer
+		if err := rows.Scan(&t.SubOrderID, &t.SellerID, &t.StripeAccountID, &t.TransferGroup, &t.Amount); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+// 出品者への入金の送信待ちの状態
+const (
+	PayoutTransferStatusPending = "pending"
+	PayoutTransferStatusSent    = "sent"
+	PayoutTransferStatusFailed  = "failed"
+	// PayoutTransferStatusCanceled は送信前に子注文の全額を返金し、送信を取りやめた入金です
+	PayoutTransferStatusCanceled = "canceled"
+)
+
+// PayoutTransfer 構造体は、送信待ちの出品者への入金（payout_transfersの行）を表します
+type PayoutTransfer struct {
+	ID            int
+	SubOrderID    int
+	Amount        int
+	Currency      string
+	Destination   string
+	TransferGroup string
+	// SourceTransaction は入金を紐づける元の支払いのChargeのIDです（プラットフォームの残高から入金する場合は空）
+	SourceTransaction string
+	Attempts          int
+}
+
+// QueuePayoutTransfer は子注文の出品者への入金を送信待ちとして記録します
+// 同じ子注文の入金が既に記録されている場合は何もしないため、Webhookが再送されても二重に記録されません
+func (s *Store) QueuePayoutTransfer(ctx context.Context, t *PayoutTransfer) error {
+	query := `
+		INSERT INTO payout_transfers (sub_order_id, amount, currency, destination, transfer_group, source_transaction)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))
+		ON CONFLICT (sub_order_id) DO NOTHING
+	`
+	_, err := s.db.Exec(ctx, query, t.SubOrderID, t.Amount, t.Currency, t.Destination, t.TransferGroup, t.SourceTransaction)
+	return err
+}
+
+// ClaimPayoutTransfers は送信する時期が来た送信待ちの入金を、古い順にlimit件まで取得します
+// 取得した入金は次の送信をleaseだけ先に延ばすため、送信中に他のサーバーが同じ入金を取得することはありません
+func (s *Store) ClaimPayoutTransfers(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]PayoutTransfer, error) {
+	query := `
+		UPDATE payout_transfers
+		SET attempts = attempts + 1, first_attempted_at = COALESCE(first_attempted_at, $1), next_attempt_at = $2, updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM payout_transfers
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at, id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, sub_order_id, amount, currency, destination, transfer_group, COALESCE(source_transaction, ''), attempts
+	`
+	rows, err := s.db.Query(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []PayoutTransfer{}
+	for rows.Next() {
+		var t PayoutTransfer
+		if err := rows.Scan(&t.ID, &t.SubOrderID, &t.Amount, &t.Currency, &t.Destination, &t.TransferGroup, &t.SourceTransaction, &t.Attempts); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+// MarkPayoutTransferSent は入金の送信が完了したことを記録し、子注文にTransfer IDを記録します
+func (s *Store) MarkPayoutTransferSent(ctx context.Context, id int, transferID string) error {
+	query := `
+		WITH sent AS (
+			UPDATE payout_transfers
+			SET status = 'sent', stripe_transfer_id = $1, last_error = '', updated_at = NOW()
+			WHERE id = $2
+			RETURNING sub_order_id
+		)
+		UPDATE sub_orders so
+		SET stripe_transfer_id = $1, updated_at = NOW()
+		FROM sent
+		WHERE so.id = sent.sub_order_id
+	`
+	_, err := s.db.Exec(ctx, query, transferID, id)
+	return err
+}
+
+// RecordPayoutTransferFailure は入金の送信に失敗したことを記録し、nextAttemptAtに再送します
+func (s *Store) RecordPayoutTransferFailure(ctx context.Context, id int, message string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE payout_transfers
+		SET last_error = $1, next_attempt_at = $2, updated_at = NOW()
+		WHERE id = $3 AND status = 'pending'
+	`
+	_, err := s.db.Exec(ctx, query, message, nextAttemptAt, id)
+	return err
+}
+
+// FailStalePayoutTransfers は最初の送信からattemptedBeforeまでに送信が完了しなかった入金を、失敗（failed）にします
+// 冪等キーの有効期限を過ぎてから再送すると二重に入金される恐れがあるため、自動では再送せずに手動での確認に回します
+func (s *Store) FailStalePayoutTransfers(ctx context.Context, attemptedBefore time.Time) (int64, error) {
+	query := `
+		UPDATE payout_transfers
+		SET status = 'failed', updated_at = NOW()
+		WHERE status = 'pending' AND first_attempted_at <= $1
+	`
+	ct, err := s.db.Exec(ctx, query, attemptedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// RecordDestinationChargeTransfer はDestination Chargeの注文について、Stripeが自動で作成したTransfer IDを記録します
+// Destination Chargeの注文は出品者が1人なので、子注文も1件だけです
+func (s *Store) RecordDestinationChargeTransfer(ctx context.Context, orderID int, transferID string) error {
+	query := `
+		UPDATE sub_orders so
+		SET stripe_transfer_id = $1, updated_at = NOW()
+		FROM orders o
+		WHERE so.order_id = o.id AND o.id = $2 AND o.stripe_transfer_group IS NULL AND so.stripe_transfer_id IS NULL
+	`
+	_, err := s.db.Exec(ctx, query, transferID, orderID)
+	return err
+}
+
+// GetRefundTarget は返金額の計算に必要な子注文の状態と明細を取得します
+// 同時に返金・キャンセルされても返金額が食い違わないよう、子注文の行をロックするため、トランザクション内で呼び出してください
+func (s *Store) GetRefundTarget(ctx context.Context, subOrderID int) (*RefundTarget, error) {
+	query := `
+		SELECT so.id, so.order_id, COALESCE(so.seller_id::text, ''), o.user_id::text, o.status, so.fulfillment_status, o.currency,
+			COALESCE(o.stripe_payment_intent_id, ''), o.stripe_transfer_group IS NULL, COALESCE(so.stripe_transfer_id, ''),
+			so.total_amount, so.shipping_fee, so.refunded_amount, so.shipping_refunded, ` + subOrderPayoutAmount + `
+		FROM sub_orders so
+		JOIN orders o ON so.order_id = o.id
+		WHERE so.id = $1
+		FOR UPDATE OF so
+	`
+	var t RefundTarget
+	err := s.db.QueryRow(ctx, query, subOrderID).Scan(&t.SubOrderID, &t.OrderID, &t.SellerID, &t.BuyerID, &t.OrderStatus, &t.FulfillmentStatus, &t.Currency,
+		&t.PaymentIntentID, &t.DestinationCharge, &t.StripeTransferID, &t.TotalAmount, &t.ShippingFee, &t.RefundedAmount, &t.ShippingRefunded, &t.PayoutAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, "SELECT id, bean_id, price_at_purchase, quantity, refunded_quantity, discount_amount FROM order_items WHERE sub_order_id = $1 ORDER BY id", subOrderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item RefundableItem
+		if err := rows.Scan(&item.ID, &item.BeanID, &item.PriceAtPurchase, &item.Quantity, &item.RefundedQuantity, &item.DiscountAmount); err != nil {
+			return nil, err
+		}
+		t.Items = append(t.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CreateRefund は返金と返金した明細をStripeへの送信待ち（pending）として記録し、明細の返金済みの数量と子注文の返金額を更新します
+// Stripeの返金はコミット後に送信し、返金のIDを冪等キーに使います。送信できなかった場合はretryAtに再送します
+// 複数のテーブルを更新するため、トランザクション内で呼び出してください
+func (s *Store) CreateRefund(ctx context.Context, refund *Refund, retryAt time.Time) error {
+	query := `
+		INSERT INTO refunds (order_id, sub_order_id, amount, shipping_amount, reason, requested_by, status, payout_reduction, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, $7, $8, $9)
+		RETURNING id, created_at, updated_at
+	`
+	err := s.db.QueryRow(ctx, query, refund.OrderID, refund.SubOrderID, refund.Amount, refund.ShippingAmount, refund.Reason, refund.RequestedBy, refund.Status,
+		refund.PayoutReduction, retryAt).Scan(&refund.ID, &refund.CreatedAt, &refund.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, item := range refund.Items {
+		batch.Queue("INSERT INTO refund_items (refund_id, order_item_id, quantity, amount, restocked) VALUES ($1, $2, $3, $4, $5)",
+			refund.ID, item.OrderItemID, item.Quantity, item.Amount, item.Restocked)
+		batch.Queue("UPDATE order_items SET refunded_quantity = refunded_quantity + $1 WHERE id = $2", item.Quantity, item.OrderItemID)
+	}
+	batch.Queue(`
+		UPDATE sub_orders
+		SET refunded_amount = refunded_amount + $1, shipping_refunded = shipping_refunded OR $2 > 0, updated_at = NOW()
+		WHERE id = $3
+	`, refund.Amount, refund.ShippingAmount, refund.SubOrderID)
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingRefund 構造体は、Stripeへの送信を待っている返金を表します
+type PendingRefund struct {
+	ID              int
+	OrderID         int
+	SubOrderID      int
+	Amount          int
+	PaymentIntentID string
+	// DestinationCharge は出品者への入金をDestination Chargeで行った注文かです
+	DestinationCharge bool
+	Attempts          int
+}
+
+// ClaimPendingRefunds はStripeに送信できていない返金のうち、再送する時期が来たものを古い順にlimit件まで取得します
+// 取得した返金は次の送信をleaseだけ先に延ばすため、送信中に他のサーバーが同じ返金を取得することはありません
+func (s *Store) ClaimPendingRefunds(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]PendingRefund, error) {
+	query := `
+		UPDATE refunds r
+		SET attempts = r.attempts + 1, next_attempt_at = $2, updated_at = NOW()
+		FROM orders o
+		WHERE r.order_id = o.id AND r.id IN (
+			SELECT id FROM refunds
+			WHERE status = 'pending' AND stripe_refund_id IS NULL AND next_attempt_at <= $1
+			ORDER BY next_attempt_at, id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING r.id, r.order_id, r.sub_order_id, r.amount, COALESCE(o.stripe_payment_intent_id, ''), o.stripe_transfer_group IS NULL, r.attempts
+	`
+	rows, err := s.db.Query(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []PendingRefund{}
+	for rows.Next() {
+		var p PendingRefund
+		if err := rows.Scan(&p.ID, &p.OrderID, &p.SubOrderID, &p.Amount, &p.PaymentIntentID, &p.DestinationCharge, &p.Attempts); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// RecordRefundFailure は返金をStripeに送信できなかったことを記録し、nextAttemptAtに再送します
+func (s *Store) RecordRefundFailure(ctx context.Context, refundID int, message string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE refunds
+		SET last_error = $1, next_attempt_at = $2, updated_at = NOW()
+		WHERE id = $3 AND status = 'pending' AND stripe_refund_id IS NULL
+	`
+	_, err := s.db.Exec(ctx, query, message, nextAttemptAt, refundID)
+	return err
+}
+
+// GetStaleUnsentRefundIDs はcreatedBeforeまでに記録し、まだStripeに送信できていない返金のIDを取得します
+func (s *Store) GetStaleUnsentRefundIDs(ctx context.Context, createdBefore time.Time) ([]int, error) {
+	rows, err := s.db.Query(ctx, "SELECT id FROM refunds WHERE status = 'pending' AND stripe_refund_id IS NULL AND created_at <= $1 ORDER BY id", createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// FailUnsentRefund はStripeに送信できていない返金を失敗（failed）にします
+// 既に送信済み・失敗済みの場合はfalseを返します
+func (s *Store) FailUnsentRefund(ctx context.Context, refundID int, message string) (bool, error) {
+	query := `
+		UPDATE refunds
+		SET status = 'failed', last_error = $1, updated_at = NOW()
+		WHERE id = $2 AND status = 'pending' AND stripe_refund_id IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, message, refundID)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+// RecordStripeRefund は返金に対応するStripeの返金IDと状態を記録します
+// Webhookで既に記録されている場合は何もせず、falseを返します
+func (s *Store) RecordStripeRefund(ctx context.Context, refundID int, stripeRefundID string, status string) (bool, error) {
+	query := `
+		UPDATE refunds
+		SET stripe_refund_id = $1, status = $2, last_error = '', updated_at = NOW()
+		WHERE id = $3 AND stripe_refund_id IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, stripeRefundID, status, refundID)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+// UpdateRefundStatus はStripeの返金IDに対応する返金の状態を更新し、返金のIDを返します
+// 返金IDをまだ記録していない（送信直後にWebhookが届いた）場合は、返金のメタデータのrefundIDで対応する返金を探して記録します
+// 対応する返金が無い（Stripeのダッシュボードから返金した）場合や、既に失敗・取り消し済みで状態を変えない場合は0を返します
+func (s *Store) UpdateRefundStatus(ctx context.Context, stripeRefundID string, refundID int, status string) (int, error) {
+	query := `
+		UPDATE refunds
+		SET stripe_refund_id = $1, status = $3, updated_at = NOW()
+		WHERE (stripe_refund_id = $1 OR (id = $2 AND stripe_refund_id IS NULL))
+			AND status NOT IN ('failed', 'canceled') AND status <> $3
+		RETURNING id
+	`
+	var id int
+	err := s.db.QueryRow(ctx, query, stripeRefundID, refundID, status).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// RevertRefund は失敗・取り消しになった返金について、明細の返金済みの数量・子注文の返金額・在庫の戻しを元に戻します
+// 送信前の出品者への入金から差し引いた額は入金額に戻し、送信待ちの入金の取り消しは取りやめます
+// 返金を失敗にしたのと同じトランザクション内で、1回だけ呼び出してください
+func (s *Store) RevertRefund(ctx context.Context, refundID int) error {
+	batch := &pgx.Batch{}
+	batch.Queue(`
+		UPDATE beans b
+		SET stock = GREATEST(b.stock - ri.quantity, 0)
+		FROM refund_items ri
+		JOIN order_items oi ON ri.order_item_id = oi.id
+		WHERE ri.refund_id = $1 AND ri.restocked AND b.id = oi.bean_id
+	`, refundID)
+	batch.Queue(`
+		UPDATE order_items oi
+		SET refunded_quantity = oi.refunded_quantity - ri.quantity
+		FROM refund_items ri
+		WHERE ri.refund_id = $1 AND oi.id = ri.order_item_id
+	`, refundID)
+	batch.Queue(`
+		UPDATE sub_orders so
+		SET refunded_amount = so.refunded_amount - r.amount, shipping_refunded = so.shipping_refunded AND r.shipping_amount = 0, updated_at = NOW()
+		FROM refunds r
+		WHERE r.id = $1 AND so.id = r.sub_order_id
+	`, refundID)
+	// 差し引いた後に送信済みになった入金は戻せないので、手動で確認する
+	batch.Queue(`
+		UPDATE payout_transfers pt
+		SET amount = pt.amount + r.payout_reduction, status = CASE WHEN pt.status = 'canceled' THEN 'pending' ELSE pt.status END, updated_at = NOW()
+		FROM refunds r
+		WHERE r.id = $1 AND r.payout_reduction > 0 AND pt.sub_order_id = r.sub_order_id AND pt.status <> 'sent'
+	`, refundID)
+	batch.Queue("UPDATE transfer_reversals SET status = 'canceled', updated_at = NOW() WHERE refund_id = $1 AND status = 'pending'", refundID)
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReduceUnsentPayoutTransfer は子注文の出品者への入金をまだ送信していない場合に、入金額をamountだけ減らします
+// 入金額が0になった場合は送信を取りやめます。送信済み・送信中の場合や入金額が足りない場合は何もせず、falseを返します
+func (s *Store) ReduceUnsentPayoutTransfer(ctx context.Context, subOrderID int, amount int) (bool, error) {
+	query := `
+		UPDATE payout_transfers
+		SET amount = amount - $1, status = CASE WHEN amount = $1 THEN 'canceled' ELSE status END, updated_at = NOW()
+		WHERE sub_order_id = $2 AND amount >= $1
+			AND (status = 'failed' OR (status = 'pending' AND next_attempt_at <= NOW()))
+	`
+	ct, err := s.db.Exec(ctx, query, amount, subOrderID)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+// 出品者への入金の取り消しの送信待ちの状態
+const (
+	TransferReversalStatusPending  = "pending"
+	TransferReversalStatusSent     = "sent"
+	TransferReversalStatusFailed   = "failed"
+	TransferReversalStatusCanceled = "canceled"
+)
+
+// TransferReversal 構造体は、送信待ちの出品者への入金の取り消し（transfer_reversalsの行）を表します
+type TransferReversal struct {
+	ID         int
+	RefundID   int
+	SubOrderID int
+	Amount     int
+	// TransferID は取り消す子注文のTransferのIDです
+	TransferID string
+	Attempts   int
+}
+
+// QueueTransferReversal は返金に応じた出品者への入金の取り消しを送信待ちとして記録します
+// 子注文の入金が送信済み、または送信待ちの場合のみ記録し、取り消す入金が無い場合はfalseを返します
+func (s *Store) QueueTransferReversal(ctx context.Context, refundID int, subOrderID int, amount int) (bool, error) {
+	query := `
+		INSERT INTO transfer_reversals (refund_id, sub_order_id, amount)
+		SELECT $1, so.id, $3
+		FROM sub_orders so
+		WHERE so.id = $2 AND (so.stripe_transfer_id IS NOT NULL
+			OR EXISTS (SELECT 1 FROM payout_transfers pt WHERE pt.sub_order_id = so.id AND pt.status = 'pending'))
+	`
+	ct, err := s.db.Exec(ctx, query, refundID, subOrderID, amount)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+// ClaimTransferReversals は送信する時期が来た入金の取り消しを、古い順にlimit件まで取得します
+// 返金がStripeで成功し、取り消す入金が送信済みのものだけを取得します
+// 取得した取り消しは次の送信をleaseだけ先に延ばすため、送信中に他のサーバーが同じ取り消しを取得することはありません
+func (s *Store) ClaimTransferReversals(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]TransferReversal, error) {
+	query := `
+		UPDATE transfer_reversals tr
+		SET attempts = tr.attempts + 1, first_attempted_at = COALESCE(tr.first_attempted_at, $1), next_attempt_at = $2, updated_at = NOW()
+		FROM sub_orders so
+		WHERE tr.sub_order_id = so.id AND tr.id IN (
+			SELECT tr.id FROM transfer_reversals tr
+			JOIN refunds r ON tr.refund_id = r.id
+			JOIN sub_orders so ON tr.sub_order_id = so.id
+			WHERE tr.status = 'pending' AND tr.next_attempt_at <= $1 AND r.status = 'succeeded' AND so.stripe_transfer_id IS NOT NULL
+			ORDER BY tr.next_attempt_at, tr.id
+			LIMIT $3
+			FOR UPDATE OF tr SKIP LOCKED
+		)
+		RETURNING tr.id, tr.refund_id, tr.sub_order_id, tr.amount, so.stripe_transfer_id, tr.attempts
+	`
+	rows, err := s.db.Query(ctx, query, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reversals := []TransferReversal{}
+	for rows.Next() {
+		var t TransferReversal
+		if err := rows.Scan(&t.ID, &t.RefundID, &t.SubOrderID, &t.Amount, &t.TransferID, &t.Attempts); err != nil {
+			return nil, err
+		}
+		reversals = append(reversals, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reversals, nil
+}
+
+// MarkTransferReversalSent は入金の取り消しの送信が完了したことを記録し、返金に取り消しのIDを記録します
+func (s *Store) MarkTransferReversalSent(ctx context.Context, id int, reversalID string) error {
+	query := `
+		WITH sent AS (
+			UPDATE transfer_reversals
+			SET status = 'sent', stripe_transfer_reversal_id = $1, last_error = '', updated_at = NOW()
+			WHERE id = $2
+			RETURNING refund_id
+		)
+		UPDATE refunds r
+		SET stripe_transfer_reversal_id = $1, updated_at = NOW()
+		FROM sent
+		WHERE r.id = sent.refund_id
+	`
+	_, err := s.db.Exec(ctx, query, reversalID, id)
+	return err
+}
+
+// RecordTransferReversalFailure は入金の取り消しの送信に失敗したことを記録し、nextAttemptAtに再送します
+func (s *Store) RecordTransferReversalFailure(ctx context.Context, id int, message string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE transfer_reversals
+		SET last_error = $1, next_attempt_at = $2, updated_at = NOW()
+		WHERE id = $3 AND status = 'pending'
+	`
+	_, err := s.db.Exec(ctx, query, message, nextAttemptAt, id)
+	return err
+}
+
+// FailStaleTransferReversals は最初の送信からattemptedBeforeまでに送信が完了しなかった入金の取り消しを、失敗（failed）にします
+// 冪等キーの有効期限を過ぎてから再送すると二重に取り消す恐れがあるため、自動では再送せずに手動での確認に回します
+func (s *Store) FailStaleTransferReversals(ctx context.Context, attemptedBefore time.Time) (int64, error) {
+	query := `
+		UPDATE transfer_reversals
+		SET status = 'failed', updated_at = NOW()
+		WHERE status = 'pending' AND first_attempted_at <= $1
+	`
+	ct, err := s.db.Exec(ctx, query, attemptedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// RestockBeans は返金・キャンセルした数量だけ豆の在庫数を戻します
+func (s *Store) RestockBeans(ctx context.Context, items []OrderItem) error {
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		batch.Queue("UPDATE beans SET stock = stock + $1 WHERE id = $2", item.Quantity, item.BeanID)
+	}
+
+	br := s.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkSubOrderCanceled は子注文をキャンセル済みにします
+func (s *Store) MarkSubOrderCanceled(ctx context.Context, subOrderID int) error {
+	query := "UPDATE sub_orders SET fulfillment_status = 'canceled', canceled_at = NOW(), updated_at = NOW() WHERE id = $1"
+	_, err := s.db.Exec(ctx, query, subOrderID)
+	return err
+}
+
+// GetActiveSubOrderIDs は注文の子注文のうち、キャンセルしていないもののIDを取得します
+func (s *Store) GetActiveSubOrderIDs(ctx context.Context, orderID int) ([]int, error) {
+	rows, err := s.db.Query(ctx, "SELECT id FROM sub_orders WHERE order_id = $1 AND canceled_at IS NULL ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetRefundsByOrderID は注文の返金を、返金した明細とともに古い順に取得します
+func (s *Store) GetRefundsByOrderID(ctx context.Context, orderID int) ([]Refund, error) {
+	query := `
+		SELECT id, order_id, sub_order_id, amount, shipping_amount, reason, COALESCE(requested_by::text, ''), status,
+			COALESCE(stripe_refund_id, ''), created_at, updated_at
+		FROM refunds
+		WHERE order_id = $1
+		ORDER BY id
+	`
+	rows, err := s.db.Query(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	indexOf := map[int]int{}
+	for rows.Next() {
+		r := Refund{Items: []RefundItem{}}
+		if err := rows.Scan(&r.ID, &r.OrderID, &r.SubOrderID, &r.Amount, &r.ShippingAmount, &r.Reason, &r.RequestedBy, &r.Status,
+			&r.StripeRefundID, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		indexOf[r.ID] = len(refunds)
+		refunds = append(refunds, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(refunds) == 0 {
+		return refunds, nil
+	}
+
+	itemQuery := `
+		SELECT ri.refund_id, ri.order_item_id, oi.bean_id, ri.quantity, ri.amount, ri.restocked
+		FROM refund_items ri
+		JOIN refunds r ON ri.refund_id = r.id
+		JOIN order_items oi ON ri.order_item_id = oi.id
+		WHERE r.order_id = $1
+		ORDER BY ri.refund_id, ri.order_item_id
+	`
+	rows, err = s.db.Query(ctx, itemQuery, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var refundID int
+		var item RefundItem
+		if err := rows.Scan(&refundID, &item.OrderItemID, &item.BeanID, &item.Quantity, &item.Amount, &item.Restocked); err != nil {
+			return nil, err
+		}
+		i := indexOf[refundID]
+		refunds[i].Items = append(refunds[i].Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// cancellationRequestColumns はキャンセル依頼を取得する際のカラムです（scanCancellationRequestと対応しています）
+const cancellationRequestColumns = `id, order_id, sub_order_id, COALESCE(requested_by::text, ''), reason, status,
+	COALESCE(resolved_by::text, ''), resolution_note, resolved_at, created_at, updated_at`
+
+// scanCancellationRequest はcancellationRequestColumnsで取得した行をCancellationRequest構造体にスキャンします
+func scanCancellationRequest(row pgx.Row) (*CancellationRequest, error) {
+	var c CancellationRequest
+	if err := row.Scan(&c.ID, &c.OrderID, &c.SubOrderID, &c.RequestedBy, &c.Reason, &c.Status,
+		&c.ResolvedBy, &c.ResolutionNote, &c.ResolvedAt, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// queryCancellationRequests はクエリの結果をキャンセル依頼のリストとして取得します
+func (s *Store) queryCancellationRequests(ctx context.Context, query string, args ...interface{}) ([]CancellationRequest, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []CancellationRequest{}
+	for rows.Next() {
+		c, err := scanCancellationRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// CreateCancellationRequests は購入者自身の注文について、発送前の子注文のキャンセル依頼を作成します
+// subOrderIDが0の場合は、注文のすべての発送前の子注文が対象です。対応を待っている依頼がある子注文は対象外です
+// 他のユーザーの注文を指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) CreateCancellationRequests(ctx context.Context, orderID int, userID string, subOrderID int, reason string) ([]CancellationRequest, error) {
+	var orderStatus string
+	if err := s.db.QueryRow(ctx, "SELECT status FROM orders WHERE id = $1 AND user_id = $2 FOR UPDATE", orderID, userID).Scan(&orderStatus); err != nil {
+		return nil, err
+	}
+	if !refundableOrderStatuses[orderStatus] {
+		return nil, fmt.Errorf("%w: order status is %s", ErrOrderNotRefundable, orderStatus)
+	}
+
+	query := `
+		INSERT INTO cancellation_requests (order_id, sub_order_id, requested_by, reason)
+		SELECT so.order_id, so.id, $2, $3
+		FROM sub_orders so
+		WHERE so.order_id = $1
+		  AND ($4 = 0 OR so.id = $4)
+		  AND so.fulfillment_status::text = ANY($5)
+		  AND NOT EXISTS (SELECT 1 FROM cancellation_requests cr WHERE cr.sub_order_id = so.id AND cr.status = 'pending')
+		ORDER BY so.id
+		RETURNING ` + cancellationRequestColumns
+	requests, err := s.queryCancellationRequests(ctx, query, orderID, userID, reason, subOrderID, cancelableFulfillmentStatuses)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, ErrSubOrderNotCancelable
+	}
+	return requests, nil
+}
+
+// GetPendingCancellationRequest は子注文の対応を待っているキャンセル依頼を取得し、行をロックします
+// 依頼が無い場合はpgx.ErrNoRowsを返します
+func (s *Store) GetPendingCancellationRequest(ctx context.Context, subOrderID int) (*CancellationRequest, error) {
+	query := "SELECT " + cancellationRequestColumns + " FROM cancellation_requests WHERE sub_order_id = $1 AND status = 'pending' FOR UPDATE"
+	return scanCancellationRequest(s.db.QueryRow(ctx, query, subOrderID))
+}
+
+// ResolveCancellationRequest は対応を待っているキャンセル依頼を、承認または却下します
+// 既に対応済みの依頼を指定した場合はpgx.ErrNoRowsを返します
+func (s *Store) ResolveCancellationRequest(ctx context.Context, requestID int, status string, resolvedBy string, note string) (*CancellationRequest, error) {
+	query := `
+		UPDATE cancellation_requests
+		SET status = $1, resolved_by = NULLIF($2, '')::uuid, resolution_note = $3, resolved_at = NOW(), updated_at = NOW()
+		WHERE id = $4 AND status = 'pending'
+		RETURNING ` + cancellationRequestColumns
+	return scanCancellationRequest(s.db.QueryRow(ctx, query, status, resolvedBy, note, requestID))
+}
+
+// GetCancellationRequestsByOrderID は注文のキャンセル依頼を古い順に取得します
+func (s *Store) GetCancellationRequestsByOrderID(ctx context.Context, orderID int) ([]CancellationRequest, error) {
+	return s.queryCancellationRequests(ctx, "SELECT "+cancellationRequestColumns+" FROM cancellation_requests WHERE order_id = $1 ORDER BY id", orderID)
+}
+
+// couponUseCondition はクーポンの利用回数に数える注文の条件です（ordersの別名はoです）
+// 支払い済みの注文と、在庫を確保して支払いを待っている注文を数えます
+// 失敗・キャンセルした注文や、決済をやり直して在庫の確保を解放した注文、全額返金した注文は数えません
+const couponUseCondition = `(o.status IN ('requires_action', 'processing', 'succeeded', 'partially_refunded', 'disputed')
+	OR (o.status = 'pending' AND EXISTS (
+		SELECT 1 FROM stock_reservations sr
+		WHERE sr.order_id = o.id AND sr.status = 'active'
+	)))`
+
+// couponColumns はクーポンを取得する際のカラムです（scanCouponと対応しています）
+const couponColumns = `c.id, c.code, c.discount_type::text, c.discount_value, c.funded_by::text, COALESCE(c.seller_id::text, ''), c.min_spend,
+	c.max_uses, c.max_uses_per_user, c.starts_at, c.expires_at, c.active, c.created_at, c.updated_at,
+	ARRAY(SELECT es.seller_id::text FROM coupon_eligible_sellers es WHERE es.coupon_id = c.id ORDER BY es.seller_id),
+	ARRAY(SELECT eb.bean_id FROM coupon_eligible_beans eb WHERE eb.coupon_id = c.id ORDER BY eb.bean_id),
+	(SELECT COUNT(*) FROM orders o WHERE o.coupon_id = c.id AND ` + couponUseCondition + `)`
+
+// scanCoupon はcouponColumnsで取得した行をCoupon構造体にスキャンします
+func scanCoupon(row pgx.Row) (*Coupon, error) {
+	var c Coupon
+	if err := row.Scan(&c.ID, &c.Code, &c.DiscountType, &c.DiscountValue, &c.FundedBy, &c.SellerID, &c.MinSpend,
+		&c.MaxUses, &c.MaxUsesPerUser, &c.StartsAt, &c.ExpiresAt, &c.Active, &c.CreatedAt, &c.UpdatedAt,
+		&c.EligibleSellerIDs, &c.EligibleBeanIDs, &c.UsedCount); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetCouponByCodeForUpdate はクーポンコードでクーポンを取得し、トランザクションの終了まで行をロックします
+// 同じクーポンを使う決済を直列にし、利用回数の上限を超えて使われないようにするため、トランザクション内で呼び出してください
+// クーポンが存在しない場合はpgx.ErrNoRowsを返します
+func (s *Store) GetCouponByCodeForUpdate(ctx context.Context, code string) (*Coupon, error) {
+	return scanCoupon(s.db.QueryRow(ctx, "SELECT "+couponColumns+" FROM coupons c WHERE c.code = $1 FOR UPDATE OF c", code))
+}
+
+// CountCouponUses はクーポンの全体の利用回数と、ユーザーの利用回数を返します
+func (s *Store) CountCouponUses(ctx context.Context, couponID int, userID string) (int, int, error) {
+	query := `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE o.user_id = $2)
+		FROM orders o
+		WHERE o.coupon_id = $1 AND ` + couponUseCondition
+	var total, byUser int
+	if err := s.db.QueryRow(ctx, query, couponID, userID).Scan(&total, &byUser); err != nil {
+		return 0, 0, err
+	}
+	return total, byUser, nil
+}
+
+// GetCouponsBySellerID は出品者が発行したクーポンを新しい順に取得します
+func (s *Store) GetCouponsBySellerID(ctx context.Context, sellerID string) ([]Coupon, error) {
+	rows, err := s.db.Query(ctx, "SELECT "+couponColumns+" FROM coupons c WHERE c.seller_id = $1 ORDER BY c.id DESC", sellerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	coupons := []Coupon{}
+	for rows.Next() {
+		c, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// CreateCoupon はクーポンと対象の出品者・商品をDBに作成します
+// コードが既に使われている場合はErrCouponCodeTakenを、対象の出品者・商品が存在しない場合はErrCouponTargetNotFoundを返します
+// 複数のテーブルに挿入するため、トランザクション内で呼び出してください
+func (s *Store) CreateCoupon(ctx context.Context, coupon *Coupon) (*Coupon, error) {
+	query := `
+		INSERT INTO coupons (code, discount_type, discount_value, funded_by, seller_id, min_spend, max_uses, max_uses_per_user, starts_at, expires_at, active)
+		VALUES ($1, $2::coupon_discount_type, $3, $4::coupon_funded_by, NULLIF($5, '')::uuid, $6, $7, $8, $9, $10, $11)
+		RETURNING id
+	`
+	var id int
+	err := s.db.QueryRow(ctx, query, coupon.Code, coupon.DiscountType, coupon.DiscountValue, coupon.FundedBy, coupon.SellerID, coupon.MinSpend,
+		coupon.MaxUses, coupon.MaxUsesPerUser, coupon.StartsAt, coupon.ExpiresAt, coupon.Active).Scan(&id)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrCouponCodeTaken
+		}
+		return nil, err
+	}
+
+	batch := &pgx.Batch{}
+	for _, sellerID := range coupon.EligibleSellerIDs {
+		batch.Queue("INSERT INTO coupon_eligible_sellers (coupon_id, seller_id) VALUES ($1, $2)", id, sellerID)
+	}
+	for _, beanID := range coupon.EligibleBeanIDs {
+		batch.Queue("INSERT INTO coupon_eligible_beans (coupon_id, bean_id) VALUES ($1, $2)", id, beanID)
+	}
+	if batch.Len() > 0 {
+		br := s.db.SendBatch(ctx, batch)
+		for i := 0; i < batch.Len(); i++ {
+			if _, err := br.Exec(); err != nil {
+				br.Close()
+				var pgErr *pgconn.PgError
+				if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+					return nil, ErrCouponTargetNotFound
+				}
+				return nil, err
+			}
+		}
+		if err := br.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return scanCoupon(s.db.QueryRow(ctx, "SELECT "+couponColumns+" FROM coupons c WHERE c.id = $1", id))
+}
+
+// DeactivateCoupon は出品者が発行したクーポンの利用を停止します
+// 他の出品者のクーポンを指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) DeactivateCoupon(ctx context.Context, couponID int, sellerID string) error {
+	ct, err := s.db.Exec(ctx, "UPDATE coupons SET active = FALSE, updated_at = NOW() WHERE id = $1 AND seller_id = $2", couponID, sellerID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CountBeansOwnedBy はbeanIDsのうち、ユーザーが出品している豆の件数を返します
+func (s *Store) CountBeansOwnedBy(ctx context.Context, userID string, beanIDs []int) (int, error) {
+	var count int
+	err := s.db.QueryRow(ctx, "SELECT COUNT(*) FROM beans WHERE user_id = $1 AND id = ANY($2)", userID, beanIDs).Scan(&count)
+	return count, err
+}
+
+// subscriptionPlanColumns は定期便のプランを取得する際のカラムです（scanSubscriptionPlanと対応しています）
+// subscription_plansの別名はp、beansの別名はbです
+const subscriptionPlanColumns = `p.id, p.bean_id, b.name, COALESCE(b.user_id::text, ''), p.name, p.quantity, p.interval_days, b.price, b.price * p.quantity,
+	p.active, p.created_at, p.updated_at`
+
+// scanTargets はsubscriptionPlanColumnsに対応するスキャン先を返します
+func (p *SubscriptionPlan) scanTargets() []interface{} {
+	return []interface{}{&p.ID, &p.BeanID, &p.BeanName, &p.SellerID, &p.Name, &p.Quantity, &p.IntervalDays, &p.UnitPrice, &p.Price,
+		&p.Active, &p.CreatedAt, &p.UpdatedAt}
+}
+
+// querySubscriptionPlans はクエリの結果を定期便のプランのリストとして取得します
+func (s *Store) querySubscriptionPlans(ctx context.Context, query string, args ...interface{}) ([]SubscriptionPlan, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []SubscriptionPlan{}
+	for rows.Next() {
+		var p SubscriptionPlan
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// CreateSubscriptionPlan は出品者自身のコーヒー豆に、定期便のプランを作成します
+// 他の出品者のコーヒー豆を指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) CreateSubscriptionPlan(ctx context.Context, plan *SubscriptionPlan, sellerID string) (*SubscriptionPlan, error) {
+	query := `
+		WITH inserted AS (
+			INSERT INTO subscription_plans (bean_id, name, quantity, interval_days)
+			SELECT id, $2, $3, $4 FROM beans WHERE id = $1 AND user_id = $5
+			RETURNING *
+		)
+		SELECT ` + subscriptionPlanColumns + `
+		FROM inserted p
+		JOIN beans b ON p.bean_id = b.id
+	`
+	var created SubscriptionPlan
+	if err := s.db.QueryRow(ctx, query, plan.BeanID, plan.Name, plan.Quantity, plan.IntervalDays, sellerID).Scan(created.scanTargets()...); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetSubscriptionPlansBySellerID は出品者のコーヒー豆の定期便のプランを、停止したものも含めて取得します
+func (s *Store) GetSubscriptionPlansBySellerID(ctx context.Context, sellerID string) ([]SubscriptionPlan, error) {
+	query := "SELECT " + subscriptionPlanColumns + " FROM subscription_plans p JOIN beans b ON p.bean_id = b.id WHERE b.user_id = $1 ORDER BY p.id"
+	return s.querySubscriptionPlans(ctx, query, sellerID)
+}
+
+// GetSubscriptionPlansByBeanID はコーヒー豆の申し込める（停止していない）定期便のプランを取得します
+func (s *Store) GetSubscriptionPlansByBeanID(ctx context.Context, beanID int) ([]SubscriptionPlan, error) {
+	query := "SELECT " + subscriptionPlanColumns + " FROM subscription_plans p JOIN beans b ON p.bean_id = b.id WHERE p.bean_id = $1 AND p.active ORDER BY p.interval_days, p.quantity, p.id"
+	return s.querySubscriptionPlans(ctx, query, beanID)
+}
+
+// GetSubscriptionPlan はIDで定期便のプランを取得します
+func (s *Store) GetSubscriptionPlan(ctx context.Context, planID int) (*SubscriptionPlan, error) {
+	var p SubscriptionPlan
+	query := "SELECT " + subscriptionPlanColumns + " FROM subscription_plans p JOIN beans b ON p.bean_id = b.id WHERE p.id = $1"
+	if err := s.db.QueryRow(ctx, query, planID).Scan(p.scanTargets()...); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DeactivateSubscriptionPlan は出品者自身の定期便のプランを停止し、新しい申し込みを受け付けないようにします
+// 申し込み済みの定期便はそのまま続きます
+// 他の出品者のプランを指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) DeactivateSubscriptionPlan(ctx context.Context, planID int, sellerID string) error {
+	query := `
+		UPDATE subscription_plans p
+		SET active = FALSE, updated_at = NOW()
+		FROM beans b
+		WHERE p.bean_id = b.id AND p.id = $1 AND b.user_id = $2
+	`
+	ct, err := s.db.Exec(ctx, query, planID, sellerID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// subscriptionQuery は定期便の申し込みを、プランとともに取得する際のクエリです（scanSubscriptionと対応しています）
+// 条件は呼び出し側でWHERE句として付け加えます
+const subscriptionQuery = `
+	SELECT s.id, s.user_id::text, s.status, s.stripe_payment_method_id, s.next_delivery_date::text, s.failed_attempts, s.last_payment_error,
+		s.paused_at, s.canceled_at, s.created_at, s.updated_at, ` + subscriptionPlanColumns + `
+	FROM subscriptions s
+	JOIN subscription_plans p ON s.plan_id = p.id
+	JOIN beans b ON p.bean_id = b.id
+`
+
+// scanSubscription はsubscriptionQueryで取得した行をSubscription構造体にスキャンします
+func scanSubscription(row pgx.Row) (*Subscription, error) {
+	var sub Subscription
+	targets := []interface{}{&sub.ID, &sub.UserID, &sub.Status, &sub.StripePaymentMethodID, &sub.NextDeliveryDate, &sub.FailedAttempts, &sub.LastPaymentError,
+		&sub.PausedAt, &sub.CanceledAt, &sub.CreatedAt, &sub.UpdatedAt}
+	if err := row.Scan(append(targets, sub.Plan.scanTargets()...)...); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// CreateSubscription は定期便の申し込みを作成します
+func (s *Store) CreateSubscription(ctx context.Context, sub *Subscription) (*Subscription, error) {
+	query := `
+		INSERT INTO subscriptions (user_id, plan_id, stripe_payment_method_id, next_delivery_date)
+		VALUES ($1, $2, $3, $4::date)
+		RETURNING id
+	`
+	var id int
+	if err := s.db.QueryRow(ctx, query, sub.UserID, sub.Plan.ID, sub.StripePaymentMethodID, sub.NextDeliveryDate).Scan(&id); err != nil {
+		return nil, err
+	}
+	return scanSubscription(s.db.QueryRow(ctx, subscriptionQuery+" WHERE s.id = $1", id))
+}
+
+// GetSubscriptionsByUserID はユーザーの定期便の申し込みを、解約済みのものも含めて新しい順に取得します
+func (s *Store) GetSubscriptionsByUserID(ctx context.Context, userID string) ([]Subscription, error) {
+	rows, err := s.db.Query(ctx, subscriptionQuery+" WHERE s.user_id = $1 ORDER BY s.id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// GetSubscriptionForUpdate はユーザー自身の定期便の申し込みを取得し、行をロックします
+// 他のユーザーの申し込みを指定した場合は、存在しない場合と同じくpgx.ErrNoRowsを返します
+func (s *Store) GetSubscriptionForUpdate(ctx context.Context, subscriptionID int, userID string) (*Subscription, error) {
+	return scanSubscription(s.db.QueryRow(ctx, subscriptionQuery+" WHERE s.id = $1 AND s.user_id = $2 FOR UPDATE OF s", subscriptionID, userID))
+}
+
+// UpdateSubscription は定期便の申し込みの状態・次のお届け日・請求に使うカードを保存します
+// 一時停止・再開・解約の日時は、状態に合わせてDBで記録します
+func (s *Store) UpdateSubscription(ctx context.Context, sub *Subscription) (*Subscription, error) {
+	query := `
+		UPDATE subscriptions
+		SET status = $1::subscription_status,
+			next_delivery_date = $2::date,
+			stripe_payment_method_id = $3,
+			failed_attempts = $4,
+			last_payment_error = $5,
+			retry_after = CASE WHEN $4 = 0 THEN NULL ELSE retry_after END,
+			paused_at = CASE WHEN $1 = 'paused' THEN COALESCE(paused_at, NOW()) ELSE NULL END,
+			canceled_at = CASE WHEN $1 = 'canceled' THEN COALESCE(canceled_at, NOW()) ELSE NULL END,
+			updated_at = NOW()
+		WHERE id = $6
+	`
+	if _, err := s.db.Exec(ctx, query, sub.Status, sub.NextDeliveryDate, sub.StripePaymentMethodID, sub.FailedAttempts, sub.LastPaymentError, sub.ID); err != nil {
+		return nil, err
+	}
+	return scanSubscription(s.db.QueryRow(ctx, subscriptionQuery+" WHERE s.id = $1", sub.ID))
+}
+
+// subscriptionDueCondition は請求する時期が来た定期便の条件です（$1はお届け日の基準となる今日の日付、$2は現在時刻です）
+const subscriptionDueCondition = `s.status = 'active' AND s.next_delivery_date <= $1::date AND (s.retry_after IS NULL OR s.retry_after <= $2)`
+
+// GetDueSubscriptionIDs は請求する時期が来た定期便のIDを、お届け日の古い順に最大limit件取得します
+func (s *Store) GetDueSubscriptionIDs(ctx context.Context, today string, now time.Time, limit int) ([]int, error) {
+	query := "SELECT s.id FROM subscriptions s WHERE " + subscriptionDueCondition + " ORDER BY s.next_delivery_date, s.id LIMIT $3"
+	rows, err := s.db.Query(ctx, query, today, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// LockDueSubscription は請求する時期が来た定期便の申し込みを取得し、行をロックします
+// 他のサーバーが請求中（ロック中）の場合や、既に請求済みの場合はpgx.ErrNoRowsを返します
+func (s *Store) LockDueSubscription(ctx context.Context, subscriptionID int, today string, now time.Time) (*Subscription, error) {
+	query := subscriptionQuery + " WHERE " + subscriptionDueCondition + " AND s.id = $3 FOR UPDATE OF s SKIP LOCKED"
+	return scanSubscription(s.db.QueryRow(ctx, query, today, now, subscriptionID))
+}
+
+// GetOpenSubscriptionOrder は定期便のお届け日の注文のうち、キャンセル・失敗になっていないものを取得します
+// 前回の請求が途中で中断した場合に、同じ注文で請求をやり直すために使います。無い場合はpgx.ErrNoRowsを返します
+func (s *Store) GetOpenSubscriptionOrder(ctx context.Context, subscriptionID int, deliveryDate string) (*Order, error) {
+	query := "SELECT " + orderColumns + " FROM orders WHERE subscription_id = $1 AND subscription_delivery_date = $2::date AND status NOT IN ('canceled', 'failed')"
+	return scanOrder(s.db.QueryRow(ctx, query, subscriptionID, deliveryDate))
+}
+
+// AdvanceSubscription は定期便の請求が済んだ後に、次のお届け日を進め、請求の失敗の記録を消します
+// 請求中に購入者がスキップなどで次のお届け日を変更していた場合は、変更を優先して何もしません
+func (s *Store) AdvanceSubscription(ctx context.Context, subscriptionID int, deliveryDate string, nextDeliveryDate string) error {
+	query := `
+		UPDATE subscriptions
+		SET next_delivery_date = $1::date, failed_attempts = 0, last_payment_error = '', retry_after = NULL, updated_at = NOW()
+		WHERE id = $2 AND next_delivery_date = $3::date
+	`
+	_, err := s.db.Exec(ctx, query, nextDeliveryDate, subscriptionID, deliveryDate)
+	return err
+}
+
+// DeferSubscriptionBilling はuntilまで定期便を請求の対象から外します（請求の失敗の記録は変えません）
+// 保留中の注文を作成してから請求の結果が分かるまでの間、同じ回を二重に請求しないために使います
+func (s *Store) DeferSubscriptionBilling(ctx context.Context, subscriptionID int, until time.Time) error {
+	_, err := s.db.Exec(ctx, "UPDATE subscriptions SET retry_after = $1, updated_at = NOW() WHERE id = $2", until, subscriptionID)
+	return err
+}
+
+// RecordSubscriptionFailure は定期便の請求の失敗を記録し、retryAfterまで再請求しないようにします
+// 失敗がmaxAttempts回続いた場合は一時停止し、戻り値で一時停止したかを返します
+func (s *Store) RecordSubscriptionFailure(ctx context.Context, subscriptionID int, message string, retryAfter time.Time, maxAttempts int) (bool, error) {
+	query := `
+		UPDATE subscriptions
+		SET failed_attempts = failed_attempts + 1,
+			last_payment_error = $1,
+			retry_after = $2,
+			status = CASE WHEN failed_attempts + 1 >= $3 THEN 'paused'::subscription_status ELSE status END,
+			paused_at = CASE WHEN failed_attempts + 1 >= $3 THEN NOW() ELSE paused_at END,
+			updated_at = NOW()
+		WHERE id = $4
+		RETURNING status
+	`
+	var status string
+	if err := s.db.QueryRow(ctx, query, message, retryAfter, maxAttempts, subscriptionID).Scan(&status); err != nil {
+		return false, err
+	}
+	return status == SubscriptionStatusPaused, nil
+}
+
+// GetUpcomingDeliveries は出品者のコーヒー豆の継続中の定期便について、until（その日を含む）までのお届け予定を日付順に取得します
+// 請求に失敗して再請求を待っているお届けも、予定に含めます
+func (s *Store) GetUpcomingDeliveries(ctx context.Context, sellerID string, until string) ([]UpcomingDelivery, error) {
+	query := `
+		SELECT s.id, p.id, p.bean_id, b.name, p.quantity, d::date::text, COALESCE(pr.display_name, '')
+		FROM subscriptions s
+		JOIN subscription_plans p ON s.plan_id = p.id
+		JOIN beans b ON p.bean_id = b.id
+		LEFT JOIN profiles pr ON pr.user_id = s.user_id
+		CROSS JOIN LATERAL generate_series(s.next_delivery_date::timestamp, $2::date::timestamp, make_interval(days => p.interval_days)) AS d
+		WHERE b.user_id = $1 AND s.status = 'active'
+		ORDER BY d, s.id
+	`
+	rows, err := s.db.Query(ctx, query, sellerID, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []UpcomingDelivery{}
+	for rows.Next() {
+		var d UpcomingDelivery
+		if err := rows.Scan(&d.SubscriptionID, &d.PlanID, &d.BeanID, &d.BeanName, &d.Quantity, &d.DeliveryDate, &d.BuyerName); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Stripe Connectアカウントの状態（profiles.stripe_account_status）
+const (
+	// StripeAccountStatusRestricted は未登録、または登録情報の不足で支払いや入金が制限されている状態です
+	StripeAccountStatusRestricted = "restricted"
+	// StripeAccountStatusPending は登録情報を提出し、Stripeの審査を待っている状態です
+	StripeAccountStatusPending = "pending"
+	// StripeAccountStatusEnabled は支払いの受け付けと入金ができる状態です
+	StripeAccountStatusEnabled = "enabled"
+)
+
+// SellerStripeAccount 構造体は、出品者のStripe Connectアカウントの登録状況を保持します
+type SellerStripeAccount struct {
+	UserID          string `json:"user_id"`
+	StripeAccountID string `json:"stripe_account_id"` // 未作成の場合は空
+	Status          string `json:"status"`
+}
+
+// PayoutsEnabled は出品者が売上を受け取れる状態かを返します
+func (a *SellerStripeAccount) PayoutsEnabled() bool {
+	return a.StripeAccountID != "" && a.Status == StripeAccountStatusEnabled
+}
+
+// GetSellerStripeAccount はユーザーのStripe Connectアカウントの登録状況を取得します
+// プロフィールが無い場合はpgx.ErrNoRowsを返します
+func (s *Store) GetSellerStripeAccount(ctx context.Context, userID string) (*SellerStripeAccount, error) {
+	account := SellerStripeAccount{UserID: userID}
+	query := `SELECT COALESCE(stripe_account_id, ''), COALESCE(stripe_account_status, '') FROM profiles WHERE user_id = $1`
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&account.StripeAccountID, &account.Status); err != nil {
+		return nil, err
+	}
+	if account.Status == "" {
+		account.Status = StripeAccountStatusRestricted
+	}
+	return &account, nil
+}
+
+// SetSellerStripeAccount はユーザーのプロフィールに、作成したStripe Connectアカウントを紐づけます
+func (s *Store) SetSellerStripeAccount(ctx context.Context, userID string, stripeAccountID string, status string) (*SellerStripeAccount, error) {
+	query := `
+		UPDATE profiles
+		SET stripe_account_id = $1, stripe_account_status = $2, updated_at = NOW()
+		WHERE user_id = $3
+	`
+	ct, err := s.db.Exec(ctx, query, stripeAccountID, status, userID)
+	if err != nil {
+		return nil, err
+	}
+	if ct.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return &SellerStripeAccount{UserID: userID, StripeAccountID: stripeAccountID, Status: status}, nil
+}
+
+// UpdateStripeAccountStatus はStripe ConnectアカウントIDで、出品者のアカウントの状態を更新します
+// 紐づくプロフィールが無い場合はfalseを返します
+func (s *Store) UpdateStripeAccountStatus(ctx context.Context, stripeAccountID string, status string) (bool, error) {
+	query := `
+		UPDATE profiles
+		SET stripe_account_status = $1, updated_at = NOW()
+		WHERE stripe_account_id = $2
+	`
+	ct, err := s.db.Exec(ctx, query, status, stripeAccountID)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() > 0, nil
+}
+
+// Profile 構造体
+type Profile struct {
+	UserID           string    `json:"user_id"`
+	DisplayName      string    `json:"display_name"`
+	IconURL          string    `json:"icon_url"`
+	PostCode         string    `json:"post_code"`
+	Address          string    `json:"address"`
+	AboutMe          string    `json:"about_me"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	StripeCustomerID *string   `json:"stripe_customer_id"`
+	// InvoiceRegistrationNumber は適格請求書発行事業者の登録番号です（"T"と13桁の数字。未登録の場合は空）
+	InvoiceRegistrationNumber string `json:"invoice_registration_number"`
+}
+
+// CreateProfile は新しいプロフィールをDBに挿入し、ユーザーに購入者（buyer）のロールを付与します
+// 決済時にEnsureProfileで作成した空のプロフィールは上書きし、登録済みのプロフィールがある場合はpgx.ErrNoRowsを返します
+func (s *Store) CreateProfile(ctx context.Context, profile *Profile) (*Profile, error) {
+	var newProfile Profile
+	query := `WITH inserted AS (
+			       INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me, invoice_registration_number)
+			       VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+			       ON CONFLICT (user_id) DO UPDATE
+			       SET display_name = EXCLUDED.display_name, icon_url = EXCLUDED.icon_url, post_code = EXCLUDED.post_code, address = EXCLUDED.address,
+			           about_me = EXCLUDED.about_me, invoice_registration_number = EXCLUDED.invoice_registration_number, updated_at = NOW()
+			       WHERE profiles.display_name = '' AND profiles.post_code = '' AND profiles.address = ''
+			       RETURNING *
+			   ), granted AS (
+			       INSERT INTO user_roles (user_id, role)
+			       SELECT user_id, 'buyer' FROM inserted
+			       ON CONFLICT (user_id, role) DO NOTHING
+			   )
+			   SELECT user_id, display_name, icon_url, post_code, address, about_me, created_at, updated_at, stripe_customer_id, COALESCE(invoice_registration_number, '') FROM inserted`
+
+	err := s.db.QueryRow(ctx, query, profile.UserID, profile.DisplayName, profile.IconURL, profile.PostCode, profile.Address, profile.AboutMe, profile.InvoiceRegistrationNumber).Scan(
+		&newProfile.UserID,
+		&newProfile.DisplayName,
+		&newProfile.IconURL,
+		&newProfile.PostCode,
+		&newProfile.Address,
+		&newProfile.AboutMe,
+		&newProfile.CreatedAt,
+		&newProfile.UpdatedAt,
+		&newProfile.StripeCustomerID,
+		&newProfile.InvoiceRegistrationNumber,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &newProfile, nil
+}
+
+// UpdateProfile は既存のプロフィールを更新します
+// invoiceRegistrationNumberがnilの場合は登録番号を変更せず、空文字列の場合は登録番号を削除します
+func (s *Store) UpdateProfile(ctx context.Context, profile *Profile, invoiceRegistrationNumber *string) (*Profile, error) {
+	var updatedProfile Profile
+	query := `UPDATE profiles
+			   SET display_name = $1, icon_url = $2, post_code = $3, address = $4, about_me = $5, invoice_registration_number = CASE WHEN $6::text IS NULL THEN invoice_registration_number ELSE NULLIF($6, '') END, updated_at = NOW()
+			   WHERE user_id = $7
+			   RETURNING user_id, display_name, icon_url, post_code, address, about_me, created_at, updated_at, stripe_customer_id, COALESCE(invoice_registration_number, '')`
+
+	err := s.db.QueryRow(ctx, query, profile.DisplayName, profile.IconURL, profile.PostCode, profile.Address, profile.AboutMe, invoiceRegistrationNumber, profile.UserID).Scan(
+		&updatedProfile.UserID,
+		&updatedProfile.DisplayName,
+		&updatedProfile.IconURL,
+		&updatedProfile.PostCode,
+		&updatedProfile.Address,
+		&updatedProfile.AboutMe,
+		&updatedProfile.CreatedAt,
+		&updatedProfile.UpdatedAt,
+		&updatedProfile.StripeCustomerID,
+		&updatedProfile.InvoiceRegistrationNumber,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &updatedProfile, nil
+}
+
+// EnsureProfile はユーザーのプロフィールが無い場合に、空のプロフィールを作成します
+// 決済の前にStripe Customerを紐づけるために使い、空のプロフィールは後からCreateProfileで登録できます
+// 決済するユーザーには、購入者（buyer）のロールも付与します
+func (s *Store) EnsureProfile(ctx context.Context, userID string) error {
+	query := `
+		WITH ensured AS (
+			INSERT INTO profiles (user_id, display_name, icon_url, post_code, address, about_me)
+			VALUES ($1, '', '', '', '', '')
+			ON CONFLICT (user_id) DO NOTHING
+		)
+		INSERT INTO user_roles (user_id, role)
+		VALUES ($1, 'buyer')
+		ON CONFLICT (user_id, role) DO NOTHING
+	`
+	_, err := s.db.Exec(ctx, query, userID)
+	return err
+}
+
+// GetStripeCustomerID はユーザーのプロフィールに紐づくStripe CustomerのIDを取得します
+// Customerが未作成の場合は空文字列を、プロフィールが無い場合はpgx.ErrNoRowsを返します
+func (s *Store) GetStripeCustomerID(ctx context.Context, userID string) (string, error) {
+	var customerID string
+	query := "SELECT COALESCE(stripe_customer_id, '') FROM profiles WHERE user_id = $1"
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&customerID); err != nil {
+		return "", err
+	}
+	return customerID, nil
+}
+
+// SetStripeCustomerID はユーザーのプロフィールに、作成したStripe Customerを紐づけ、紐づいているCustomerのIDを返します
+// 既に他のCustomerが紐づいている（同時に作成された）場合は変更せず、紐づいているCustomerのIDを返します
+// プロフィールが無い場合はpgx.ErrNoRowsを返します
+func (s *Store) SetStripeCustomerID(ctx context.Context, userID string, customerID string) (string, error) {
+	query := `
+		UPDATE profiles
+		SET stripe_customer_id = COALESCE(stripe_customer_id, $1), updated_at = NOW()
+		WHERE user_id = $2
+		RETURNING stripe_customer_id
+	`
+	var linked string
+	if err := s.db.QueryRow(ctx, query, customerID, userID).Scan(&linked); err != nil {
+		return "", err
+	}
+	return linked, nil
+}
+
+// RecordStripeEvent は処理したStripeのイベントIDを記録します
+// 既に記録済みのイベントであればfalseを返します
+// 副作用と同じトランザクションで呼び出すことで、イベントがちょうど1回だけ処理されるようにします
+func (s *Store) RecordStripeEvent(ctx context.Context, eventID string, eventType string) (bool, error) {
+	query := `
+		INSERT INTO stripe_webhook_events (id, type)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`
+	ct, err := s.db.Exec(ctx, query, eventID, eventType)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// GetUserRoles はユーザーに付与されたロールを取得します
+func (s *Store) GetUserRoles(ctx context.Context, userID string) ([]string, error) {
+	rows, err := s.db.Query(ctx, "SELECT role::text FROM user_roles WHERE user_id = $1 ORDER BY role", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// GrantUserRole はユーザーにロールを付与します
+// 既に付与されている場合はfalseを返し、ユーザーが存在しない場合はErrUserNotFoundを返します
+func (s *Store) GrantUserRole(ctx context.Context, userID string, role string, grantedBy string) (bool, error) {
+	query := `
+		INSERT INTO user_roles (user_id, role, granted_by)
+		VALUES ($1, $2::user_role, NULLIF($3, '')::uuid)
+		ON CONFLICT (user_id, role) DO NOTHING
+	`
+	ct, err := s.db.Exec(ctx, query, userID, role, grantedBy)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// RevokeUserRole はユーザーのロールを削除します（付与されていなかった場合はfalse）
+func (s *Store) RevokeUserRole(ctx context.Context, userID string, role string) (bool, error) {
+	ct, err := s.db.Exec(ctx, "DELETE FROM user_roles WHERE user_id = $1 AND role = $2::user_role", userID, role)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// RecordAuditLog は監査ログを記録します
+// 操作と同じトランザクションで呼び出し、操作がロールバックされた場合は記録も残らないようにしてください
+func (s *Store) RecordAuditLog(ctx context.Context, entry *AuditLog) error {
+	details := entry.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	query := `
+		INSERT INTO audit_logs (actor_id, actor_roles, action, target_type, target_id, target_owner_id, reason, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	`
+	return s.db.QueryRow(ctx, query, entry.ActorID, append([]string{}, entry.ActorRoles...), entry.Action, entry.TargetType, entry.TargetID,
+		entry.TargetOwnerID, entry.Reason, details).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAuditLogs は監査ログを新しい順に1ページ分取得します
+// targetType・targetID・actorIDが空でない場合は、その値で絞り込みます
+func (s *Store) GetAuditLogs(ctx context.Context, targetType string, targetID string, actorID string, page PageParams) (*AuditLogPage, error) {
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	if targetType != "" {
+		args = append(args, targetType)
+		conditions = append(conditions, fmt.Sprintf("target_type = $%d", len(args)))
+	}
+	if targetID != "" {
+		args = append(args, targetID)
+		conditions = append(conditions, fmt.Sprintf("target_id = $%d", len(args)))
+	}
+	if actorID != "" {
+		args = append(args, actorID)
+		conditions = append(conditions, fmt.Sprintf("actor_id = $%d", len(args)))
+	}
+	// カーソルが指定されていれば、そのログより古いものに絞り込む
+	if page.Cursor != "" {
+		cursorID, err := decodeOrderCursor(page.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cursorID)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(args)))
+	}
+
+	// 次のページがあるかを判定するため、1件多く取得する
+	args = append(args, limit+1)
+	query := fmt.Sprintf(`
+		SELECT id, actor_id, actor_roles, action, target_type, target_id, target_owner_id, reason, details, created_at
+		FROM audit_logs WHERE %s ORDER BY id DESC LIMIT $%d
+	`, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []AuditLog{}
+	for rows.Next() {
+		var l AuditLog
+		if err := rows.Scan(&l.ID, &l.ActorID, &l.ActorRoles, &l.Action, &l.TargetType, &l.TargetID, &l.TargetOwnerID, &l.Reason, &l.Details, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &AuditLogPage{Items: logs}
+	if len(logs) > limit {
+		result.Items = logs[:limit]
+		next, err := encodeOrderCursor(result.Items[limit-1].ID)
+		if err != nil {
+			return nil, err
+		}
+		result.NextCursor = &next
+	}
+	return result, nil
+}
+
+// SetBeanUnpublished は豆を理由とともに非公開にする（unpublishedがfalseの場合は公開に戻す）
+// 既に非公開の豆を非公開にした場合は、非公開にした日時を変えずに理由を更新します
+func (s *Store) SetBeanUnpublished(ctx context.Context, beanID int, unpublished bool, actorID string, reason string) (*Bean, error) {
+	query := `
+		WITH updated AS (
+			UPDATE beans
+			SET unpublished_at = CASE WHEN $2 THEN COALESCE(unpublished_at, NOW()) END,
+			    unpublished_reason = CASE WHEN $2 THEN $3 ELSE '' END,
+			    unpublished_by = CASE WHEN $2 THEN $4::uuid END,
+			    updated_at = NOW()
+			WHERE id = $1
+			RETURNING *
+		)
+		SELECT ` + beanColumns("updated") + ` FROM updated`
+	var b Bean
+	if err := s.db.QueryRow(ctx, query, beanID, unpublished, reason, actorID).Scan(b.scanTargets()...); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// SuspendSeller は出品者を停止します（停止中の出品者の豆は購入者に表示されなくなります）
+// 既に停止中の場合はfalseを返し、ユーザーが存在しない場合はErrUserNotFoundを返します
+func (s *Store) SuspendSeller(ctx context.Context, sellerID string, actorID string, reason string) (bool, error) {
+	query := `
+		INSERT INTO seller_suspensions (user_id, reason, suspended_by)
+		VALUES ($1, $2, NULLIF($3, '')::uuid)
+		ON CONFLICT (user_id) DO NOTHING
+	`
+	ct, err := s.db.Exec(ctx, query, sellerID, reason, actorID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// UnsuspendSeller は出品者の停止を解除します（停止されていなかった場合はfalse）
+func (s *Store) UnsuspendSeller(ctx context.Context, sellerID string) (bool, error) {
+	ct, err := s.db.Exec(ctx, "DELETE FROM seller_suspensions WHERE user_id = $1", sellerID)
+	if err != nil {
+		return false, err
+	}
+	return ct.RowsAffected() == 1, nil
+}
+
+// PausedSubscription は、豆が購入者に表示されなくなったために一時停止した定期便です
+type PausedSubscription struct {
+	ID     int
+	UserID string
+	BeanID int
+}
+
+// PauseBeanSubscriptions は豆の継続中の定期便をすべて一時停止し、一時停止した定期便を返します
+// 非公開にされた豆の定期便を、次の請求を待たずに止めるために使います（公開に戻しても自動では再開しない）
+func (s *Store) PauseBeanSubscriptions(ctx context.Context, beanID int) ([]PausedSubscription, error) {
+	return s.pauseSubscriptions(ctx, "p.bean_id = $1", beanID)
+}
+
+// PauseSellerSubscriptions は出品者のすべての豆の継続中の定期便を一時停止し、一時停止した定期便を返します
+// 停止された出品者の定期便を、次の請求を待たずに止めるために使います（停止を解除しても自動では再開しない）
+func (s *Store) PauseSellerSubscriptions(ctx context.Context, sellerID string) ([]PausedSubscription, error) {
+	return s.pauseSubscriptions(ctx, "b.user_id = $1", sellerID)
+}
+
+// pauseSubscriptions は条件に一致するプランの継続中の定期便を一時停止します
+// conditionではプランをp、豆をbとして参照できます
+func (s *Store) pauseSubscriptions(ctx context.Context, condition string, arg interface{}) ([]PausedSubscription, error) {
+	query := `
+		UPDATE subscriptions
+		SET status = 'paused', paused_at = NOW(), updated_at = NOW()
+		FROM subscription_plans p
+		JOIN beans b ON b.id = p.bean_id
+		WHERE subscriptions.plan_id = p.id AND subscriptions.status = 'active' AND ` + condition + `
+		RETURNING subscriptions.id, subscriptions.user_id, p.bean_id
+	`
+	rows, err := s.db.Query(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paused := []PausedSubscription{}
+	for rows.Next() {
+		var sub PausedSubscription
+		if err := rows.Scan(&sub.ID, &sub.UserID, &sub.BeanID); err != nil {
+			return nil, err
+		}
+		paused = append(paused, sub)
+	}
+	return paused, rows.Err()
+}
+
+// IsSellerSuspended は出品者が停止されているかを返します
+func (s *Store) IsSellerSuspended(ctx context.Context, sellerID string) (bool, error) {
+	var suspended bool
+	err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM seller_suspensions WHERE user_id = $1)", sellerID).Scan(&suspended)
+	return suspended, err
+}
+
+// CountBeansBySeller は出品者の豆の件数を返します（非公開の豆も含みます）
+func (s *Store) CountBeansBySeller(ctx context.Context, sellerID string) (int, error) {
+	var count int
+	err := s.db.QueryRow(ctx, "SELECT COUNT(*) FROM beans WHERE user_id = $1", sellerID).Scan(&count)
+	return count, err
+}
+
+// IsBeanListed は豆が購入者に表示される（非公開にされておらず、出品者が停止されていない）かを返します
+func (s *Store) IsBeanListed(ctx context.Context, beanID int) (bool, error) {
+	var listed bool
+	err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM beans b WHERE b.id = $1 AND "+listedBeanCondition("b")+")", beanID).Scan(&listed)
+	return listed, err
+}
+
+// GetSubOrderPayouts は注文の子注文ごとの、出品者への入金の状態を取得します（管理者向け）
+func (s *Store) GetSubOrderPayouts(ctx context.Context, orderID int) ([]SubOrderPayout, error) {
+	query := `
+		SELECT so.id, COALESCE(so.seller_id::text, ''), COALESCE(so.stripe_account_id, ''), COALESCE(so.stripe_transfer_id, ''), ` + subOrderPayoutAmount + `,
+			COALESCE(pt.status, ''), COALESCE(pt.last_error, '')
+		FROM sub_orders so
+		LEFT JOIN payout_transfers pt ON pt.sub_order_id = so.id
+		WHERE so.order_id = $1
+		ORDER BY so.id
+	`
+	rows, err := s.db.Query(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := []SubOrderPayout{}
+	for rows.Next() {
+		var p SubOrderPayout
+		if err := rows.Scan(&p.SubOrderID, &p.SellerID, &p.StripeAccountID, &p.StripeTransferID, &p.Amount, &p.TransferStatus, &p.TransferError); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
@@ -0,0 +1,881 @@
+// backend/subscription.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// 定期便の申し込みの状態（subscription_status型）
+const (
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusPaused   = "paused"
+	SubscriptionStatusCanceled = "canceled"
+)
+
+// 購入者が定期便に対して行える操作
+const (
+	SubscriptionActionPause  = "pause"
+	SubscriptionActionResume = "resume"
+	SubscriptionActionSkip   = "skip"
+	SubscriptionActionCancel = "cancel"
+)
+
+// 定期便のプランで指定できる範囲
+const (
+	minSubscriptionIntervalDays = 7
+	maxSubscriptionIntervalDays = 90
+	maxSubscriptionQuantity     = 20
+	// maxSubscriptionLeadDays は申し込み時に指定できる、最初のお届け日までの日数の上限です
+	maxSubscriptionLeadDays = 90
+)
+
+// subscriptionBillingInterval は請求する時期が来た定期便を確認する間隔です
+const subscriptionBillingInterval = 10 * time.Minute
+
+// subscriptionBillingBatchSize は1回の確認で請求する定期便の最大件数です
+const subscriptionBillingBatchSize = 50
+
+// maxSubscriptionPaymentAttempts は定期便を一時停止するまでに、請求を試みる回数です
+const maxSubscriptionPaymentAttempts = 3
+
+// subscriptionRetryDelay は定期便の請求に失敗した場合に、再請求するまでの間隔です
+const subscriptionRetryDelay = 24 * time.Hour
+
+// dateLayout はお届け日の形式です
+const dateLayout = "2006-01-02"
+
+// jst はお届け日の基準となる日本標準時です（tzdataの無い環境でも使えるよう固定のオフセットで定義します）
+var jst = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// ErrInvalidSubscriptionAction は定期便の状態に対して行えない操作をしようとした場合に返されます
+var ErrInvalidSubscriptionAction = errors.New("invalid subscription action")
+
+// ErrPaymentMethodNotUsable は購入者のものではないカードを、定期便の請求に使おうとした場合に返されます
+var ErrPaymentMethodNotUsable = errors.New("payment method is not usable")
+
+// SubscriptionPlan 構造体は、出品者がコーヒー豆ごとに用意する定期便のプランを保持します
+type SubscriptionPlan struct {
+	ID       int    `json:"id"`
+	BeanID   int    `json:"bean_id"`
+	BeanName string `json:"bean_name"`
+	SellerID string `json:"seller_id"`
+	Name     string `json:"name"`
+	// Quantity は1回のお届けの数量（袋数）です
+	Quantity int `json:"quantity"`
+	// IntervalDays はお届けの間隔（日数）です
+	IntervalDays int `json:"interval_days"`
+	// UnitPrice はコーヒー豆の現在の価格です（請求時点の価格で請求します）
+	UnitPrice int `json:"unit_price"`
+	// Price は1回のお届けの商品の金額（現在の価格×数量。送料を除く）です
+	Price     int       `json:"price"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate はプランの数量と間隔が指定できる範囲かを確認します
+func (p *SubscriptionPlan) Validate() error {
+	if p.BeanID <= 0 {
+		return fmt.Errorf("bean_id is required")
+	}
+	if p.Quantity <= 0 || p.Quantity > maxSubscriptionQuantity {
+		return fmt.Errorf("quantity must be between 1 and %d", maxSubscriptionQuantity)
+	}
+	if p.IntervalDays < minSubscriptionIntervalDays || p.IntervalDays > maxSubscriptionIntervalDays {
+		return fmt.Errorf("interval_days must be between %d and %d", minSubscriptionIntervalDays, maxSubscriptionIntervalDays)
+	}
+	return nil
+}
+
+// Subscription 構造体は、購入者の定期便の申し込みを保持します
+type Subscription struct {
+	ID                    int    `json:"id"`
+	UserID                string `json:"user_id"`
+	Status                string `json:"status"`
+	StripePaymentMethodID string `json:"stripe_payment_method_id"`
+	// NextDeliveryDate は次のお届け日です（"2006-01-02"の形式）。この日に請求して注文を作成します
+	NextDeliveryDate string `json:"next_delivery_date"`
+	// FailedAttempts は請求に連続して失敗した回数です
+	FailedAttempts   int              `json:"failed_attempts"`
+	LastPaymentError string           `json:"last_payment_error"`
+	PausedAt         *time.Time       `json:"paused_at"`
+	CanceledAt       *time.Time       `json:"canceled_at"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+	Plan             SubscriptionPlan `json:"plan"`
+}
+
+// UpcomingDelivery 構造体は、出品者から見た定期便のお届け予定を保持します
+type UpcomingDelivery struct {
+	SubscriptionID int    `json:"subscription_id"`
+	PlanID         int    `json:"plan_id"`
+	BeanID         int    `json:"bean_id"`
+	BeanName       string `json:"bean_name"`
+	Quantity       int    `json:"quantity"`
+	DeliveryDate   string `json:"delivery_date"`
+	BuyerName      string `json:"buyer_name"`
+}
+
+// todayInJST は日本標準時での今日の日付を返します
+func todayInJST(now time.Time) string {
+	return now.In(jst).Format(dateLayout)
+}
+
+// addDays は"2006-01-02"の形式の日付にdays日を加えた日付を返します
+func addDays(date string, days int) (string, error) {
+	t, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return "", err
+	}
+	return t.AddDate(0, 0, days).Format(dateLayout), nil
+}
+
+// applySubscriptionAction は定期便の申し込みに購入者の操作を適用します（保存は呼び出し側で行います）
+// 一時停止中の定期便を再開する場合、過ぎてしまったお届け日は今日に繰り下げ、請求の失敗の記録を消します
+// スキップは次のお届けを1回分先に進めます
+func applySubscriptionAction(sub *Subscription, action string, today string) error {
+	switch action {
+	case SubscriptionActionPause:
+		if sub.Status != SubscriptionStatusActive {
+			return fmt.Errorf("%w: cannot pause a %s subscription", ErrInvalidSubscriptionAction, sub.Status)
+		}
+		sub.Status = SubscriptionStatusPaused
+	case SubscriptionActionResume:
+		if sub.Status != SubscriptionStatusPaused {
+			return fmt.Errorf("%w: cannot resume a %s subscription", ErrInvalidSubscriptionAction, sub.Status)
+		}
+		sub.Status = SubscriptionStatusActive
+		if sub.NextDeliveryDate < today {
+			sub.NextDeliveryDate = today
+		}
+		sub.FailedAttempts = 0
+		sub.LastPaymentError = ""
+	case SubscriptionActionSkip:
+		if sub.Status == SubscriptionStatusCanceled {
+			return fmt.Errorf("%w: cannot skip a canceled subscription", ErrInvalidSubscriptionAction)
+		}
+		next, err := addDays(sub.NextDeliveryDate, sub.Plan.IntervalDays)
+		if err != nil {
+			return err
+		}
+		sub.NextDeliveryDate = next
+	case SubscriptionActionCancel:
+		if sub.Status == SubscriptionStatusCanceled {
+			return fmt.Errorf("%w: subscription is already canceled", ErrInvalidSubscriptionAction)
+		}
+		sub.Status = SubscriptionStatusCanceled
+	default:
+		return fmt.Errorf("%w: unknown action %s", ErrInvalidSubscriptionAction, action)
+	}
+	return nil
+}
+
+// verifySetupIntent はカードの登録の手続きが購入者のStripe Customerで完了していて、購入者がいない状態（off_session）の請求に使えることを確認し、登録したカードのIDを返します
+// 購入者がいる状態での支払い用に保存したカードは、定期便の請求で本人認証を求められて失敗するため使えません
+// Stripeを呼び出すため、トランザクションの外で呼び出してください（ensureStripeCustomerを参照）
+func verifySetupIntent(ctx context.Context, store *Store, payments PaymentProvider, userID string, setupIntentID string) (string, error) {
+	if !strings.HasPrefix(setupIntentID, "seti_") {
+		return "", fmt.Errorf("%w: invalid setup intent id", ErrPaymentMethodNotUsable)
+	}
+	customerID, err := ensureStripeCustomer(ctx, store, payments, userID)
+	if err != nil {
+		return "", err
+	}
+
+	si, err := payments.GetSetupIntent(ctx, setupIntentID)
+	if err != nil {
+		if errors.Is(err, ErrSetupIntentNotFound) {
+			return "", fmt.Errorf("%w: setup intent not found", ErrPaymentMethodNotUsable)
+		}
+		return "", err
+	}
+	if si.CustomerID != customerID {
+		return "", fmt.Errorf("%w: setup intent belongs to another customer", ErrPaymentMethodNotUsable)
+	}
+	if si.Usage != string(stripe.SetupIntentUsageOffSession) {
+		return "", fmt.Errorf("%w: card was not set up for off-session payments", ErrPaymentMethodNotUsable)
+	}
+	if si.Status != string(stripe.SetupIntentStatusSucceeded) || si.PaymentMethodID == "" {
+		return "", fmt.Errorf("%w: card setup has not succeeded", ErrPaymentMethodNotUsable)
+	}
+
+	// 登録後に削除（Customerから切り離し）されたカードは使えない
+	pm, err := payments.GetPaymentMethod(ctx, si.PaymentMethodID)
+	if err != nil {
+		if errors.Is(err, ErrPaymentMethodNotFound) {
+			return "", fmt.Errorf("%w: payment method not found", ErrPaymentMethodNotUsable)
+		}
+		return "", err
+	}
+	if pm.Card == nil {
+		return "", fmt.Errorf("%w: only cards can be used for subscriptions", ErrPaymentMethodNotUsable)
+	}
+	if pm.CustomerID != customerID {
+		return "", fmt.Errorf("%w: payment method has been removed", ErrPaymentMethodNotUsable)
+	}
+	return pm.ID, nil
+}
+
+// createSubscriptionOrder は定期便の1回分の注文を、チェックアウトと同じく保留中として作成し、在庫を確保します
+// 戻り値は作成した注文と、その注文に請求するPaymentIntentのパラメータです（請求はコミット後に行います）
+// storeはLockDueSubscriptionでsubをロックしたトランザクションに紐づいている必要があります
+func createSubscriptionOrder(ctx context.Context, store *Store, sub *Subscription, defaultFeeBasisPoints int, reservationTTL time.Duration, now time.Time) (*Order, *PaymentIntentParams, error) {
+	// 非公開にされた豆や、停止された出品者の豆は請求しない
+	listed, err := store.IsBeanListed(ctx, sub.Plan.BeanID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !listed {
+		return nil, nil, ErrBeanUnavailable
+	}
+
+	items := []CartItemDetail{{BeanID: sub.Plan.BeanID, Name: sub.Plan.BeanName, Price: sub.Plan.UnitPrice, Quantity: sub.Plan.Quantity}}
+	sellers, err := store.GroupCartItemsBySeller(ctx, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, seller := range sellers {
+		if !seller.PayoutsEnabled() {
+			return nil, nil, fmt.Errorf("seller %s cannot receive payments", shortID(seller.SellerID))
+		}
+	}
+	if err := store.QuoteShipping(ctx, sub.UserID, sellers); err != nil {
+		return nil, nil, err
+	}
+
+	var totalAmount int64
+	for _, seller := range sellers {
+		totalAmount += int64(seller.Total())
+	}
+	if totalAmount < minimumChargeAmountJPY {
+		return nil, nil, fmt.Errorf("total %d is below the minimum charge amount", totalAmount)
+	}
+
+	customerID, err := store.GetStripeCustomerID(ctx, sub.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if customerID == "" {
+		return nil, nil, fmt.Errorf("user %s has no stripe customer", shortID(sub.UserID))
+	}
+
+	// 定期便の請求は在庫確保の解放の対象外にするため、在庫を先に確保してから請求する
+	orderItems := orderItemsFromCart(items)
+	if err := store.DecrementBeanStock(ctx, orderItems); err != nil {
+		return nil, nil, err
+	}
+
+	params := &PaymentIntentParams{
+		Amount:          totalAmount,
+		Currency:        string(stripe.CurrencyJPY),
+		CustomerID:      customerID,
+		PaymentMethodID: sub.StripePaymentMethodID,
+		Metadata: map[string]string{
+			"user_id":         sub.UserID,
+			"subscription_id": strconv.Itoa(sub.ID),
+		},
+	}
+	transferGroup := routePayouts(params, sellers, defaultFeeBasisPoints, fmt.Sprintf("subscription_%d_%s", sub.ID, sub.NextDeliveryDate))
+
+	subscriptionID := sub.ID
+	order := &Order{
+		UserID:                   sub.UserID,
+		Status:                   OrderStatusPending,
+		TotalAmount:              int(totalAmount),
+		Currency:                 string(stripe.CurrencyJPY),
+		StripeTransferGroup:      transferGroup,
+		PlatformFeeBasisPoints:   defaultFeeBasisPoints,
+		SubscriptionID:           &subscriptionID,
+		SubscriptionDeliveryDate: sub.NextDeliveryDate,
+	}
+	if _, err := store.CreateOrderForSellers(ctx, order, sellers); err != nil {
+		return nil, nil, err
+	}
+	if err := store.CreateStockReservations(ctx, sub.UserID, order.ID, orderItems, now.Add(reservationTTL)); err != nil {
+		return nil, nil, err
+	}
+
+	// Webhookが注文への紐づけより先に届いても注文を特定できるよう、注文IDをメタデータに含める
+	// 冪等キーは定期便・お届け日・注文で決まるため、同じ注文への請求をやり直しても二重に請求されない
+	// （カードが拒否された回は注文をキャンセルし、再請求では新しい注文として請求する）
+	params.Metadata["order_id"] = strconv.Itoa(order.ID)
+	params.IdempotencyKey = fmt.Sprintf("subscription_%d_%s_order_%d", sub.ID, sub.NextDeliveryDate, order.ID)
+	return order, params, nil
+}
+
+// paymentErrorMessage は請求の失敗を、購入者に表示できる短い理由に変換します
+func paymentErrorMessage(err error) string {
+	var cardErr *CardError
+	if errors.As(err, &cardErr) {
+		if cardErr.Message != "" {
+			return cardErr.Message
+		}
+		return cardErr.Code
+	}
+	switch {
+	case errors.Is(err, ErrInsufficientStock):
+		return "out of stock"
+	case errors.Is(err, ErrShippingAddressRequired):
+		return "a valid post code is required in your profile"
+	case errors.Is(err, ErrShippingUnavailable):
+		return "the beans cannot be shipped to your address"
+	case errors.Is(err, ErrBeanUnavailable):
+		return "the beans are no longer available"
+	}
+	return "billing failed"
+}
+
+// billDueSubscriptions は請求する時期が来た定期便を、1件ずつ請求します
+// 請求に失敗した定期便は失敗を記録して翌日に再請求し、失敗が続いた場合は一時停止します
+// 戻り値は請求して注文を作成した件数です
+func (a *Api) billDueSubscriptions(ctx context.Context, now time.Time) (int, error) {
+	today := todayInJST(now)
+	ids, err := a.store.GetDueSubscriptionIDs(ctx, today, now, subscriptionBillingBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	billed := 0
+	for _, id := range ids {
+		order, err := a.billSubscription(ctx, id, today, now)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// 他のサーバーが請求中、または既に請求済み
+			continue
+		}
+		if err != nil {
+			log.Printf("WARN: Failed to bill subscription %d: %v", id, err)
+			paused, recordErr := a.store.RecordSubscriptionFailure(ctx, id, paymentErrorMessage(err), now.Add(subscriptionRetryDelay), maxSubscriptionPaymentAttempts)
+			if recordErr != nil {
+				log.Printf("ERROR: Failed to record billing failure of subscription %d: %v", id, recordErr)
+			} else if paused {
+				log.Printf("⏸️ Subscription %d was paused after %d failed attempts", id, maxSubscriptionPaymentAttempts)
+			}
+			continue
+		}
+		billed++
+		log.Printf("🔁 Created order %d for subscription %d", order.ID, id)
+	}
+	return billed, nil
+}
+
+// billSubscription は定期便の1回分を請求して注文を作成し、次のお届け日に進めます
+// 注文と在庫の確保を保留中としてコミットしてから、Stripeを呼び出す間に行をロックしないよう、トランザクションの外で
+// 保存済みのカードに購入者がいない状態（off_session）で請求します。支払いが完了すると、Webhookで通常の注文と同じく支払い済みになります
+func (a *Api) billSubscription(ctx context.Context, subscriptionID int, today string, now time.Time) (*Order, error) {
+	sub, order, params, err := a.createSubscriptionOrderInTx(ctx, subscriptionID, today, now)
+	if err != nil {
+		return nil, err
+	}
+	if params == nil {
+		// 前回の請求で既に支払われていた回は、次のお届け日に進めただけで終わる
+		return order, nil
+	}
+
+	pi, err := a.paymentProvider().CreatePaymentIntent(ctx, params)
+	if err != nil {
+		var cardErr *CardError
+		if errors.As(err, &cardErr) {
+			// カードが拒否された回は注文をキャンセルして在庫を解放し、再請求では新しい注文を作成する
+			a.abandonCheckout(ctx, order.ID, "")
+		}
+		// それ以外の失敗では支払われた可能性があるため、注文を残す
+		// 支払われていればWebhookで注文に紐づき、支払われていなければ在庫確保の期限切れでキャンセルされる
+		return nil, err
+	}
+
+	// Webhookで注文を特定できるよう、PaymentIntentを注文に紐づけてから次のお届け日に進める
+	// ここで失敗しても、WebhookがメタデータでPaymentIntentを紐づけ、次の確認で支払い済みの回として進める
+	order.StripePaymentIntentID = pi.ID
+	if err := a.store.AttachPaymentIntent(ctx, order.ID, pi.ID); err != nil {
+		log.Printf("ERROR: Failed to attach pi_id %s to order %d: %v", pi.ID, order.ID, err)
+		return order, nil
+	}
+	if err := advanceSubscription(ctx, a.store, sub); err != nil {
+		log.Printf("ERROR: Failed to advance subscription %d: %v", sub.ID, err)
+	}
+	return order, nil
+}
+
+// createSubscriptionOrderInTx は定期便をロックして1回分の保留中の注文を作成し、トランザクションをコミットします
+// 請求の結果が分かるまで同じ回を二重に請求しないよう、在庫確保の有効期限まで定期便を請求の対象から外します
+// 前回の請求で既に支払われていた場合は、その注文で次のお届け日に進め、PaymentIntentのパラメータにnilを返します
+func (a *Api) createSubscriptionOrderInTx(ctx context.Context, subscriptionID int, today string, now time.Time) (*Subscription, *Order, *PaymentIntentParams, error) {
+	tx, err := a.dbpool.Begin(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+	store := NewStore(tx)
+
+	sub, err := store.LockDueSubscription(ctx, subscriptionID, today, now)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	existing, err := store.GetOpenSubscriptionOrder(ctx, sub.ID, sub.NextDeliveryDate)
+	if err == nil {
+		if existing.Status == OrderStatusPending && existing.StripePaymentIntentID == "" {
+			// 前回の請求の結果がまだ分からない（支払われていなければ、在庫確保の期限切れでキャンセルされる）
+			return nil, nil, nil, pgx.ErrNoRows
+		}
+		if err := advanceSubscription(ctx, store, sub); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		return sub, existing, nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, nil, err
+	}
+
+	ttl := a.stockReservationTTL()
+	order, params, err := createSubscriptionOrder(ctx, store, sub, a.platformFeeBasisPoints, ttl, now)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := store.DeferSubscriptionBilling(ctx, sub.ID, now.Add(ttl)); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	return sub, order, params, nil
+}
+
+// advanceSubscription は請求が済んだ定期便を、次のお届け日に進めます
+func advanceSubscription(ctx context.Context, store *Store, sub *Subscription) error {
+	next, err := addDays(sub.NextDeliveryDate, sub.Plan.IntervalDays)
+	if err != nil {
+		return err
+	}
+	return store.AdvanceSubscription(ctx, sub.ID, sub.NextDeliveryDate, next)
+}
+
+// runSubscriptionBiller は一定間隔で請求する時期が来た定期便を請求します
+// ctxがキャンセルされるまで処理を続けるので、goroutineとして起動してください
+func (a *Api) runSubscriptionBiller(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := a.billDueSubscriptions(ctx, time.Now()); err != nil {
+				log.Printf("ERROR: Failed to bill subscriptions: %v", err)
+			}
+		}
+	}
+}
+
+// beanSubscriptionPlansHandler はコーヒー豆の申し込める定期便のプランを返します
+func (a *Api) beanSubscriptionPlansHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid bean ID", http.StatusBadRequest)
+		return
+	}
+
+	plans, err := a.store.GetSubscriptionPlansByBeanID(r.Context(), id)
+	if err != nil {
+		log.Printf("ERROR: Failed to get subscription plans from DB: %v", err)
+		http.Error(w, "Failed to get subscription plans", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plans); err != nil {
+		log.Printf("ERROR: Failed to encode subscription plans to JSON: %v", err)
+	}
+}
+
+// sellerSubscriptionPlansHandler は "/api/seller/subscription-plans" へのリクエストをHTTPメソッドによって振り分ける
+func (a *Api) sellerSubscriptionPlansHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーである必要があるので、ここでチェック
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	switch r.Method {
+	case http.MethodGet:
+		plans, err := a.store.GetSubscriptionPlansBySellerID(r.Context(), userID)
+		if err != nil {
+			log.Printf("ERROR: Failed to get subscription plans from DB: %v", err)
+			http.Error(w, "Failed to get subscription plans", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(plans); err != nil {
+			log.Printf("ERROR: Failed to encode subscription plans to JSON: %v", err)
+		}
+	case http.MethodPost:
+		a.createSubscriptionPlanHandler(w, r, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createSubscriptionPlanHandler は出品者自身のコーヒー豆に、定期便のプランを作成します
+func (a *Api) createSubscriptionPlanHandler(w http.ResponseWriter, r *http.Request, userID string) {
+	var plan SubscriptionPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	plan.Name = strings.TrimSpace(plan.Name)
+	if err := plan.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := a.store.CreateSubscriptionPlan(r.Context(), &plan, userID)
+	if err != nil {
+		// 他の出品者のコーヒー豆である可能性を示唆しないよう、一般的なNot Foundを返す
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Bean not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to create subscription plan in DB: %v", err)
+		http.Error(w, "Failed to create subscription plan", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Printf("ERROR: Failed to encode subscription plan to JSON: %v", err)
+	}
+}
+
+// deactivateSubscriptionPlanHandler は出品者自身の定期便のプランを停止します（申し込み済みの定期便は続きます）
+func (a *Api) deactivateSubscriptionPlanHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーである必要があるので、ここでチェック
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription plan ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.store.DeactivateSubscriptionPlan(r.Context(), id, userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Subscription plan not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to deactivate subscription plan in DB: %v", err)
+		http.Error(w, "Failed to deactivate subscription plan", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUpcomingDeliveriesHandler は出品者のコーヒー豆の定期便のお届け予定を返します
+// クエリパラメータdaysで、今日から何日先までの予定を返すかを指定できます（既定は28日、最大90日）
+func (a *Api) getUpcomingDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーである必要があるので、ここでチェック
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 28
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSubscriptionIntervalDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxSubscriptionIntervalDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	until, err := addDays(todayInJST(time.Now()), days)
+	if err != nil {
+		http.Error(w, "Failed to get upcoming deliveries", http.StatusInternalServerError)
+		return
+	}
+	deliveries, err := a.store.GetUpcomingDeliveries(r.Context(), userID, until)
+	if err != nil {
+		log.Printf("ERROR: Failed to get upcoming deliveries from DB: %v", err)
+		http.Error(w, "Failed to get upcoming deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		log.Printf("ERROR: Failed to encode upcoming deliveries to JSON: %v", err)
+	}
+}
+
+// CreateSubscriptionRequest は定期便の申し込み時に受け取るリクエストボディです
+type CreateSubscriptionRequest struct {
+	PlanID int `json:"plan_id"`
+	// SetupIntentID は請求に使うカードを、購入者がいない状態（off_session）で使えるよう登録した手続きのIDです
+	SetupIntentID string `json:"setup_intent_id"`
+	// StartDate は最初のお届け日です（"2006-01-02"の形式。省略した場合は今日）
+	StartDate string `json:"start_date"`
+}
+
+// subscriptionsHandler は "/api/subscriptions" へのリクエストをHTTPメソッドによって振り分ける
+func (a *Api) subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーである必要があるので、ここでチェック
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	switch r.Method {
+	case http.MethodGet:
+		subs, err := a.store.GetSubscriptionsByUserID(r.Context(), userID)
+		if err != nil {
+			log.Printf("ERROR: Failed to get subscriptions from DB: %v", err)
+			http.Error(w, "Failed to get subscriptions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(subs); err != nil {
+			log.Printf("ERROR: Failed to encode subscriptions to JSON: %v", err)
+		}
+	case http.MethodPost:
+		a.createSubscriptionHandler(w, r, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createSubscriptionHandler は定期便のプランに、保存済みのカードで申し込みます
+// 申し込みの時点で送料を計算できることと、出品者が売上を受け取れることを確認します
+func (a *Api) createSubscriptionHandler(w http.ResponseWriter, r *http.Request, userID string) {
+	var req CreateSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	today := todayInJST(time.Now())
+	if req.StartDate == "" {
+		req.StartDate = today
+	}
+	latest, err := addDays(today, maxSubscriptionLeadDays)
+	if err != nil {
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+	if _, err := time.Parse(dateLayout, req.StartDate); err != nil || req.StartDate < today || req.StartDate > latest {
+		http.Error(w, fmt.Sprintf("start_date must be a date (YYYY-MM-DD) within %d days from today", maxSubscriptionLeadDays), http.StatusBadRequest)
+		return
+	}
+
+	plan, err := a.store.GetSubscriptionPlan(r.Context(), req.PlanID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Subscription plan not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get subscription plan from DB: %v", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+	if !plan.Active {
+		http.Error(w, "Subscription plan is no longer available", http.StatusConflict)
+		return
+	}
+
+	// 初回の請求と同じ計算で、送料を計算できるか・出品者が売上を受け取れるかを確認する
+	sellers, err := a.store.GroupCartItemsBySeller(r.Context(), []CartItemDetail{{BeanID: plan.BeanID, Price: plan.UnitPrice, Quantity: plan.Quantity}})
+	if err != nil {
+		log.Printf("ERROR: Failed to get seller of subscription plan: %v", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+	for _, seller := range sellers {
+		if !seller.PayoutsEnabled() {
+			http.Error(w, "The seller cannot receive payments yet", http.StatusConflict)
+			return
+		}
+	}
+	if err := a.store.QuoteShipping(r.Context(), userID, sellers); err != nil {
+		switch {
+		case errors.Is(err, ErrShippingAddressRequired):
+			http.Error(w, "A valid post code is required in your profile to calculate shipping", http.StatusBadRequest)
+		case errors.Is(err, ErrShippingUnavailable):
+			http.Error(w, "The beans cannot be shipped to your address", http.StatusConflict)
+		default:
+			log.Printf("ERROR: Failed to calculate shipping fee: %v", err)
+			http.Error(w, "Failed to calculate shipping fee", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Stripeを呼び出す間にDBの行をロックしないよう、カードの確認はトランザクションの外で行う
+	paymentMethodID, err := verifySetupIntent(r.Context(), a.store, a.paymentProvider(), userID, req.SetupIntentID)
+	if err != nil {
+		if errors.Is(err, ErrPaymentMethodNotUsable) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("ERROR: Failed to verify payment method: %v", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	sub, err := a.store.CreateSubscription(r.Context(), &Subscription{UserID: userID, Plan: *plan, StripePaymentMethodID: paymentMethodID, NextDeliveryDate: req.StartDate})
+	if err != nil {
+		log.Printf("ERROR: Failed to create subscription in DB: %v", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(sub); err != nil {
+		log.Printf("ERROR: Failed to encode subscription to JSON: %v", err)
+	}
+}
+
+// UpdateSubscriptionRequest は定期便の操作時に受け取るリクエストボディです
+type UpdateSubscriptionRequest struct {
+	// Action は "pause", "resume", "skip", "cancel" のいずれかです
+	Action string `json:"action"`
+	// SetupIntentID は再開時に請求に使うカードを変更する場合に、カードを登録した手続きのIDを指定します
+	SetupIntentID string `json:"setup_intent_id"`
+}
+
+// updateSubscriptionHandler は購入者自身の定期便を、一時停止・再開・スキップ・解約します
+func (a *Api) updateSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証済みユーザーである必要があるので、ここでチェック
+	principal, ok := mustPrincipal(w, r)
+	if !ok {
+		return
+	}
+	userID := principal.UserID
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Action = strings.ToLower(strings.TrimSpace(req.Action))
+	if req.SetupIntentID != "" && req.Action != SubscriptionActionResume {
+		http.Error(w, "setup_intent_id can only be changed when resuming", http.StatusBadRequest)
+		return
+	}
+
+	// 新しいカードは、Stripeを呼び出す間に定期便の行をロックしないよう、トランザクションの外で確認する
+	paymentMethodID := ""
+	if req.SetupIntentID != "" {
+		paymentMethodID, err = verifySetupIntent(r.Context(), a.store, a.paymentProvider(), userID, req.SetupIntentID)
+		if err != nil {
+			if errors.Is(err, ErrPaymentMethodNotUsable) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("ERROR: Failed to verify payment method: %v", err)
+			http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 請求との競合を避けるため、行をロックしてから操作する
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context())
+	store := NewStore(tx)
+
+	sub, err := store.GetSubscriptionForUpdate(r.Context(), id, userID)
+	if err != nil {
+		// 他のユーザーの定期便である可能性を示唆しないよう、一般的なNot Foundを返す
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("ERROR: Failed to get subscription from DB: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if err := applySubscriptionAction(sub, req.Action, todayInJST(time.Now())); err != nil {
+		if errors.Is(err, ErrInvalidSubscriptionAction) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("ERROR: Failed to apply subscription action: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if paymentMethodID != "" {
+		sub.StripePaymentMethodID = paymentMethodID
+	}
+
+	updated, err := store.UpdateSubscription(r.Context(), sub)
+	if err != nil {
+		log.Printf("ERROR: Failed to update subscription in DB: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit transaction: %v", err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Printf("ERROR: Failed to encode subscription to JSON: %v", err)
+	}
+}
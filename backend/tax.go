@@ -0,0 +1,77 @@
+// backend/tax.go
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 消費税の区分（beans.tax_category）
+// コーヒー豆は飲食料品のため軽減税率、グッズや器具は標準税率です
+const (
+	// TaxCategoryReduced は軽減税率（8%）の対象です
+	TaxCategoryReduced = "reduced"
+	// TaxCategoryStandard は標準税率（10%）の対象です
+	TaxCategoryStandard = "standard"
+)
+
+// 消費税率（%）
+const (
+	reducedTaxRate  = 8
+	standardTaxRate = 10
+)
+
+// taxRates は消費税の区分ごとの税率（%）です
+var taxRates = map[string]int{
+	TaxCategoryReduced:  reducedTaxRate,
+	TaxCategoryStandard: standardTaxRate,
+}
+
+// includedTax は税込金額に含まれる消費税額を返します（1円未満は切り捨て）
+func includedTax(amount int, rate int) int {
+	return amount * rate / (100 + rate)
+}
+
+// TaxBreakdown 構造体は、税率ごとの対象額（税込）と消費税額を保持します
+// 適格請求書の要件に合わせて、消費税額は明細ごとではなく税率ごとに1回だけ端数処理します
+type TaxBreakdown struct {
+	ReducedTaxableAmount  int `json:"reduced_taxable_amount"`  // 軽減税率（8%）対象の税込金額
+	ReducedTax            int `json:"reduced_tax"`             // 軽減税率（8%）の消費税額
+	StandardTaxableAmount int `json:"standard_taxable_amount"` // 標準税率（10%）対象の税込金額
+	StandardTax           int `json:"standard_tax"`            // 標準税率（10%）の消費税額
+}
+
+// newTaxBreakdown は税率ごとの対象額（税込）から、消費税額を計算したTaxBreakdownを返します
+func newTaxBreakdown(reducedTaxableAmount int, standardTaxableAmount int) TaxBreakdown {
+	return TaxBreakdown{
+		ReducedTaxableAmount:  reducedTaxableAmount,
+		ReducedTax:            includedTax(reducedTaxableAmount, reducedTaxRate),
+		StandardTaxableAmount: standardTaxableAmount,
+		StandardTax:           includedTax(standardTaxableAmount, standardTaxRate),
+	}
+}
+
+// Add は2つのTaxBreakdownを合計します
+// 注文全体の合計は子注文（出品者ごとの請求書）で計算した消費税額の合計であり、改めて端数処理はしません
+func (t TaxBreakdown) Add(other TaxBreakdown) TaxBreakdown {
+	return TaxBreakdown{
+		ReducedTaxableAmount:  t.ReducedTaxableAmount + other.ReducedTaxableAmount,
+		ReducedTax:            t.ReducedTax + other.ReducedTax,
+		StandardTaxableAmount: t.StandardTaxableAmount + other.StandardTaxableAmount,
+		StandardTax:           t.StandardTax + other.StandardTax,
+	}
+}
+
+// invoiceRegistrationNumberPattern は適格請求書発行事業者の登録番号（"T"と13桁の数字）の形式です
+var invoiceRegistrationNumberPattern = regexp.MustCompile(`^T[0-9]{13}$`)
+
+// normalizeInvoiceRegistrationNumber は登録番号の前後の空白とハイフンを取り除き、先頭の"t"を大文字にします
+func normalizeInvoiceRegistrationNumber(v string) string {
+	v = strings.ReplaceAll(strings.TrimSpace(v), "-", "")
+	return strings.ToUpper(v)
+}
+
+// isValidInvoiceRegistrationNumber は登録番号の形式が正しいかを返します
+func isValidInvoiceRegistrationNumber(v string) bool {
+	return invoiceRegistrationNumberPattern.MatchString(v)
+}
@@ -0,0 +1,466 @@
+// backend/webhook.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errInvalidWebhookPayload はイベントのデータを解釈できない場合に返されます
+var errInvalidWebhookPayload = errors.New("invalid webhook payload")
+
+// handleStripeWebhook はStripeからのWebhookを受け取り処理します
+// イベントIDの記録と、そのイベントによる副作用を1つのトランザクションで行うため、
+// 再送されたイベントは何もせずに200を返します
+func (a *Api) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	const MaxBodyBytes = int64(65536)
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("ERROR: Failed to read webhook body: %v", err)
+		http.Error(w, "Failed to read request body", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 決済代行サービスの署名を検証する
+	event, err := a.paymentProvider().ConstructWebhookEvent(payload, r.Header)
+	if err != nil {
+		log.Printf("ERROR: Webhook signature verification failed: %v", err)
+		http.Error(w, "Webhook signature verification failed", http.StatusBadRequest)
+		return
+	}
+
+	// トランザクションを開始
+	tx, err := a.dbpool.Begin(r.Context())
+	if err != nil {
+		log.Printf("ERROR: Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to process webhook event", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(r.Context()) // エラー発生時にロールバック（イベントIDの記録も取り消される）
+
+	storeWithTx := NewStore(tx)
+
+	// イベントIDを記録する。既に記録済みであれば処理済みなので何もしない
+	// 同じイベントが同時に届いた場合、後の方は先のトランザクションが終わるまで待たされる
+	recorded, err := storeWithTx.RecordStripeEvent(r.Context(), event.ID, string(event.Type))
+	if err != nil {
+		log.Printf("ERROR: Failed to record webhook event %s: %v", event.ID, err)
+		http.Error(w, "Failed to process webhook event", http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		log.Printf("INFO: Webhook event %s (%s) has already been processed", event.ID, event.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := a.processStripeEvent(r.Context(), storeWithTx, event); err != nil {
+		switch {
+		case errors.Is(err, errInvalidWebhookPayload):
+			log.Printf("ERROR: Failed to parse webhook event %s: %v", event.ID, err)
+			http.Error(w, "Failed to parse webhook data", http.StatusBadRequest)
+		default:
+			log.Printf("ERROR: Failed to process webhook event %s: %v", event.ID, err)
+			http.Error(w, "Failed to process webhook event", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// トランザクションをコミット
+	if err := tx.Commit(r.Context()); err != nil {
+		log.Printf("ERROR: Failed to commit webhook event %s: %v", event.ID, err)
+		http.Error(w, "Failed to process webhook event", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// asyncPaymentReservationTTL は支払いの完了を待っている間の在庫確保の有効期限です
+// コンビニ決済（既定で3日以内の支払い）や銀行振込は、完了まで数日かかるため長めに確保します
+const asyncPaymentReservationTTL = 4 * 24 * time.Hour
+
+// processStripeEvent はイベントの種類に応じて注文や在庫を更新します
+// storeはWebhookのトランザクションに紐づいている必要があります
+func (a *Api) processStripeEvent(ctx context.Context, store *Store, event *WebhookEvent) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var paymentIntent webhookPaymentIntent
+		if err := decodeWebhookData(event, &paymentIntent); err != nil {
+			return err
+		}
+		log.Printf("✅ PaymentIntent succeeded: %s", paymentIntent.ID)
+		return a.completeOrderForPaymentIntent(ctx, store, event.ID, &paymentIntent)
+
+	case "charge.succeeded":
+		var charge webhookCharge
+		if err := decodeWebhookData(event, &charge); err != nil {
+			return err
+		}
+		// Destination Chargeの支払いでは、Stripeが自動で作成した出品者への入金をChargeに含めて通知する
+		if charge.Transfer == "" || charge.PaymentIntent == "" {
+			return nil
+		}
+		order, err := store.GetOrderForPaymentIntent(ctx, string(charge.PaymentIntent), charge.Metadata)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				log.Printf("WARN: Order not found for pi_id: %s", charge.PaymentIntent)
+				return nil
+			}
+			return err
+		}
+		if err := store.RecordDestinationChargeTransfer(ctx, order.ID, string(charge.Transfer)); err != nil {
+			return fmt.Errorf("failed to record destination charge transfer for order %d: %w", order.ID, err)
+		}
+		return nil
+
+	case "payment_intent.processing", "payment_intent.requires_action":
+		var paymentIntent webhookPaymentIntent
+		if err := decodeWebhookData(event, &paymentIntent); err != nil {
+			return err
+		}
+		status := OrderStatusProcessing
+		if event.Type == "payment_intent.requires_action" {
+			status = OrderStatusRequiresAction
+		}
+		log.Printf("⏳ PaymentIntent %s: %s", status, paymentIntent.ID)
+
+		// 支払いの完了を待つ間に在庫確保が期限切れにならないよう延長する
+		order, err := store.GetOrderForPaymentIntent(ctx, paymentIntent.ID, paymentIntent.Metadata)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if order != nil {
+			if _, err := store.ExtendStockReservations(ctx, order.ID, time.Now().Add(asyncPaymentReservationTTL)); err != nil {
+				return fmt.Errorf("failed to extend stock reservations: %w", err)
+			}
+		}
+		return transitionOrder(ctx, store, event.ID, paymentIntent.ID, paymentIntent.Metadata, status, paymentIntent.paymentMethodType(), "", false)
+
+	case "payment_intent.payment_failed":
+		var paymentIntent webhookPaymentIntent
+		if err := decodeWebhookData(event, &paymentIntent); err != nil {
+			return err
+		}
+		reason := ""
+		if paymentIntent.LastPaymentError != nil {
+			reason = paymentIntent.LastPaymentError.Message
+		}
+		log.Printf("❌ PaymentIntent failed: %s, Reason: %s", paymentIntent.ID, reason)
+
+		// 注文を失敗にし、確保していた在庫を解放する
+		return transitionOrder(ctx, store, event.ID, paymentIntent.ID, paymentIntent.Metadata, OrderStatusFailed, paymentIntent.paymentMethodType(), reason, true)
+
+	case "payment_intent.canceled":
+		var paymentIntent webhookPaymentIntent
+		if err := decodeWebhookData(event, &paymentIntent); err != nil {
+			return err
+		}
+		log.Printf("🚫 PaymentIntent canceled: %s", paymentIntent.ID)
+
+		// 注文をキャンセルにし、確保していた在庫を解放する
+		return transitionOrder(ctx, store, event.ID, paymentIntent.ID, paymentIntent.Metadata, OrderStatusCanceled, "", paymentIntent.CancellationReason, true)
+
+	case "charge.refunded":
+		var charge webhookCharge
+		if err := decodeWebhookData(event, &charge); err != nil {
+			return err
+		}
+		if charge.PaymentIntent == "" {
+			log.Printf("WARN: Refunded charge %s has no PaymentIntent", charge.ID)
+			return nil
+		}
+		log.Printf("💸 Charge refunded: %s (%d/%d)", charge.ID, charge.AmountRefunded, charge.Amount)
+
+		// 全額返金されていなければ一部返金として記録する
+		status := OrderStatusPartiallyRefunded
+		if charge.Refunded || charge.AmountRefunded >= charge.Amount {
+			status = OrderStatusRefunded
+		}
+		reason := fmt.Sprintf("refunded %d of %d %s", charge.AmountRefunded, charge.Amount, charge.Currency)
+		return transitionOrder(ctx, store, event.ID, string(charge.PaymentIntent), charge.Metadata, status, "", reason, false)
+
+	case "charge.refund.updated":
+		var re webhookRefund
+		if err := decodeWebhookData(event, &re); err != nil {
+			return err
+		}
+		// 返金の送信直後に届いた場合は、まだ返金IDを記録していないので、メタデータの返金のIDで探す
+		refundID, _ := strconv.Atoi(re.Metadata["refund_id"])
+		status := refundStatusOf(re.Status)
+		updated, err := store.UpdateRefundStatus(ctx, re.ID, refundID, status)
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			log.Printf("INFO: No refund to update for Stripe refund %s", re.ID)
+			return nil
+		}
+		// 失敗・取り消しになった返金は、返金額・在庫の記録を元に戻す
+		if isRefundUnsuccessful(status) {
+			if err := store.RevertRefund(ctx, updated); err != nil {
+				return fmt.Errorf("failed to revert refund %d: %w", updated, err)
+			}
+			log.Printf("ERROR: Refund %s was %s: %s, manual refund required", re.ID, status, re.FailureReason)
+		}
+		return nil
+
+	case "charge.dispute.created":
+		var dispute webhookDispute
+		if err := decodeWebhookData(event, &dispute); err != nil {
+			return err
+		}
+		if dispute.PaymentIntent == "" {
+			log.Printf("WARN: Dispute %s has no PaymentIntent", dispute.ID)
+			return nil
+		}
+		log.Printf("⚠️ Dispute created: %s, Reason: %s", dispute.ID, dispute.Reason)
+
+		reason := fmt.Sprintf("dispute %s: %s (%d %s)", dispute.ID, dispute.Reason, dispute.Amount, dispute.Currency)
+		return transitionOrder(ctx, store, event.ID, string(dispute.PaymentIntent), nil, OrderStatusDisputed, "", reason, false)
+
+	case "account.updated":
+		var acct webhookAccount
+		if err := decodeWebhookData(event, &acct); err != nil {
+			return err
+		}
+		status := connectAccountStatus(acct.ChargesEnabled, acct.PayoutsEnabled, acct.DetailsSubmitted)
+		updated, err := store.UpdateStripeAccountStatus(ctx, acct.ID, status)
+		if err != nil {
+			return fmt.Errorf("failed to update stripe account %s: %w", acct.ID, err)
+		}
+		if !updated {
+			log.Printf("WARN: Profile not found for stripe account: %s", acct.ID)
+			return nil
+		}
+		log.Printf("🏪 Stripe account %s is now %s", acct.ID, status)
+		return nil
+
+	default:
+		log.Printf("🤷‍♀️ Unhandled event type: %s", event.Type)
+		return nil
+	}
+}
+
+// decodeWebhookData はイベントのデータを、イベントの種類に応じた構造体として解釈します
+func decodeWebhookData(event *WebhookEvent, v interface{}) error {
+	if err := json.Unmarshal(event.Data, v); err != nil {
+		return fmt.Errorf("%w: %s: %v", errInvalidWebhookPayload, event.Type, err)
+	}
+	return nil
+}
+
+// expandableID は他のオブジェクトへの参照です
+// 展開されていなければIDの文字列、展開されていればオブジェクトとして届くので、どちらの場合もIDを読み取ります
+type expandableID string
+
+func (e *expandableID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*e = ""
+		return nil
+	}
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*e = expandableID(id)
+		return nil
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	*e = expandableID(object.ID)
+	return nil
+}
+
+// webhookPaymentIntent はイベントで届く支払い（PaymentIntent）のうち、注文の処理に使う項目です
+type webhookPaymentIntent struct {
+	ID string `json:"id"`
+	// AmountReceived は実際に支払われた額です
+	AmountReceived int64 `json:"amount_received"`
+	// LatestCharge は支払いに対応する最新のChargeです（APIバージョン2022-11-15以降のWebhookにのみ含まれる）
+	LatestCharge expandableID `json:"latest_charge"`
+	// Charges は支払いのChargeの一覧で、新しい順に並びます（APIバージョン2022-11-15より前のWebhookに含まれる）
+	Charges struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	} `json:"charges"`
+	PaymentMethodTypes []string          `json:"payment_method_types"`
+	CancellationReason string            `json:"cancellation_reason"`
+	Metadata           map[string]string `json:"metadata"`
+	LastPaymentError   *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+// paymentMethodType は支払い方法の種類を返します
+func (pi *webhookPaymentIntent) paymentMethodType() string {
+	if len(pi.PaymentMethodTypes) > 0 {
+		return pi.PaymentMethodTypes[0]
+	}
+	return ""
+}
+
+// chargeID は支払いに対応する最新のChargeのIDを返します（分からない場合は空）
+// Webhookのエンドポイントのバージョンによってlatest_chargeとcharges.dataのどちらかしか届かないため、両方を確認します
+func (pi *webhookPaymentIntent) chargeID() string {
+	if pi.LatestCharge != "" {
+		return string(pi.LatestCharge)
+	}
+	if len(pi.Charges.Data) > 0 {
+		return pi.Charges.Data[0].ID
+	}
+	return ""
+}
+
+// webhookCharge はイベントで届くChargeのうち、注文の処理に使う項目です
+// 支払い（PaymentIntent）で作成されたChargeのメタデータには、支払いのメタデータが引き継がれます
+type webhookCharge struct {
+	ID             string            `json:"id"`
+	Amount         int64             `json:"amount"`
+	AmountRefunded int64             `json:"amount_refunded"`
+	Currency       string            `json:"currency"`
+	Refunded       bool              `json:"refunded"`
+	PaymentIntent  expandableID      `json:"payment_intent"`
+	Transfer       expandableID      `json:"transfer"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+// webhookRefund はイベントで届く返金のうち、注文の処理に使う項目です
+type webhookRefund struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	FailureReason string            `json:"failure_reason"`
+	Metadata      map[string]string `json:"metadata"`
+}
+
+// webhookDispute はイベントで届く支払いへの異議申し立てのうち、注文の処理に使う項目です
+type webhookDispute struct {
+	ID            string       `json:"id"`
+	Reason        string       `json:"reason"`
+	Amount        int64        `json:"amount"`
+	Currency      string       `json:"currency"`
+	PaymentIntent expandableID `json:"payment_intent"`
+}
+
+// webhookAccount はイベントで届く出品者の入金先のアカウントのうち、状態の同期に使う項目です
+type webhookAccount struct {
+	ID               string `json:"id"`
+	ChargesEnabled   bool   `json:"charges_enabled"`
+	PayoutsEnabled   bool   `json:"payouts_enabled"`
+	DetailsSubmitted bool   `json:"details_submitted"`
+}
+
+// shortID はログ出力用にIDの先頭8文字を返します
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// completeOrderForPaymentIntent はPaymentIntentに紐づく保留中の注文を支払い済みにします
+// 確保していた在庫を注文済みにし、購入者のカートを空にして、出品者への入金を送信待ちとして記録します
+func (a *Api) completeOrderForPaymentIntent(ctx context.Context, store *Store, eventID string, paymentIntent *webhookPaymentIntent) error {
+	// 保留中の注文を取得（注文への紐づけより先に届いた場合は、メタデータの注文IDで探す）
+	order, err := store.GetOrderForPaymentIntent(ctx, paymentIntent.ID, paymentIntent.Metadata)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("WARN: Order not found for pi_id: %s", paymentIntent.ID)
+			return nil
+		}
+		return err
+	}
+	shortUserID := shortID(order.UserID)
+
+	// 注文を支払い済みにする（既に支払い済みなどで遷移できない場合は何もしない）
+	if _, err := store.TransitionOrderStatus(ctx, order.ID, OrderStatusSucceeded, paymentIntent.paymentMethodType(), eventID, ""); err != nil {
+		if errors.Is(err, ErrInvalidOrderTransition) {
+			log.Printf("INFO: Ignoring payment success for order %d of user %s: %v", order.ID, shortUserID, err)
+			return nil
+		}
+		return fmt.Errorf("failed to update order %d: %w", order.ID, err)
+	}
+
+	// PaymentIntent作成時に確保した在庫を注文済みにする
+	converted, err := store.ConvertStockReservations(ctx, order.ID)
+	if err != nil {
+		return fmt.Errorf("failed to convert stock reservations: %w", err)
+	}
+
+	// 確保が無い（期限切れで解放済みなど）場合は、注文明細の数量だけ在庫数を減らす
+	// 支払いは完了しているので在庫不足でも注文は支払い済みにし、不足分を記録して返金などの対応に回す
+	if converted == 0 {
+		orderItems, err := store.GetOrderItemsByOrderID(ctx, order.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get order items for order %d: %w", order.ID, err)
+		}
+		shortfalls, err := store.DecrementBeanStockForPaidOrder(ctx, order.ID, orderItems)
+		if err != nil {
+			return fmt.Errorf("failed to decrement stock for order %d: %w", order.ID, err)
+		}
+		for _, shortfall := range shortfalls {
+			log.Printf("ERROR: Order %d is short of %d units of bean %d, manual refund required", order.ID, shortfall.Quantity, shortfall.BeanID)
+		}
+	}
+
+	// カートを空にする（定期便の注文はカートと関係ないので、カートはそのままにする）
+	if order.SubscriptionID == nil {
+		if err := store.ClearCart(ctx, order.UserID); err != nil {
+			return fmt.Errorf("failed to clear cart for user %s: %w", shortUserID, err)
+		}
+	}
+
+	// 出品者ごとの入金を送信待ちとして記録する
+	// Webhookの応答が遅れないよう、送信はWebhookの処理では行わず、runPayoutSenderが定期的に行う
+	if err := queueSellerPayouts(ctx, store, order, paymentIntent.chargeID(), paymentIntent.AmountReceived); err != nil {
+		return err
+	}
+
+	log.Printf("🎉 Order %d succeeded for user %s", order.ID, shortUserID)
+	return nil
+}
+
+// transitionOrder はPaymentIntentに紐づく注文の状態を更新し、その遷移を履歴に記録します
+// metadataはPaymentIntentのメタデータで、注文への紐づけより先に届いた場合に注文IDで注文を探すために使います
+// releaseStockがtrueの場合、確保していた在庫も解放します
+// 注文が見つからない場合や、許可されていない遷移（確定した注文を戻すなど）の場合は何もしません
+func transitionOrder(ctx context.Context, store *Store, eventID string, paymentIntentID string, metadata map[string]string, status string, paymentMethodType string, reason string, releaseStock bool) error {
+	order, err := store.GetOrderForPaymentIntent(ctx, paymentIntentID, metadata)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("WARN: Order not found for pi_id: %s", paymentIntentID)
+			return nil
+		}
+		return err
+	}
+
+	if _, err := store.TransitionOrderStatus(ctx, order.ID, status, paymentMethodType, eventID, reason); err != nil {
+		if errors.Is(err, ErrInvalidOrderTransition) {
+			log.Printf("INFO: Ignoring transition of order %d: %v", order.ID, err)
+			return nil
+		}
+		return err
+	}
+
+	if releaseStock {
+		if _, err := store.ReleaseStockReservations(ctx, order.ID); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("📝 Order %d for user %s is now %s", order.ID, shortID(order.UserID), status)
+	return nil
+}
@@ -25,6 +25,7 @@ const mockBeanDetail = {
   price: 1500,
   process: 'washed',
   roast_profile: 'medium',
+  tax_category: 'reduced',
 };
 
 // 正常なレスポンスを返すfetchモック
@@ -79,6 +80,7 @@ test('詳細データが正しく表示される', async () => {
   expect(await screen.findByText(mockBeanDetail.name)).toBeInTheDocument();
   expect(screen.getByText(`産地: ${mockBeanDetail.origin}`)).toBeInTheDocument();
   expect(screen.getByText(`${mockBeanDetail.price}円`)).toBeInTheDocument();
+  expect(screen.getByText('税込（軽減税率8%）')).toBeInTheDocument();
   expect(mockFetchSuccess).toHaveBeenCalledWith('/api/beans/1');
 });
 
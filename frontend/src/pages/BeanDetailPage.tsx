@@ -24,6 +24,7 @@ interface BeanDetail {
   price: number;
   process: string;
   roast_profile: string;
+  tax_category: string;
 }
 
 export default function BeanDetailPage() {
@@ -161,6 +162,9 @@ export default function BeanDetailPage() {
           <Text size="xl" fw={700} mt="md">
             {bean.price}円
           </Text>
+          <Text size="sm" c="dimmed">
+            税込（{bean.tax_category === 'standard' ? '標準税率10%' : '軽減税率8%'}）
+          </Text>
 
           <Group mt="lg" align="flex-end">
             <NumberInput
@@ -15,7 +15,7 @@ beforeAll(() => {
   globalThis.fetch = vi.fn((url) => {
     let body;
     if (url.toString().endsWith('/api/beans')) {
-      body = JSON.stringify(mockBeanList);
+      body = JSON.stringify({ items: mockBeanList, next_cursor: null, total_count: mockBeanList.length });
     } else if (url.toString().startsWith('/api/beans/')) {
       body = JSON.stringify(mockBeanDetail);
     }
@@ -17,6 +17,12 @@ interface Bean {
   name: string;
 }
 
+interface BeanPage {
+  items: Bean[];
+  next_cursor: string | null;
+  total_count: number;
+}
+
 export default function BeanListPage() {
   const [beans, setBeans] = useState<Bean[]>([]);
   const [loading, setLoading] = useState<boolean>(true);
@@ -29,8 +35,8 @@ export default function BeanListPage() {
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
         }
-        const data: Bean[] = await response.json();
-        setBeans(data);
+        const data: BeanPage = await response.json();
+        setBeans(data.items);
       } catch (e: unknown) {
         if (e instanceof Error) {
           setError(e.message);
@@ -30,6 +30,9 @@ const mockBean = {
   name: 'Old Bean Name',
   origin: 'Old Origin',
   price: 1200,
+  stock: 10,
+  weight_grams: 200,
+  tax_category: 'standard',
   process: 'washed',
   roast_profile: 'medium',
 };
@@ -141,6 +144,9 @@ describe('EditBeanPage', () => {
           name: 'New Bean Name',
           origin: 'Old Origin',
           price: 1200,
+          stock: 10,
+          weight_grams: 200,
+          tax_category: 'standard',
           process: 'washed',
           roast_profile: 'medium',
         }),
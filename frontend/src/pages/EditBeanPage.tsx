@@ -23,6 +23,9 @@ interface BeanInput {
   name: string;
   origin: string;
   price: number | '';
+  stock: number | '';
+  weight_grams: number | '';
+  tax_category: string; // 消費税の区分（reduced: 軽減税率8%, standard: 標準税率10%）
   process: string;
   roast_profile: string;
 }
@@ -41,6 +44,9 @@ export default function EditBeanPage() {
       name: '',
       origin: '',
       price: '',
+      stock: '',
+      weight_grams: '',
+      tax_category: 'reduced', // コーヒー豆は飲食料品のため軽減税率
       process: '',
       roast_profile: '',
     },
@@ -48,6 +54,8 @@ export default function EditBeanPage() {
       name: (value) => (value.trim().length > 0 ? null : '名前を入力してください'),
       origin: (value) => (value.trim().length > 0 ? null : '産地を入力してください'),
       price: (value) => (value !== '' && Number(value) >= 0 ? null : '価格を0以上で入力してください'),
+      stock: (value) => (value !== '' && Number.isInteger(Number(value)) && Number(value) >= 0 ? null : '在庫数を0以上の整数で入力してください'),
+      weight_grams: (value) => (value !== '' && Number.isInteger(Number(value)) && Number(value) >= 0 ? null : '内容量を0以上の整数で入力してください'),
       process: (value) => (value ? null : '精製方法を選択してください'),
       roast_profile: (value) => (value ? null : '焙煎度を選択してください'),
     },
@@ -66,6 +74,9 @@ export default function EditBeanPage() {
           name: data.name,
           origin: data.origin,
           price: data.price,
+          stock: data.stock,
+          weight_grams: data.weight_grams,
+          tax_category: data.tax_category ?? 'reduced',
           process: data.process,
           roast_profile: data.roast_profile,
         });
@@ -104,6 +115,8 @@ export default function EditBeanPage() {
         body: JSON.stringify({
           ...values,
           price: Number(values.price),
+          stock: Number(values.stock),
+          weight_grams: Number(values.weight_grams),
         }),
       });
 
@@ -167,13 +180,41 @@ export default function EditBeanPage() {
           {...form.getInputProps('origin')}
         />
         <NumberInput
-          label="価格"
+          label="価格（税込）"
           placeholder="例：1500"
           mb="sm"
           min={0}
           hideControls
           {...form.getInputProps('price')}
         />
+        <NumberInput
+          label="在庫数"
+          placeholder="例：10"
+          mb="sm"
+          min={0}
+          allowDecimal={false}
+          hideControls
+          {...form.getInputProps('stock')}
+        />
+        <NumberInput
+          label="内容量（g）"
+          placeholder="例：200"
+          mb="sm"
+          min={0}
+          allowDecimal={false}
+          hideControls
+          {...form.getInputProps('weight_grams')}
+        />
+        <Select
+          label="消費税区分"
+          mb="sm"
+          allowDeselect={false}
+          data={[
+            { value: 'reduced', label: '軽減税率（8%）' },
+            { value: 'standard', label: '標準税率（10%）' },
+          ]}
+          {...form.getInputProps('tax_category')}
+        />
         <Select
           label="精製方法"
           placeholder="精製方法を選択してください"
@@ -68,7 +68,7 @@ describe('MyBeansPage', () => {
     });
     // APIレスポンスをモック（空の配列）
     vi.mocked(fetch).mockResolvedValueOnce(
-      new Response(JSON.stringify([]), { status: 200 })
+      new Response(JSON.stringify({ items: [], next_cursor: null, total_count: 0 }), { status: 200 })
     );
 
     renderWithProviders(<MyBeansPage />);
@@ -106,7 +106,7 @@ describe('MyBeansPage', () => {
     });
     // APIレスポンスをモック
     vi.mocked(fetch).mockResolvedValueOnce(
-      new Response(JSON.stringify(mockBeans), { status: 200 })
+      new Response(JSON.stringify({ items: mockBeans, next_cursor: null, total_count: mockBeans.length }), { status: 200 })
     );
 
     renderWithProviders(<MyBeansPage />);
@@ -125,6 +125,33 @@ describe('MyBeansPage', () => {
     ).toBeInTheDocument();
   });
 
+  test('在庫切れの豆には在庫数の設定を促す表示がされる', async () => {
+    const mockBeans = [
+      { id: 1, name: 'My Coffee 1', stock: 0 },
+      { id: 2, name: 'My Coffee 2', stock: 5 },
+    ];
+    // ログイン状態をモック
+    vi.mocked(supabase.auth.getSession).mockResolvedValueOnce({
+      data: { session: mockSession },
+      error: null,
+    });
+    // APIレスポンスをモック
+    vi.mocked(fetch).mockResolvedValueOnce(
+      new Response(JSON.stringify({ items: mockBeans, next_cursor: null, total_count: mockBeans.length }), { status: 200 })
+    );
+
+    renderWithProviders(<MyBeansPage />);
+
+    await waitFor(() => {
+      expect(screen.getByText('My Coffee 1')).toBeInTheDocument();
+    });
+
+    // 在庫が0の豆だけに表示される
+    expect(
+      screen.getAllByText('在庫切れ（編集から在庫数を設定してください）')
+    ).toHaveLength(1);
+  });
+
   test('豆の削除処理が成功し、リストから削除される', async () => {
     const user = userEvent.setup();
     const mockBeans = [
@@ -138,7 +165,7 @@ describe('MyBeansPage', () => {
     });
     // GET APIレスポンスをモック
     vi.mocked(fetch).mockResolvedValueOnce(
-      new Response(JSON.stringify(mockBeans), { status: 200 })
+      new Response(JSON.stringify({ items: mockBeans, next_cursor: null, total_count: mockBeans.length }), { status: 200 })
     );
     // DELETE APIレスポンスをモック
     vi.mocked(fetch).mockResolvedValueOnce(
@@ -201,7 +228,7 @@ describe('MyBeansPage', () => {
     });
     // GET APIレスポンスをモック
     vi.mocked(fetch).mockResolvedValueOnce(
-      new Response(JSON.stringify(mockBeans), { status: 200 })
+      new Response(JSON.stringify({ items: mockBeans, next_cursor: null, total_count: mockBeans.length }), { status: 200 })
     );
     // DELETE APIレスポンスをモック（失敗）
     vi.mocked(fetch).mockResolvedValueOnce(
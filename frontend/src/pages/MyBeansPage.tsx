@@ -11,6 +11,7 @@ import {
   Title,
   Button,
   Group,
+  Badge,
 } from '@mantine/core';
 import { modals } from '@mantine/modals';
 import { notifications } from '@mantine/notifications';
@@ -20,6 +21,13 @@ import { useAuth } from '../contexts/AuthContext';
 interface Bean {
   id: number;
   name: string;
+  stock: number;
+}
+
+interface BeanPage {
+  items: Bean[];
+  next_cursor: string | null;
+  total_count: number;
 }
 
 export default function MyBeansPage() {
@@ -46,8 +54,8 @@ export default function MyBeansPage() {
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
         }
-        const data: Bean[] | null = await response.json();
-        setBeans(data || []); // APIがnullを返した場合も空配列として扱う
+        const data: BeanPage | null = await response.json();
+        setBeans(data?.items || []); // APIがnullを返した場合も空配列として扱う
       } catch (e: unknown) {
         if (e instanceof Error) {
           setError(e.message);
@@ -149,14 +157,22 @@ export default function MyBeansPage() {
           beans.map((bean) => (
             <List.Item key={bean.id}>
               <Group justify="space-between">
-                <Link
-                  to={`/beans/${bean.id}`}
-                  style={{ textDecoration: 'none' }}
-                >
-                  <Text component="span" c="blue.7">
-                    {bean.name}
-                  </Text>
-                </Link>
+                <Group gap="xs">
+                  <Link
+                    to={`/beans/${bean.id}`}
+                    style={{ textDecoration: 'none' }}
+                  >
+                    <Text component="span" c="blue.7">
+                      {bean.name}
+                    </Text>
+                  </Link>
+                  {/* 在庫数の管理を始める前から出品している豆は在庫0になっているため、在庫数の設定を促す */}
+                  {bean.stock === 0 && (
+                    <Badge color="orange" variant="light">
+                      在庫切れ（編集から在庫数を設定してください）
+                    </Badge>
+                  )}
+                </Group>
                 <Group>
                   <Button
                     component={Link}
@@ -54,7 +54,7 @@ describe('NewBeanPage', () => {
     expect(screen.getByText('新しいコーヒー豆を登録')).toBeInTheDocument();
     expect(screen.getByLabelText('名前')).toBeInTheDocument();
     expect(screen.getByLabelText('産地')).toBeInTheDocument();
-    expect(screen.getByLabelText('価格')).toBeInTheDocument();
+    expect(screen.getByLabelText('価格（税込）')).toBeInTheDocument();
     expect(screen.getByRole('textbox', { name: '精製方法' })).toBeInTheDocument();
     expect(screen.getByRole('textbox', { name: '焙煎度' })).toBeInTheDocument();
     expect(
@@ -99,7 +99,9 @@ describe('NewBeanPage', () => {
     // フォームに入力
     await userEvent.type(screen.getByLabelText('名前'), 'Test Bean');
     await userEvent.type(screen.getByLabelText('産地'), 'Test Origin');
-    await userEvent.type(screen.getByLabelText('価格'), '1000');
+    await userEvent.type(screen.getByLabelText('価格（税込）'), '1000');
+    await userEvent.type(screen.getByLabelText('在庫数'), '10');
+    await userEvent.type(screen.getByLabelText('内容量（g）'), '200');
 
     await userEvent.click(screen.getByRole('textbox', { name: '精製方法' }));
     await userEvent.click(screen.getByText('washed'));
@@ -151,7 +153,9 @@ describe('NewBeanPage', () => {
     // フォームに入力
     await userEvent.type(screen.getByLabelText('名前'), 'Test Bean');
     await userEvent.type(screen.getByLabelText('産地'), 'Test Origin');
-    await userEvent.type(screen.getByLabelText('価格'), '1000');
+    await userEvent.type(screen.getByLabelText('価格（税込）'), '1000');
+    await userEvent.type(screen.getByLabelText('在庫数'), '10');
+    await userEvent.type(screen.getByLabelText('内容量（g）'), '200');
 
     await userEvent.click(screen.getByRole('textbox', { name: '精製方法' }));
     await userEvent.click(screen.getByText('washed'));
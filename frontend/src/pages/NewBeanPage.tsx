@@ -20,7 +20,10 @@ import { supabase } from '../lib/supabaseClient';
 interface BeanInput {
   name: string;
   origin: string;
-  price: number | ''; // NumberInputは空文字を扱うことがあるため
+  price: number | '';
+  stock: number | ''; // NumberInputは空文字を扱うことがあるため
+  weight_grams: number | '';
+  tax_category: string; // 消費税の区分（reduced: 軽減税率8%, standard: 標準税率10%）
   process: string;
   roast_profile: string;
 }
@@ -36,6 +39,9 @@ export default function NewBeanPage() {
       name: '',
       origin: '',
       price: '',
+      stock: '',
+      weight_grams: '',
+      tax_category: 'reduced', // コーヒー豆は飲食料品のため軽減税率
       process: '',
       roast_profile: '',
     },
@@ -43,6 +49,8 @@ export default function NewBeanPage() {
       name: (value) => (value.trim().length > 0 ? null : '名前を入力してください'),
       origin: (value) => (value.trim().length > 0 ? null : '産地を入力してください'),
       price: (value) => (value !== '' && Number(value) >= 0 ? null : '価格を0以上で入力してください'),
+      stock: (value) => (value !== '' && Number.isInteger(Number(value)) && Number(value) >= 0 ? null : '在庫数を0以上の整数で入力してください'),
+      weight_grams: (value) => (value !== '' && Number.isInteger(Number(value)) && Number(value) >= 0 ? null : '内容量を0以上の整数で入力してください'),
       process: (value) => (value ? null : '精製方法を選択してください'),
       roast_profile: (value) => (value ? null : '焙煎度を選択してください'),
     },
@@ -71,6 +79,8 @@ export default function NewBeanPage() {
         body: JSON.stringify({
           ...values,
           price: Number(values.price), // API送信時に数値に変換
+          stock: Number(values.stock),
+          weight_grams: Number(values.weight_grams),
         }),
       });
 
@@ -126,13 +136,41 @@ export default function NewBeanPage() {
           {...form.getInputProps('origin')}
         />
         <NumberInput
-          label="価格"
+          label="価格（税込）"
           placeholder="例：1500"
           mb="sm"
           min={0}
           hideControls
           {...form.getInputProps('price')}
         />
+        <NumberInput
+          label="在庫数"
+          placeholder="例：10"
+          mb="sm"
+          min={0}
+          allowDecimal={false}
+          hideControls
+          {...form.getInputProps('stock')}
+        />
+        <NumberInput
+          label="内容量（g）"
+          placeholder="例：200"
+          mb="sm"
+          min={0}
+          allowDecimal={false}
+          hideControls
+          {...form.getInputProps('weight_grams')}
+        />
+        <Select
+          label="消費税区分"
+          mb="sm"
+          allowDeselect={false}
+          data={[
+            { value: 'reduced', label: '軽減税率（8%）' },
+            { value: 'standard', label: '標準税率（10%）' },
+          ]}
+          {...form.getInputProps('tax_category')}
+        />
         <Select
           label="精製方法"
           placeholder="精製方法を選択してください"
@@ -0,0 +1,25 @@
+-- 豆ごとの在庫数（袋単位。カートの数量と同じ単位）
+-- 新しく出品する豆は出品時に在庫数を指定するため、既定値は0にする
+ALTER TABLE public.beans
+ADD COLUMN stock INTEGER NOT NULL DEFAULT 0,
+ADD CONSTRAINT beans_stock_check CHECK (stock >= 0);
+
+-- 在庫数を管理する前から出品されている豆も、実際の在庫数が分からないため0（在庫切れ）にする
+-- 仮の在庫数を設定すると、実際には無い豆が売れてしまうため
+-- 出品者にはマイページで在庫数の設定を促し、豆の更新（PUT /api/beans/{id}）で在庫数を設定してもらう
+UPDATE public.beans SET stock = 0;
+
+-- 支払い済みの注文で在庫が足りなかった数量（確保が期限切れで解放された後に支払いが完了した場合など）
+-- 出品者・管理者が返金などで対応するために記録する
+CREATE TABLE public.order_stock_shortfalls (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    bean_id BIGINT NOT NULL REFERENCES public.beans(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (order_id, bean_id)
+);
+
+COMMENT ON TABLE public.order_stock_shortfalls IS '支払い済みの注文で不足した在庫数を管理するテーブル';
+
+ALTER TABLE public.order_stock_shortfalls ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,22 @@
+-- 保留中の注文の作成から決済完了までの間、在庫を確保しておくためのテーブル
+-- 確保はPaymentIntentの作成前にコミットするため、PaymentIntentではなく注文に紐づける
+-- 確保中(active)の数量はbeans.stockから差し引かれている
+CREATE TABLE public.stock_reservations (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES auth.users(id),
+    bean_id BIGINT NOT NULL REFERENCES public.beans(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'converted', 'released', 'expired')),
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (order_id, bean_id)
+);
+
+COMMENT ON TABLE public.stock_reservations IS '決済中の在庫確保を管理するテーブル';
+
+CREATE INDEX stock_reservations_active_expires_at_idx ON public.stock_reservations (expires_at) WHERE status = 'active';
+CREATE INDEX stock_reservations_user_id_idx ON public.stock_reservations (user_id) WHERE status = 'active';
+
+ALTER TABLE public.stock_reservations ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,11 @@
+-- 処理済みのStripe Webhookイベントを記録するテーブル
+-- 再送されたイベントを二重に処理しないために使う
+CREATE TABLE public.stripe_webhook_events (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE public.stripe_webhook_events IS '処理済みのStripe Webhookイベントを管理するテーブル';
+
+ALTER TABLE public.stripe_webhook_events ENABLE ROW LEVEL SECURITY;
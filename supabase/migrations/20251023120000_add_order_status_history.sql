@@ -0,0 +1,26 @@
+-- 決済の進行・返金・チャージバックを表す注文の状態を追加
+ALTER TYPE public.order_status ADD VALUE IF NOT EXISTS 'requires_action';
+ALTER TYPE public.order_status ADD VALUE IF NOT EXISTS 'partially_refunded';
+ALTER TYPE public.order_status ADD VALUE IF NOT EXISTS 'refunded';
+ALTER TYPE public.order_status ADD VALUE IF NOT EXISTS 'disputed';
+
+-- 注文の状態遷移の履歴（注文のタイムラインを再現するために使う）
+CREATE TABLE public.order_status_history (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    from_status public.order_status,
+    to_status public.order_status NOT NULL,
+    stripe_event_id TEXT,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE public.order_status_history IS '注文の状態遷移の履歴を管理するテーブル';
+
+CREATE INDEX order_status_history_order_id_idx ON public.order_status_history (order_id, created_at);
+
+ALTER TABLE public.order_status_history ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view the history of their own orders." ON public.order_status_history FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.orders
+  WHERE ((orders.id = order_status_history.order_id) AND (orders.user_id = auth.uid())))));
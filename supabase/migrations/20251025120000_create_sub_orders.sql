@@ -0,0 +1,59 @@
+-- 出品者による発送までの進捗を表す状態
+CREATE TYPE public.fulfillment_status AS ENUM (
+    'unfulfilled',
+    'accepted',
+    'roasting',
+    'shipped',
+    'delivered'
+);
+
+-- 出品者ごとの子注文
+-- 1つの注文（親注文）に複数の出品者の商品が含まれる場合、出品者ごとに小計・送料・発送の進捗・入金を管理する
+CREATE TABLE public.sub_orders (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    seller_id UUID REFERENCES auth.users(id),
+    subtotal INTEGER NOT NULL DEFAULT 0,
+    shipping_fee INTEGER NOT NULL DEFAULT 0,
+    total_amount INTEGER NOT NULL DEFAULT 0,
+    fulfillment_status public.fulfillment_status NOT NULL DEFAULT 'unfulfilled',
+    carrier TEXT,
+    tracking_number TEXT,
+    shipped_at TIMESTAMPTZ,
+    delivered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE public.sub_orders IS '注文を出品者ごとに分けた子注文を管理するテーブル';
+
+CREATE INDEX sub_orders_order_id_idx ON public.sub_orders (order_id);
+CREATE INDEX sub_orders_seller_id_idx ON public.sub_orders (seller_id, id);
+
+ALTER TABLE public.order_items ADD COLUMN sub_order_id BIGINT REFERENCES public.sub_orders(id) ON DELETE CASCADE;
+
+CREATE INDEX order_items_sub_order_id_idx ON public.order_items (sub_order_id);
+
+-- 既存の注文明細を、注文と出品者の組ごとに子注文へまとめる（発送の進捗は未対応から始める）
+INSERT INTO public.sub_orders (order_id, seller_id, subtotal, total_amount)
+SELECT oi.order_id, b.user_id, SUM(oi.price_at_purchase * oi.quantity), SUM(oi.price_at_purchase * oi.quantity)
+FROM public.order_items oi
+JOIN public.beans b ON oi.bean_id = b.id
+GROUP BY oi.order_id, b.user_id;
+
+UPDATE public.order_items oi
+SET sub_order_id = so.id
+FROM public.beans b, public.sub_orders so
+WHERE oi.bean_id = b.id AND so.order_id = oi.order_id AND so.seller_id IS NOT DISTINCT FROM b.user_id;
+
+ALTER TABLE public.sub_orders ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view sub-orders of their own orders." ON public.sub_orders FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.orders
+  WHERE ((orders.id = sub_orders.order_id) AND (orders.user_id = auth.uid())))));
+
+CREATE POLICY "Sellers can view their own sub-orders." ON public.sub_orders FOR SELECT USING ((seller_id = auth.uid()));
+
+CREATE POLICY "Sellers can view items of their own sub-orders." ON public.order_items FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.sub_orders
+  WHERE ((sub_orders.id = order_items.sub_order_id) AND (sub_orders.seller_id = auth.uid())))));
@@ -0,0 +1,39 @@
+-- 出品者のStripe Connectアカウントへの入金を記録する
+-- 出品者が1人の注文はDestination Charge、複数の注文は支払い後に子注文ごとのTransferで入金する
+ALTER TABLE public.orders
+    ADD COLUMN stripe_transfer_group TEXT;
+
+ALTER TABLE public.sub_orders
+    ADD COLUMN stripe_account_id TEXT,
+    ADD COLUMN stripe_transfer_id TEXT UNIQUE;
+
+COMMENT ON COLUMN public.orders.stripe_transfer_group IS '子注文ごとのTransferをまとめるグループ（Destination Chargeの場合はNULL）';
+COMMENT ON COLUMN public.sub_orders.stripe_account_id IS '注文時点の出品者のStripe ConnectアカウントID';
+COMMENT ON COLUMN public.sub_orders.stripe_transfer_id IS '出品者への入金に対応するStripeのTransfer ID';
+
+-- 子注文ごとのTransferで入金する注文の、出品者への入金の送信待ち（outbox）
+-- 支払い完了のWebhookのトランザクション内で記録し、コミット後に送信するため、ロールバックされた入金が送信されることはない
+CREATE TABLE public.payout_transfers (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    sub_order_id BIGINT NOT NULL UNIQUE REFERENCES public.sub_orders(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    currency TEXT NOT NULL,
+    destination TEXT NOT NULL,
+    transfer_group TEXT NOT NULL,
+    source_transaction TEXT,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed')),
+    stripe_transfer_id TEXT UNIQUE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    first_attempted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON TABLE public.payout_transfers IS '出品者への入金（Transfer）の送信待ちを管理するテーブル';
+COMMENT ON COLUMN public.payout_transfers.first_attempted_at IS '最初に送信を試みた日時（冪等キーの有効期限を過ぎた再送を避けるために使う）';
+
+CREATE INDEX payout_transfers_pending_idx ON public.payout_transfers (next_attempt_at) WHERE status = 'pending';
+
+ALTER TABLE public.payout_transfers ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,20 @@
+-- プラットフォーム手数料
+-- 手数料率はベーシスポイント（1 = 0.01%）の整数で保持し、手数料は1円未満を切り捨てた整数で記録する
+
+-- 出品者ごとの手数料率（NULLの場合は全体の手数料率を使う）
+ALTER TABLE public.profiles
+    ADD COLUMN platform_fee_basis_points INTEGER CHECK (platform_fee_basis_points BETWEEN 0 AND 10000);
+
+ALTER TABLE public.orders
+    ADD COLUMN platform_fee INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN platform_fee_basis_points INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE public.sub_orders
+    ADD COLUMN platform_fee INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN platform_fee_basis_points INTEGER NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN public.profiles.platform_fee_basis_points IS '出品者ごとのプラットフォーム手数料率（ベーシスポイント）';
+COMMENT ON COLUMN public.orders.platform_fee IS '子注文のプラットフォーム手数料の合計';
+COMMENT ON COLUMN public.orders.platform_fee_basis_points IS '注文時点の全体のプラットフォーム手数料率（ベーシスポイント）';
+COMMENT ON COLUMN public.sub_orders.platform_fee IS '子注文の小計に対するプラットフォーム手数料';
+COMMENT ON COLUMN public.sub_orders.platform_fee_basis_points IS '子注文に適用したプラットフォーム手数料率（ベーシスポイント）';
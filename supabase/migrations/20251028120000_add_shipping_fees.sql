@@ -0,0 +1,57 @@
+-- 送料
+-- 出品者ごとに送料表（全国一律・重さの区分ごと・都道府県ごと）と送料無料の下限を設定し、
+-- 購入時に子注文ごとの送料を計算して注文の合計に含める
+
+-- コーヒー豆の内容量（グラム）。重さの区分ごとの送料の計算に使う
+ALTER TABLE public.beans
+    ADD COLUMN weight_grams INTEGER NOT NULL DEFAULT 0 CHECK (weight_grams >= 0);
+
+CREATE TYPE public.shipping_rate_type AS ENUM (
+    'flat',
+    'weight',
+    'prefecture'
+);
+
+CREATE TABLE public.shipping_settings (
+    seller_id UUID PRIMARY KEY REFERENCES auth.users(id) ON DELETE CASCADE,
+    rate_type public.shipping_rate_type NOT NULL DEFAULT 'flat',
+    flat_fee INTEGER NOT NULL DEFAULT 0 CHECK (flat_fee >= 0),
+    free_shipping_threshold INTEGER CHECK (free_shipping_threshold >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 荷物の重さがmax_weight_grams以下となる最も軽い区分の送料を適用する
+CREATE TABLE public.shipping_weight_rates (
+    seller_id UUID NOT NULL REFERENCES public.shipping_settings(seller_id) ON DELETE CASCADE,
+    max_weight_grams INTEGER NOT NULL CHECK (max_weight_grams > 0),
+    fee INTEGER NOT NULL CHECK (fee >= 0),
+    PRIMARY KEY (seller_id, max_weight_grams)
+);
+
+-- prefecture_codeはJIS X 0401の都道府県コード（1〜47）
+CREATE TABLE public.shipping_prefecture_rates (
+    seller_id UUID NOT NULL REFERENCES public.shipping_settings(seller_id) ON DELETE CASCADE,
+    prefecture_code SMALLINT NOT NULL CHECK (prefecture_code BETWEEN 1 AND 47),
+    fee INTEGER NOT NULL CHECK (fee >= 0),
+    PRIMARY KEY (seller_id, prefecture_code)
+);
+
+ALTER TABLE public.orders
+    ADD COLUMN shipping_fee INTEGER NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN public.beans.weight_grams IS 'コーヒー豆の内容量（グラム）';
+COMMENT ON COLUMN public.shipping_settings.free_shipping_threshold IS '送料が無料になる小計の下限（NULLの場合は送料無料なし）';
+COMMENT ON COLUMN public.orders.shipping_fee IS '子注文の送料の合計（total_amountに含む）';
+
+-- 送料は購入前に誰でも確認でき、変更は出品者本人のみが行える
+ALTER TABLE public.shipping_settings ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.shipping_weight_rates ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.shipping_prefecture_rates ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Shipping settings are viewable by everyone." ON public.shipping_settings FOR SELECT USING (true);
+CREATE POLICY "Sellers can manage their own shipping settings." ON public.shipping_settings USING ((seller_id = auth.uid())) WITH CHECK ((seller_id = auth.uid()));
+CREATE POLICY "Shipping weight rates are viewable by everyone." ON public.shipping_weight_rates FOR SELECT USING (true);
+CREATE POLICY "Sellers can manage their own shipping weight rates." ON public.shipping_weight_rates USING ((seller_id = auth.uid())) WITH CHECK ((seller_id = auth.uid()));
+CREATE POLICY "Shipping prefecture rates are viewable by everyone." ON public.shipping_prefecture_rates FOR SELECT USING (true);
+CREATE POLICY "Sellers can manage their own shipping prefecture rates." ON public.shipping_prefecture_rates USING ((seller_id = auth.uid())) WITH CHECK ((seller_id = auth.uid()));
@@ -0,0 +1,64 @@
+-- 消費税（軽減税率）と適格請求書（インボイス制度）
+-- 価格は税込で保持し、消費税額は子注文（出品者ごとの請求書）ごとに税率別に1回だけ切り捨てで計算する
+
+-- 消費税の区分（reduced: 軽減税率8%、standard: 標準税率10%）
+CREATE TYPE public.tax_category AS ENUM (
+    'reduced',
+    'standard'
+);
+
+-- コーヒー豆は飲食料品のため、既存の商品は軽減税率の対象とする
+ALTER TABLE public.beans
+    ADD COLUMN tax_category public.tax_category NOT NULL DEFAULT 'reduced';
+
+-- 購入時点の消費税の区分
+ALTER TABLE public.order_items
+    ADD COLUMN tax_category public.tax_category NOT NULL DEFAULT 'reduced';
+
+-- 適格請求書発行事業者の登録番号（"T"と13桁の数字）
+ALTER TABLE public.profiles
+    ADD COLUMN invoice_registration_number TEXT CHECK (invoice_registration_number ~ '^T[0-9]{13}$');
+
+ALTER TABLE public.sub_orders
+    ADD COLUMN reduced_taxable_amount INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN reduced_tax INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN standard_taxable_amount INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN standard_tax INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN seller_invoice_registration_number TEXT;
+
+ALTER TABLE public.orders
+    ADD COLUMN reduced_taxable_amount INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN reduced_tax INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN standard_taxable_amount INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN standard_tax INTEGER NOT NULL DEFAULT 0;
+
+-- 既存の注文は、商品を軽減税率・送料を標準税率として消費税の内訳を記録する
+UPDATE public.sub_orders
+SET reduced_taxable_amount = subtotal,
+    reduced_tax = subtotal * 8 / 108,
+    standard_taxable_amount = shipping_fee,
+    standard_tax = shipping_fee * 10 / 110;
+
+UPDATE public.orders o
+SET reduced_taxable_amount = t.reduced_taxable_amount,
+    reduced_tax = t.reduced_tax,
+    standard_taxable_amount = t.standard_taxable_amount,
+    standard_tax = t.standard_tax
+FROM (
+    SELECT order_id,
+           SUM(reduced_taxable_amount) AS reduced_taxable_amount,
+           SUM(reduced_tax) AS reduced_tax,
+           SUM(standard_taxable_amount) AS standard_taxable_amount,
+           SUM(standard_tax) AS standard_tax
+    FROM public.sub_orders
+    GROUP BY order_id
+) t
+WHERE o.id = t.order_id;
+
+COMMENT ON COLUMN public.beans.tax_category IS '消費税の区分（価格は税込）';
+COMMENT ON COLUMN public.profiles.invoice_registration_number IS '適格請求書発行事業者の登録番号';
+COMMENT ON COLUMN public.sub_orders.reduced_taxable_amount IS '軽減税率（8%）対象の税込金額';
+COMMENT ON COLUMN public.sub_orders.reduced_tax IS '軽減税率（8%）の消費税額';
+COMMENT ON COLUMN public.sub_orders.standard_taxable_amount IS '標準税率（10%）対象の税込金額（送料を含む）';
+COMMENT ON COLUMN public.sub_orders.standard_tax IS '標準税率（10%）の消費税額';
+COMMENT ON COLUMN public.sub_orders.seller_invoice_registration_number IS '注文時点の出品者の適格請求書発行事業者の登録番号';
@@ -0,0 +1,77 @@
+-- クーポン
+-- 定率（%）または定額（円）の値引きを、プラットフォームまたは出品者の負担で行う
+-- 値引きは対象商品の金額に応じて子注文・消費税の区分ごとに割り当て、送料は値引きしない
+
+-- 値引きの種類（percentage: 定率、fixed: 定額）
+CREATE TYPE public.coupon_discount_type AS ENUM (
+    'percentage',
+    'fixed'
+);
+
+-- 値引きの負担者（platform: プラットフォーム、seller: 出品者）
+CREATE TYPE public.coupon_funded_by AS ENUM (
+    'platform',
+    'seller'
+);
+
+CREATE TABLE public.coupons (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    code TEXT NOT NULL UNIQUE CHECK (code ~ '^[A-Z0-9_-]{3,32}$'),
+    discount_type public.coupon_discount_type NOT NULL,
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),
+    funded_by public.coupon_funded_by NOT NULL,
+    -- 出品者負担のクーポンを発行した出品者（対象はこの出品者の商品に限る）
+    seller_id UUID REFERENCES auth.users(id) ON DELETE CASCADE,
+    min_spend INTEGER NOT NULL DEFAULT 0 CHECK (min_spend >= 0),
+    max_uses INTEGER CHECK (max_uses > 0),
+    max_uses_per_user INTEGER CHECK (max_uses_per_user > 0),
+    starts_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (discount_type <> 'percentage' OR discount_value <= 100),
+    CHECK ((funded_by = 'seller') = (seller_id IS NOT NULL)),
+    CHECK (starts_at IS NULL OR expires_at IS NULL OR starts_at < expires_at)
+);
+
+-- 対象の出品者・商品（どちらも登録が無い場合は、すべての出品者・商品が対象）
+CREATE TABLE public.coupon_eligible_sellers (
+    coupon_id BIGINT NOT NULL REFERENCES public.coupons(id) ON DELETE CASCADE,
+    seller_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    PRIMARY KEY (coupon_id, seller_id)
+);
+
+CREATE TABLE public.coupon_eligible_beans (
+    coupon_id BIGINT NOT NULL REFERENCES public.coupons(id) ON DELETE CASCADE,
+    bean_id BIGINT NOT NULL REFERENCES public.beans(id) ON DELETE CASCADE,
+    PRIMARY KEY (coupon_id, bean_id)
+);
+
+CREATE INDEX coupons_seller_id_idx ON public.coupons (seller_id) WHERE seller_id IS NOT NULL;
+
+ALTER TABLE public.orders
+    ADD COLUMN coupon_id BIGINT REFERENCES public.coupons(id),
+    ADD COLUMN coupon_code TEXT,
+    ADD COLUMN discount_amount INTEGER NOT NULL DEFAULT 0 CHECK (discount_amount >= 0);
+
+ALTER TABLE public.sub_orders
+    ADD COLUMN discount_amount INTEGER NOT NULL DEFAULT 0 CHECK (discount_amount >= 0),
+    ADD COLUMN discount_funded_by public.coupon_funded_by;
+
+CREATE INDEX orders_coupon_id_idx ON public.orders (coupon_id) WHERE coupon_id IS NOT NULL;
+
+COMMENT ON TABLE public.coupons IS 'クーポン（プロモーションコード）';
+COMMENT ON COLUMN public.coupons.discount_value IS '定率の場合は値引き率（%）、定額の場合は値引き額（円）';
+COMMENT ON COLUMN public.coupons.min_spend IS '対象商品の小計がこの金額以上の場合に利用できる';
+COMMENT ON COLUMN public.coupons.max_uses IS '全体の利用回数の上限（NULLの場合は無制限）';
+COMMENT ON COLUMN public.coupons.max_uses_per_user IS '購入者ごとの利用回数の上限（NULLの場合は無制限）';
+COMMENT ON COLUMN public.orders.coupon_code IS '注文時点のクーポンコード';
+COMMENT ON COLUMN public.orders.discount_amount IS '子注文の値引き額の合計（total_amountから差し引き済み）';
+COMMENT ON COLUMN public.sub_orders.discount_amount IS '子注文の商品に割り当てたクーポンの値引き額（total_amountから差し引き済み）';
+COMMENT ON COLUMN public.sub_orders.discount_funded_by IS '値引きの負担者（プラットフォーム負担の値引きは出品者への入金額に含める）';
+
+-- クーポンの内容や利用状況はバックエンドからのみ扱い、コードの総当たりを防ぐため公開しない
+ALTER TABLE public.coupons ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.coupon_eligible_sellers ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.coupon_eligible_beans ENABLE ROW LEVEL SECURITY;
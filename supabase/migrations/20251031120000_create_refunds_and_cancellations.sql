@@ -0,0 +1,144 @@
+-- 返金とキャンセル
+-- 購入者のキャンセル依頼を出品者が発送前に承認する、または管理者が強制的にキャンセルする
+-- 返金は子注文の明細の数量ごと（一部返金）または子注文の全額で行い、明細と紐づけて記録する
+
+-- キャンセルした子注文は発送の対象外とする
+ALTER TYPE public.fulfillment_status ADD VALUE IF NOT EXISTS 'canceled';
+
+-- 明細ごとの返金済みの数量と、クーポンの値引きのうち明細に割り当てた額
+ALTER TABLE public.order_items
+    ADD COLUMN refunded_quantity INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN discount_amount INTEGER NOT NULL DEFAULT 0 CHECK (discount_amount >= 0),
+    ADD CONSTRAINT order_items_refunded_quantity_check CHECK (refunded_quantity BETWEEN 0 AND quantity);
+
+ALTER TABLE public.sub_orders
+    ADD COLUMN refunded_amount INTEGER NOT NULL DEFAULT 0 CHECK (refunded_amount >= 0),
+    ADD COLUMN shipping_refunded BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN canceled_at TIMESTAMPTZ;
+
+-- 既存の注文の値引きを、子注文の明細の金額に比例して割り当てる（端数は最初の明細に割り当てる）
+UPDATE public.order_items oi
+SET discount_amount = shares.discount_amount
+FROM (
+    SELECT oi.id,
+           so.discount_amount * oi.price_at_purchase * oi.quantity / NULLIF(so.subtotal, 0)
+             + CASE WHEN ROW_NUMBER() OVER w = 1
+                    THEN so.discount_amount - SUM(so.discount_amount * oi.price_at_purchase * oi.quantity / NULLIF(so.subtotal, 0)) OVER w_all
+                    ELSE 0 END AS discount_amount
+    FROM public.order_items oi
+    JOIN public.sub_orders so ON oi.sub_order_id = so.id
+    WHERE so.discount_amount > 0
+    WINDOW w AS (PARTITION BY so.id ORDER BY oi.id), w_all AS (PARTITION BY so.id)
+) shares
+WHERE oi.id = shares.id;
+
+-- 返金（Stripeの1回の返金に対応する）
+CREATE TABLE public.refunds (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    sub_order_id BIGINT NOT NULL REFERENCES public.sub_orders(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    shipping_amount INTEGER NOT NULL DEFAULT 0 CHECK (shipping_amount >= 0),
+    reason TEXT NOT NULL DEFAULT '',
+    requested_by UUID REFERENCES auth.users(id) ON DELETE SET NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed', 'canceled')),
+    stripe_refund_id TEXT UNIQUE,
+    stripe_transfer_reversal_id TEXT,
+    payout_reduction INTEGER NOT NULL DEFAULT 0 CHECK (payout_reduction >= 0),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 返金した明細と数量
+CREATE TABLE public.refund_items (
+    refund_id BIGINT NOT NULL REFERENCES public.refunds(id) ON DELETE CASCADE,
+    order_item_id BIGINT NOT NULL REFERENCES public.order_items(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    amount INTEGER NOT NULL CHECK (amount >= 0),
+    restocked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (refund_id, order_item_id)
+);
+
+-- 子注文ごとのTransferで入金した注文の、返金に応じた出品者への入金の取り消しの送信待ち（outbox）
+-- 返金がStripeで成功し、取り消す入金が送信済みになってから送信する
+CREATE TABLE public.transfer_reversals (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    refund_id BIGINT NOT NULL UNIQUE REFERENCES public.refunds(id) ON DELETE CASCADE,
+    sub_order_id BIGINT NOT NULL REFERENCES public.sub_orders(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed', 'canceled')),
+    stripe_transfer_reversal_id TEXT UNIQUE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    first_attempted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 入金を送信する前に返金した子注文は、送信待ちの入金額を減らす（全額を返金した場合は送信を取りやめる）
+ALTER TABLE public.payout_transfers
+    DROP CONSTRAINT payout_transfers_amount_check,
+    ADD CONSTRAINT payout_transfers_amount_check CHECK (amount >= 0),
+    DROP CONSTRAINT payout_transfers_status_check,
+    ADD CONSTRAINT payout_transfers_status_check CHECK (status IN ('pending', 'sent', 'failed', 'canceled'));
+
+CREATE INDEX refunds_order_id_idx ON public.refunds (order_id);
+CREATE INDEX refunds_unsent_idx ON public.refunds (next_attempt_at) WHERE status = 'pending' AND stripe_refund_id IS NULL;
+CREATE INDEX transfer_reversals_pending_idx ON public.transfer_reversals (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX refunds_sub_order_id_idx ON public.refunds (sub_order_id);
+CREATE INDEX refund_items_order_item_id_idx ON public.refund_items (order_item_id);
+
+-- キャンセル依頼（子注文ごと）
+CREATE TABLE public.cancellation_requests (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    order_id BIGINT NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    sub_order_id BIGINT NOT NULL REFERENCES public.sub_orders(id) ON DELETE CASCADE,
+    requested_by UUID REFERENCES auth.users(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    resolved_by UUID REFERENCES auth.users(id) ON DELETE SET NULL,
+    resolution_note TEXT NOT NULL DEFAULT '',
+    resolved_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 子注文ごとに、対応を待っている依頼は1件だけ
+CREATE UNIQUE INDEX cancellation_requests_pending_idx ON public.cancellation_requests (sub_order_id) WHERE status = 'pending';
+CREATE INDEX cancellation_requests_order_id_idx ON public.cancellation_requests (order_id);
+
+COMMENT ON TABLE public.refunds IS '注文の返金を管理するテーブル';
+COMMENT ON TABLE public.transfer_reversals IS '返金に応じた出品者への入金の取り消しの送信待ちを管理するテーブル';
+COMMENT ON COLUMN public.refunds.payout_reduction IS '返金に応じて、送信前の出品者への入金から差し引いた額';
+COMMENT ON COLUMN public.refunds.next_attempt_at IS 'Stripeに返金を送信できなかった場合に、次に再送する日時';
+COMMENT ON TABLE public.refund_items IS '返金した注文明細と数量を管理するテーブル';
+COMMENT ON TABLE public.cancellation_requests IS '購入者からのキャンセル依頼を管理するテーブル';
+COMMENT ON COLUMN public.order_items.refunded_quantity IS '返金済みの数量';
+COMMENT ON COLUMN public.order_items.discount_amount IS 'クーポンの値引きのうち明細に割り当てた額';
+COMMENT ON COLUMN public.sub_orders.refunded_amount IS '子注文の返金額の合計（送料を含む）';
+COMMENT ON COLUMN public.refunds.shipping_amount IS '返金額のうち送料の額';
+
+ALTER TABLE public.refunds ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.refund_items ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.cancellation_requests ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.transfer_reversals ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view refunds of their own orders." ON public.refunds FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.orders
+  WHERE ((orders.id = refunds.order_id) AND (orders.user_id = auth.uid())))));
+
+CREATE POLICY "Sellers can view refunds of their own sub-orders." ON public.refunds FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.sub_orders
+  WHERE ((sub_orders.id = refunds.sub_order_id) AND (sub_orders.seller_id = auth.uid())))));
+
+CREATE POLICY "Users can view cancellation requests of their own orders." ON public.cancellation_requests FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.orders
+  WHERE ((orders.id = cancellation_requests.order_id) AND (orders.user_id = auth.uid())))));
+
+CREATE POLICY "Sellers can view cancellation requests of their own sub-orders." ON public.cancellation_requests FOR SELECT USING ((EXISTS ( SELECT 1
+   FROM public.sub_orders
+  WHERE ((sub_orders.id = cancellation_requests.sub_order_id) AND (sub_orders.seller_id = auth.uid())))));
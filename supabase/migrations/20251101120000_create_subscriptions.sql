@@ -0,0 +1,69 @@
+-- 定期便（サブスクリプション）
+-- 出品者がコーヒー豆ごとに定期便のプランを用意し、購入者は保存済みのカードで申し込む
+-- お届け日になるとバックエンドのスケジューラーが保存済みのカードで請求し、通常の注文と同じテーブルに注文を作成する
+
+CREATE TABLE public.subscription_plans (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    bean_id BIGINT NOT NULL REFERENCES public.beans(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    -- 1回のお届けの数量（袋数）
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    -- お届けの間隔（日数。例: 14 = 2週間ごと）
+    interval_days INTEGER NOT NULL CHECK (interval_days BETWEEN 7 AND 90),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 定期便の状態（active: 継続中、paused: 一時停止中、canceled: 解約済み）
+CREATE TYPE public.subscription_status AS ENUM (
+    'active',
+    'paused',
+    'canceled'
+);
+
+CREATE TABLE public.subscriptions (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    plan_id BIGINT NOT NULL REFERENCES public.subscription_plans(id),
+    status public.subscription_status NOT NULL DEFAULT 'active',
+    -- 請求に使う保存済みのカード（購入者のStripe Customerに紐づくもの）
+    stripe_payment_method_id TEXT NOT NULL,
+    -- 次のお届け日（この日に請求して注文を作成する）
+    next_delivery_date DATE NOT NULL,
+    -- 請求に連続して失敗した回数と、最後の失敗の理由
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    last_payment_error TEXT NOT NULL DEFAULT '',
+    -- 請求に失敗した場合、この日時まで再請求しない
+    retry_after TIMESTAMPTZ,
+    paused_at TIMESTAMPTZ,
+    canceled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX subscription_plans_bean_id_idx ON public.subscription_plans (bean_id);
+CREATE INDEX subscriptions_user_id_idx ON public.subscriptions (user_id);
+CREATE INDEX subscriptions_plan_id_idx ON public.subscriptions (plan_id);
+CREATE INDEX subscriptions_due_idx ON public.subscriptions (next_delivery_date) WHERE status = 'active';
+
+-- 定期便の各回の注文（同じ回の注文が二重に作成されないよう、お届け日ごとに一意にする）
+-- カードが拒否されてキャンセル・失敗になった注文は、再請求で同じお届け日の注文を作り直すため対象外にする
+ALTER TABLE public.orders
+    ADD COLUMN subscription_id BIGINT REFERENCES public.subscriptions(id) ON DELETE SET NULL,
+    ADD COLUMN subscription_delivery_date DATE;
+
+CREATE UNIQUE INDEX orders_subscription_delivery_idx ON public.orders (subscription_id, subscription_delivery_date) WHERE subscription_id IS NOT NULL AND status NOT IN ('canceled', 'failed');
+
+COMMENT ON TABLE public.subscription_plans IS '出品者がコーヒー豆ごとに用意する定期便のプラン';
+COMMENT ON TABLE public.subscriptions IS '購入者の定期便の申し込み';
+COMMENT ON COLUMN public.subscriptions.next_delivery_date IS '次のお届け日（スキップすると1回分先に進む）';
+COMMENT ON COLUMN public.orders.subscription_id IS '定期便の注文の場合の申し込み';
+COMMENT ON COLUMN public.orders.subscription_delivery_date IS '定期便の注文の場合のお届け日';
+
+ALTER TABLE public.subscription_plans ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.subscriptions ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Subscription plans are viewable by everyone." ON public.subscription_plans FOR SELECT USING (true);
+
+CREATE POLICY "Users can view their own subscriptions." ON public.subscriptions FOR SELECT USING ((auth.uid() = user_id));
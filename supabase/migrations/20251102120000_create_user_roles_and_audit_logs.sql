@@ -0,0 +1,62 @@
+-- ユーザーのロールと、管理者権限での操作の監査ログ
+-- ロールはユーザーごとに複数持てる（例: 出品者かつ焙煎所）
+-- buyer はプロフィールの登録・決済時に、seller は豆の出品時にバックエンドが付与し、roaster・moderator・admin は管理者が付与する
+-- moderator は不正な出品の修正・削除、admin はそれに加えて注文の強制キャンセル・返金とロールの付与ができる
+
+CREATE TYPE public.user_role AS ENUM (
+    'buyer',
+    'seller',
+    'roaster',
+    'moderator',
+    'admin'
+);
+
+CREATE TABLE public.user_roles (
+    user_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    role public.user_role NOT NULL,
+    -- ロールを付与した管理者（マイグレーションやSQLで直接付与した場合はNULL）
+    granted_by UUID,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+-- 監査ログ（管理者・モデレーターが他のユーザーの出品や注文を操作した記録）
+-- 操作したユーザーや対象のユーザーが削除されても記録を残すため、auth.usersは参照しない
+CREATE TABLE public.audit_logs (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    actor_id UUID NOT NULL,
+    -- 操作した時点でのロール
+    actor_roles TEXT[] NOT NULL DEFAULT '{}',
+    -- 操作の種類（例: bean.update, bean.delete, order.cancel, order.refund, user_role.grant）
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    -- 操作の対象の所有者（出品者や購入者）
+    target_owner_id UUID,
+    reason TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_logs_target_idx ON public.audit_logs (target_type, target_id);
+CREATE INDEX audit_logs_actor_id_idx ON public.audit_logs (actor_id);
+
+COMMENT ON TABLE public.user_roles IS 'ユーザーごとのロール';
+COMMENT ON TABLE public.audit_logs IS '管理者・モデレーターによる、他のユーザーの出品や注文の操作の記録';
+COMMENT ON COLUMN public.audit_logs.actor_roles IS '操作した時点での、操作したユーザーのロール';
+COMMENT ON COLUMN public.audit_logs.target_owner_id IS '操作の対象の所有者';
+
+ALTER TABLE public.user_roles ENABLE ROW LEVEL SECURITY;
+-- 監査ログはバックエンドからのみ読み書きする（ポリシーを作成しない）
+ALTER TABLE public.audit_logs ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view their own roles." ON public.user_roles FOR SELECT USING ((auth.uid() = user_id));
+
+-- 既存のユーザーにも、プロフィールを登録済みなら buyer、出品済みなら seller のロールを付与する
+INSERT INTO public.user_roles (user_id, role)
+SELECT user_id, 'buyer' FROM public.profiles
+ON CONFLICT (user_id, role) DO NOTHING;
+
+INSERT INTO public.user_roles (user_id, role)
+SELECT DISTINCT user_id, 'seller' FROM public.beans WHERE user_id IS NOT NULL
+ON CONFLICT (user_id, role) DO NOTHING;
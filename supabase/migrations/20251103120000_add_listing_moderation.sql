@@ -0,0 +1,27 @@
+-- 出品の非公開化と出品者の停止
+-- 管理者・モデレーターは不正な出品を理由とともに非公開にし、後から元に戻せる
+-- 停止された出品者の豆は、非公開にしていなくても一覧や詳細に表示されず、購入できない
+
+ALTER TABLE public.beans
+    ADD COLUMN unpublished_at TIMESTAMPTZ,
+    ADD COLUMN unpublished_reason TEXT NOT NULL DEFAULT '',
+    ADD COLUMN unpublished_by UUID;
+
+CREATE INDEX beans_unpublished_idx ON public.beans (unpublished_at) WHERE unpublished_at IS NOT NULL;
+
+-- 停止中の出品者（停止を解除すると行を削除する。操作の履歴は audit_logs に残る）
+CREATE TABLE public.seller_suspensions (
+    user_id UUID PRIMARY KEY REFERENCES auth.users(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL DEFAULT '',
+    suspended_by UUID,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON COLUMN public.beans.unpublished_at IS '管理者・モデレーターが出品を非公開にした日時（公開中はNULL）';
+COMMENT ON COLUMN public.beans.unpublished_reason IS '出品を非公開にした理由';
+COMMENT ON COLUMN public.beans.unpublished_by IS '出品を非公開にした管理者・モデレーター';
+COMMENT ON TABLE public.seller_suspensions IS '停止中の出品者（停止中の出品者の豆は表示・購入できない）';
+
+ALTER TABLE public.seller_suspensions ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Sellers can view their own suspension." ON public.seller_suspensions FOR SELECT USING ((auth.uid() = user_id));